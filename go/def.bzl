@@ -33,6 +33,9 @@ load("@io_bazel_rules_go//go/private:go_toolchain.bzl",
 load("@io_bazel_rules_go//go/private:rules/prefix.bzl",
     "go_prefix",
 )
+load("@io_bazel_rules_go//go/private:rules/source.bzl",
+    _go_source = "go_source",
+)
 load("@io_bazel_rules_go//go/private:rules/wrappers.bzl",
     _go_library_macro = "go_library_macro",
     _go_binary_macro = "go_binary_macro",
@@ -69,6 +72,9 @@ go_binary = _go_binary_macro
 go_test = _go_test_macro
 """See go/core.rst#go_test for full documentation."""
 
+go_source = _go_source
+"""See go/core.rst#go_source for full documentation."""
+
 go_path = _go_path
 """
     go_path is a rule for creating `go build` compatible file layouts from a set of Bazel.
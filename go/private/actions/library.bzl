@@ -77,6 +77,7 @@ def emit_library(ctx, go_toolchain,
     obj = ctx.new_file(src, "%s.dir/%s.o" % (ctx.label.name, src.basename[:-2]))
     go_toolchain.actions.asm(ctx, go_toolchain, src, source.headers, obj)
     extra_objects += [obj]
+  extra_objects += list(source.syso)
   archive = cgo_info.archive if cgo_info else None
 
   for dep in deps:
@@ -33,6 +33,11 @@ asm_exts = [
     ".h",  # may be included by .s
 ]
 
+# Object files added to the package archive, as with "go build".
+syso_exts = [
+    ".syso",
+]
+
 # be consistent to cc_library.
 hdr_exts = [
     ".h",
@@ -53,12 +58,12 @@ c_exts = [
     ".hxx",
 ]
 
-go_filetype = FileType(go_exts + asm_exts)
+go_filetype = FileType(go_exts + asm_exts + syso_exts)
 cc_hdr_filetype = FileType(hdr_exts)
 
 # Extensions of files we can build with the Go compiler or with cc_library.
 # This is a subset of the extensions recognized by go/build.
-cgo_filetype = FileType(go_exts + asm_exts + c_exts)
+cgo_filetype = FileType(go_exts + asm_exts + syso_exts + c_exts)
 
 def pkg_dir(workspace_root, package_name):
   """Returns a relative path to a package directory from the root of the
@@ -85,6 +90,7 @@ def split_srcs(srcs):
   go = depset()
   headers = depset()
   asm = depset()
+  syso = depset()
   c = depset()
   for src in srcs:
     if any([src.basename.endswith(ext) for ext in go_exts]):
@@ -93,6 +99,8 @@ def split_srcs(srcs):
       headers += [src]
     elif any([src.basename.endswith(ext) for ext in asm_exts]):
       asm += [src]
+    elif any([src.basename.endswith(ext) for ext in syso_exts]):
+      syso += [src]
     elif any([src.basename.endswith(ext) for ext in c_exts]):
       c += [src]
     else:
@@ -101,11 +109,12 @@ def split_srcs(srcs):
       go = go,
       headers = headers,
       asm = asm,
+      syso = syso,
       c = c,
   )
 
 def join_srcs(source):
-  return depset() + source.go + source.headers + source.asm + source.c
+  return depset() + source.go + source.headers + source.asm + source.syso + source.c
 
 
 def go_importpath(ctx):
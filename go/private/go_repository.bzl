@@ -23,21 +23,53 @@ def _go_repository_impl(ctx):
       fail("cannot specify both of urls and commit", "commit")
     if ctx.attr.tag:
       fail("cannot specify both of urls and tag", "tag")
+    if ctx.attr.branch:
+      fail("cannot specify both of urls and branch", "branch")
+    if ctx.attr.init_submodules:
+      fail("cannot specify both of urls and init_submodules", "init_submodules")
+    if ctx.attr.version:
+      fail("cannot specify both of urls and version", "version")
     ctx.download_and_extract(
         url = ctx.attr.urls,
         sha256 = ctx.attr.sha256,
         stripPrefix = ctx.attr.strip_prefix,
         type = ctx.attr.type,
     )
+  elif ctx.attr.version:
+    # module zip from a proxy
+    for attr in ("commit", "tag", "branch", "vcs", "remote", "init_submodules"):
+      if getattr(ctx.attr, attr):
+        fail("cannot specify both of version and %s" % attr, attr)
+    # sha256 is checked by fetch_repo, which reports the sum of the zip file
+    # if it's missing so it can be copied into the rule.
+    proxy = ctx.attr.proxy
+    if not proxy:
+      # GOPROXY may be a comma-separated list. Only the first proxy is used.
+      proxy = ctx.os.environ.get("GOPROXY", "").split(",")[0]
+    if not proxy or proxy in ("direct", "off"):
+      fail("version is specified, but proxy is not set, and GOPROXY does not name a proxy", "proxy")
+    _fetch_repo = "@io_bazel_rules_go_repository_tools//:bin/fetch_repo{}".format(executable_extension(ctx))
+    result = env_execute(
+        ctx,
+        [
+            ctx.path(Label(_fetch_repo)),
+            '--dest', ctx.path(''),
+            '--importpath', ctx.attr.importpath,
+            '--proxy', proxy,
+            '--version', ctx.attr.version,
+            '--sha256', ctx.attr.sha256,
+        ],
+        environment = _proxy_env(ctx),
+    )
+    if result.return_code:
+      fail("failed to fetch %s: %s" % (ctx.name, result.stderr))
   else:
-    if ctx.attr.commit and ctx.attr.tag:
-      fail("cannot specify both of commit and tag", "commit")
-    if ctx.attr.commit:
-      rev = ctx.attr.commit
-    elif ctx.attr.tag:
-      rev = ctx.attr.tag
-    else:
-      fail("neither commit or tag is specified", "commit")
+    revs = [r for r in (ctx.attr.commit, ctx.attr.tag, ctx.attr.branch) if r]
+    if len(revs) > 1:
+      fail("only one of commit, tag, or branch may be specified", "commit")
+    if not revs:
+      fail("neither commit, tag, nor branch is specified", "commit")
+    rev = revs[0]
 
     # Using fetch repo
     if ctx.attr.vcs and not ctx.attr.remote:
@@ -49,23 +81,31 @@ def _go_repository_impl(ctx):
     if "SSH_AUTH_SOCK" in ctx.os.environ:
       fetch_repo_env["SSH_AUTH_SOCK"] = ctx.os.environ["SSH_AUTH_SOCK"]
 
-    # TODO(yugui): support submodule?
-    # c.f. https://www.bazel.io/versions/master/docs/be/workspace.html#git_repository.init_submodules
     _fetch_repo = "@io_bazel_rules_go_repository_tools//:bin/fetch_repo{}".format(executable_extension(ctx))
-    result = env_execute(
-        ctx,
-        [
-            ctx.path(Label(_fetch_repo)),
-            '--dest', ctx.path(''),
-            '--remote', ctx.attr.remote,
-            '--rev', rev,
-            '--vcs', ctx.attr.vcs,
-            '--importpath', ctx.attr.importpath,
-        ],
-        environment = fetch_repo_env,
-    )
+    fetch_repo_args = [
+        ctx.path(Label(_fetch_repo)),
+        '--dest', ctx.path(''),
+        '--remote', ctx.attr.remote,
+        '--rev', rev,
+        '--vcs', ctx.attr.vcs,
+        '--importpath', ctx.attr.importpath,
+        '--print_rev',
+    ]
+    if ctx.attr.commit and ctx.attr.vcs in ("", "git", "hg"):
+      # fetch_repo can only resolve revisions for git and hg. When vcs is
+      # empty, it's detected from the import path, and verification is
+      # skipped if it isn't one of these.
+      fetch_repo_args.extend(['--commit', ctx.attr.commit])
+    if ctx.attr.init_submodules:
+      fetch_repo_args.append('--submodules')
+    result = env_execute(ctx, fetch_repo_args, environment = fetch_repo_env)
     if result.return_code:
       fail("failed to fetch %s: %s" % (ctx.name, result.stderr))
+    resolved = result.stdout.strip()
+    if resolved and not ctx.attr.commit:
+      # Tags and branches may move. Report the commit so it can be pinned.
+      print("%s: %s resolved to commit %s. Set commit = \"%s\" for reproducible builds." % (
+          ctx.name, rev, resolved, resolved))
 
   generate = ctx.attr.build_file_generation == "on"
   if ctx.attr.build_file_generation == "auto":
@@ -98,6 +138,8 @@ go_repository = repository_rule(
         "importpath": attr.string(mandatory = True),
         "commit": attr.string(),
         "tag": attr.string(),
+        "branch": attr.string(),
+        "init_submodules": attr.bool(default = False),
 
         # Attributes for a repository that cannot be inferred from the import path
         "vcs": attr.string(default="", values=["", "git", "hg", "svn", "bzr"]),
@@ -109,14 +151,28 @@ go_repository = repository_rule(
         "type": attr.string(),
         "sha256": attr.string(),
 
+        # Attributes for a repository that comes from a module proxy
+        "version": attr.string(),
+        "proxy": attr.string(),
+
         # Attributes for a repository that needs automatic build file generation
         "build_file_name": attr.string(default="BUILD.bazel,BUILD"),
         "build_file_generation": attr.string(default="auto", values=["on", "auto", "off"]),
         "build_tags": attr.string_list(),
     },
+    environ = ["GOPROXY"],
 )
 """See go/workspace.rst#go-repository for full documentation."""
 
+def _proxy_env(ctx):
+  """Returns environment variables that configure HTTP proxies for
+  fetch_repo, copied from the host environment."""
+  env = {}
+  for name in ("HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"):
+    if name in ctx.os.environ:
+      env[name] = ctx.os.environ[name]
+  return env
+
 def env_execute(ctx, arguments, environment = None, **kwargs):
   """env_execute prepends "env -i" to "arguments" before passing it to
   ctx.execute.
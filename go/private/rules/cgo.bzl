@@ -103,7 +103,7 @@ def _cgo_codegen_impl(ctx):
   
   return [
       _CgoCodegen(
-          go_files = go_outs,
+          go_files = go_outs + source.syso,
           main_c = depset([cgo_main]),
           deps = deps,
           exports = depset([cgo_export_h]),
@@ -113,7 +113,7 @@ def _cgo_codegen_impl(ctx):
           runfiles = runfiles,
       ),
       OutputGroupInfo(
-          go_files = go_outs,
+          go_files = go_outs + source.syso,
           c_files = c_outs + source.headers,
           main_c = depset([cgo_main]),
       ),
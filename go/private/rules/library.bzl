@@ -41,7 +41,7 @@ def _go_library_impl(ctx):
       deps = ctx.attr.deps,
       cgo_info = cgo_info,
       embed = embed,
-      want_coverage = ctx.coverage_instrumented(),
+      want_coverage = ctx.coverage_instrumented() and "no_coverage" not in ctx.attr.tags,
       importpath = go_importpath(ctx),
   )
   cgo_exports = ctx.attr.cgo_info[CgoInfo].exports if ctx.attr.cgo_info else depset()
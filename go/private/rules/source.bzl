@@ -0,0 +1,64 @@
+# Copyright 2017 The Bazel Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load("@io_bazel_rules_go//go/private:providers.bzl",
+    "GoLibrary",
+    "GoEmbed",
+)
+
+def _go_source_impl(ctx):
+  """Implements the go_source() rule."""
+  srcs = depset(ctx.files.srcs)
+  deps = depset([d[GoLibrary] for d in ctx.attr.deps])
+  gc_goopts = tuple(ctx.attr.gc_goopts)
+  cover_vars = ()
+  for t in ctx.attr.embed:
+    goembed = t[GoEmbed]
+    srcs += getattr(goembed, "srcs", depset())
+    deps += getattr(goembed, "deps", ())
+    gc_goopts += getattr(goembed, "gc_goopts", ())
+    cover_vars += getattr(goembed, "cover_vars", ())
+    if getattr(goembed, "cgo_info", None):
+      fail("go_source may not embed %s, which has cgo" % t.label)
+
+  runfiles = ctx.runfiles(collect_data = True)
+  for t in ctx.attr.deps + ctx.attr.embed:
+    runfiles = runfiles.merge(t.data_runfiles)
+
+  return [
+      GoEmbed(
+          srcs = srcs, # The original sources
+          build_srcs = srcs, # The sources are compiled as they are
+          deps = deps, # The direct depencancies of the sources
+          cover_vars = cover_vars,
+          cgo_info = None,
+          gc_goopts = gc_goopts,
+      ),
+      DefaultInfo(
+          files = srcs,
+          runfiles = runfiles,
+      ),
+  ]
+
+go_source = rule(
+    _go_source_impl,
+    attrs = {
+        "data": attr.label_list(allow_files = True, cfg = "data"),
+        "srcs": attr.label_list(allow_files = True),
+        "deps": attr.label_list(providers = [GoLibrary]),
+        "embed": attr.label_list(providers = [GoEmbed]),
+        "gc_goopts": attr.string_list(),
+    },
+)
+"""See go/core.rst#go_source for full documentation."""
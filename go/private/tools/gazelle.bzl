@@ -14,16 +14,25 @@
 
 _script_content = """
 BASE=$(pwd)
-WORKSPACE=$(dirname $(readlink WORKSPACE))
+# "bazel run" sets BUILD_WORKSPACE_DIRECTORY to the workspace root. Older
+# versions of Bazel don't, so follow the WORKSPACE link in the runfiles tree.
+WORKSPACE="${{BUILD_WORKSPACE_DIRECTORY:-}}"
+if [ -z "$WORKSPACE" ]; then
+  WORKSPACE_FILE=WORKSPACE
+  while [ -L "$WORKSPACE_FILE" ]; do
+    WORKSPACE_FILE=$(readlink "$WORKSPACE_FILE")
+  done
+  WORKSPACE=$(dirname "$WORKSPACE_FILE")
+fi
 cd "$WORKSPACE"
-$BASE/{gazelle} {args} $@
+"$BASE/{gazelle}" {args} "$@"
 """
 
 def _gazelle_script_impl(ctx):
   prefix = ctx.attr.prefix if ctx.attr.prefix else ctx.attr._go_prefix.go_prefix
   args = [ctx.attr.command] + ctx.attr.args
   args += [
-      "-repo_root", "$WORKSPACE",
+      "-repo_root", '"$WORKSPACE"',
       "-go_prefix", prefix,
       "-external", ctx.attr.external,
       "-mode", ctx.attr.mode,
@@ -47,8 +56,8 @@ _gazelle_script = rule(
     _gazelle_script_impl,
     attrs = {
         "command": attr.string(values=["update", "fix"], default="update"),
-        "mode": attr.string(values=["print", "fix", "diff"], default="fix"),
-        "external": attr.string(values=["external", "vendored"], default="external"),
+        "mode": attr.string(values=["print", "fix", "diff", "check", "json"], default="fix"),
+        "external": attr.string(values=["external", "vendored", "hybrid"], default="external"),
         "build_tags": attr.string_list(),
         "args": attr.string_list(),
         "prefix": attr.string(),
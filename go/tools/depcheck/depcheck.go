@@ -0,0 +1,204 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
+)
+
+// problemKind describes how a declared dependency differs from the
+// dependencies implied by imports.
+type problemKind int
+
+const (
+	// missingDep indicates a package is imported, but the library that
+	// provides it is not in deps.
+	missingDep problemKind = iota
+
+	// unusedDep indicates a library is in deps, but no package it provides
+	// is imported.
+	unusedDep
+)
+
+// problem is a difference between the deps of a rule and the imports of its
+// sources.
+type problem struct {
+	kind problemKind
+
+	// rule is the absolute label of the rule with the problem.
+	rule string
+
+	// dep is the absolute label of the dependency that is missing or unused.
+	dep string
+}
+
+// String returns a buildozer command that fixes the problem.
+func (p problem) String() string {
+	var command string
+	switch p.kind {
+	case missingDep:
+		command = "add"
+	case unusedDep:
+		command = "remove"
+	}
+	return fmt.Sprintf("buildozer '%s deps %s' %s", command, p.dep, p.rule)
+}
+
+// goRuleKinds is the set of rule kinds whose deps are checked.
+var goRuleKinds = map[string]bool{
+	"go_binary":  true,
+	"go_library": true,
+	"go_test":    true,
+}
+
+// check walks the directories in c.Dirs and returns problems with the deps
+// of Go rules in existing build files. Imports are resolved the same way
+// Gazelle resolves them when it generates rules. Directories without build
+// files are skipped.
+func check(c *config.Config) []problem {
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	var problems []problem
+	for _, dir := range c.Dirs {
+		packages.Walk(c, dir, func(c *config.Config, pkg *packages.Package, oldFile *bf.File) {
+			if oldFile == nil {
+				return
+			}
+			g := rules.NewGenerator(c, r, l, pkg.Rel, oldFile)
+			genRules, _ := g.GenerateRules(pkg)
+			problems = append(problems, compareDeps(pkg.Rel, genRules, oldFile)...)
+		})
+	}
+	return problems
+}
+
+// compareDeps compares the deps of generated rules with the deps of rules
+// with the same kind and name in oldFile. rel is the slash-separated path
+// to the build file's directory, relative to the repository root. Declared
+// deps with "# keep" comments are never reported as unused.
+func compareDeps(rel string, genRules []bf.Expr, oldFile *bf.File) []problem {
+	oldRules := make(map[string]*bf.Rule)
+	for _, r := range oldFile.Rules("") {
+		if goRuleKinds[r.Kind()] {
+			oldRules[r.Kind()+":"+r.Name()] = r
+		}
+	}
+
+	var problems []problem
+	for _, e := range genRules {
+		call, ok := e.(*bf.CallExpr)
+		if !ok {
+			continue
+		}
+		gen := bf.Rule{Call: call}
+		old, ok := oldRules[gen.Kind()+":"+gen.Name()]
+		if !ok {
+			continue
+		}
+		ruleLabel := normalizeLabel(rel, ":"+old.Name())
+
+		want, _ := depLabels(rel, gen.Attr("deps"))
+		have, kept := depLabels(rel, old.Attr("deps"))
+		for _, dep := range sortedKeys(want) {
+			if !have[dep] {
+				problems = append(problems, problem{kind: missingDep, rule: ruleLabel, dep: dep})
+			}
+		}
+		for _, dep := range sortedKeys(have) {
+			if !want[dep] && !kept[dep] {
+				problems = append(problems, problem{kind: unusedDep, rule: ruleLabel, dep: dep})
+			}
+		}
+	}
+	return problems
+}
+
+// depLabels returns the set of labels in a deps expression, including
+// labels in select branches. Labels are normalized with normalizeLabel.
+// A separate set of labels marked with "# keep" comments is also returned.
+func depLabels(rel string, e bf.Expr) (labels, kept map[string]bool) {
+	labels = make(map[string]bool)
+	kept = make(map[string]bool)
+	var visit func(e bf.Expr)
+	visit = func(e bf.Expr) {
+		switch e := e.(type) {
+		case *bf.StringExpr:
+			label := normalizeLabel(rel, e.Value)
+			labels[label] = true
+			if com := e.Comment(); len(com.Suffix) > 0 && strings.HasPrefix(com.Suffix[0].Token, "# keep") {
+				kept[label] = true
+			}
+		case *bf.ListExpr:
+			for _, elem := range e.List {
+				visit(elem)
+			}
+		case *bf.BinaryExpr:
+			visit(e.X)
+			visit(e.Y)
+		case *bf.CallExpr:
+			for _, arg := range e.List {
+				visit(arg)
+			}
+		case *bf.DictExpr:
+			for _, elem := range e.List {
+				if kv, ok := elem.(*bf.KeyValueExpr); ok {
+					visit(kv.Value)
+				}
+			}
+		}
+	}
+	if e != nil {
+		visit(e)
+	}
+	return labels, kept
+}
+
+// normalizeLabel converts a label that may be relative to the package at rel
+// or that may omit its target name into an absolute label with an explicit
+// target name. For example, in package "foo", ":bar" becomes "//foo:bar",
+// and "//baz" becomes "//baz:baz".
+func normalizeLabel(rel, label string) string {
+	if !strings.HasPrefix(label, "//") && !strings.HasPrefix(label, "@") {
+		return fmt.Sprintf("//%s:%s", rel, strings.TrimPrefix(label, ":"))
+	}
+	if strings.Contains(label, ":") {
+		return label
+	}
+	i := strings.Index(label, "//")
+	if i < 0 {
+		// A repository name by itself, like "@foo", refers to "@foo//:foo".
+		return fmt.Sprintf("%s//:%s", label, label[1:])
+	}
+	return fmt.Sprintf("%s:%s", label, path.Base(label[i+len("//"):]))
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,127 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+func TestNormalizeLabel(t *testing.T) {
+	for _, tc := range []struct {
+		rel, label, want string
+	}{
+		{"foo", ":bar", "//foo:bar"},
+		{"foo", "bar", "//foo:bar"},
+		{"", ":bar", "//:bar"},
+		{"foo", "//baz", "//baz:baz"},
+		{"foo", "//baz/qux:go_default_library", "//baz/qux:go_default_library"},
+		{"foo", "@com_example_repo//baz", "@com_example_repo//baz:baz"},
+		{"foo", "@com_example_repo", "@com_example_repo//:com_example_repo"},
+	} {
+		if got := normalizeLabel(tc.rel, tc.label); got != tc.want {
+			t.Errorf("normalizeLabel(%q, %q) = %q; want %q", tc.rel, tc.label, got, tc.want)
+		}
+	}
+}
+
+func stringExpr(s string, keep bool) *bf.StringExpr {
+	e := &bf.StringExpr{Value: s}
+	if keep {
+		e.Comments.Suffix = []bf.Comment{{Token: "# keep"}}
+	}
+	return e
+}
+
+func ruleExpr(kind, name string, deps bf.Expr) *bf.CallExpr {
+	call := &bf.CallExpr{
+		X: &bf.LiteralExpr{Token: kind},
+		List: []bf.Expr{
+			&bf.BinaryExpr{X: &bf.LiteralExpr{Token: "name"}, Op: "=", Y: &bf.StringExpr{Value: name}},
+		},
+	}
+	if deps != nil {
+		call.List = append(call.List, &bf.BinaryExpr{X: &bf.LiteralExpr{Token: "deps"}, Op: "=", Y: deps})
+	}
+	return call
+}
+
+func TestCompareDeps(t *testing.T) {
+	genRules := []bf.Expr{
+		ruleExpr("go_library", "go_default_library", &bf.ListExpr{List: []bf.Expr{
+			stringExpr("//a:go_default_library", false),
+			stringExpr("//b", false),
+			stringExpr("@com_example_repo//c:go_default_library", false),
+		}}),
+		ruleExpr("go_test", "go_default_test", nil),
+	}
+	oldFile := &bf.File{Stmt: []bf.Expr{
+		ruleExpr("go_library", "go_default_library", &bf.BinaryExpr{
+			X: &bf.ListExpr{List: []bf.Expr{
+				stringExpr("//a:go_default_library", false),
+				stringExpr("//unused:go_default_library", false),
+				stringExpr("//kept:go_default_library", true),
+			}},
+			Op: "+",
+			Y: &bf.CallExpr{
+				X: &bf.LiteralExpr{Token: "select"},
+				List: []bf.Expr{&bf.DictExpr{List: []bf.Expr{
+					&bf.KeyValueExpr{
+						Key:   &bf.StringExpr{Value: "@io_bazel_rules_go//go/platform:linux_amd64"},
+						Value: &bf.ListExpr{List: []bf.Expr{stringExpr("//b:b", false)}},
+					},
+				}}},
+			},
+		}),
+		ruleExpr("go_test", "go_default_test", &bf.ListExpr{List: []bf.Expr{
+			stringExpr(":go_default_library", false),
+		}}),
+		ruleExpr("cc_library", "go_default_library", &bf.ListExpr{List: []bf.Expr{
+			stringExpr("//cc:unrelated", false),
+		}}),
+	}}
+
+	got := compareDeps("pkg", genRules, oldFile)
+	want := []problem{
+		{kind: missingDep, rule: "//pkg:go_default_library", dep: "@com_example_repo//c:go_default_library"},
+		{kind: unusedDep, rule: "//pkg:go_default_library", dep: "//unused:go_default_library"},
+		{kind: unusedDep, rule: "//pkg:go_default_test", dep: "//pkg:go_default_library"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestProblemString(t *testing.T) {
+	for _, tc := range []struct {
+		p    problem
+		want string
+	}{
+		{
+			problem{kind: missingDep, rule: "//foo:go_default_library", dep: "//bar:go_default_library"},
+			"buildozer 'add deps //bar:go_default_library' //foo:go_default_library",
+		}, {
+			problem{kind: unusedDep, rule: "//foo:go_default_library", dep: "//bar:go_default_library"},
+			"buildozer 'remove deps //bar:go_default_library' //foo:go_default_library",
+		},
+	} {
+		if got := tc.p.String(); got != tc.want {
+			t.Errorf("got %q; want %q", got, tc.want)
+		}
+	}
+}
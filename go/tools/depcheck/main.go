@@ -0,0 +1,109 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command depcheck reports Go rules in existing build files whose deps don't
+// match the imports of their sources. Imports are resolved to labels the same
+// way Gazelle resolves them. Each unused or missing dependency is printed as
+// a buildozer command that fixes it, for example:
+//
+//     buildozer 'remove deps //foo:go_default_library' //bar:go_default_library
+//     buildozer 'add deps //baz:go_default_library' //bar:go_default_library
+//
+// depcheck exits with code 4 if any problems are found.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/wspace"
+)
+
+// exitProblems is the exit code when problems are found. This matches
+// Gazelle's check mode.
+const exitProblems = 4
+
+func main() {
+	log.SetPrefix("depcheck: ")
+	log.SetFlags(0)
+
+	c, err := newConfiguration(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	problems := check(c)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		os.Exit(exitProblems)
+	}
+}
+
+func newConfiguration(args []string) (*config.Config, error) {
+	fs := flag.NewFlagSet("depcheck", flag.ExitOnError)
+	buildFileName := fs.String("build_file_name", "BUILD.bazel,BUILD", "comma-separated list of valid build file names")
+	buildTags := fs.String("build_tags", "", "comma-separated list of build tags")
+	external := fs.String("external", "external", "external: resolve external packages with go_repository\n\tvendored: resolve external packages as packages in vendor/\n\thybrid: resolve external packages in vendor/ if present, otherwise with go_repository")
+	goPrefix := fs.String("go_prefix", "", "go_prefix of the target workspace")
+	repoRoot := fs.String("repo_root", "", "path to the repository root. If not set, depcheck searches for a WORKSPACE file.")
+	resolveWKT := fs.Bool("resolve_wkt", true, "whether imports of well-known protobuf type packages are resolved to\n\t@io_bazel_rules_go//proto/wkt targets")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: depcheck -go_prefix example.com/repo [flags...] [package-dirs...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var c config.Config
+	var err error
+	c.Dirs = fs.Args()
+	if len(c.Dirs) == 0 {
+		c.Dirs = []string{"."}
+	}
+	for i := range c.Dirs {
+		if c.Dirs[i], err = filepath.Abs(c.Dirs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if *repoRoot != "" {
+		c.RepoRoot = *repoRoot
+	} else if c.RepoRoot, err = wspace.Find(c.Dirs[0]); err != nil {
+		return nil, fmt.Errorf("-repo_root not specified, and WORKSPACE cannot be found: %v", err)
+	}
+	if *goPrefix == "" {
+		return nil, fmt.Errorf("-go_prefix must be set")
+	}
+	c.GoPrefix = *goPrefix
+
+	c.ValidBuildFileNames = strings.Split(*buildFileName, ",")
+	if err := c.SetBuildTags(*buildTags); err != nil {
+		return nil, err
+	}
+	c.Platforms = config.DefaultPlatformTags
+	c.PreprocessTags()
+	if c.DepMode, err = config.DependencyModeFromString(*external); err != nil {
+		return nil, err
+	}
+	c.StructureMode = config.HierarchicalMode
+	c.ResolveWellKnownTypes = *resolveWKT
+	c.ShortLabels = true
+	return &c, nil
+}
@@ -94,3 +94,37 @@ func TestGetRepoRoot_error(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckRev(t *testing.T) {
+	const full = "8ee79997227bf9b34611aee7946ae64735e6fd93"
+	for _, tc := range []struct {
+		label, want string
+		ok          bool
+	}{
+		{label: "no commit", want: "", ok: true},
+		{label: "full", want: full, ok: true},
+		{label: "abbreviated", want: "8ee7999", ok: true},
+		{label: "upper case", want: "8EE7999", ok: true},
+		{label: "mismatch", want: "1234567", ok: false},
+	} {
+		err := checkRev("v1.0.0", full, tc.want)
+		if tc.ok && err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("[%s] expected error", tc.label)
+		}
+	}
+}
+
+func TestVerifyRevUnsupportedVCS(t *testing.T) {
+	// Revisions can't be resolved for svn and bzr, so the check is skipped
+	// without running any commands in the (missing) directory.
+	for _, cmd := range []string{"svn", "bzr"} {
+		got, err := verifyRev(vcs.ByCmd(cmd), "/nonexistent", "1234", "1234", true)
+		if err != nil {
+			t.Errorf("[%s] %v", cmd, err)
+		} else if got != "" {
+			t.Errorf("[%s] got revision %q; want none", cmd, got)
+		}
+	}
+}
@@ -11,9 +11,12 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"log"
+	"os/exec"
+	"strings"
 
 	"golang.org/x/tools/go/vcs"
 )
@@ -24,6 +27,12 @@ var (
 	rev        = flag.String("rev", "", "target revision")
 	dest       = flag.String("dest", "", "destination directory")
 	importpath = flag.String("importpath", "", "Go importpath to the repository fetch")
+	submodules = flag.Bool("submodules", false, "whether to initialize and update submodules after checking out the target revision. Only supported for git.")
+	commit     = flag.String("commit", "", "if set, the commit that the target revision must resolve to. Used to verify tags and branches. Ignored for VCSs other than git and hg.")
+	proxy      = flag.String("proxy", "", "URL of a Go module proxy. If set, the module version named by --version is downloaded from the proxy instead of using a VCS.")
+	version    = flag.String("version", "", "module version to download. Must be used with the --proxy flag.")
+	sum        = flag.String("sha256", "", "expected SHA-256 sum of the module zip file downloaded with --proxy. Required with --proxy; if it's missing, the sum of the zip file is reported.")
+	printRev   = flag.Bool("print_rev", false, "whether to print the commit that the target revision resolved to. Ignored for VCSs other than git and hg.")
 
 	// Used for overriding in tests to disable network calls.
 	repoRootForImportPath = vcs.RepoRootForImportPath
@@ -58,12 +67,105 @@ func getRepoRoot(remote, cmd, importpath string) (*vcs.RepoRoot, error) {
 	return r, nil
 }
 
+// resolvedRevCmds maps VCS commands to the arguments for a command that
+// prints the full identifier of the revision checked out in the current
+// directory.
+var resolvedRevCmds = map[string][]string{
+	"git": {"rev-parse", "HEAD"},
+	"hg":  {"log", "-r", ".", "--template", "{node}"},
+}
+
+// resolvedRev returns the full identifier of the revision checked out in dir.
+func resolvedRev(v *vcs.Cmd, dir string) (string, error) {
+	args, ok := resolvedRevCmds[v.Cmd]
+	if !ok {
+		return "", fmt.Errorf("resolving revisions is not supported for %s", v.Name)
+	}
+	c := exec.Command(v.Cmd, args...)
+	c.Dir = dir
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v\n%s", v.Cmd, strings.Join(args, " "), err, stderr.Bytes())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// checkRev returns an error if got, the full identifier of the revision that
+// rev resolved to, does not match want, which may be abbreviated.
+func checkRev(rev, got, want string) error {
+	if want == "" || strings.HasPrefix(strings.ToLower(got), strings.ToLower(want)) {
+		return nil
+	}
+	return fmt.Errorf("revision %s resolved to commit %s; want %s", rev, got, want)
+}
+
+// verifyRev checks that rev, checked out in dir, resolved to commit. If
+// commit is empty, nothing is checked. verifyRev returns the full identifier
+// of the checked out revision if resolve is true. Revisions can only be
+// resolved for the VCSs in resolvedRevCmds; for others, verifyRev does
+// nothing and returns an empty string.
+func verifyRev(v *vcs.Cmd, dir, rev, commit string, resolve bool) (string, error) {
+	if _, ok := resolvedRevCmds[v.Cmd]; !ok || (commit == "" && !resolve) {
+		return "", nil
+	}
+	got, err := resolvedRev(v, dir)
+	if err != nil {
+		return "", err
+	}
+	if err := checkRev(rev, got, commit); err != nil {
+		return "", err
+	}
+	if !resolve {
+		return "", nil
+	}
+	return got, nil
+}
+
+func updateSubmodules(v *vcs.Cmd, dir string) error {
+	if v.Cmd != "git" {
+		return fmt.Errorf("submodules are not supported for %s", v.Name)
+	}
+	c := exec.Command("git", "submodule", "update", "--init", "--recursive")
+	c.Dir = dir
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("git submodule update: %v\n%s", err, out)
+	}
+	return nil
+}
+
 func run() error {
+	if (*proxy == "") != (*version == "") {
+		return fmt.Errorf("--proxy should be used with the --version flag")
+	}
+	if *proxy != "" {
+		if *importpath == "" {
+			return fmt.Errorf("--importpath must be set when fetching from a proxy")
+		}
+		return fetchModule(*proxy, *importpath, *version, *sum, *dest)
+	}
+
 	r, err := getRepoRoot(*remote, *cmd, *importpath)
 	if err != nil {
 		return err
 	}
-	return r.VCS.CreateAtRev(*dest, r.Repo, *rev)
+	if err := r.VCS.CreateAtRev(*dest, r.Repo, *rev); err != nil {
+		return err
+	}
+	if *submodules {
+		if err := updateSubmodules(r.VCS, *dest); err != nil {
+			return err
+		}
+	}
+	got, err := verifyRev(r.VCS, *dest, *rev, *commit, *printRev)
+	if err != nil {
+		return err
+	}
+	if got != "" {
+		fmt.Println(got)
+	}
+	return nil
 }
 
 func main() {
@@ -0,0 +1,148 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// fetchModule downloads the zip file for version of the module at importpath
+// from a module proxy at proxyURL and extracts it into dest. wantSum must
+// match the hex-encoded SHA-256 sum of the zip file. If wantSum is empty, the
+// zip file isn't extracted, and the returned error reports its sum so it can
+// be pinned.
+//
+// Proxies follow the GOPROXY protocol: the zip file is at
+// $proxyURL/$module/@v/$version.zip, and files in the zip file are in a
+// directory named $module@$version.
+func fetchModule(proxyURL, importpath, version, wantSum, dest string) error {
+	escapedPath, err := escapeModulePath(importpath)
+	if err != nil {
+		return err
+	}
+	escapedVersion, err := escapeModulePath(version)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/%s/@v/%s.zip", strings.TrimSuffix(proxyURL, "/"), escapedPath, escapedVersion)
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s: %v", url, err)
+	}
+
+	sum := sha256.Sum256(data)
+	gotSum := hex.EncodeToString(sum[:])
+	if wantSum == "" {
+		return fmt.Errorf("%s: sha256 must be set when fetching a module version; the zip file has sha256 %s", url, gotSum)
+	}
+	if !strings.EqualFold(gotSum, wantSum) {
+		return fmt.Errorf("%s: got sha256 %s; want %s", url, gotSum, wantSum)
+	}
+
+	return extractModuleZip(data, importpath+"@"+version, dest)
+}
+
+// escapeModulePath escapes upper case letters in a module path or version
+// as an exclamation mark followed by the lower case letter, since proxies
+// may be served from case-insensitive file systems.
+func escapeModulePath(p string) (string, error) {
+	var buf bytes.Buffer
+	for _, r := range p {
+		if r >= 0x80 {
+			return "", fmt.Errorf("invalid character %q in module path or version %q", r, p)
+		}
+		if unicode.IsUpper(r) {
+			buf.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String(), nil
+}
+
+// extractModuleZip extracts files under the directory prefix in the zip file
+// data into dest. Files outside prefix are not allowed.
+func extractModuleZip(data []byte, prefix, dest string) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	prefix += "/"
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, prefix) || path.Clean(f.Name) != strings.TrimSuffix(f.Name, "/") {
+			return fmt.Errorf("unexpected file %q in module zip; want files in %q", f.Name, prefix)
+		}
+		rel := strings.TrimPrefix(f.Name, prefix)
+		if rel == "" {
+			continue
+		}
+		outPath := filepath.Join(dest, filepath.FromSlash(rel))
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(outPath, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return err
+		}
+		if err := extractFile(f, outPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(f *zip.File, outPath string) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	mode := os.FileMode(0644)
+	if f.Mode()&0111 != 0 {
+		mode = 0755
+	}
+	w, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
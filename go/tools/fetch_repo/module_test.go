@@ -0,0 +1,132 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEscapeModulePath(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"github.com/bazeltest/rules_go", "github.com/bazeltest/rules_go"},
+		{"github.com/BurntSushi/toml", "github.com/!burnt!sushi/toml"},
+		{"v1.0.0-RC1", "v1.0.0-!r!c1"},
+	} {
+		if got, err := escapeModulePath(tc.in); err != nil {
+			t.Errorf("escapeModulePath(%q): %v", tc.in, err)
+		} else if got != tc.want {
+			t.Errorf("escapeModulePath(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchModule(t *testing.T) {
+	// Files in the zip use the module path as is. Only the URL is escaped.
+	data := makeZip(t, map[string]string{
+		"example.com/Foo@v1.0.0/foo.go":     "package foo",
+		"example.com/Foo@v1.0.0/bar/bar.go": "package bar",
+	})
+	sum := sha256.Sum256(data)
+	hexSum := hex.EncodeToString(sum[:])
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/example.com/!foo/@v/v1.0.0.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		label, sum string
+		ok         bool
+	}{
+		{label: "no sum"},
+		{label: "good sum", sum: hexSum, ok: true},
+		{label: "bad sum", sum: "0123456789abcdef"},
+	} {
+		dest, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "fetch_repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dest)
+
+		err = fetchModule(srv.URL, "example.com/Foo", "v1.0.0", tc.sum, dest)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("[%s] expected error", tc.label)
+			} else if tc.sum == "" && !strings.Contains(err.Error(), hexSum) {
+				t.Errorf("[%s] error %q does not report sha256 %s", tc.label, err, hexSum)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+			continue
+		}
+		for _, name := range []string{"foo.go", "bar/bar.go"} {
+			if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name))); err != nil {
+				t.Errorf("[%s] %v", tc.label, err)
+			}
+		}
+	}
+}
+
+func TestExtractModuleZipOutsidePrefix(t *testing.T) {
+	dest, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "fetch_repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	for _, name := range []string{"other@v1.0.0/foo.go", "example.com/foo@v1.0.0/../foo.go"} {
+		data := makeZip(t, map[string]string{name: "package foo"})
+		if err := extractModuleZip(data, "example.com/foo@v1.0.0", dest); err == nil {
+			t.Errorf("extractModuleZip with file %q: expected error", name)
+		}
+	}
+}
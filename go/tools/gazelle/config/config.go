@@ -17,11 +17,48 @@ package config
 
 import (
 	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// KnownHost is an import path prefix, like a hosting site or a vanity
+// domain, where the roots of repositories are a fixed number of path
+// components below the prefix. For example, repositories on k8s.io are
+// named by one component, like k8s.io/apimachinery.
+type KnownHost struct {
+	// Prefix is the import path prefix, like "k8s.io".
+	Prefix string
+
+	// Components is the number of path components after Prefix that name
+	// a repository. If it's 0, Prefix is itself a repository root.
+	Components int
+}
+
+// ParseKnownHost parses a known host written as prefix=components, for
+// example, "k8s.io=1".
+func ParseKnownHost(s string) (KnownHost, error) {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return KnownHost{}, fmt.Errorf("known host %q must have the form prefix=components", s)
+	}
+	prefix := strings.Trim(s[:i], "/")
+	n, err := strconv.Atoi(s[i+1:])
+	if err != nil || n < 0 || prefix == "" {
+		return KnownHost{}, fmt.Errorf("known host %q must have the form prefix=components", s)
+	}
+	return KnownHost{Prefix: prefix, Components: n}, nil
+}
+
 // Config holds information about how Gazelle should run. This is mostly
 // based on command-line arguments.
+//
+// Dirs and RepoRoot are file system paths, which use the native separator
+// (a backslash on Windows). Other paths in Config, like GoPrefixRel and keys
+// of ChangedDirs, are slash-separated and relative to RepoRoot, like the
+// package paths in labels. RelPath converts from the first to the second.
 type Config struct {
 	// Dirs is a list of absolute paths to directories where Gazelle should run.
 	Dirs []string
@@ -46,14 +83,324 @@ type Config struct {
 	// This is used to map imports to labels within the repository.
 	GoPrefix string
 
+	// GoPrefixRel is the slash-separated path to the directory corresponding
+	// to GoPrefix, relative to RepoRoot. This is empty unless GoPrefix was
+	// set by a "# gazelle:prefix" directive in a subdirectory.
+	GoPrefixRel string
+
 	// DepMode determines how imports outside of GoPrefix are resolved.
 	DepMode DependencyMode
 
 	// KnownImports is a list of imports to add to the external resolver cache.
 	KnownImports []string
 
+	// KnownHosts lists import path prefixes, in addition to the built-in
+	// ones, under which the external resolver can find repository roots
+	// without looking them up over the network.
+	KnownHosts []KnownHost
+
+	// ResolveWellKnownTypes determines whether imports of Go packages for
+	// well-known protobuf types are resolved to targets in
+	// @io_bazel_rules_go//proto/wkt instead of being resolved like other
+	// imports outside of GoPrefix.
+	ResolveWellKnownTypes bool
+
+	// GoResolveOverrides maps Go import paths to labels that should be used
+	// for them instead of the labels the resolver would choose. Entries are
+	// added with "# gazelle:resolve go import/path label" directives.
+	GoResolveOverrides map[string]string
+
+	// RepoOverrides maps import path prefixes of external repositories to
+	// where they're built instead, for teams developing a dependency in
+	// another checkout. Values are repository names like "@foo", for
+	// repositories declared with local_repository or replaced with
+	// --override_repository, or packages in this repository like
+	// "//third_party/foo". Imports under a prefix are resolved relative to
+	// the value. Entries are added with "# gazelle:repo_override" directives.
+	RepoOverrides map[string]string
+
+	// PreferredLabels are labels of rules chosen when an import path is
+	// provided by more than one rule in the index built with -bazel_query.
+	// Labels are absolute, like "//foo:go_default_library". They are added
+	// with "# gazelle:prefer label" directives.
+	PreferredLabels []string
+
+	// GenerateTestdata determines whether go_test rules for packages with a
+	// testdata directory get a data attribute with a glob of that directory.
+	GenerateTestdata bool
+
+	// ShortLabels determines whether labels are written in the short form
+	// buildifier prefers: ":target" for targets in the same package, and
+	// "//pkg" instead of "//pkg:pkg". When false, labels are written in full.
+	ShortLabels bool
+
+	// InternalVisibility determines whether libraries and binaries in or
+	// below a directory named "internal" are only visible to the tree rooted
+	// at that directory's parent, following Go's rules for internal packages.
+	// When false, they are visible to everything.
+	InternalVisibility bool
+
+	// AttrPolicies determines how generated attributes are merged into
+	// existing rules, keyed by attribute name. Attributes not in this map
+	// are merged using Gazelle's defaults. Entries are added with
+	// "# gazelle:attr name policy" directives.
+	AttrPolicies map[string]AttrPolicy
+
+	// BinaryNaming determines how go_binary rules are named in hierarchical
+	// mode. It is either DirNameBinaryNaming, ImportPathBinaryNaming, or a
+	// template containing "{dirname}" or "{importpath}", which are replaced
+	// with the names those strategies would produce. See CheckBinaryNaming.
+	BinaryNaming string
+
+	// LibraryNaming determines how go_library rules are named in
+	// hierarchical mode. It is either DefaultLibraryNaming, where libraries
+	// are named DefaultLibName, or DirNameLibraryNaming, where they're named
+	// after their directories. Libraries in external repositories are always
+	// named DefaultLibName.
+	LibraryNaming string
+
+	// LibraryAliases determines what the fix command does with aliases named
+	// DefaultLibName for libraries renamed with DirNameLibraryNaming. When
+	// it's "add", an alias is added for each library that is renamed, so
+	// labels outside the repository keep working for a deprecation period.
+	// When it's "remove", those aliases are removed. When it's empty,
+	// existing aliases are left alone.
+	LibraryAliases string
+
+	// ExternalNaming is the name of the convention used to name external
+	// repositories after the import paths of their roots. The conventions
+	// are listed in the resolve package. If this is empty, repositories are
+	// named after the reverse-DNS form of their import paths.
+	ExternalNaming string
+
+	// RepoNamer names external repositories after the import paths of their
+	// roots. If it's set, ExternalNaming is ignored. Programs that use
+	// Gazelle as a library may set it to follow their own convention.
+	RepoNamer func(importpath string) string
+
+	// RepoCacheFile is the path to a file where repository roots found by
+	// looking up import paths over the network are cached across runs. If
+	// this is empty, results are only cached in memory.
+	RepoCacheFile string
+
+	// RepoCacheTTL is how long entries in RepoCacheFile are used before
+	// they're looked up again.
+	RepoCacheTTL time.Duration
+
+	// RepoRootsFile is the path to a file checked into the repository that
+	// records the repository roots of import paths looked up over the
+	// network, so everyone resolves them the same way, even offline. Roots
+	// in the file are used instead of looking import paths up. New roots
+	// are only added if the file exists. If this is empty, no file is used.
+	RepoRootsFile string
+
+	// RepoLookupInterval is the minimum time between the starts of network
+	// lookups of import paths on the same host. If it's zero, lookups
+	// aren't limited.
+	RepoLookupInterval time.Duration
+
+	// RepoLookupRetries is the number of times a failed network lookup of an
+	// import path is retried, with exponential backoff, before the failure
+	// is reported.
+	RepoLookupRetries int
+
+	// RepoLookupJobs is the maximum number of network lookups of import
+	// paths in flight at once. Lookups are started while directories are
+	// still being scanned, before rules are generated for them. If it's
+	// zero, import paths are looked up one at a time as rules are generated.
+	RepoLookupJobs int
+
+	// Offline prevents import paths from being looked up over the network
+	// to find the repositories that provide them. Repositories may still be
+	// found with KnownImports, RepoRootsFile, RepoCacheFile, and well-known
+	// hosting sites. Other imports can't be resolved unless OfflineHeuristic
+	// is set.
+	Offline bool
+
+	// OfflineHeuristic determines whether, when Offline is set, repositories
+	// providing unknown imports are guessed to be rooted at the first three
+	// components of the import paths.
+	OfflineHeuristic bool
+
 	// StructureMode determines how build files are organized within a project.
 	StructureMode StructureMode
+
+	// ProtoMode determines how rules are generated for .proto files.
+	ProtoMode ProtoMode
+
+	// DisabledKinds is the set of rule kinds Gazelle doesn't generate. Rules
+	// of these kinds are neither created nor deleted, but existing rules are
+	// still fixed and indexed. Kinds are disabled with -generate and
+	// "# gazelle:generate" directives.
+	DisabledKinds map[string]bool
+
+	// TestSize and TestTimeout are the size and timeout attributes set on
+	// generated go_test rules. They are empty by default, which leaves the
+	// attributes out. Existing values in build files are never changed.
+	// They are set with "# gazelle:test_size" and "# gazelle:test_timeout"
+	// directives.
+	TestSize, TestTimeout string
+
+	// TestRundir is the directory generated go_test rules run in: either
+	// TestRundirPackage or TestRundirWorkspace. Existing rundir attributes
+	// in build files are never changed. It's set with
+	// "# gazelle:test_rundir" directives.
+	TestRundir string
+
+	// TestOnly determines whether generated go_library and go_binary rules
+	// are marked testonly, so only tests and other testonly rules may depend
+	// on them. This is useful for test helpers and fakes. Existing testonly
+	// attributes in build files are never changed. It's set with
+	// "# gazelle:testonly" directives.
+	TestOnly bool
+
+	// NoCoverage determines whether generated go_library rules are tagged
+	// with NoCoverageTag, so they aren't instrumented when tests are run
+	// with "bazel coverage". This is useful for vendored and generated code.
+	// It's set with "# gazelle:coverage off" directives.
+	NoCoverage bool
+
+	// AnnotateDeps determines whether each label in the deps of generated
+	// rules gets a trailing comment naming the import path it was resolved
+	// from, like "# example.com/a/b". The merger keeps these comments up to
+	// date in existing rules. It's set with "# gazelle:annotate_deps"
+	// directives.
+	AnnotateDeps bool
+
+	// XDefs are entries added to the x_defs attribute of generated go_binary
+	// rules, mapping variables like "example.com/version.Version" to the
+	// values they're set to at link time. Values may refer to stamping
+	// variables like "{STABLE_GIT_TAG}". Other entries in existing x_defs
+	// are kept. Entries are added with "# gazelle:x_def name=value"
+	// directives.
+	XDefs map[string]string
+
+	// GcGoopts and GcLinkopts are flags added to the gc_goopts and
+	// gc_linkopts attributes of generated rules, like "-trimpath". GcGoopts
+	// are set on libraries and on binaries and tests that don't embed a
+	// library (others get the flags through the library). GcLinkopts are
+	// set on binaries and tests. They are set with "# gazelle:gc_goopts" and
+	// "# gazelle:gc_linkopts" directives.
+	GcGoopts, GcLinkopts []string
+
+	// DefaultTags is a list of tags added to the tags attribute of every
+	// generated rule, for example, to mark vendored code "manual". Existing
+	// tags are kept. Tags are set with "# gazelle:default_tags" directives.
+	DefaultTags []string
+
+	// DefaultVisibility is a list of labels Gazelle writes as the
+	// default_visibility of a package declaration at the top of each build
+	// file. When it's set, generated rules don't get their own visibility
+	// attributes, and existing visibility attributes that match the default
+	// are removed. It's set with "# gazelle:default_visibility" directives.
+	DefaultVisibility []string
+
+	// UseGitignore determines whether files and directories matched by
+	// patterns in .gitignore files are skipped. Directories listed in
+	// .bazelignore at the repository root are always skipped.
+	UseGitignore bool
+
+	// EmptyBuildFiles determines whether build files are created in
+	// directories without Go packages that have packages below them. When
+	// it's EmptyBuildFilesEmpty, the new files are empty. When it's
+	// EmptyBuildFilesPackage, they contain a package declaration. When it's
+	// empty, no build files are created in these directories.
+	EmptyBuildFiles string
+
+	// FollowSymlinks determines whether symbolic links to directories outside
+	// the repository are followed. Links to directories inside the repository
+	// and links that would form a cycle are never followed.
+	FollowSymlinks bool
+
+	// AllowRelativeImports determines whether packages with relative imports
+	// (like "./foo") get rules. When false, each relative import is reported
+	// as an error, and no rules are generated for the package. When true,
+	// a warning is reported, and relative imports are resolved to packages
+	// in the repository.
+	AllowRelativeImports bool
+
+	// ImportCycleErrors determines whether import cycles between rules in
+	// the repository are reported as errors. When true, build files are not
+	// written if there are any cycles. When false, cycles are reported as
+	// warnings.
+	ImportCycleErrors bool
+
+	// UpdateDepsOnly determines whether only the deps attributes of existing
+	// rules are updated. Other attributes are left alone, rules aren't added
+	// or deleted, and new build files aren't created. It's set with
+	// -update=deps.
+	UpdateDepsOnly bool
+
+	// NewOnParseError determines what happens in directories with existing
+	// build files that can't be parsed. These directories are always
+	// skipped when build files are merged. When true, the rules Gazelle
+	// would generate for them are written to a new file next to the broken
+	// one, named with NewFileSuffix, so they can be merged by hand.
+	NewOnParseError bool
+
+	// ChangedDirs is the set of directories rules are generated for when
+	// Gazelle is run with -changed_files or -since, as slash-separated paths
+	// relative to RepoRoot. Directories with rules that depend on rules in
+	// these directories are updated, too. Other directories are still walked
+	// so directives in their build files apply, but their source files
+	// aren't read. If this is nil, rules are generated for all directories.
+	ChangedDirs map[string]bool
+
+	// BazelQuery determines whether Go imports are resolved with an index
+	// of the go_library and go_proto_library rules in the repository built
+	// with "bazel query". This finds rules declared by macros and rules
+	// whose import paths don't match their directories.
+	BazelQuery bool
+
+	// BazelQueryFile is the path to a file with saved output of
+	// "bazel query --output=xml", which is read to build the index instead
+	// of running bazel. Setting it implies BazelQuery.
+	BazelQueryFile string
+
+	// ExcludedDirs is a list of directories Gazelle skips, set in the
+	// repository's config file. Paths are slash-separated and relative to
+	// RepoRoot. Like directories in .bazelignore, they are never visited.
+	ExcludedDirs []string
+
+	// BackupSuffix is appended to the paths of build files to name copies
+	// of their previous contents, which are saved before the files are
+	// rewritten. If this is empty, no copies are saved.
+	BackupSuffix string
+
+	// BuildFileHeader is written at the top of build files Gazelle creates,
+	// for example, a license block or buildifier directives. It contains only
+	// comment lines and blank lines; see ParseBuildFileHeader. Headers of
+	// existing files are never changed. If this is empty, no header is
+	// written.
+	BuildFileHeader string
+
+	// Loads lists .bzl files that load statements are managed for, in
+	// addition to the files Gazelle knows about, along with the kinds of
+	// rules or macros loaded from each file. Entries are added with
+	// "# gazelle:load file kind..." directives.
+	Loads []LoadInfo
+
+	// KindAliases maps names of macros that wrap rules, like
+	// "team_go_library", to the kinds of rules they wrap, like "go_library".
+	// Existing calls to these macros are updated as if they were rules of
+	// the wrapped kinds, and they keep their macro names. Aliases are added
+	// with "# gazelle:kind_alias macro kind" directives.
+	KindAliases map[string]string
+
+	// SourceGroups split large packages into go_source rules that are
+	// embedded in the package's library. Library files matching a group's
+	// patterns are listed in the group's rule instead of the library. Groups
+	// are added with "# gazelle:go_source name pattern..." directives and
+	// apply to subdirectories.
+	SourceGroups []SourceGroup
+
+	// GoPathName is the name of a go_path rule declared with a
+	// "# gazelle:go_path name" directive in the directory GoPathRel. The rule
+	// depends on the go_library rules generated in that directory and its
+	// subdirectories. GoPathName is inherited by subdirectories, so it's
+	// set wherever libraries need to be recorded; it's empty if no
+	// directive applies.
+	GoPathName, GoPathRel string
 }
 
 var DefaultValidBuildFileNames = []string{"BUILD.bazel", "BUILD"}
@@ -71,6 +418,24 @@ func (c *Config) DefaultBuildFileName() string {
 	return c.ValidBuildFileNames[0]
 }
 
+// RelPath returns the slash-separated path of p, a file system path,
+// relative to c.RepoRoot. The repository root itself is "". false is
+// returned if p is not in the repository.
+func (c *Config) RelPath(p string) (string, bool) {
+	rel, err := filepath.Rel(c.RepoRoot, p)
+	if err != nil {
+		return "", false
+	}
+	if rel == "." {
+		return "", true
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
 // BuildTags is a set of build constraints.
 type BuildTags map[string]bool
 
@@ -125,6 +490,73 @@ func (c *Config) PreprocessTags() {
 	}
 }
 
+// AttrPolicy determines how a generated attribute is merged with the same
+// attribute in an existing rule.
+type AttrPolicy int
+
+const (
+	// OverwriteAttr indicates the attribute is fully managed by Gazelle. The
+	// existing value is replaced with the generated value, or removed if
+	// nothing was generated.
+	OverwriteAttr AttrPolicy = iota
+
+	// MergeAttr indicates the existing and generated values are combined.
+	// Values in the existing attribute are never removed.
+	MergeAttr
+
+	// KeepAttr indicates the attribute is owned by the user. Gazelle won't
+	// change, add, or remove it in existing rules.
+	KeepAttr
+)
+
+// AttrPolicyFromString converts a string from a directive to an AttrPolicy.
+// Valid strings are "overwrite", "merge", and "keep". An error will be
+// returned for an invalid string.
+func AttrPolicyFromString(s string) (AttrPolicy, error) {
+	switch s {
+	case "overwrite":
+		return OverwriteAttr, nil
+	case "merge":
+		return MergeAttr, nil
+	case "keep":
+		return KeepAttr, nil
+	default:
+		return 0, fmt.Errorf("unrecognized attribute policy: %q", s)
+	}
+}
+
+// LoadInfo describes a .bzl file and the symbols loaded from it.
+// merger.FixLoads adds load statements for kinds used in a build file and
+// removes load statements for kinds that are no longer used.
+type LoadInfo struct {
+	// File is the label of the .bzl file.
+	File string
+
+	// Kinds are the names of rules or macros loaded from File.
+	Kinds []string
+}
+
+// SourceGroup is a named set of file name patterns. Library sources that
+// match a group are listed in a go_source rule with the group's name.
+type SourceGroup struct {
+	// Name is the name of the go_source rule.
+	Name string
+
+	// Patterns are matched against base names of source files with
+	// path.Match, for example, "tables*.go".
+	Patterns []string
+}
+
+// Match returns whether the file name matches any of g's patterns.
+func (g SourceGroup) Match(name string) bool {
+	for _, p := range g.Patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // DependencyMode determines how imports of packages outside of the prefix
 // are resolved.
 type DependencyMode int
@@ -137,22 +569,150 @@ const (
 	// VendorMode indicates imports should be resolved to libraries in the
 	// vendor directory.
 	VendorMode
+
+	// HybridMode indicates imports should be resolved to libraries in the
+	// vendor directory if they are present there and to external
+	// dependencies otherwise.
+	HybridMode
 )
 
 // DependencyModeFromString converts a string from the command line
-// to a DependencyMode. Valid strings are "external", "vendor". An error will
-// be returned for an invalid string.
+// to a DependencyMode. Valid strings are "external", "vendored", and
+// "hybrid". An error will be returned for an invalid string.
 func DependencyModeFromString(s string) (DependencyMode, error) {
 	switch s {
 	case "external":
 		return ExternalMode, nil
 	case "vendored":
 		return VendorMode, nil
+	case "hybrid":
+		return HybridMode, nil
 	default:
 		return 0, fmt.Errorf("unrecognized dependency mode: %q", s)
 	}
 }
 
+const (
+	// DirNameBinaryNaming indicates go_binary rules are named after the
+	// directory that contains them. This is the default.
+	DirNameBinaryNaming = "dirname"
+
+	// ImportPathBinaryNaming indicates go_binary rules are named after the
+	// last element of the package's import path, ignoring a major version
+	// suffix like "v2". This is the name "go build" gives the binary.
+	ImportPathBinaryNaming = "importpath"
+)
+
+const (
+	// DefaultLibraryNaming indicates go_library rules are named
+	// DefaultLibName. This is the default.
+	DefaultLibraryNaming = "go_default_library"
+
+	// DirNameLibraryNaming indicates go_library rules are named after the
+	// directory that contains them, like go_binary rules. Libraries for
+	// commands get a "_lib" suffix, so they don't collide with binaries.
+	DirNameLibraryNaming = "dirname"
+)
+
+// CheckBinaryNaming returns an error if s is not a valid value for
+// BinaryNaming. Valid values are "dirname", "importpath", and templates
+// like "{dirname}_bin" that contain at least one placeholder and no
+// characters that can't appear in a target name.
+func CheckBinaryNaming(s string) error {
+	switch s {
+	case DirNameBinaryNaming, ImportPathBinaryNaming:
+		return nil
+	}
+	if !strings.Contains(s, "{dirname}") && !strings.Contains(s, "{importpath}") {
+		return fmt.Errorf("binary naming %q must be \"dirname\", \"importpath\", or a template containing {dirname} or {importpath}", s)
+	}
+	if strings.ContainsAny(s, "/:") {
+		return fmt.Errorf("binary naming template %q must not contain '/' or ':'", s)
+	}
+	return nil
+}
+
+// ProtoMode determines how rules are generated for .proto files, and how
+// .pb.go files generated from them are handled. The mode may be set for the
+// whole repository with -proto and changed for a directory and its
+// subdirectories with a "# gazelle:proto" directive.
+type ProtoMode int
+
+const (
+	// DefaultProtoMode indicates one proto_library and one go_proto_library
+	// should be generated for the .proto files in each directory, and
+	// go_library rules should embed the go_proto_library. .pb.go files
+	// generated from .proto files in the same directory are left out of srcs,
+	// since they would define the same symbols as the go_proto_library.
+	// Despite the name, this mode must be requested; -proto defaults to
+	// LegacyProtoMode, so existing repositories keep compiling their
+	// checked-in .pb.go files.
+	DefaultProtoMode ProtoMode = iota
+
+	// DisableGlobalProtoMode indicates no proto rules should be generated
+	// anywhere in the repository. .pb.go files are compiled like other .go
+	// files. Existing proto rules are left alone.
+	DisableGlobalProtoMode
+
+	// DisableProtoMode is like DisableGlobalProtoMode, but it's meant to be
+	// set with a directive for a directory and its subdirectories.
+	DisableProtoMode
+
+	// LegacyProtoMode indicates no proto rules should be generated, and .pb.go
+	// files are compiled like other .go files. A filegroup named
+	// DefaultProtosName is generated for .proto files in directories that
+	// also contain .pb.go files, as older versions of Gazelle did, for
+	// existing consumers of that filegroup.
+	LegacyProtoMode
+
+	// PackageProtoMode is like DefaultProtoMode, but one proto_library and one
+	// go_proto_library are generated for each proto package declared by
+	// .proto files in a directory, instead of one for the whole directory.
+	PackageProtoMode
+
+	// LegacyFilegroupProtoMode is like DefaultProtoMode, but a filegroup
+	// named DefaultProtosName is also generated for the .proto files in each
+	// directory, as in LegacyProtoMode. It's meant for repositories migrating
+	// from checked-in .pb.go files to generated proto rules, so consumers of
+	// the filegroup keep working while they're moved to the proto_library.
+	LegacyFilegroupProtoMode
+)
+
+// ProtoModeFromString converts a string from the command line or a
+// directive to a ProtoMode. Valid strings are "default", "disable_global",
+// "disable", "legacy", "legacy_filegroup", and "package". An error will be
+// returned for an invalid string.
+func ProtoModeFromString(s string) (ProtoMode, error) {
+	switch s {
+	case "default":
+		return DefaultProtoMode, nil
+	case "disable_global":
+		return DisableGlobalProtoMode, nil
+	case "disable":
+		return DisableProtoMode, nil
+	case "legacy":
+		return LegacyProtoMode, nil
+	case "legacy_filegroup":
+		return LegacyFilegroupProtoMode, nil
+	case "package":
+		return PackageProtoMode, nil
+	default:
+		return 0, fmt.Errorf("unrecognized proto mode: %q", s)
+	}
+}
+
+// ShouldGenerateRules returns whether proto_library and go_proto_library
+// rules should be generated in this mode.
+func (m ProtoMode) ShouldGenerateRules() bool {
+	return m == DefaultProtoMode || m == PackageProtoMode || m == LegacyFilegroupProtoMode
+}
+
+// ShouldIncludePregeneratedFiles returns whether .pb.go files generated
+// from .proto files in the same directory should be compiled in this mode.
+func (m ProtoMode) ShouldIncludePregeneratedFiles() bool {
+	return !m.ShouldGenerateRules()
+}
+
 // StructureMode determines how build files are organized within a project.
 type StructureMode int
 
@@ -166,3 +726,128 @@ const (
 	// new_http_archive.
 	FlatMode
 )
+
+// GeneratedKinds lists the kinds of rules Gazelle generates. These are the
+// kinds that may be disabled with -generate and "# gazelle:generate".
+var GeneratedKinds = []string{
+	"filegroup",
+	"go_binary",
+	"go_grpc_library",
+	"go_library",
+	"go_proto_library",
+	"go_test",
+	"proto_library",
+}
+
+func isGeneratedKind(kind string) bool {
+	for _, k := range GeneratedKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// DisabledKindsFromString converts the value of -generate, a comma-separated
+// list of kinds to generate, to a set of kinds that are not generated. If s
+// is empty, all kinds are generated, and nil is returned. An error is
+// returned for a kind Gazelle doesn't generate.
+func DisabledKindsFromString(s string) (map[string]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	enabled := make(map[string]bool)
+	for _, kind := range strings.Split(s, ",") {
+		kind = strings.TrimSpace(kind)
+		if !isGeneratedKind(kind) {
+			return nil, fmt.Errorf("unrecognized rule kind: %q", kind)
+		}
+		enabled[kind] = true
+	}
+	disabled := make(map[string]bool)
+	for _, kind := range GeneratedKinds {
+		if !enabled[kind] {
+			disabled[kind] = true
+		}
+	}
+	return disabled, nil
+}
+
+// ShouldGenerate returns whether rules of the given kind should be
+// generated.
+func (c *Config) ShouldGenerate(kind string) bool {
+	return !c.DisabledKinds[kind]
+}
+
+// CheckTestSize returns an error if s is not a valid size for a test rule.
+// An empty string is valid; it means no size is set.
+func CheckTestSize(s string) error {
+	switch s {
+	case "", "small", "medium", "large", "enormous":
+		return nil
+	}
+	return fmt.Errorf("test size %q must be \"small\", \"medium\", \"large\", or \"enormous\"", s)
+}
+
+// CheckTestTimeout returns an error if s is not a valid timeout for a test
+// rule. An empty string is valid; it means no timeout is set.
+func CheckTestTimeout(s string) error {
+	switch s {
+	case "", "short", "moderate", "long", "eternal":
+		return nil
+	}
+	return fmt.Errorf("test timeout %q must be \"short\", \"moderate\", \"long\", or \"eternal\"", s)
+}
+
+const (
+	// TestRundirPackage runs tests in their package directories, like
+	// "go test" does. This is the default.
+	TestRundirPackage = "package"
+
+	// TestRundirWorkspace runs tests in the root of the workspace, so
+	// fixtures are read with workspace-relative paths, like they are in
+	// runfiles.
+	TestRundirWorkspace = "workspace"
+)
+
+// CheckTestRundir returns an error if s is not a valid value for a
+// "# gazelle:test_rundir" directive.
+func CheckTestRundir(s string) error {
+	switch s {
+	case TestRundirPackage, TestRundirWorkspace:
+		return nil
+	}
+	return fmt.Errorf("test rundir %q must be %q or %q", s, TestRundirPackage, TestRundirWorkspace)
+}
+
+const (
+	// EmptyBuildFilesEmpty creates empty build files. See
+	// Config.EmptyBuildFiles.
+	EmptyBuildFilesEmpty = "empty"
+
+	// EmptyBuildFilesPackage creates build files containing only a package
+	// declaration. See Config.EmptyBuildFiles.
+	EmptyBuildFilesPackage = "package"
+)
+
+// CheckRepoOverride returns an error if s is not a valid target for a
+// "# gazelle:repo_override" directive: a repository name like "@foo" or
+// "@foo//", or a package in this repository like "//third_party/foo".
+func CheckRepoOverride(s string) error {
+	if strings.HasPrefix(s, "//") && !strings.Contains(s, ":") {
+		return nil
+	}
+	if name := strings.TrimSuffix(strings.TrimPrefix(s, "@"), "//"); strings.HasPrefix(s, "@") && name != "" && !strings.ContainsAny(name, "/:") {
+		return nil
+	}
+	return fmt.Errorf("%q must be a repository like @foo or a package like //third_party/foo", s)
+}
+
+// NoCoverageTag is the tag that stops go_library rules from being
+// instrumented for coverage.
+const NoCoverageTag = "no_coverage"
+
+// NewFileSuffix is appended to the name of a build file that can't be parsed
+// to name the file generated rules are written to instead, when
+// NewOnParseError is set.
+const NewFileSuffix = ".gazelle-new"
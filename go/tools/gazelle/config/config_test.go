@@ -15,7 +15,11 @@ limitations under the License.
 
 package config
 
-import "testing"
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
 
 func TestPreprocessTags(t *testing.T) {
 	c := &Config{
@@ -46,3 +50,98 @@ func TestPreprocessTags(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckBinaryNaming(t *testing.T) {
+	for _, tc := range []struct {
+		naming string
+		ok     bool
+	}{
+		{DirNameBinaryNaming, true},
+		{ImportPathBinaryNaming, true},
+		{"{dirname}_bin", true},
+		{"cmd_{importpath}", true},
+		{"", false},
+		{"bin", false},
+		{"{dirname}/bin", false},
+		{"{dirname}:bin", false},
+	} {
+		err := CheckBinaryNaming(tc.naming)
+		if tc.ok && err != nil {
+			t.Errorf("%q: got error %v; want success", tc.naming, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%q: got success; want error", tc.naming)
+		}
+	}
+}
+
+func TestParseKnownHost(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want KnownHost
+		ok   bool
+	}{
+		{"k8s.io=1", KnownHost{Prefix: "k8s.io", Components: 1}, true},
+		{"example.com/go/=2", KnownHost{Prefix: "example.com/go", Components: 2}, true},
+		{"go.opencensus.io=0", KnownHost{Prefix: "go.opencensus.io", Components: 0}, true},
+		{"k8s.io", KnownHost{}, false},
+		{"=1", KnownHost{}, false},
+		{"k8s.io=-1", KnownHost{}, false},
+		{"k8s.io=one", KnownHost{}, false},
+	} {
+		got, err := ParseKnownHost(tc.s)
+		if tc.ok && err != nil {
+			t.Errorf("%q: got error %v; want success", tc.s, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%q: got success; want error", tc.s)
+		} else if got != tc.want {
+			t.Errorf("%q: got %#v; want %#v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestDisabledKindsFromString(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want map[string]bool
+		ok   bool
+	}{
+		{"", nil, true},
+		{"go_library,go_test", map[string]bool{
+			"filegroup":        true,
+			"go_binary":        true,
+			"go_grpc_library":  true,
+			"go_proto_library": true,
+			"proto_library":    true,
+		}, true},
+		{"go_library,cc_library", nil, false},
+	} {
+		got, err := DisabledKindsFromString(tc.s)
+		if tc.ok && err != nil {
+			t.Errorf("%q: got error %v; want success", tc.s, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%q: got success; want error", tc.s)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v; want %v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestRelPath(t *testing.T) {
+	root := filepath.FromSlash("/repo")
+	c := &Config{RepoRoot: root}
+	for _, tc := range []struct {
+		path, want string
+		wantOK     bool
+	}{
+		{path: "/repo", want: "", wantOK: true},
+		{path: "/repo/a/b", want: "a/b", wantOK: true},
+		{path: "/repo/..a", want: "..a", wantOK: true},
+		{path: "/other", wantOK: false},
+		{path: "/", wantOK: false},
+	} {
+		got, ok := c.RelPath(filepath.FromSlash(tc.path))
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("RelPath(%q) = %q, %v; want %q, %v", tc.path, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
@@ -16,20 +16,17 @@ limitations under the License.
 package config
 
 import (
-	"log"
-	"regexp"
+	"path"
 	"strings"
 
 	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/directives"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 )
 
 // Directive is a key-value pair extracted from a top-level comment in
-// a build file. Directives have the following format:
-//
-//     # gazelle:key value
-//
-// Keys may not contain spaces. Values may be empty and may contain spaces,
-// but surrounding space is trimmed.
+// a build file. See directives.Directive for the format. Positions aren't
+// recorded here; tools that need them should use directives.Parse.
 type Directive struct {
 	Key, Value string
 }
@@ -37,68 +34,70 @@ type Directive struct {
 // Top-level directives apply to the whole package or build file. They must
 // appear before the first statement.
 var knownTopLevelDirectives = map[string]bool{
-	"build_file_name": true,
-	"build_tags":      true,
-	"exclude":         true,
-	"ignore":          true,
+	"attr":               true,
+	"build_file_name":    true,
+	"build_tags":         true,
+	"annotate_deps":      true,
+	"coverage":           true,
+	"default_tags":       true,
+	"default_visibility": true,
+	"exclude":            true,
+	"gc_goopts":          true,
+	"gc_linkopts":        true,
+	"generate":           true,
+	"go_path":            true,
+	"go_source":          true,
+	"ignore":             true,
+	"kind_alias":         true,
+	"load":               true,
+	"prefer":             true,
+	"prefix":             true,
+	"proto":              true,
+	"repo_override":      true,
+	"resolve":            true,
+	"test_rundir":        true,
+	"test_size":          true,
+	"test_timeout":       true,
+	"testonly":           true,
+	"x_def":              true,
+}
+
+// IsKnownDirective returns whether key is the key of a top-level directive
+// Gazelle understands. It may be passed to directives.Parse.
+func IsKnownDirective(key string) bool {
+	return knownTopLevelDirectives[key]
 }
 
 // TODO(jayconrod): annotation directives will apply to an individual rule.
 // They must appear in the block of comments above that rule.
 
 // ParseDirectives scans f for Gazelle directives. The full list of directives
-// is returned. Errors are reported for unrecognized directives and directives
+// is returned. Warnings are logged for unrecognized directives and directives
 // out of place (after the first statement).
 func ParseDirectives(f *bf.File) []Directive {
-	var directives []Directive
-	beforeStmt := true
-	parseComment := func(com bf.Comment) {
-		match := directiveRe.FindStringSubmatch(com.Token)
-		if match == nil {
-			return
-		}
-		key, value := match[1], match[2]
-		if _, ok := knownTopLevelDirectives[key]; !ok {
-			log.Printf("%s:%d: unknown directive: %s", f.Path, com.Start.Line, com.Token)
-			return
-		}
-		if !beforeStmt {
-			log.Printf("%s:%d: top-level directive may not appear after the first statement", f.Path, com.Start.Line)
-			return
-		}
-		directives = append(directives, Directive{key, value})
+	ds, errs := directives.Parse(f, IsKnownDirective)
+	for _, err := range errs {
+		logging.WarningfAt(err.Path, err.Pos.Line, "%s", err.Msg)
 	}
-
-	for _, s := range f.Stmt {
-		coms := s.Comment()
-		for _, com := range coms.Before {
-			parseComment(com)
-		}
-		_, isComment := s.(*bf.CommentBlock)
-		beforeStmt = beforeStmt && isComment
-		for _, com := range coms.Suffix {
-			parseComment(com)
-		}
-		for _, com := range coms.After {
-			parseComment(com)
-		}
+	var result []Directive
+	for _, d := range ds {
+		result = append(result, Directive{d.Key, d.Value})
 	}
-	return directives
+	return result
 }
 
-var directiveRe = regexp.MustCompile(`^#\s*gazelle:(\w+)\s*(.*?)\s*$`)
-
 // ApplyDirectives applies directives that modify the configuration to a
 // copy of c, which is returned. If there are no configuration directives,
-// c is returned unmodified.
-func ApplyDirectives(c *Config, directives []Directive) *Config {
+// c is returned unmodified. rel is the slash-separated path to the directory
+// containing the directives, relative to the repository root.
+func ApplyDirectives(c *Config, directives []Directive, rel string) *Config {
 	modified := *c
 	didModify := false
 	for _, d := range directives {
 		switch d.Key {
 		case "build_tags":
 			if err := modified.SetBuildTags(d.Value); err != nil {
-				log.Print(err)
+				logging.Error(err)
 				modified.GenericTags = c.GenericTags
 			} else {
 				modified.PreprocessTags()
@@ -107,6 +106,273 @@ func ApplyDirectives(c *Config, directives []Directive) *Config {
 		case "build_file_name":
 			modified.ValidBuildFileNames = strings.Split(d.Value, ",")
 			didModify = true
+		case "prefix":
+			modified.GoPrefix = d.Value
+			modified.GoPrefixRel = rel
+			didModify = true
+		case "proto":
+			mode, err := ProtoModeFromString(d.Value)
+			if err != nil {
+				logging.Errorf("gazelle:proto directive in %q: %v", rel, err)
+				continue
+			}
+			modified.ProtoMode = mode
+			didModify = true
+		case "go_path":
+			name := strings.TrimSpace(d.Value)
+			if name == "" || strings.ContainsAny(name, " \t:/") {
+				logging.Errorf("gazelle:go_path directive in %q: expected rule name; got %q", rel, d.Value)
+				continue
+			}
+			modified.GoPathName = name
+			modified.GoPathRel = rel
+			didModify = true
+		case "go_source":
+			fields := strings.Fields(d.Value)
+			if len(fields) == 0 {
+				logging.Errorf("gazelle:go_source directive in %q: expected rule name and file patterns; got %q", rel, d.Value)
+				continue
+			}
+			name, patterns := fields[0], fields[1:]
+			if name == DefaultLibName || name == DefaultTestName || name == DefaultXTestName {
+				logging.Errorf("gazelle:go_source directive in %q: name %q is used by another rule", rel, name)
+				continue
+			}
+			badPattern := false
+			for _, p := range patterns {
+				if _, err := path.Match(p, ""); err != nil {
+					logging.Errorf("gazelle:go_source directive in %q: bad pattern %q: %v", rel, p, err)
+					badPattern = true
+				}
+			}
+			if badPattern {
+				continue
+			}
+			groups := make([]SourceGroup, 0, len(modified.SourceGroups)+1)
+			for _, g := range modified.SourceGroups {
+				if g.Name != name {
+					groups = append(groups, g)
+				}
+			}
+			// A group with no patterns matches no files. Its rule is generated
+			// empty, so a rule left over from it is deleted.
+			groups = append(groups, SourceGroup{Name: name, Patterns: patterns})
+			modified.SourceGroups = groups
+			didModify = true
+		case "gc_goopts":
+			modified.GcGoopts = strings.Fields(d.Value)
+			didModify = true
+		case "gc_linkopts":
+			modified.GcLinkopts = strings.Fields(d.Value)
+			didModify = true
+		case "generate":
+			fields := strings.Fields(d.Value)
+			if len(fields) != 2 || fields[1] != "on" && fields[1] != "off" {
+				logging.Errorf("gazelle:generate directive in %q: expected rule kind and \"on\" or \"off\"; got %q", rel, d.Value)
+				continue
+			}
+			kind := fields[0]
+			if !isGeneratedKind(kind) {
+				logging.Errorf("gazelle:generate directive in %q: unrecognized rule kind: %q", rel, kind)
+				continue
+			}
+			disabled := make(map[string]bool, len(modified.DisabledKinds)+1)
+			for k, v := range modified.DisabledKinds {
+				disabled[k] = v
+			}
+			if fields[1] == "off" {
+				disabled[kind] = true
+			} else {
+				delete(disabled, kind)
+			}
+			modified.DisabledKinds = disabled
+			didModify = true
+		case "annotate_deps", "coverage", "testonly":
+			if d.Value != "on" && d.Value != "off" {
+				logging.Errorf("gazelle:%s directive in %q: expected \"on\" or \"off\"; got %q", d.Key, rel, d.Value)
+				continue
+			}
+			switch d.Key {
+			case "annotate_deps":
+				modified.AnnotateDeps = d.Value == "on"
+			case "coverage":
+				modified.NoCoverage = d.Value == "off"
+			default:
+				modified.TestOnly = d.Value == "on"
+			}
+			didModify = true
+		case "default_tags":
+			var tags []string
+			for _, t := range strings.Split(d.Value, ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					tags = append(tags, t)
+				}
+			}
+			modified.DefaultTags = tags
+			didModify = true
+		case "default_visibility":
+			// An empty value stops Gazelle from maintaining the package
+			// declaration in this directory and its subdirectories.
+			var vis []string
+			for _, label := range strings.Fields(d.Value) {
+				if !strings.HasPrefix(label, "//") && !strings.HasPrefix(label, "@") {
+					logging.Errorf("gazelle:default_visibility directive in %q: expected absolute label; got %q", rel, label)
+					continue
+				}
+				vis = append(vis, label)
+			}
+			modified.DefaultVisibility = vis
+			didModify = true
+		case "test_rundir":
+			if d.Value == "" {
+				d.Value = TestRundirPackage
+			}
+			if err := CheckTestRundir(d.Value); err != nil {
+				logging.Errorf("gazelle:test_rundir directive in %q: %v", rel, err)
+				continue
+			}
+			modified.TestRundir = d.Value
+			didModify = true
+		case "test_size":
+			if err := CheckTestSize(d.Value); err != nil {
+				logging.Errorf("gazelle:test_size directive in %q: %v", rel, err)
+				continue
+			}
+			modified.TestSize = d.Value
+			didModify = true
+		case "test_timeout":
+			if err := CheckTestTimeout(d.Value); err != nil {
+				logging.Errorf("gazelle:test_timeout directive in %q: %v", rel, err)
+				continue
+			}
+			modified.TestTimeout = d.Value
+			didModify = true
+		case "x_def":
+			// "name=value" sets an entry. "name" without a value removes an
+			// entry inherited from a parent directory.
+			name, value := d.Value, ""
+			hasValue := false
+			if i := strings.Index(d.Value, "="); i >= 0 {
+				name, value, hasValue = d.Value[:i], d.Value[i+1:], true
+			}
+			name = strings.TrimSpace(name)
+			if name == "" || strings.ContainsAny(name, " \t") {
+				logging.Errorf("gazelle:x_def directive in %q: expected name=value; got %q", rel, d.Value)
+				continue
+			}
+			defs := make(map[string]string, len(modified.XDefs)+1)
+			for k, v := range modified.XDefs {
+				defs[k] = v
+			}
+			if hasValue {
+				defs[name] = strings.TrimSpace(value)
+			} else {
+				delete(defs, name)
+			}
+			modified.XDefs = defs
+			didModify = true
+		case "attr":
+			fields := strings.Fields(d.Value)
+			if len(fields) != 2 {
+				logging.Errorf("gazelle:attr directive in %q: expected attribute name and policy; got %q", rel, d.Value)
+				continue
+			}
+			policy, err := AttrPolicyFromString(fields[1])
+			if err != nil {
+				logging.Errorf("gazelle:attr directive in %q: %v", rel, err)
+				continue
+			}
+			policies := make(map[string]AttrPolicy, len(modified.AttrPolicies)+1)
+			for k, v := range modified.AttrPolicies {
+				policies[k] = v
+			}
+			policies[fields[0]] = policy
+			modified.AttrPolicies = policies
+			didModify = true
+		case "kind_alias":
+			// "macro kind" adds an alias. "macro" alone removes an alias
+			// inherited from a parent directory.
+			fields := strings.Fields(d.Value)
+			if len(fields) != 1 && len(fields) != 2 {
+				logging.Errorf("gazelle:kind_alias directive in %q: expected macro name and rule kind; got %q", rel, d.Value)
+				continue
+			}
+			macro := fields[0]
+			if isGeneratedKind(macro) {
+				logging.Errorf("gazelle:kind_alias directive in %q: %q is a kind Gazelle generates", rel, macro)
+				continue
+			}
+			if len(fields) == 2 && !isGeneratedKind(fields[1]) {
+				logging.Errorf("gazelle:kind_alias directive in %q: unrecognized rule kind: %q", rel, fields[1])
+				continue
+			}
+			aliases := make(map[string]string, len(modified.KindAliases)+1)
+			for k, v := range modified.KindAliases {
+				aliases[k] = v
+			}
+			if len(fields) == 2 {
+				aliases[macro] = fields[1]
+			} else {
+				delete(aliases, macro)
+			}
+			modified.KindAliases = aliases
+			didModify = true
+		case "load":
+			fields := strings.Fields(d.Value)
+			if len(fields) < 2 {
+				logging.Errorf("gazelle:load directive in %q: expected file label and kinds; got %q", rel, d.Value)
+				continue
+			}
+			loads := make([]LoadInfo, 0, len(modified.Loads)+1)
+			loads = append(loads, modified.Loads...)
+			loads = append(loads, LoadInfo{File: fields[0], Kinds: fields[1:]})
+			modified.Loads = loads
+			didModify = true
+		case "resolve":
+			fields := strings.Fields(d.Value)
+			if len(fields) != 3 {
+				logging.Errorf("gazelle:resolve directive in %q: expected language, import path, and label; got %q", rel, d.Value)
+				continue
+			}
+			lang, imp, label := fields[0], fields[1], fields[2]
+			if lang != "go" {
+				logging.Errorf("gazelle:resolve directive in %q: unsupported language %q", rel, lang)
+				continue
+			}
+			overrides := make(map[string]string, len(modified.GoResolveOverrides)+1)
+			for k, v := range modified.GoResolveOverrides {
+				overrides[k] = v
+			}
+			overrides[imp] = label
+			modified.GoResolveOverrides = overrides
+			didModify = true
+		case "repo_override":
+			fields := strings.Fields(d.Value)
+			if len(fields) != 2 {
+				logging.Errorf("gazelle:repo_override directive in %q: expected import path prefix and repository or package; got %q", rel, d.Value)
+				continue
+			}
+			prefix, target := fields[0], fields[1]
+			if err := CheckRepoOverride(target); err != nil {
+				logging.Errorf("gazelle:repo_override directive in %q: %v", rel, err)
+				continue
+			}
+			overrides := make(map[string]string, len(modified.RepoOverrides)+1)
+			for k, v := range modified.RepoOverrides {
+				overrides[k] = v
+			}
+			overrides[prefix] = target
+			modified.RepoOverrides = overrides
+			didModify = true
+		case "prefer":
+			if !strings.HasPrefix(d.Value, "//") && !strings.HasPrefix(d.Value, "@") || strings.ContainsAny(d.Value, " \t") {
+				logging.Errorf("gazelle:prefer directive in %q: expected an absolute label; got %q", rel, d.Value)
+				continue
+			}
+			labels := make([]string, 0, len(modified.PreferredLabels)+1)
+			labels = append(labels, modified.PreferredLabels...)
+			modified.PreferredLabels = append(labels, d.Value)
+			didModify = true
 		}
 	}
 	if !didModify {
@@ -62,7 +62,7 @@ foo(
 
 func TestApplyDirectives(t *testing.T) {
 	for _, tc := range []struct {
-		desc       string
+		desc, rel  string
 		directives []Directive
 		want       Config
 	}{
@@ -78,12 +78,209 @@ func TestApplyDirectives(t *testing.T) {
 			desc:       "build_file_name",
 			directives: []Directive{{"build_file_name", "foo,bar"}},
 			want:       Config{ValidBuildFileNames: []string{"foo", "bar"}},
+		}, {
+			desc:       "prefix",
+			directives: []Directive{{"prefix", "example.com/team-a"}},
+			rel:        "team-a",
+			want:       Config{GoPrefix: "example.com/team-a", GoPrefixRel: "team-a"},
+		}, {
+			desc:       "proto",
+			directives: []Directive{{"proto", "legacy"}},
+			want:       Config{ProtoMode: LegacyProtoMode},
+		}, {
+			desc:       "proto legacy_filegroup",
+			directives: []Directive{{"proto", "legacy_filegroup"}},
+			want:       Config{ProtoMode: LegacyFilegroupProtoMode},
+		}, {
+			desc:       "proto invalid",
+			directives: []Directive{{"proto", "bogus"}},
+			want:       Config{},
+		}, {
+			desc: "generate",
+			directives: []Directive{
+				{"generate", "go_test off"},
+				{"generate", "go_binary off"},
+				{"generate", "go_binary on"},
+				{"generate", "go_library bogus"},
+				{"generate", "cc_library off"},
+			},
+			want: Config{DisabledKinds: map[string]bool{"go_test": true}},
+		}, {
+			desc: "test size and timeout",
+			directives: []Directive{
+				{"test_size", "medium"},
+				{"test_timeout", "long"},
+				{"test_size", "huge"},
+				{"test_timeout", "forever"},
+			},
+			want: Config{TestSize: "medium", TestTimeout: "long"},
+		}, {
+			desc: "test rundir",
+			directives: []Directive{
+				{"test_rundir", "workspace"},
+				{"test_rundir", "module"},
+			},
+			want: Config{TestRundir: "workspace"},
+		}, {
+			desc: "testonly and coverage",
+			directives: []Directive{
+				{"testonly", "on"},
+				{"coverage", "off"},
+				{"testonly", "yes"},
+				{"coverage", ""},
+			},
+			want: Config{TestOnly: true, NoCoverage: true},
+		}, {
+			desc: "annotate deps",
+			directives: []Directive{
+				{"annotate_deps", "on"},
+				{"annotate_deps", "true"},
+			},
+			want: Config{AnnotateDeps: true},
+		}, {
+			desc: "x_def",
+			directives: []Directive{
+				{"x_def", "example.com/version.Version={STABLE_GIT_TAG}"},
+				{"x_def", "main.Commit = {STABLE_GIT_COMMIT}"},
+				{"x_def", "main.Date=today"},
+				{"x_def", "main.Date"},
+				{"x_def", "=bogus"},
+			},
+			want: Config{XDefs: map[string]string{
+				"example.com/version.Version": "{STABLE_GIT_TAG}",
+				"main.Commit":                 "{STABLE_GIT_COMMIT}",
+			}},
+		}, {
+			desc: "gc opts",
+			directives: []Directive{
+				{"gc_goopts", "-trimpath $(GOPATH)"},
+				{"gc_linkopts", "-s"},
+				{"gc_linkopts", "-s -w"},
+			},
+			want: Config{
+				GcGoopts:   []string{"-trimpath", "$(GOPATH)"},
+				GcLinkopts: []string{"-s", "-w"},
+			},
+		}, {
+			desc:       "default_tags",
+			directives: []Directive{{"default_tags", "manual, no-remote"}},
+			want:       Config{DefaultTags: []string{"manual", "no-remote"}},
+		}, {
+			desc:       "default_tags empty",
+			directives: []Directive{{"default_tags", ""}},
+			want:       Config{},
+		}, {
+			desc: "kind_alias",
+			directives: []Directive{
+				{"kind_alias", "team_go_library go_library"},
+				{"kind_alias", "team_go_test go_test"},
+				{"kind_alias", "team_go_test"},
+				{"kind_alias", "go_test go_library"},
+				{"kind_alias", "team_macro not_a_kind"},
+			},
+			want: Config{KindAliases: map[string]string{"team_go_library": "go_library"}},
+		}, {
+			desc:       "default_visibility",
+			directives: []Directive{{"default_visibility", "//foo:__subpackages__ :bad @bar//:__pkg__"}},
+			want:       Config{DefaultVisibility: []string{"//foo:__subpackages__", "@bar//:__pkg__"}},
+		}, {
+			desc: "default_visibility empty",
+			directives: []Directive{
+				{"default_visibility", "//visibility:public"},
+				{"default_visibility", ""},
+			},
+			want: Config{},
+		}, {
+			desc:       "go_path",
+			directives: []Directive{{"go_path", "gopath"}, {"go_path", "bad/name"}},
+			rel:        "tools",
+			want:       Config{GoPathName: "gopath", GoPathRel: "tools"},
+		}, {
+			desc: "go_source",
+			directives: []Directive{
+				{"go_source", "tables tables*.go"},
+				{"go_source", "gen gen_a.go gen_b.go"},
+				{"go_source", "tables table.go tables*.go"},
+				{"go_source", "gen"},
+				{"go_source", "bad [.go"},
+				{"go_source", "go_default_library lib.go"},
+			},
+			want: Config{SourceGroups: []SourceGroup{
+				{Name: "tables", Patterns: []string{"table.go", "tables*.go"}},
+				{Name: "gen", Patterns: []string{}},
+			}},
+		}, {
+			desc: "attr",
+			directives: []Directive{
+				{"attr", "deps merge"},
+				{"attr", "visibility keep"},
+				{"attr", "srcs overwrite"},
+				{"attr", "copts bogus"},
+				{"attr", "copts"},
+			},
+			want: Config{AttrPolicies: map[string]AttrPolicy{
+				"deps":       MergeAttr,
+				"visibility": KeepAttr,
+				"srcs":       OverwriteAttr,
+			}},
+		}, {
+			desc: "load",
+			directives: []Directive{
+				{"load", "@team//build:defs.bzl go_proto_compiler go_team_library"},
+				{"load", "//build:gen.bzl gen_go"},
+				{"load", "//build:empty.bzl"},
+			},
+			want: Config{Loads: []LoadInfo{
+				{File: "@team//build:defs.bzl", Kinds: []string{"go_proto_compiler", "go_team_library"}},
+				{File: "//build:gen.bzl", Kinds: []string{"gen_go"}},
+			}},
+		}, {
+			desc: "resolve",
+			directives: []Directive{
+				{"resolve", "go github.com/foo/bar //third_party/bar:go_default_library"},
+				{"resolve", "go example.com/baz @com_example_baz//:go_default_library"},
+			},
+			want: Config{GoResolveOverrides: map[string]string{
+				"github.com/foo/bar": "//third_party/bar:go_default_library",
+				"example.com/baz":    "@com_example_baz//:go_default_library",
+			}},
+		}, {
+			desc: "resolve invalid",
+			directives: []Directive{
+				{"resolve", "go github.com/foo/bar"},
+				{"resolve", "proto foo.proto //foo:foo_proto"},
+			},
+			want: Config{},
+		}, {
+			desc: "repo override",
+			directives: []Directive{
+				{"repo_override", "example.com/dep @dep"},
+				{"repo_override", "example.com/nested //third_party/nested"},
+				{"repo_override", "example.com/bad //third_party/bad:lib"},
+				{"repo_override", "example.com/bad dep"},
+				{"repo_override", "example.com/bad"},
+			},
+			want: Config{RepoOverrides: map[string]string{
+				"example.com/dep":    "@dep",
+				"example.com/nested": "//third_party/nested",
+			}},
+		}, {
+			desc: "prefer",
+			directives: []Directive{
+				{"prefer", "//api:go_default_library"},
+				{"prefer", "go_default_library"},
+				{"prefer", "@com_example_baz//:go_default_library"},
+			},
+			want: Config{PreferredLabels: []string{
+				"//api:go_default_library",
+				"@com_example_baz//:go_default_library",
+			}},
 		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
 			c := &Config{}
 			c.PreprocessTags()
-			got := ApplyDirectives(c, tc.directives)
+			got := ApplyDirectives(c, tc.directives, tc.rel)
 			tc.want.PreprocessTags()
 			if !reflect.DeepEqual(*got, tc.want) {
 				t.Errorf("got %#v ; want %#v", *got, tc.want)
@@ -0,0 +1,165 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileNames are the names of config files Gazelle reads from the root of a
+// repository, in the order they're looked for. Only the first one present
+// is read.
+var FileNames = []string{"gazelle.json", ".gazelle.json"}
+
+// File holds defaults for a repository, read from a config file at its root.
+// Checking in a config file lets every invocation of Gazelle use the same
+// settings. Flags given on the command line override values in the file.
+// Empty fields have no effect.
+type File struct {
+	// Path is the absolute path to the file that was read.
+	Path string `json:"-"`
+
+	// Prefix is the default for -go_prefix.
+	Prefix string `json:"prefix"`
+
+	// Exclude lists directories Gazelle should skip, like directories listed
+	// in .bazelignore. Paths are slash-separated and relative to the
+	// repository root.
+	Exclude []string `json:"exclude"`
+
+	// Platforms lists the platforms rules are generated for, like
+	// "linux_amd64". Each name must be a config_setting in
+	// @io_bazel_rules_go//go/platform. If empty, DefaultPlatformTags is used.
+	Platforms []string `json:"platforms"`
+
+	// BuildFileName is the default for -build_file_name.
+	BuildFileName string `json:"build_file_name"`
+
+	// Proto is the default for -proto.
+	Proto string `json:"proto"`
+
+	// BuildFileHeader is the default for -build_file_header. It's a
+	// slash-separated path relative to the repository root.
+	BuildFileHeader string `json:"build_file_header"`
+}
+
+// LoadFile reads the config file at the root of the repository repoRoot.
+// If there's no config file, LoadFile returns nil and no error.
+func LoadFile(repoRoot string) (*File, error) {
+	for _, name := range FileNames {
+		p := filepath.Join(repoRoot, name)
+		data, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		f, err := ParseFile(p, data)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	return nil, nil
+}
+
+// ParseFile parses the contents of a config file. filename is used in error
+// messages. Unknown fields are reported as errors, so misspelled settings
+// aren't silently ignored.
+func ParseFile(filename string, data []byte) (*File, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	for key := range fields {
+		if !knownFileFields[key] {
+			return nil, fmt.Errorf("%s: unknown setting %q", filename, key)
+		}
+	}
+	f := &File{Path: filename}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	for i, dir := range f.Exclude {
+		rel, err := cleanExcludedDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("%s: exclude: %v", filename, err)
+		}
+		f.Exclude[i] = rel
+	}
+	if len(f.Platforms) > 0 {
+		if _, err := PlatformTagsFromNames(f.Platforms); err != nil {
+			return nil, fmt.Errorf("%s: platforms: %v", filename, err)
+		}
+	}
+	return f, nil
+}
+
+var knownFileFields = map[string]bool{
+	"prefix":            true,
+	"exclude":           true,
+	"platforms":         true,
+	"build_file_name":   true,
+	"proto":             true,
+	"build_file_header": true,
+}
+
+// ParseBuildFileHeader checks the contents of a build file header, which
+// Gazelle writes at the top of new build files. Headers may only contain
+// comments and blank lines, so they can't change the meaning of a file.
+// filename is used in error messages. The header is returned without
+// surrounding blank lines.
+func ParseBuildFileHeader(filename string, data []byte) (string, error) {
+	header := strings.Trim(string(data), "\n")
+	for i, line := range strings.Split(header, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return "", fmt.Errorf("%s:%d: build file header may only contain comments; got %q", filename, i+1, line)
+		}
+	}
+	return header, nil
+}
+
+func cleanExcludedDir(dir string) (string, error) {
+	rel := path.Clean(dir)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") || path.IsAbs(rel) {
+		return "", fmt.Errorf("%q is not a directory inside the repository", dir)
+	}
+	return rel, nil
+}
+
+// PlatformTagsFromNames returns PlatformTags for the platforms named like
+// "linux_amd64". The build tags for each platform are its OS and
+// architecture.
+func PlatformTagsFromNames(names []string) (PlatformTags, error) {
+	platforms := make(PlatformTags)
+	for _, name := range names {
+		i := strings.Index(name, "_")
+		if i <= 0 || i == len(name)-1 {
+			return nil, fmt.Errorf("platform %q must have the form os_arch, like linux_amd64", name)
+		}
+		os, arch := name[:i], name[i+1:]
+		label := fmt.Sprintf("@%s//go/platform:%s", RulesGoRepoName, name)
+		platforms[label] = BuildTags{os: true, arch: true}
+	}
+	return platforms, nil
+}
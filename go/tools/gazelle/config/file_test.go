@@ -0,0 +1,115 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFile(t *testing.T) {
+	for _, tc := range []struct {
+		desc, data string
+		want       *File
+		wantErr    string
+	}{
+		{
+			desc: "empty",
+			data: "{}",
+			want: &File{Path: "gazelle.json"},
+		}, {
+			desc: "all",
+			data: `{
+  "prefix": "example.com/repo",
+  "exclude": ["a/b/", "c"],
+  "platforms": ["linux_amd64", "darwin_amd64"],
+  "build_file_name": "BUILD",
+  "proto": "disable_global",
+  "build_file_header": "tools/header.txt"
+}`,
+			want: &File{
+				Path:            "gazelle.json",
+				Prefix:          "example.com/repo",
+				Exclude:         []string{"a/b", "c"},
+				Platforms:       []string{"linux_amd64", "darwin_amd64"},
+				BuildFileName:   "BUILD",
+				Proto:           "disable_global",
+				BuildFileHeader: "tools/header.txt",
+			},
+		}, {
+			desc:    "unknown",
+			data:    `{"go_prefix": "example.com/repo"}`,
+			wantErr: `unknown setting "go_prefix"`,
+		}, {
+			desc:    "exclude outside",
+			data:    `{"exclude": ["../x"]}`,
+			wantErr: "not a directory inside the repository",
+		}, {
+			desc:    "bad platform",
+			data:    `{"platforms": ["linux"]}`,
+			wantErr: "must have the form os_arch",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := ParseFile("gazelle.json", []byte(tc.data))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v; want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v; want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseBuildFileHeader(t *testing.T) {
+	for _, tc := range []struct {
+		desc, data, want, wantErr string
+	}{
+		{
+			desc: "comments",
+			data: "\n# Copyright 2017 Example\n\n# buildifier: disable=load\n\n",
+			want: "# Copyright 2017 Example\n\n# buildifier: disable=load",
+		}, {
+			desc:    "statement",
+			data:    "# Copyright\npackage(default_visibility = [\"//visibility:public\"])\n",
+			wantErr: "header.txt:2: build file header may only contain comments",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := ParseBuildFileHeader("header.txt", []byte(tc.data))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v; want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
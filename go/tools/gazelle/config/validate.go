@@ -0,0 +1,92 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ValidationError describes a problem with a Config, along with a suggestion
+// for fixing it.
+type ValidationError struct {
+	// Option is the flag the problem is about, like "-go_prefix".
+	Option string
+
+	// Problem describes what is wrong. It's a complete message that
+	// mentions Option.
+	Problem string
+
+	// Suggestion tells the user how to fix the problem. It may be empty.
+	Suggestion string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Problem
+}
+
+// ValidationErrors is a list of problems found by Validate.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks c for missing options and combinations of options that
+// can't be used together. If any problems are found, Validate returns all of
+// them as ValidationErrors; otherwise, it returns nil.
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+	if c.GoPrefix == "" {
+		errs = append(errs, &ValidationError{
+			Option:     "-go_prefix",
+			Problem:    "-go_prefix not set, and no go_prefix rule in root build file, import comment in root .go files, or module statement in go.mod",
+			Suggestion: "pass the import path of the repository root with -go_prefix, for example -go_prefix=example.com/repo",
+		})
+	}
+	if c.StructureMode == FlatMode {
+		for _, dir := range c.Dirs {
+			if dir != c.RepoRoot {
+				errs = append(errs, &ValidationError{
+					Option:     "-experimental_flat",
+					Problem:    fmt.Sprintf("-experimental_flat generates one build file for the whole repository, but %s is not the repository root", dir),
+					Suggestion: fmt.Sprintf("run Gazelle on the repository root %s without naming other directories", c.RepoRoot),
+				})
+				break
+			}
+		}
+	}
+	if c.DepMode == VendorMode {
+		vendorDir := filepath.Join(c.RepoRoot, "vendor")
+		if fi, err := os.Stat(vendorDir); err != nil || !fi.IsDir() {
+			errs = append(errs, &ValidationError{
+				Option:     "-external",
+				Problem:    fmt.Sprintf("-external=vendored resolves dependencies to the vendor directory, but %s does not exist", vendorDir),
+				Suggestion: "vendor dependencies first, or use -external=external to resolve them to go_repository rules",
+			})
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,80 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	root, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	vendorRoot := filepath.Join(root, "vendored")
+	if err := os.MkdirAll(filepath.Join(vendorRoot, "vendor"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc    string
+		c       Config
+		options []string
+	}{
+		{
+			desc: "valid",
+			c:    Config{RepoRoot: root, Dirs: []string{root}, GoPrefix: "example.com/repo"},
+		}, {
+			desc:    "empty prefix",
+			c:       Config{RepoRoot: root, Dirs: []string{root}},
+			options: []string{"-go_prefix"},
+		}, {
+			desc: "flat root",
+			c:    Config{RepoRoot: root, Dirs: []string{root}, GoPrefix: "example.com/repo", StructureMode: FlatMode},
+		}, {
+			desc:    "flat subdir",
+			c:       Config{RepoRoot: root, Dirs: []string{root, vendorRoot}, GoPrefix: "example.com/repo", StructureMode: FlatMode},
+			options: []string{"-experimental_flat"},
+		}, {
+			desc: "vendored",
+			c:    Config{RepoRoot: vendorRoot, Dirs: []string{vendorRoot}, GoPrefix: "example.com/repo", DepMode: VendorMode},
+		}, {
+			desc:    "vendored without vendor",
+			c:       Config{RepoRoot: root, Dirs: []string{root}, DepMode: VendorMode},
+			options: []string{"-go_prefix", "-external"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var options []string
+			if err := tc.c.Validate(); err != nil {
+				for _, e := range err.(ValidationErrors) {
+					if e.Suggestion == "" {
+						t.Errorf("%s: no suggestion", e.Option)
+					}
+					options = append(options, e.Option)
+				}
+			}
+			if !reflect.DeepEqual(options, tc.options) {
+				t.Errorf("got problems with %q; want %q", options, tc.options)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package directives parses Gazelle directives, which are comments in build
+// files like "# gazelle:prefix example.com/repo". It's used by Gazelle to
+// configure itself, and it may be used by other tools that need to read
+// directives the same way Gazelle does, like linters.
+//
+// This package only finds directives. The meanings of the directives Gazelle
+// understands are defined in the config package: config.IsKnownDirective
+// reports whether a key is one of them, and config.ApplyDirectives applies
+// them to a configuration.
+package directives
+
+import (
+	"fmt"
+	"regexp"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+// Directive is a key-value pair extracted from a top-level comment in
+// a build file. Directives have the following format:
+//
+//     # gazelle:key value
+//
+// Keys may not contain spaces. Values may be empty and may contain spaces,
+// but surrounding space is trimmed.
+type Directive struct {
+	Key, Value string
+
+	// Pos is the position of the comment the directive was read from.
+	Pos bf.Position
+}
+
+// Error describes a comment that looks like a directive but can't be used.
+// These are usually reported as warnings.
+type Error struct {
+	// Path is the path to the build file containing the comment.
+	Path string
+
+	// Pos is the position of the comment.
+	Pos bf.Position
+
+	// Msg describes the problem.
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Pos.Line, e.Msg)
+}
+
+// Parse scans f for top-level directives. Top-level directives apply to the
+// whole build file. They must appear before the first statement.
+//
+// isKnown reports whether a directive key is recognized; config.IsKnownDirective
+// may be used for the directives Gazelle understands. If isKnown is nil, all
+// keys are accepted.
+//
+// Directives are returned in the order they appear. Comments with unknown
+// keys and directives that appear after the first statement are not
+// returned; an Error is returned for each of them instead.
+func Parse(f *bf.File, isKnown func(key string) bool) ([]Directive, []*Error) {
+	var directives []Directive
+	var errs []*Error
+	beforeStmt := true
+	parseComment := func(com bf.Comment) {
+		match := directiveRe.FindStringSubmatch(com.Token)
+		if match == nil {
+			return
+		}
+		key, value := match[1], match[2]
+		if isKnown != nil && !isKnown(key) {
+			errs = append(errs, &Error{
+				Path: f.Path,
+				Pos:  com.Start,
+				Msg:  fmt.Sprintf("unknown directive: %s", com.Token),
+			})
+			return
+		}
+		if !beforeStmt {
+			errs = append(errs, &Error{
+				Path: f.Path,
+				Pos:  com.Start,
+				Msg:  "top-level directive may not appear after the first statement",
+			})
+			return
+		}
+		directives = append(directives, Directive{Key: key, Value: value, Pos: com.Start})
+	}
+
+	for _, s := range f.Stmt {
+		coms := s.Comment()
+		for _, com := range coms.Before {
+			parseComment(com)
+		}
+		_, isComment := s.(*bf.CommentBlock)
+		beforeStmt = beforeStmt && isComment
+		for _, com := range coms.Suffix {
+			parseComment(com)
+		}
+		for _, com := range coms.After {
+			parseComment(com)
+		}
+	}
+	return directives, errs
+}
+
+var directiveRe = regexp.MustCompile(`^#\s*gazelle:(\w+)\s*(.*?)\s*$`)
@@ -0,0 +1,69 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package directives
+
+import (
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+func TestParse(t *testing.T) {
+	content := `# gazelle:prefix example.com/repo
+#gazelle:bogus value
+
+# gazelle:ignore
+go_library(name = "go_default_library")  # gazelle:ignore suffix
+`
+	f, err := bf.Parse("BUILD.bazel", []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	isKnown := func(key string) bool { return key != "bogus" }
+
+	ds, errs := Parse(f, isKnown)
+	type keyValueLine struct {
+		key, value string
+		line       int
+	}
+	var got []keyValueLine
+	for _, d := range ds {
+		got = append(got, keyValueLine{d.Key, d.Value, d.Pos.Line})
+	}
+	want := []keyValueLine{
+		{"prefix", "example.com/repo", 1},
+		{"ignore", "", 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got directives %v; want %v", got, want)
+	}
+	var gotErrs []string
+	for _, err := range errs {
+		gotErrs = append(gotErrs, err.Error())
+	}
+	wantErrs := []string{
+		"BUILD.bazel:2: unknown directive: #gazelle:bogus value",
+		"BUILD.bazel:5: top-level directive may not appear after the first statement",
+	}
+	if !reflect.DeepEqual(gotErrs, wantErrs) {
+		t.Errorf("got errors %q; want %q", gotErrs, wantErrs)
+	}
+
+	if ds, errs := Parse(f, nil); len(ds) != 3 || len(errs) != 1 {
+		t.Errorf("with all keys known: got %d directives and %d errors; want 3 and 1", len(ds), len(errs))
+	}
+}
@@ -0,0 +1,106 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+)
+
+// archiveSHA256 downloads the archive at url and returns the hex-encoded
+// SHA-256 of its content. It accesses the network and may be replaced in
+// tests.
+var archiveSHA256 = httpSHA256
+
+// toArchiveRules converts go_repository rules pinned to commits into rules
+// that download an archive of the same commit over HTTP. Each archive is
+// downloaded once to compute its sha256, which Bazel checks when it fetches
+// the archive, so builds are reproducible and work with
+// --experimental_repository_hash. Only repositories hosted on GitHub have
+// archives at known URLs; other rules are returned unchanged.
+func toArchiveRules(rules []*bf.CallExpr) ([]*bf.CallExpr, error) {
+	archiveRules := make([]*bf.CallExpr, len(rules))
+	for i, call := range rules {
+		r := &bf.Rule{Call: call}
+		importPath, commit := r.AttrString("importpath"), r.AttrString("commit")
+		url, stripPrefix, ok := githubArchive(importPath, commit)
+		if !ok {
+			logging.Infof("%s: no HTTP archive is known for this repository; it will be fetched with git", importPath)
+			archiveRules[i] = call
+			continue
+		}
+		sum, err := archiveSHA256(url)
+		if err != nil {
+			return nil, err
+		}
+		archiveRules[i] = &bf.CallExpr{
+			X: &bf.LiteralExpr{Token: "go_repository"},
+			List: []bf.Expr{
+				repoAttr("name", r.Name()),
+				repoAttr("importpath", importPath),
+				repoAttr("sha256", sum),
+				repoAttr("strip_prefix", stripPrefix),
+				repoAttr("type", "tar.gz"),
+				&bf.BinaryExpr{
+					X:  &bf.LiteralExpr{Token: "urls"},
+					Op: "=",
+					Y:  &bf.ListExpr{List: []bf.Expr{&bf.StringExpr{Value: url}}},
+				},
+			},
+			ForceMultiLine: true,
+		}
+	}
+	return archiveRules, nil
+}
+
+// githubArchive returns the URL of the .tar.gz archive GitHub serves for
+// the repository at importPath at commit, and the directory the archive's
+// files are in. ok is false if importPath isn't the root of a GitHub
+// repository.
+func githubArchive(importPath, commit string) (url, stripPrefix string, ok bool) {
+	parts := strings.Split(importPath, "/")
+	if len(parts) != 3 || parts[0] != "github.com" || commit == "" {
+		return "", "", false
+	}
+	url = fmt.Sprintf("https://%s/archive/%s.tar.gz", importPath, commit)
+	stripPrefix = fmt.Sprintf("%s-%s", parts[2], commit)
+	return url, stripPrefix, true
+}
+
+// httpSHA256 downloads url and returns the hex-encoded SHA-256 of the
+// response body.
+func httpSHA256(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", fmt.Errorf("%s: %v", url, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
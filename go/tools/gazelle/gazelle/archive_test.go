@@ -0,0 +1,88 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+func TestToArchiveRules(t *testing.T) {
+	oldArchiveSHA256 := archiveSHA256
+	defer func() { archiveSHA256 = oldArchiveSHA256 }()
+	var downloaded []string
+	archiveSHA256 = func(url string) (string, error) {
+		downloaded = append(downloaded, url)
+		return "cafe", nil
+	}
+
+	rules := []*bf.CallExpr{
+		newRepoRule("com_github_pkg_errors", "abc", "github.com/pkg/errors"),
+		newRepoRule("org_golang_x_tools", "def", "golang.org/x/tools"),
+	}
+	got, err := toArchiveRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const wantURL = "https://github.com/pkg/errors/archive/abc.tar.gz"
+	if len(downloaded) != 1 || downloaded[0] != wantURL {
+		t.Errorf("downloaded %q; want [%q]", downloaded, wantURL)
+	}
+	r := &bf.Rule{Call: got[0]}
+	for _, a := range []struct{ key, want string }{
+		{"name", "com_github_pkg_errors"},
+		{"importpath", "github.com/pkg/errors"},
+		{"commit", ""},
+		{"sha256", "cafe"},
+		{"strip_prefix", "errors-abc"},
+		{"type", "tar.gz"},
+	} {
+		if got := r.AttrString(a.key); got != a.want {
+			t.Errorf("%s: got %q; want %q", a.key, got, a.want)
+		}
+	}
+	if urls, ok := r.Attr("urls").(*bf.ListExpr); !ok || len(urls.List) != 1 || urls.List[0].(*bf.StringExpr).Value != wantURL {
+		t.Errorf("urls: got %#v; want [%q]", r.Attr("urls"), wantURL)
+	}
+	if got[1] != rules[1] {
+		t.Errorf("rule for repository not on GitHub was changed")
+	}
+}
+
+func TestGithubArchive(t *testing.T) {
+	for _, tc := range []struct {
+		importPath, commit, url, stripPrefix string
+		ok                                   bool
+	}{
+		{
+			importPath:  "github.com/pkg/errors",
+			commit:      "abc",
+			url:         "https://github.com/pkg/errors/archive/abc.tar.gz",
+			stripPrefix: "errors-abc",
+			ok:          true,
+		},
+		{importPath: "github.com/pkg/errors/sub", commit: "abc"},
+		{importPath: "github.com/pkg/errors"},
+		{importPath: "golang.org/x/tools", commit: "abc"},
+	} {
+		url, stripPrefix, ok := githubArchive(tc.importPath, tc.commit)
+		if url != tc.url || stripPrefix != tc.stripPrefix || ok != tc.ok {
+			t.Errorf("githubArchive(%q, %q) = %q, %q, %v; want %q, %q, %v", tc.importPath, tc.commit, url, stripPrefix, ok, tc.url, tc.stripPrefix, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+)
+
+// benchRepoFiles returns files for a repository with n packages, ten per
+// directory, each importing the package before it and with a test.
+func benchRepoFiles(n int) []fileSpec {
+	files := []fileSpec{{path: "WORKSPACE"}}
+	for i := 0; i < n; i++ {
+		prev := (i + n - 1) % n
+		dir := fmt.Sprintf("d%d/p%d", i/10, i)
+		files = append(files,
+			fileSpec{path: dir + "/lib.go", content: fmt.Sprintf("package p%d\n\nimport _ \"example.com/bench/d%d/p%d\"\n", i, prev/10, prev)},
+			fileSpec{path: dir + "/lib_test.go", content: fmt.Sprintf("package p%d\n\nimport \"testing\"\n\nfunc TestX(t *testing.T) {}\n", i)})
+	}
+	return files
+}
+
+// BenchmarkRun measures the time and allocations needed to generate and merge
+// build files for a whole repository. Files are not written, so the results
+// don't depend on the file system.
+func BenchmarkRun(b *testing.B) {
+	for _, bc := range []struct {
+		desc string
+		n    int
+		args []string
+	}{
+		{desc: "100 packages", n: 100},
+		{desc: "1000 packages", n: 1000},
+		{desc: "1000 packages flat", n: 1000, args: []string{"-experimental_flat"}},
+	} {
+		b.Run(bc.desc, func(b *testing.B) {
+			dir, err := createFiles(benchRepoFiles(bc.n))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			args := append([]string{"-go_prefix", "example.com/bench", "-repo_root", dir}, bc.args...)
+			args = append(args, dir)
+			cs, cmd, _, _, err := newConfigurations(args)
+			if err != nil {
+				b.Fatal(err)
+			}
+			discard := func(*config.Config, *bf.File) error { return nil }
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, c := range cs {
+					if _, err := run(c, cmd, discard); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// changedDirs returns the set of directories that rules should be generated
+// for when the files at the absolute paths in files have changed. Keys are
+// slash-separated paths relative to root. Files outside root are ignored.
+//
+// Each file's directory is included. If a file is in a testdata directory,
+// the directory containing testdata is included too, since its go_test
+// rule may need a data attribute.
+func changedDirs(root string, files []string) map[string]bool {
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		if !isDescendingDir(f, root) {
+			continue
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(f))
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+		dirs[rel] = true
+		for dir := rel; dir != ""; {
+			parent := path.Dir(dir)
+			if parent == "." {
+				parent = ""
+			}
+			if path.Base(dir) == "testdata" {
+				dirs[parent] = true
+			}
+			dir = parent
+		}
+	}
+	return dirs
+}
+
+// gitChangedFiles returns the absolute paths of files in the git repository
+// containing root that differ from the commit ref, including untracked
+// files that aren't ignored. Only files in root are listed.
+func gitChangedFiles(root, ref string) ([]string, error) {
+	diff, err := gitOutput(root, "diff", "--name-only", "--relative", ref, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := gitOutput(root, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range append(diff, untracked...) {
+		files = append(files, filepath.Join(root, filepath.FromSlash(name)))
+	}
+	return files, nil
+}
+
+// gitOutput runs git with args in dir and returns the lines it prints.
+func gitOutput(dir string, args ...string) ([]string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v\n%s", strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,102 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+)
+
+func TestChangedDirs(t *testing.T) {
+	root := filepath.FromSlash("/repo")
+	files := []string{
+		"/repo/main.go",
+		"/repo/a/b/b.go",
+		"/repo/c/testdata/sub/x.txt",
+		"/other/d.go",
+	}
+	for i, f := range files {
+		files[i] = filepath.FromSlash(f)
+	}
+	got := changedDirs(root, files)
+	want := map[string]bool{
+		"":               true,
+		"a/b":            true,
+		"c":              true,
+		"c/testdata/sub": true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestRunChangedDirs(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"WORKSPACE":              "",
+		"BUILD.bazel":            "",
+		"changed/changed.go":     "package changed\n",
+		"dependent/dependent.go": "package dependent\n\nimport _ \"example.com/repo/changed\"\n",
+		"dependent/BUILD.bazel": `go_library(
+    name = "go_default_library",
+    srcs = ["dependent.go"],
+    importpath = "example.com/repo/dependent",
+    deps = ["//changed:go_default_library"],
+)
+`,
+		"unchanged/unchanged.go": "package unchanged\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := defaultConfig(dir)
+	c.GoPrefix = "example.com/repo"
+	c.ChangedDirs = changedDirs(dir, []string{filepath.Join(dir, "changed", "changed.go")})
+	var got []string
+	emit := func(c *config.Config, f *bf.File) error {
+		rel, err := filepath.Rel(dir, f.Path)
+		if err != nil {
+			return err
+		}
+		got = append(got, filepath.ToSlash(rel))
+		return nil
+	}
+	if _, err := run(c, updateCmd, emit); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if want := []string{"changed/BUILD.bazel", "dependent/BUILD.bazel"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %q; want %q", got, want)
+	}
+}
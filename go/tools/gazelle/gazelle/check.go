@@ -0,0 +1,48 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+)
+
+// errFileChanged is returned by checkFile when a build file on disk is
+// out of date. It is not reported as an error; visitors record the path of
+// the file instead.
+var errFileChanged = errors.New("build file is out of date")
+
+// checkFile compares the formatted contents of file with the file on disk.
+// It returns errFileChanged if they differ or if the file does not exist.
+// Nothing is written.
+func checkFile(c *config.Config, file *bf.File) error {
+	data, err := ioutil.ReadFile(file.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errFileChanged
+		}
+		return err
+	}
+	if !bytes.Equal(data, bf.Format(file)) {
+		return errFileChanged
+	}
+	return nil
+}
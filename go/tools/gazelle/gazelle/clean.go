@@ -0,0 +1,86 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
+)
+
+// cleanVisitor removes the rules Gazelle would generate from existing build
+// files for the clean command. Rules are matched by kind and name with the
+// rules generated for each directory, including empty ones, so rules are
+// removed whether or not their sources still exist. Rules marked with
+// "# keep" and rules of other kinds are left alone. Build files are never
+// created, and nothing else in them is changed, except that loads which
+// are no longer needed are removed.
+type cleanVisitor struct {
+	visitorBase
+
+	// genRules holds the rules generated for the whole repository in flat
+	// mode. They're removed from the root build file in finish.
+	genRules []bf.Expr
+}
+
+func (v *cleanVisitor) visit(c *config.Config, pkg *packages.Package, oldFile *bf.File) {
+	if v.c.StructureMode == config.FlatMode {
+		g := rules.NewGenerator(c, v.r, v.l, "", nil)
+		rs, empty := g.GenerateRules(pkg)
+		v.genRules = append(v.genRules, rs...)
+		v.genRules = append(v.genRules, empty...)
+		return
+	}
+	if oldFile == nil {
+		return
+	}
+	g := rules.NewGenerator(c, v.r, v.l, pkg.Rel, oldFile)
+	rs, empty := g.GenerateRules(pkg)
+	v.clean(c, oldFile, append(rs, empty...))
+}
+
+func (v *cleanVisitor) finish() {
+	if v.c.StructureMode != config.FlatMode {
+		return
+	}
+	oldFile, err := loadBuildFile(v.c, v.c.RepoRoot)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Error(err)
+		}
+		return
+	}
+	v.clean(v.c, oldFile, v.genRules)
+}
+
+// clean removes rules matching genRules from oldFile and emits the result
+// if anything was removed.
+func (v *cleanVisitor) clean(c *config.Config, oldFile *bf.File, genRules []bf.Expr) {
+	cleanedFile := merger.RemoveRules(oldFile, genRules, c.KindAliases)
+	if cleanedFile == oldFile {
+		return
+	}
+	cleanedFile = merger.FixLoads(cleanedFile, c.Loads)
+	if logging.Enabled(logging.InfoLevel) {
+		reportChanges(c, oldFile, cleanedFile, nil, nil)
+	}
+	v.emitFile(cleanedFile)
+}
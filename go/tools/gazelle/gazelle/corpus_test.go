@@ -0,0 +1,161 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file runs Gazelle end to end on a corpus of small repositories in
+// testdata/corpus, each representative of a kind of project: a plain Go
+// project, one with lots of cgo, one with .proto files, and one with vendored
+// dependencies. Each directory with a BUILD.want file should end up with a
+// build file with the same content. BUILD.old files are copied as existing
+// build files before Gazelle runs.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/testdata"
+)
+
+var corpus = []struct {
+	name, prefix string
+	args         []string
+}{
+	{name: "small", prefix: "example.com/small"},
+	{name: "cgo", prefix: "example.com/cgo"},
+	{name: "proto", prefix: "example.com/proto", args: []string{"-proto", "default"}},
+	{name: "vendored", prefix: "example.com/vendored", args: []string{"-external", "vendored"}},
+}
+
+// copyCorpusRepo copies the corpus repository name to a new temporary
+// directory, which is returned. BUILD.want files are skipped, BUILD.old files
+// are renamed to the default build file name, and a WORKSPACE file is added.
+func copyCorpusRepo(name string) (string, error) {
+	src := filepath.Join(testdata.Dir(), "corpus", name)
+	dst, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "corpus_test")
+	if err != nil {
+		return "", err
+	}
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0700)
+		case info.Name() == "BUILD.want":
+			return nil
+		case info.Name() == "BUILD.old":
+			target = filepath.Join(filepath.Dir(target), config.DefaultValidBuildFileNames[0])
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, 0600)
+	})
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dst, "WORKSPACE"), nil, 0600)
+	}
+	if err != nil {
+		os.RemoveAll(dst)
+		return "", err
+	}
+	return dst, nil
+}
+
+func TestCorpus(t *testing.T) {
+	for _, tc := range corpus {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := copyCorpusRepo(tc.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			args := append([]string{"-go_prefix", tc.prefix}, tc.args...)
+			if err := runGazelle(dir, args); err != nil {
+				t.Fatal(err)
+			}
+
+			src := filepath.Join(testdata.Dir(), "corpus", tc.name)
+			err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.Name() != "BUILD.want" {
+					return err
+				}
+				rel, err := filepath.Rel(src, filepath.Dir(path))
+				if err != nil {
+					return err
+				}
+				want, err := ioutil.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				gotPath := filepath.Join(dir, rel, config.DefaultValidBuildFileNames[0])
+				got, err := ioutil.ReadFile(gotPath)
+				if err != nil {
+					t.Errorf("%s: %v", rel, err)
+				} else if string(got) != string(want) {
+					t.Errorf("%s: got %s ; want %s", rel, got, want)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// BenchmarkCorpus measures the time and allocations needed to generate and
+// merge build files for each repository in the corpus. Files are not
+// written, so each iteration does the same work.
+func BenchmarkCorpus(b *testing.B) {
+	for _, tc := range corpus {
+		b.Run(tc.name, func(b *testing.B) {
+			dir, err := copyCorpusRepo(tc.name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			args := append([]string{"-go_prefix", tc.prefix, "-repo_root", dir}, tc.args...)
+			args = append(args, dir)
+			cs, cmd, _, _, err := newConfigurations(args)
+			if err != nil {
+				b.Fatal(err)
+			}
+			discard := func(*config.Config, *bf.File) error { return nil }
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, c := range cs {
+					if _, err := run(c, cmd, discard); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+)
+
+// cycleKinds are the kinds of rules whose dependencies are recorded in an
+// importGraph.
+var cycleKinds = map[string]bool{
+	"go_binary":        true,
+	"go_grpc_library":  true,
+	"go_library":       true,
+	"go_proto_library": true,
+	"go_source":        true,
+	"go_test":          true,
+}
+
+// importGraph records dependencies between Go rules in the repository, as
+// written in the build files Gazelle emits. Nodes are labels in their long
+// form, like "//foo:go_default_library". Dependencies on other repositories
+// aren't recorded, since they can't form cycles through this repository.
+type importGraph struct {
+	edges map[string][]string
+}
+
+func newImportGraph() *importGraph {
+	return &importGraph{edges: make(map[string][]string)}
+}
+
+// addFile records the deps, embed, and library attributes of Go rules in f,
+// the build file for the directory rel.
+func (g *importGraph) addFile(f *bf.File, rel string) {
+	for _, r := range f.Rules("") {
+		if !cycleKinds[r.Kind()] || r.Name() == "" {
+			continue
+		}
+		from := resolve.Label{Pkg: rel, Name: r.Name()}.FullString()
+		var deps []string
+		for _, key := range []string{"deps", "embed"} {
+			deps = append(deps, attrStrings(r, key)...)
+		}
+		if lib := r.AttrString("library"); lib != "" {
+			deps = append(deps, lib)
+		}
+		var tos []string
+		for _, dep := range deps {
+			l, err := resolve.ParseLabel(dep)
+			if err != nil || l.Repo != "" {
+				continue
+			}
+			if l.Relative {
+				l.Pkg = rel
+			}
+			tos = append(tos, l.FullString())
+		}
+		g.edges[from] = tos
+	}
+}
+
+// cycles returns one cycle for each strongly connected component of the
+// graph that has one. Each cycle is a list of labels starting and ending with
+// the same label, which is the least label in the cycle. Cycles are sorted by
+// their first labels.
+func (g *importGraph) cycles() [][]string {
+	var cycles [][]string
+	for _, scc := range g.components() {
+		sort.Strings(scc)
+		if c := g.shortestCycle(scc[0], scc); c != nil {
+			cycles = append(cycles, c)
+		}
+	}
+	// Cycles come from disjoint components, so their first labels differ.
+	sort.Sort(byFirstLabel(cycles))
+	return cycles
+}
+
+type byFirstLabel [][]string
+
+func (s byFirstLabel) Len() int           { return len(s) }
+func (s byFirstLabel) Less(i, j int) bool { return s[i][0] < s[j][0] }
+func (s byFirstLabel) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// components returns the strongly connected components of the graph, found
+// with Tarjan's algorithm. Nodes are visited in sorted order, so the result
+// doesn't depend on map iteration order.
+func (g *importGraph) components() [][]string {
+	nodes := make([]string, 0, len(g.edges))
+	for n := range g.edges {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+
+	index := make(map[string]int)
+	lowlink := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var sccs [][]string
+	var connect func(n string)
+	connect = func(n string) {
+		index[n] = len(index)
+		lowlink[n] = index[n]
+		stack = append(stack, n)
+		onStack[n] = true
+		for _, m := range g.edges[n] {
+			if _, ok := index[m]; !ok {
+				connect(m)
+				if lowlink[m] < lowlink[n] {
+					lowlink[n] = lowlink[m]
+				}
+			} else if onStack[m] && index[m] < lowlink[n] {
+				lowlink[n] = index[m]
+			}
+		}
+		if lowlink[n] != index[n] {
+			return
+		}
+		var scc []string
+		for {
+			m := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[m] = false
+			scc = append(scc, m)
+			if m == n {
+				break
+			}
+		}
+		sccs = append(sccs, scc)
+	}
+	for _, n := range nodes {
+		if _, ok := index[n]; !ok {
+			connect(n)
+		}
+	}
+	return sccs
+}
+
+// shortestCycle returns the shortest path from start back to itself through
+// the nodes in scc, or nil if there is none. A component with one node only
+// has a cycle if the node depends on itself.
+func (g *importGraph) shortestCycle(start string, scc []string) []string {
+	inSCC := make(map[string]bool, len(scc))
+	for _, n := range scc {
+		inSCC[n] = true
+	}
+	prev := make(map[string]string)
+	queue := []string{start}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		deps := append([]string(nil), g.edges[n]...)
+		sort.Strings(deps)
+		for _, m := range deps {
+			if m == start {
+				path := []string{start}
+				for p := n; p != start; p = prev[p] {
+					path = append(path, p)
+				}
+				path = append(path, start)
+				for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+					path[i], path[j] = path[j], path[i]
+				}
+				return path
+			}
+			if _, seen := prev[m]; seen || !inSCC[m] {
+				continue
+			}
+			prev[m] = n
+			queue = append(queue, m)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestImportGraphCycles(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		edges map[string][]string
+		want  [][]string
+	}{
+		{
+			desc: "no cycles",
+			edges: map[string][]string{
+				"//a:go_default_library": {"//b:go_default_library"},
+				"//b:go_default_library": {"//c:go_default_library"},
+				"//a:go_default_test":    {"//a:go_default_library", "//b:go_default_library"},
+			},
+		}, {
+			desc: "self",
+			edges: map[string][]string{
+				"//a:go_default_library": {"//a:go_default_library"},
+			},
+			want: [][]string{{"//a:go_default_library", "//a:go_default_library"}},
+		}, {
+			desc: "shortest",
+			edges: map[string][]string{
+				"//a:go_default_library": {"//b:go_default_library"},
+				"//b:go_default_library": {"//c:go_default_library", "//d:go_default_library"},
+				"//c:go_default_library": {"//d:go_default_library"},
+				"//d:go_default_library": {"//a:go_default_library"},
+			},
+			want: [][]string{{
+				"//a:go_default_library",
+				"//b:go_default_library",
+				"//d:go_default_library",
+				"//a:go_default_library",
+			}},
+		}, {
+			desc: "two cycles",
+			edges: map[string][]string{
+				"//x:go_default_library": {"//y:go_default_library"},
+				"//y:go_default_library": {"//x:go_default_library", "//a:go_default_library"},
+				"//a:go_default_library": {"//b:go_default_library"},
+				"//b:go_default_library": {"//a:go_default_library"},
+			},
+			want: [][]string{
+				{"//a:go_default_library", "//b:go_default_library", "//a:go_default_library"},
+				{"//x:go_default_library", "//y:go_default_library", "//x:go_default_library"},
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			g := &importGraph{edges: tc.edges}
+			if got := g.cycles(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
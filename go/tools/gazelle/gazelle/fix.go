@@ -16,14 +16,71 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
 )
 
+// fixFile writes file to its path. The file is written to a temporary file
+// in the same directory, which is then renamed, so an interrupted run never
+// leaves a truncated build file behind. If c.BackupSuffix is set and the
+// file's previous contents differ, they are saved to a file named by
+// appending the suffix.
 func fixFile(c *config.Config, file *bf.File) error {
-	if err := ioutil.WriteFile(file.Path, bf.Format(file), 0644); err != nil {
+	data := bf.Format(file)
+	perm := os.FileMode(0644)
+	if st, err := os.Stat(file.Path); err == nil {
+		perm = st.Mode().Perm()
+		if c.BackupSuffix != "" {
+			if err := backupFile(file.Path, c.BackupSuffix, data, perm); err != nil {
+				return err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomic(file.Path, data, perm)
+}
+
+// backupFile copies the contents of the file at path to a file named by
+// appending suffix, unless they are the same as data.
+func backupFile(path, suffix string, data []byte, perm os.FileMode) error {
+	old, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(old, data) {
+		return nil
+	}
+	return writeFileAtomic(path+suffix, old, perm)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// path, then renames it to path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
 		return err
 	}
 	return nil
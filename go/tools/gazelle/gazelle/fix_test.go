@@ -84,6 +84,57 @@ func TestFixFile(t *testing.T) {
 	}
 }
 
+func TestFixFileBackup(t *testing.T) {
+	tmpdir := os.Getenv("TEST_TMPDIR")
+	dir, err := ioutil.TempDir(tmpdir, "")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", tmpdir, "", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "BUILD.bazel")
+	oldContent := "# old content\n"
+	if err := ioutil.WriteFile(path, []byte(oldContent), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	c := defaultConfig(dir)
+	c.BackupSuffix = ".orig"
+	newFile := &bf.File{Path: path}
+	if err := fixFile(c, newFile); err != nil {
+		t.Fatalf("fixFile(%q) failed with %v; want success", path, err)
+	}
+
+	if buf, err := ioutil.ReadFile(path + ".orig"); err != nil {
+		t.Errorf("ioutil.ReadFile(%q) failed with %v; want success", path+".orig", err)
+	} else if got := string(buf); got != oldContent {
+		t.Errorf("backup = %q; want %q", got, oldContent)
+	}
+	if buf, err := ioutil.ReadFile(path); err != nil {
+		t.Errorf("ioutil.ReadFile(%q) failed with %v; want success", path, err)
+	} else if got, want := string(buf), bf.FormatString(newFile); got != want {
+		t.Errorf("buf = %q; want %q", got, want)
+	}
+	if st, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if got, want := st.Mode().Perm(), os.FileMode(0640); got != want {
+		t.Errorf("mode = %v; want %v", got, want)
+	}
+
+	// No temporary files should be left behind.
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		var names []string
+		for _, fi := range infos {
+			names = append(names, fi.Name())
+		}
+		t.Errorf("files in directory: %q; want BUILD.bazel and BUILD.bazel.orig", names)
+	}
+}
+
 func TestCreateFile(t *testing.T) {
 	// Create a directory with a simple .go file.
 	tmpdir := os.Getenv("TEST_TMPDIR")
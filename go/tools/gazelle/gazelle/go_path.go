@@ -0,0 +1,100 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+)
+
+// goPathLibrary is a go_library rule that a go_path rule may depend on.
+type goPathLibrary struct {
+	label      resolve.Label
+	visibility []string
+}
+
+// goPathLibraries records the go_library rules generated in directories
+// where a "# gazelle:go_path" directive applies. Directories are visited
+// after their subdirectories, so when the directory with the directive is
+// visited, the libraries in its subtree have all been recorded.
+type goPathLibraries []goPathLibrary
+
+// add records the go_library rules in rs, generated for the directory rel.
+func (libs *goPathLibraries) add(rel string, rs []bf.Expr) {
+	for _, s := range rs {
+		r := bf.Rule{Call: s.(*bf.CallExpr)}
+		if r.Kind() != "go_library" {
+			continue
+		}
+		*libs = append(*libs, goPathLibrary{
+			label:      resolve.Label{Pkg: rel, Name: r.Name()},
+			visibility: r.AttrStrings("visibility"),
+		})
+	}
+}
+
+// under returns the labels of the libraries recorded in rel and its
+// subdirectories that are visible to rules in rel. Libraries that aren't
+// visible, like internal libraries in other subtrees, are skipped; go_path
+// still includes them if they're dependencies of other libraries.
+func (libs goPathLibraries) under(rel string) []resolve.Label {
+	var labels []resolve.Label
+	for _, l := range libs {
+		if !isDescendingRel(l.label.Pkg, rel) || !visibleFrom(l.label.Pkg, l.visibility, rel) {
+			continue
+		}
+		labels = append(labels, l.label)
+	}
+	return labels
+}
+
+// visibleFrom returns whether a rule in the package pkg with the given
+// visibility may be depended on by rules in the package rel. Rules without
+// a visibility attribute are assumed to be visible, since the package's
+// default_visibility isn't known here.
+func visibleFrom(pkg string, visibility []string, rel string) bool {
+	if len(visibility) == 0 {
+		return true
+	}
+	for _, v := range visibility {
+		switch {
+		case v == "//visibility:public":
+			return true
+		case v == "//visibility:private":
+			if pkg == rel {
+				return true
+			}
+		case strings.HasSuffix(v, ":__subpackages__"):
+			if isDescendingRel(rel, strings.TrimSuffix(strings.TrimPrefix(v, "//"), ":__subpackages__")) {
+				return true
+			}
+		case strings.HasSuffix(v, ":__pkg__"):
+			if rel == strings.TrimSuffix(strings.TrimPrefix(v, "//"), ":__pkg__") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isDescendingRel returns whether rel is root or one of its
+// subdirectories. Both are slash-separated paths relative to the
+// repository root.
+func isDescendingRel(rel, root string) bool {
+	return root == "" || rel == root || strings.HasPrefix(rel, root+"/")
+}
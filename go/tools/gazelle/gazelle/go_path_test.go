@@ -0,0 +1,66 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+)
+
+func TestGoPathLibrariesUnder(t *testing.T) {
+	lib := func(pkg string, visibility ...string) goPathLibrary {
+		return goPathLibrary{
+			label:      resolve.Label{Pkg: pkg, Name: "go_default_library"},
+			visibility: visibility,
+		}
+	}
+	libs := goPathLibraries{
+		lib("a"),
+		lib("a/b", "//visibility:public"),
+		lib("a/internal/x", "//a:__subpackages__"),
+		lib("ab", "//visibility:public"),
+		lib("c/private", "//visibility:private"),
+		lib("c", "//c:__pkg__"),
+		lib("", "//visibility:public"),
+	}
+	for _, tc := range []struct {
+		rel  string
+		want []string
+	}{
+		{
+			rel:  "",
+			want: []string{"//a:go_default_library", "//a/b:go_default_library", "//ab:go_default_library", "//:go_default_library"},
+		}, {
+			rel:  "a",
+			want: []string{"//a:go_default_library", "//a/b:go_default_library", "//a/internal/x:go_default_library"},
+		}, {
+			rel:  "c",
+			want: []string{"//c:go_default_library"},
+		}, {
+			rel: "d",
+		},
+	} {
+		var got []string
+		for _, l := range libs.under(tc.rel) {
+			got = append(got, l.String())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("under(%q): got %q; want %q", tc.rel, got, tc.want)
+		}
+	}
+}
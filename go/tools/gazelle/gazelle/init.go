@@ -0,0 +1,100 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/walk"
+)
+
+// workspaceBoilerplate is the content of a new WORKSPACE file. It matches
+// the setup instructions in the rules_go README.
+const workspaceBoilerplate = `git_repository(
+    name = "io_bazel_rules_go",
+    remote = "https://github.com/bazelbuild/rules_go.git",
+    commit = "d8d73c918ed7b59a5584e0cab4f5274d2f91faab",
+)
+
+load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies", "go_register_toolchains")
+
+go_rules_dependencies()
+
+go_register_toolchains()
+`
+
+// initWorkspace bootstraps the repository at c.RepoRoot. It creates a
+// WORKSPACE file with rules_go boilerplate if there isn't one, and it adds
+// a gazelle rule with the inferred prefix to the root build file if there
+// isn't one already. Files are emitted with emit, so -mode applies as it does
+// for other commands. Build files for Go packages are not generated; running
+// the new gazelle rule does that.
+func initWorkspace(c *config.Config, emit emitFunc) ([]string, error) {
+	v := &visitorBase{c: c, emit: emit}
+
+	workspacePath := filepath.Join(c.RepoRoot, "WORKSPACE")
+	if _, err := os.Stat(workspacePath); os.IsNotExist(err) {
+		f, err := bf.Parse(workspacePath, []byte(workspaceBoilerplate))
+		if err != nil {
+			return nil, err
+		}
+		v.emitFile(f)
+	} else if err != nil {
+		return nil, err
+	}
+
+	buildFile, err := loadBuildFile(c, c.RepoRoot)
+	if os.IsNotExist(err) {
+		buildFile = &bf.File{Path: filepath.Join(c.RepoRoot, walk.NewBuildFileName(c, c.RepoRoot))}
+	} else if err != nil {
+		return nil, err
+	}
+	if len(buildFile.Rules("gazelle")) == 0 {
+		rule, err := gazelleRule(c, buildFile.Path)
+		if err != nil {
+			return nil, err
+		}
+		buildFile.Stmt = append(buildFile.Stmt, rule)
+		buildFile = merger.FixLoads(buildFile, c.Loads)
+		bf.Rewrite(buildFile, nil)
+		v.emitFile(buildFile)
+	}
+
+	return v.result()
+}
+
+// gazelleRule returns a gazelle rule that runs Gazelle with the prefix and
+// dependency mode in c.
+func gazelleRule(c *config.Config, path string) (bf.Expr, error) {
+	external := ""
+	switch c.DepMode {
+	case config.VendorMode:
+		external = "    external = \"vendored\",\n"
+	case config.HybridMode:
+		external = "    external = \"hybrid\",\n"
+	}
+	content := fmt.Sprintf("gazelle(\n    name = \"gazelle\",\n%s    prefix = %q,\n)\n", external, c.GoPrefix)
+	f, err := bf.Parse(path, []byte(content))
+	if err != nil {
+		return nil, err
+	}
+	return f.Stmt[0], nil
+}
@@ -23,6 +23,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -93,12 +94,12 @@ func runGazelle(wd string, args []string) error {
 	}
 	defer os.Chdir(oldWd)
 
-	c, cmd, emit, err := newConfiguration(args)
+	cs, cmd, emit, opts, err := newConfigurations(args)
 	if err != nil {
 		return err
 	}
 
-	run(c, cmd, emit)
+	runRoots(cs, cmd, emit, opts)
 	return nil
 }
 
@@ -324,6 +325,98 @@ go_library(
 	}
 }
 
+func TestInit(t *testing.T) {
+	files := []fileSpec{
+		{path: "go.mod", content: "module example.com/foo\n"},
+		{path: "a/a.go", content: "package a"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, []string{"init", "-external", "vendored"}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{
+		{path: "WORKSPACE", content: workspaceBoilerplate},
+		{
+			path: config.DefaultValidBuildFileNames[0],
+			content: `load("@io_bazel_rules_go//go:def.bzl", "gazelle")
+
+gazelle(
+    name = "gazelle",
+    external = "vendored",
+    prefix = "example.com/foo",
+)
+`,
+		},
+	})
+	if _, err := os.Stat(filepath.Join(dir, "a", config.DefaultValidBuildFileNames[0])); err == nil {
+		t.Errorf("init generated a build file for a Go package")
+	}
+}
+
+func TestInitExistingBuildFile(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE", content: "# existing\n"},
+		{
+			path: "BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_prefix")
+
+go_prefix("example.com/foo")
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, []string{"init"}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{
+		{path: "WORKSPACE", content: "# existing\n"},
+		{
+			path: "BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "gazelle", "go_prefix")
+
+go_prefix("example.com/foo")
+
+gazelle(
+    name = "gazelle",
+    prefix = "example.com/foo",
+)
+`,
+		},
+	})
+
+	// Running init again should not change anything.
+	oldWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldWd)
+	cs, cmd, emit, opts, err := newConfigurations([]string{"init", "-mode", "check"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range runRoots(cs, cmd, emit, opts) {
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if len(res.changed) > 0 {
+			t.Errorf("got changed files %q after init ; want none", res.changed)
+		}
+	}
+}
+
 func TestFixUnlinkedCgoLibrary(t *testing.T) {
 	files := []fileSpec{
 		{path: "WORKSPACE"},
@@ -402,6 +495,196 @@ func TestMultipleDirectories(t *testing.T) {
 	}
 }
 
+// TestBazelRun checks that Gazelle finds the workspace through
+// BUILD_WORKSPACE_DIRECTORY when it's run with "bazel run". The working
+// directory is a runfiles tree with its own WORKSPACE, and the workspace
+// is reached through a symbolic link.
+func TestBazelRun(t *testing.T) {
+	files := []fileSpec{
+		{path: "repo/WORKSPACE"},
+		{
+			path:    "repo/a/a.go",
+			content: "package a",
+		}, {
+			path:    "repo/b/b.go",
+			content: "package b",
+		},
+		{path: "runfiles/WORKSPACE"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(dir, "repo"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	oldEnv, hadEnv := os.LookupEnv(workspaceDirEnv)
+	if err := os.Setenv(workspaceDirEnv, link); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if hadEnv {
+			os.Setenv(workspaceDirEnv, oldEnv)
+		} else {
+			os.Unsetenv(workspaceDirEnv)
+		}
+	}()
+
+	args := []string{"-go_prefix", "example.com/foo", "a"}
+	if err := runGazelle(filepath.Join(dir, "runfiles"), args); err != nil {
+		t.Fatal(err)
+	}
+	buildName := config.DefaultValidBuildFileNames[0]
+	if _, err := os.Stat(filepath.Join(dir, "repo", "a", buildName)); err != nil {
+		t.Errorf("a/%s not created: %v", buildName, err)
+	}
+	for _, p := range []string{"repo/b", "runfiles"} {
+		if _, err := os.Stat(filepath.Join(dir, p, buildName)); err == nil {
+			t.Errorf("%s/%s was created; want only a/%s", p, buildName, buildName)
+		}
+	}
+}
+
+func TestRepoRootFromAnywhere(t *testing.T) {
+	files := []fileSpec{
+		{path: "repo/WORKSPACE"},
+		{path: "repo/a/a.go", content: "package a"},
+		{path: "repo/b/b.go", content: "package b"},
+		{path: "elsewhere/"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix", "example.com/foo", "-repo_root", filepath.Join(dir, "repo"), "a"}
+	if err := runGazelle(filepath.Join(dir, "elsewhere"), args); err != nil {
+		t.Fatal(err)
+	}
+	buildName := config.DefaultValidBuildFileNames[0]
+	if _, err := os.Stat(filepath.Join(dir, "repo", "a", buildName)); err != nil {
+		t.Errorf("a/%s not created: %v", buildName, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "repo", "b", buildName)); err == nil {
+		t.Errorf("b/%s was created; want only a/%s", buildName, buildName)
+	}
+}
+
+func TestMultipleRepoRoots(t *testing.T) {
+	files := []fileSpec{
+		{path: "one/WORKSPACE"},
+		{path: "one/a/a.go", content: "package a"},
+		{path: "one/b/b.go", content: "package b"},
+		{path: "two/WORKSPACE"},
+		{path: "two/c/c.go", content: "package c"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	one := filepath.Join(dir, "one")
+	two := filepath.Join(dir, "two")
+	buildName := config.DefaultValidBuildFileNames[0]
+
+	// With directories, each directory is processed in the root containing it.
+	args := []string{"-go_prefix", "example.com/foo", "-repo_root", one, "-repo_root", two, filepath.Join(one, "a"), filepath.Join(two, "c")}
+	cs, cmd, emit, opts, err := newConfigurations(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 2 || cs[0].RepoRoot != one || cs[1].RepoRoot != two {
+		t.Fatalf("got %d configurations; want configurations for %s and %s", len(cs), one, two)
+	}
+	for _, res := range runRoots(cs, cmd, emit, opts) {
+		if res.err != nil {
+			t.Errorf("%s: %v", res.c.RepoRoot, res.err)
+		}
+	}
+	for _, p := range []string{"one/a", "two/c"} {
+		if _, err := os.Stat(filepath.Join(dir, p, buildName)); err != nil {
+			t.Errorf("%s/%s not created: %v", p, buildName, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(one, "b", buildName)); err == nil {
+		t.Errorf("one/b/%s was created", buildName)
+	}
+
+	// Without directories, each root is processed entirely.
+	args = []string{"-go_prefix", "example.com/foo", "-repo_root", one, "-repo_root", two}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(one, "b", buildName)); err != nil {
+		t.Errorf("one/b/%s not created: %v", buildName, err)
+	}
+
+	// Directories outside all roots are an error.
+	args = []string{"-go_prefix", "example.com/foo", "-repo_root", one, "-repo_root", two, dir}
+	if _, _, _, _, err := newConfigurations(args); err == nil {
+		t.Error("got success for directory outside repo roots; want error")
+	}
+}
+
+func TestProfiling(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{path: "a/a.go", content: "package a"},
+		{path: "profiles/"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cpuProfile := filepath.Join(dir, "profiles", "cpu")
+	memProfile := filepath.Join(dir, "profiles", "mem")
+	traceFile := filepath.Join(dir, "profiles", "trace")
+	args := []string{
+		"-go_prefix", "example.com/foo",
+		"-repo_root", dir,
+		"-cpuprofile", cpuProfile,
+		"-memprofile", memProfile,
+		"-trace", traceFile,
+		filepath.Join(dir, "a"),
+	}
+	cs, cmd, emit, opts, err := newConfigurations(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop, err := startProfiling(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runRoots(cs, cmd, emit, opts)
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{cpuProfile, memProfile} {
+		if st, err := os.Stat(p); err != nil {
+			t.Errorf("profile not written: %v", err)
+		} else if st.Size() == 0 {
+			t.Errorf("%s: profile is empty", p)
+		}
+	}
+	data, err := ioutil.ReadFile(traceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stage := range []string{"walk", "parse", "resolve", "merge", "write"} {
+		if !strings.Contains(string(data), stage+"\t") {
+			t.Errorf("trace does not contain %s stage:\n%s", stage, data)
+		}
+	}
+}
+
 func TestErrorOutsideWorkspace(t *testing.T) {
 	files := []fileSpec{
 		{path: "a/"},
@@ -467,6 +750,140 @@ func TestBuildFileNameIgnoresBuild(t *testing.T) {
 	}
 }
 
+func TestBrokenBuildFile(t *testing.T) {
+	const broken = "go_library(\n    name = \"go_default_library\",\n"
+	for _, tc := range []struct {
+		desc    string
+		args    []string
+		files   []fileSpec
+		want    []fileSpec
+		missing []string
+	}{
+		{
+			desc: "hierarchical",
+			files: []fileSpec{
+				{path: "a/BUILD.bazel", content: broken},
+				{path: "a/a.go", content: "package a"},
+				{path: "b/b.go", content: "package b"},
+			},
+			want: []fileSpec{
+				{path: "a/BUILD.bazel", content: broken},
+				{
+					path: "b/BUILD.bazel",
+					content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["b.go"],
+    importpath = "example.com/repo/b",
+    visibility = ["//visibility:public"],
+)
+`,
+				},
+			},
+			missing: []string{"a/BUILD.bazel.gazelle-new"},
+		}, {
+			desc: "hierarchical new file",
+			args: []string{"-new_on_parse_error"},
+			files: []fileSpec{
+				{path: "a/BUILD.bazel", content: broken},
+				{path: "a/a.go", content: "package a"},
+			},
+			want: []fileSpec{
+				{path: "a/BUILD.bazel", content: broken},
+				{
+					path: "a/BUILD.bazel.gazelle-new",
+					content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+)
+`,
+				},
+			},
+		}, {
+			desc: "flat",
+			args: []string{"-experimental_flat"},
+			files: []fileSpec{
+				{path: "BUILD.bazel", content: broken},
+				{path: "a/a.go", content: "package a"},
+			},
+			want: []fileSpec{
+				{path: "BUILD.bazel", content: broken},
+			},
+			missing: []string{"BUILD.bazel.gazelle-new"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			files := append([]fileSpec{{path: "WORKSPACE"}}, tc.files...)
+			dir, err := createFiles(files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			args := append([]string{"-go_prefix", "example.com/repo"}, tc.args...)
+			if err := runGazelle(dir, args); err != nil {
+				t.Fatal(err)
+			}
+			checkFiles(t, dir, tc.want)
+			for _, p := range tc.missing {
+				if _, err := os.Stat(filepath.Join(dir, p)); !os.IsNotExist(err) {
+					t.Errorf("%s: got %v; want not exist", p, err)
+				}
+			}
+		})
+	}
+}
+
+func TestGoPath(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:go_path gopath
+
+load("@io_bazel_rules_go//go:def.bzl", "go_path")
+
+go_path(
+    name = "gopath",
+    deps = ["//gone:go_default_library"],
+)
+`,
+		},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/internal/x/x.go", content: "package x"},
+		{path: "b/b.go", content: "package b"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, []string{"-go_prefix", "example.com/repo"}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "BUILD.bazel",
+		content: `# gazelle:go_path gopath
+
+load("@io_bazel_rules_go//go:def.bzl", "go_path")
+
+go_path(
+    name = "gopath",
+    deps = [
+        "//a:go_default_library",
+        "//b:go_default_library",
+    ],
+)
+`,
+	}})
+}
+
 func TestExternalVendor(t *testing.T) {
 	files := []fileSpec{
 		{path: "WORKSPACE"},
@@ -748,3 +1165,159 @@ go_library(
 // TODO(jayconrod): more tests
 //   run in fix mode in testdata directories to create new files
 //   run in diff mode in testdata directories to update existing files (no change)
+
+func TestCheckMode(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{path: "a/a.go", content: "package a"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix", "example.com/repo", "-repo_root", dir, "-mode", "check", dir}
+	cs, cmd, emit, _, err := newConfigurations(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cs[0]
+	changed, err := run(c, cmd, emit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "a", "BUILD.bazel"),
+		filepath.Join(dir, "BUILD.bazel"),
+	}
+	if !reflect.DeepEqual(changed, want) {
+		t.Errorf("got changed files %q ; want %q", changed, want)
+	}
+	for _, p := range want {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s: file was written in check mode", p)
+		}
+	}
+
+	// Write the files, then check again. Nothing should be reported.
+	args = []string{"-go_prefix", "example.com/repo", "-repo_root", dir, dir}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = run(c, cmd, emit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) > 0 {
+		t.Errorf("got changed files %q after update ; want none", changed)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "gazelle.json",
+			content: `{
+  "prefix": "example.com/repo",
+  "exclude": ["third_party/"],
+  "platforms": ["linux_amd64"],
+  "build_file_name": "BUILD",
+  "proto": "package"
+}`,
+		},
+		{path: "a.go", content: "package repo"},
+		{path: "third_party/b/b.go", content: "package b"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// -proto is set on the command line, so it overrides the file.
+	args := []string{"-repo_root", dir, "-proto", "disable", dir}
+	cs, _, _, _, err := newConfigurations(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cs[0]
+	if c.GoPrefix != "example.com/repo" {
+		t.Errorf("got prefix %q; want %q", c.GoPrefix, "example.com/repo")
+	}
+	if want := []string{"third_party"}; !reflect.DeepEqual(c.ExcludedDirs, want) {
+		t.Errorf("got excluded dirs %q; want %q", c.ExcludedDirs, want)
+	}
+	wantPlatform := "@io_bazel_rules_go//go/platform:linux_amd64"
+	if len(c.Platforms) != 1 || !c.Platforms[wantPlatform]["linux"] {
+		t.Errorf("got platforms %v; want only %s", c.Platforms, wantPlatform)
+	}
+	if want := []string{"BUILD"}; !reflect.DeepEqual(c.ValidBuildFileNames, want) {
+		t.Errorf("got build file names %q; want %q", c.ValidBuildFileNames, want)
+	}
+	if c.ProtoMode != config.DisableProtoMode {
+		t.Errorf("got proto mode %v; want %v", c.ProtoMode, config.DisableProtoMode)
+	}
+
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "third_party", "b", "BUILD")); !os.IsNotExist(err) {
+		t.Errorf("build file was generated in excluded directory")
+	}
+}
+
+func TestEnvDefaults(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{path: "a.go", content: "package repo"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, env := range []string{"GAZELLE_MODE", "GAZELLE_PREFIX", "GAZELLE_REPO_ROOT"} {
+		old, had := os.LookupEnv(env)
+		defer func(env string) {
+			if had {
+				os.Setenv(env, old)
+			} else {
+				os.Unsetenv(env)
+			}
+		}(env)
+	}
+	os.Setenv("GAZELLE_PREFIX", "example.com/env")
+	os.Setenv("GAZELLE_REPO_ROOT", dir)
+
+	getPrefix := func(args []string) string {
+		cs, _, _, _, err := newConfigurations(append(args, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cs[0].RepoRoot != dir {
+			t.Errorf("got repo root %s; want %s", cs[0].RepoRoot, dir)
+		}
+		return cs[0].GoPrefix
+	}
+	if got := getPrefix(nil); got != "example.com/env" {
+		t.Errorf("with environment: got prefix %q; want %q", got, "example.com/env")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "gazelle.json"), []byte(`{"prefix": "example.com/file"}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if got := getPrefix(nil); got != "example.com/file" {
+		t.Errorf("with config file: got prefix %q; want %q", got, "example.com/file")
+	}
+	if got := getPrefix([]string{"-go_prefix", "example.com/flag"}); got != "example.com/flag" {
+		t.Errorf("with flag: got prefix %q; want %q", got, "example.com/flag")
+	}
+
+	os.Setenv("GAZELLE_MODE", "bogus")
+	want := "unrecognized emit mode"
+	if _, _, _, _, err := newConfigurations([]string{dir}); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v; want error containing %q", err, want)
+	}
+}
@@ -0,0 +1,204 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/trace"
+)
+
+// buildFileJSON describes the rules Gazelle generates for a build file. It
+// is written to stdout by jsonFile.
+type buildFileJSON struct {
+	// Path is the path to the build file relative to the repository root,
+	// with slashes.
+	Path string
+
+	Rules []ruleJSON
+}
+
+// ruleJSON describes a rule generated by Gazelle, merged with the existing
+// rule of the same kind and name if there is one.
+type ruleJSON struct {
+	Kind, Name string
+
+	// Attrs contains the attributes of the rule other than name. Strings,
+	// lists, and dicts are converted to JSON strings, arrays, and objects.
+	// True and False are converted to booleans. A call to select is converted
+	// to an object with a "select" key whose value is the converted dict. A
+	// sum like a + b is converted to an object with a "+" key whose value is
+	// an array of the operands. Other expressions are converted to objects
+	// with an "expr" key whose value is the expression in build file syntax.
+	Attrs map[string]interface{}
+
+	// Srcs and Deps are the source files and dependency labels in the srcs
+	// and deps attributes, on all platforms, without duplicates.
+	Srcs []string `json:",omitempty"`
+	Deps []string `json:",omitempty"`
+}
+
+// jsonFile writes a description of the rules generated for f to stdout as a
+// JSON object. Nothing is written to disk. Objects for multiple files are
+// written one after another, like the output of "go list -json".
+func jsonFile(c *config.Config, f *bf.File) error {
+	data, err := json.MarshalIndent(describeFile(c, f), "", "\t")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// statsJSON is written to stdout after the descriptions of build files when
+// -stats is given in JSON mode.
+type statsJSON struct {
+	Stats trace.Stats
+}
+
+// writeStatsJSON writes stats to w as a JSON object with a Stats field, so
+// it can be told apart from the objects describing build files.
+func writeStatsJSON(w io.Writer, stats trace.Stats) error {
+	data, err := json.MarshalIndent(statsJSON{stats}, "", "\t")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = w.Write(data)
+	return err
+}
+
+// describeFile returns a description of the rules in f that Gazelle
+// generates. Other rules and statements are not described.
+func describeFile(c *config.Config, f *bf.File) buildFileJSON {
+	desc := buildFileJSON{
+		Path:  printPath(c, f.Path),
+		Rules: []ruleJSON{},
+	}
+	for _, r := range f.Rules("") {
+		if !isGeneratedKind(r) {
+			continue
+		}
+		desc.Rules = append(desc.Rules, describeRule(r))
+	}
+	return desc
+}
+
+// describeRule returns a description of r.
+func describeRule(r *bf.Rule) ruleJSON {
+	rule := ruleJSON{
+		Kind:  r.Kind(),
+		Name:  r.Name(),
+		Attrs: make(map[string]interface{}),
+		Srcs:  attrStrings(r, "srcs"),
+		Deps:  attrStrings(r, "deps"),
+	}
+	for _, k := range r.AttrKeys() {
+		if k != "name" {
+			rule.Attrs[k] = exprJSON(r.Attr(k))
+		}
+	}
+	return rule
+}
+
+// isGeneratedKind returns whether r is a kind of rule Gazelle generates.
+func isGeneratedKind(r *bf.Rule) bool {
+	switch r.Kind() {
+	case "go_library", "go_binary", "go_test", "go_source", "proto_library", "go_proto_library":
+		return true
+	case "filegroup":
+		return r.Name() == config.DefaultProtosName
+	default:
+		return false
+	}
+}
+
+// attrStrings returns the strings in the attribute "key" of r without
+// duplicates, or nil if the attribute isn't a list or select of lists.
+func attrStrings(r *bf.Rule, key string) []string {
+	strs, ok := merger.ListStrings(r.Attr(key))
+	if !ok {
+		return nil
+	}
+	var uniq []string
+	seen := make(map[string]bool)
+	for _, s := range strs {
+		if !seen[s] {
+			seen[s] = true
+			uniq = append(uniq, s)
+		}
+	}
+	return uniq
+}
+
+// exprJSON converts a build file expression to a value that can be encoded
+// as JSON. See ruleJSON.Attrs for the conversions.
+func exprJSON(e bf.Expr) interface{} {
+	switch e := e.(type) {
+	case *bf.StringExpr:
+		return e.Value
+	case *bf.LiteralExpr:
+		switch e.Token {
+		case "True":
+			return true
+		case "False":
+			return false
+		}
+	case *bf.ListExpr:
+		values := make([]interface{}, len(e.List))
+		for i, x := range e.List {
+			values[i] = exprJSON(x)
+		}
+		return values
+	case *bf.DictExpr:
+		values := make(map[string]interface{})
+		for _, entry := range e.List {
+			kv, ok := entry.(*bf.KeyValueExpr)
+			if !ok {
+				return map[string]interface{}{"expr": bf.FormatString(e)}
+			}
+			key, ok := kv.Key.(*bf.StringExpr)
+			if !ok {
+				return map[string]interface{}{"expr": bf.FormatString(e)}
+			}
+			values[key.Value] = exprJSON(kv.Value)
+		}
+		return values
+	case *bf.CallExpr:
+		if x, ok := e.X.(*bf.LiteralExpr); ok && x.Token == "select" && len(e.List) == 1 {
+			return map[string]interface{}{"select": exprJSON(e.List[0])}
+		}
+	case *bf.BinaryExpr:
+		if e.Op == "+" {
+			return map[string]interface{}{"+": sumJSON(e)}
+		}
+	}
+	return map[string]interface{}{"expr": bf.FormatString(e)}
+}
+
+// sumJSON returns the converted operands of a sum like a + b + c.
+func sumJSON(e bf.Expr) []interface{} {
+	if b, ok := e.(*bf.BinaryExpr); ok && b.Op == "+" {
+		return append(sumJSON(b.X), sumJSON(b.Y)...)
+	}
+	return []interface{}{exprJSON(e)}
+}
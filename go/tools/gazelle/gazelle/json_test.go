@@ -0,0 +1,76 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+)
+
+func TestDescribeFile(t *testing.T) {
+	c := &config.Config{RepoRoot: "/repo"}
+	f, err := bf.Parse(filepath.Join("/repo", "a", "BUILD.bazel"), []byte(`
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "a_linux.go",
+    ],
+    cgo = True,
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+    deps = ["//b:go_default_library"] + select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": [
+            "//b:go_default_library",
+            "//c:go_default_library",
+        ],
+        "//conditions:default": [],
+    }),
+)
+
+genrule(
+    name = "gen",
+    outs = ["gen.go"],
+    cmd = "touch $@",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(describeFile(c, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"Path":"a/BUILD.bazel","Rules":[{"Kind":"go_library","Name":"go_default_library",` +
+		`"Attrs":{"cgo":true,"deps":{"+":[["//b:go_default_library"],{"select":{` +
+		`"//conditions:default":[],` +
+		`"@io_bazel_rules_go//go/platform:linux_amd64":["//b:go_default_library","//c:go_default_library"]}}]},` +
+		`"importpath":"example.com/repo/a",` +
+		`"srcs":["a.go","a_linux.go"],` +
+		`"visibility":["//visibility:public"]},` +
+		`"Srcs":["a.go","a_linux.go"],` +
+		`"Deps":["//b:go_default_library","//c:go_default_library"]}]}`
+	if got := string(data); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
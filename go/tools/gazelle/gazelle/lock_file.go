@@ -0,0 +1,308 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+)
+
+// lockedRepo is a repository pinned to a revision by a dependency manager.
+type lockedRepo struct {
+	// importPath is the import path of the repository root.
+	importPath string
+
+	// commit is the revision the repository is pinned to.
+	commit string
+
+	// source is an alternate location the dependency manager fetches the
+	// repository from, like a fork. It's empty if the repository is fetched
+	// from its import path.
+	source string
+}
+
+// lockFileParser reads the repositories pinned in a dependency manager's
+// lock file. path is the name of the file, used in error messages, and
+// data is its content. Repositories should be returned in the order they
+// appear in the file.
+type lockFileParser func(path string, data []byte) ([]lockedRepo, error)
+
+// lockFileParsers maps lock file base names to parsers. Support for other
+// dependency managers may be added here.
+var lockFileParsers = map[string]lockFileParser{
+	"Gopkg.lock":  parseDepLockFile,
+	"glide.lock":  parseGlideLockFile,
+	"vendor.json": parseGovendorFile,
+}
+
+// lockFileNames returns the sorted base names of supported lock files.
+func lockFileNames() []string {
+	var names []string
+	for name := range lockFileParsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// importLockFile reads the lock file at path and returns a go_repository
+// rule for each repository it pins. The parser is chosen by the file's
+// base name.
+func importLockFile(c *config.Config, path string) ([]*bf.CallExpr, error) {
+	parse, ok := lockFileParsers[filepath.Base(path)]
+	if !ok {
+		return nil, fmt.Errorf("%s: unrecognized lock file; supported files are %s", path, strings.Join(lockFileNames(), ", "))
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	repos, err := parse(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	repoName := resolve.RepoNamerForConfig(c)
+	var rules []*bf.CallExpr
+	for _, r := range repos {
+		if r.source != "" {
+			logging.WarningfAt(path, 0, "%s is fetched from %s; go_repository will fetch it from its import path instead", r.importPath, r.source)
+		}
+		rules = append(rules, newRepoRule(repoName(r.importPath), r.commit, r.importPath))
+	}
+	return rules, nil
+}
+
+// parseDepLockFile reads a Gopkg.lock file written by dep. Each
+// [[projects]] table names a repository and the revision it's pinned to.
+// Only the subset of TOML dep writes is supported: tables, and keys with
+// string or string list values. Lists may span several lines.
+func parseDepLockFile(path string, data []byte) ([]lockedRepo, error) {
+	var repos []lockedRepo
+	var r *lockedRepo
+	finish := func(lineNum int) error {
+		if r == nil {
+			return nil
+		}
+		if r.importPath == "" || r.commit == "" {
+			return fmt.Errorf("%s:%d: project is missing name or revision", path, lineNum)
+		}
+		repos = append(repos, *r)
+		r = nil
+		return nil
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	inList := false
+	for s.Scan() {
+		lineNum++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if inList {
+			inList = !strings.HasSuffix(line, "]")
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if err := finish(lineNum); err != nil {
+				return nil, err
+			}
+			if line == "[[projects]]" {
+				r = &lockedRepo{}
+			}
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNum)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if strings.HasPrefix(value, "[") {
+			inList = !strings.HasSuffix(value, "]")
+			continue
+		}
+		if !strings.HasPrefix(value, `"`) {
+			continue
+		}
+		str, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid string: %s", path, lineNum, value)
+		}
+		switch key {
+		case "name":
+			r.importPath = str
+		case "revision":
+			r.commit = str
+		case "source":
+			r.source = str
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(lineNum); err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+// parseGlideLockFile reads a glide.lock file written by glide. Each entry
+// in the imports and testImports lists names a repository and the commit
+// it's pinned to in its version field. Only the subset of YAML glide writes
+// is supported: those lists are top-level keys, and their entries are
+// block mappings that start with "- name:".
+func parseGlideLockFile(path string, data []byte) ([]lockedRepo, error) {
+	var repos []lockedRepo
+	var r *lockedRepo
+	inImports := false
+	finish := func(lineNum int) error {
+		if r == nil {
+			return nil
+		}
+		if r.importPath == "" || r.commit == "" {
+			return fmt.Errorf("%s:%d: import is missing name or version", path, lineNum)
+		}
+		repos = append(repos, *r)
+		r = nil
+		return nil
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for s.Scan() {
+		lineNum++
+		line := s.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '-' {
+			// A top-level key ends the previous list.
+			if err := finish(lineNum); err != nil {
+				return nil, err
+			}
+			inImports = trimmed == "imports:" || trimmed == "testImports:"
+			continue
+		}
+		if !inImports {
+			continue
+		}
+		if line[0] == '-' {
+			// A new entry in the imports list.
+			if err := finish(lineNum); err != nil {
+				return nil, err
+			}
+			r = &lockedRepo{}
+			trimmed = strings.TrimSpace(trimmed[1:])
+		} else if strings.HasPrefix(trimmed, "-") {
+			// An entry in a nested list, like subpackages.
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		i := strings.Index(trimmed, ":")
+		if i < 0 {
+			continue
+		}
+		key, value := trimmed[:i], unquoteYAML(strings.TrimSpace(trimmed[i+1:]))
+		switch key {
+		case "name":
+			r.importPath = value
+		case "version":
+			r.commit = value
+		case "repo":
+			r.source = value
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(lineNum); err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+// unquoteYAML removes quotes from a YAML scalar if it has them.
+func unquoteYAML(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		if s[0] == '"' {
+			if u, err := strconv.Unquote(s); err == nil {
+				return u
+			}
+		}
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseGovendorFile reads a vendor/vendor.json file written by govendor.
+// govendor pins packages rather than repositories, so packages are grouped
+// by the root of the repository that provides them. Packages from the same
+// repository must be pinned to the same revision.
+func parseGovendorFile(path string, data []byte) ([]lockedRepo, error) {
+	var file struct {
+		Package []struct {
+			Path, Revision, Origin string
+		}
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var repos []lockedRepo
+	index := make(map[string]int)
+	for _, p := range file.Package {
+		if p.Path == "" || p.Revision == "" {
+			return nil, fmt.Errorf("%s: package %q is missing path or revision", path, p.Path)
+		}
+		root, err := repoRootForImportPath(p.Path, false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if i, ok := index[root.Root]; ok {
+			if repos[i].commit != p.Revision {
+				return nil, fmt.Errorf("%s: packages in %s are pinned to different revisions, %s and %s", path, root.Root, repos[i].commit, p.Revision)
+			}
+			continue
+		}
+		r := lockedRepo{importPath: root.Root, commit: p.Revision}
+		if p.Origin != "" && p.Origin != p.Path {
+			r.source = p.Origin
+		}
+		index[root.Root] = len(repos)
+		repos = append(repos, r)
+	}
+	return repos, nil
+}
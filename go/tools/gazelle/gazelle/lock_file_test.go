@@ -0,0 +1,174 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseLockFiles(t *testing.T) {
+	defer stubRepoLookup()()
+	for _, tc := range []struct {
+		desc, content string
+		parse         lockFileParser
+		want          []lockedRepo
+		wantErr       bool
+	}{
+		{
+			desc:  "dep",
+			parse: parseDepLockFile,
+			content: `# This file is autogenerated, do not edit; changes may be undone by the next 'dep ensure'.
+
+
+[[projects]]
+  name = "github.com/pkg/errors"
+  packages = ["."]
+  revision = "645ef00459ed84a119197bfb8d8205042c6df63d"
+  version = "v0.8.0"
+
+[[projects]]
+  branch = "master"
+  name = "golang.org/x/tools"
+  packages = [
+    "go/vcs"
+  ]
+  revision = "5d2fd3ccab986d52112bf301d47a819783339d0e"
+  source = "https://github.com/golang/tools"
+
+[solve-meta]
+  analyzer-name = "dep"
+  inputs-digest = "abc"
+`,
+			want: []lockedRepo{
+				{importPath: "github.com/pkg/errors", commit: "645ef00459ed84a119197bfb8d8205042c6df63d"},
+				{importPath: "golang.org/x/tools", commit: "5d2fd3ccab986d52112bf301d47a819783339d0e", source: "https://github.com/golang/tools"},
+			},
+		}, {
+			desc:  "dep missing revision",
+			parse: parseDepLockFile,
+			content: `[[projects]]
+  name = "github.com/pkg/errors"
+`,
+			wantErr: true,
+		}, {
+			desc:  "glide",
+			parse: parseGlideLockFile,
+			content: `hash: abc
+updated: 2017-10-30T12:00:00Z
+imports:
+- name: github.com/pkg/errors
+  version: 645ef00459ed84a119197bfb8d8205042c6df63d
+testImports:
+- name: golang.org/x/tools
+  version: "5d2fd3ccab986d52112bf301d47a819783339d0e"
+  repo: https://github.com/golang/tools
+  subpackages:
+  - go/vcs
+`,
+			want: []lockedRepo{
+				{importPath: "github.com/pkg/errors", commit: "645ef00459ed84a119197bfb8d8205042c6df63d"},
+				{importPath: "golang.org/x/tools", commit: "5d2fd3ccab986d52112bf301d47a819783339d0e", source: "https://github.com/golang/tools"},
+			},
+		}, {
+			desc:  "govendor",
+			parse: parseGovendorFile,
+			content: `{
+	"comment": "",
+	"ignore": "test",
+	"package": [
+		{"path": "github.com/pkg/errors", "revision": "645ef00459ed84a119197bfb8d8205042c6df63d"},
+		{"path": "golang.org/x/tools/go/vcs", "revision": "5d2fd3ccab986d52112bf301d47a819783339d0e"},
+		{"path": "golang.org/x/tools/imports", "revision": "5d2fd3ccab986d52112bf301d47a819783339d0e"}
+	],
+	"rootPath": "example.com/repo"
+}`,
+			want: []lockedRepo{
+				{importPath: "github.com/pkg/errors", commit: "645ef00459ed84a119197bfb8d8205042c6df63d"},
+				{importPath: "golang.org/x/tools", commit: "5d2fd3ccab986d52112bf301d47a819783339d0e"},
+			},
+		}, {
+			desc:  "govendor different revisions",
+			parse: parseGovendorFile,
+			content: `{"package": [
+	{"path": "golang.org/x/tools/go/vcs", "revision": "abc"},
+	{"path": "golang.org/x/tools/imports", "revision": "def"}
+]}`,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := tc.parse("lock", []byte(tc.content))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got success; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v; want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUpdateReposFromFile(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "WORKSPACE", content: updateReposWorkspace},
+		{
+			path: "Gopkg.lock",
+			content: `[[projects]]
+  name = "github.com/pkg/errors"
+  packages = ["."]
+  revision = "645ef00459ed84a119197bfb8d8205042c6df63d"
+  version = "v0.8.0"
+`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, []string{"update-repos", "-from_file", "Gopkg.lock"}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "WORKSPACE",
+		content: `git_repository(
+    name = "io_bazel_rules_go",
+    remote = "https://github.com/bazelbuild/rules_go.git",
+    tag = "0.7.0",
+)
+
+load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies", "go_register_toolchains", "go_repository")
+
+go_rules_dependencies()
+
+go_register_toolchains()
+
+go_repository(
+    name = "com_github_pkg_errors",
+    commit = "645ef00459ed84a119197bfb8d8205042c6df63d",
+    importpath = "github.com/pkg/errors",
+)
+`,
+	}})
+}
@@ -25,15 +25,21 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/pprof"
 	"sort"
 	"strings"
+	"time"
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/trace"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/walk"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/wspace"
 )
 
@@ -43,26 +49,52 @@ var modeFromName = map[string]emitFunc{
 	"print": printFile,
 	"fix":   fixFile,
 	"diff":  diffFile,
+	"check": checkFile,
+	"json":  jsonFile,
 }
 
+// Exit codes returned by Gazelle. exitStale matches the code buildifier
+// uses when a file needs to be reformatted in its check mode.
+const (
+	exitError = 1
+	exitStale = 4
+)
+
 type command int
 
 const (
 	updateCmd command = iota
 	fixCmd
+	initCmd
+	updateReposCmd
+	serveCmd
+	preCommitCmd
+	cleanCmd
 )
 
 var commandFromName = map[string]command{
 	"update": updateCmd,
 	"fix":    fixCmd,
+	"init":   initCmd,
+
+	"update-repos": updateReposCmd,
+	"serve":        serveCmd,
+	"pre-commit":   preCommitCmd,
+	"clean":        cleanCmd,
 }
 
-func run(c *config.Config, cmd command, emit emitFunc) {
+// run generates and emits build files for each directory in c.Dirs. It
+// returns the paths of files that were reported as out of date by emit (only
+// checkFile does this). An error is returned if any file could not be
+// emitted; individual errors are logged as they happen.
+func run(c *config.Config, cmd command, emit emitFunc) (changed []string, err error) {
 	v := newVisitor(c, cmd, emit)
+	pl := newPipeline(v, v.resolver().NewPrefetcher(c.RepoLookupJobs))
 	for _, dir := range c.Dirs {
-		packages.Walk(c, dir, v.visit)
+		packages.Walk(c, dir, pl.add)
 	}
-	v.finish()
+	pl.finish()
+	return v.result()
 }
 
 type visitor interface {
@@ -74,6 +106,13 @@ type visitor interface {
 
 	// finish is called once after all directories have been visited.
 	finish()
+
+	// result returns the paths of build files that were out of date and
+	// an error if any file could not be emitted. It is called after finish.
+	result() (changed []string, err error)
+
+	// resolver returns the Resolver used to resolve imports.
+	resolver() *resolve.Resolver
 }
 
 type visitorBase struct {
@@ -82,22 +121,65 @@ type visitorBase struct {
 	l         resolve.Labeler
 	shouldFix bool
 	emit      emitFunc
+
+	// changed is a list of paths to build files that emit reported
+	// as out of date.
+	changed []string
+
+	// emitErr is set if emit failed for any file.
+	emitErr bool
+
+	// graph records dependencies between Go rules in emitted files, so
+	// import cycles can be reported after all directories are visited.
+	graph *importGraph
+
+	// pending holds files that haven't been emitted yet because import
+	// cycles are errors. They're emitted by checkCycles if there are none.
+	pending []*bf.File
+
+	// cycleErr is set if import cycles were found and they're errors.
+	cycleErr bool
 }
 
 func newVisitor(c *config.Config, cmd command, emit emitFunc) visitor {
 	l := resolve.NewLabeler(c)
+	if cmd == cleanCmd {
+		// Only the kinds and names of generated rules matter, so imports are
+		// resolved without looking anything up.
+		offline := *c
+		offline.Offline = true
+		offline.OfflineHeuristic = true
+		return newVisitorWithResolver(c, cmd, emit, l, resolve.NewResolver(&offline, l))
+	}
 	r := resolve.NewResolver(c, l)
+	r.SetProtoIndex(packages.IndexProtos(c))
+	r.SetSecondaryIndex(packages.IndexSecondaryPackages(c))
+	if c.BazelQuery {
+		r.SetGoIndex(resolve.QueryGoIndex(c))
+	}
+	return newVisitorWithResolver(c, cmd, emit, l, r)
+}
+
+// newVisitorWithResolver is like newVisitor, but it uses l and r instead of
+// creating a new labeler and resolver, so the indexes and caches they hold
+// can be reused across runs. The serve command does this.
+func newVisitorWithResolver(c *config.Config, cmd command, emit emitFunc, l resolve.Labeler, r *resolve.Resolver) visitor {
 	base := visitorBase{
 		c:         c,
 		r:         r,
 		l:         l,
 		shouldFix: cmd == fixCmd,
 		emit:      emit,
+		graph:     newImportGraph(),
+	}
+	if cmd == cleanCmd {
+		base.graph = nil
+		return &cleanVisitor{visitorBase: base}
 	}
 	if c.StructureMode == config.HierarchicalMode {
 		v := &hierarchicalVisitor{visitorBase: base}
 		for _, dir := range c.Dirs {
-			if c.RepoRoot == dir {
+			if c.RepoRoot == dir && (c.ChangedDirs == nil || c.ChangedDirs[""]) {
 				v.shouldProcessRoot = true
 				break
 			}
@@ -105,79 +187,173 @@ func newVisitor(c *config.Config, cmd command, emit emitFunc) visitor {
 		return v
 	}
 
-	return &flatVisitor{
+	v := &flatVisitor{
 		visitorBase: base,
 		rules:       make(map[string][]bf.Expr),
+		depSources:  make(rules.DepSources),
 	}
+	for _, dir := range c.Dirs {
+		if c.RepoRoot == dir {
+			v.walksRoot = true
+			break
+		}
+	}
+	return v
 }
 
 // hierarchicalVisitor generates and updates one build file per directory.
+// Each build file is merged and emitted as soon as its directory is visited,
+// and nothing from the directory is kept afterward, so memory use doesn't
+// grow with the size of the repository.
 type hierarchicalVisitor struct {
 	visitorBase
 	shouldProcessRoot, didProcessRoot bool
+
+	// goPathLibs holds the libraries that go_path rules may depend on. It's
+	// only added to in directories where a "# gazelle:go_path" directive
+	// applies.
+	goPathLibs goPathLibraries
 }
 
 func (v *hierarchicalVisitor) visit(c *config.Config, pkg *packages.Package, oldFile *bf.File) {
+	if pkg.Rel == "" {
+		v.didProcessRoot = true
+	}
+	endResolve := trace.Start(trace.Resolve, pkg.Dir)
 	g := rules.NewGenerator(c, v.r, v.l, pkg.Rel, oldFile)
 	rules, empty := g.GenerateRules(pkg)
-	genFile := &bf.File{
-		Path: filepath.Join(pkg.Dir, c.DefaultBuildFileName()),
-		Stmt: rules,
+	if c.GoPathName != "" {
+		v.goPathLibs.add(pkg.Rel, rules)
+		// When only changed directories are visited, libraries elsewhere
+		// are missing, so an existing go_path rule is left alone.
+		if c.GoPathRel == pkg.Rel && c.ChangedDirs == nil {
+			rules = append(rules, g.GeneratePath(c.GoPathName, v.goPathLibs.under(pkg.Rel)))
+		}
+	}
+	endResolve()
+	genFile := &bf.File{Stmt: rules}
+	if oldFile != nil {
+		genFile.Path = oldFile.Path
+	} else if pkg.BrokenBuildFile != "" {
+		genFile.Path = pkg.BrokenBuildFile + config.NewFileSuffix
+	} else {
+		genFile.Path = filepath.Join(pkg.Dir, walk.NewBuildFileName(c, pkg.Dir))
 	}
-	v.mergeAndEmit(genFile, oldFile, empty)
+	v.mergeAndEmit(c, genFile, oldFile, empty, g.DepSources())
 }
 
 func (v *hierarchicalVisitor) finish() {
+	defer v.checkCycles()
 	if !v.shouldProcessRoot || v.didProcessRoot {
 		return
 	}
 
 	// We did not process a package at the repository root. We need to create
 	// a build file if none exists.
-	for _, base := range v.c.ValidBuildFileNames {
-		p := filepath.Join(v.c.RepoRoot, base)
-		if _, err := os.Stat(p); err == nil || !os.IsNotExist(err) {
-			return
-		}
-	}
-	p := filepath.Join(v.c.RepoRoot, v.c.DefaultBuildFileName())
-	if f, err := os.Create(p); err != nil {
-		log.Print(err)
-	} else {
-		f.Close()
+	if _, err := walk.FindBuildFile(v.c, v.c.RepoRoot); !os.IsNotExist(err) {
+		return
 	}
+	p := filepath.Join(v.c.RepoRoot, walk.NewBuildFileName(v.c, v.c.RepoRoot))
+	v.emitFile(merger.AddHeader(&bf.File{Path: p}, v.c.BuildFileHeader))
 }
 
 // flatVisitor generates and updates a single build file that contains rules
-// for everything in the repository.
+// for everything in the repository. Generated rules are held until the file
+// is emitted in finish; existing build files in subdirectories are not kept.
 type flatVisitor struct {
 	visitorBase
 	rules       map[string][]bf.Expr
 	empty       []bf.Expr
+	depSources  rules.DepSources
 	oldRootFile *bf.File
+
+	// loadedRoot is set once oldRootFile has been loaded or found to be
+	// missing.
+	loadedRoot bool
+
+	// rootBroken is the path to the root build file if it exists but
+	// couldn't be read or parsed. It's never overwritten.
+	rootBroken string
+
+	// walksRoot is set if the repository root is one of the directories
+	// walked. Walk reports errors in the root build file in that case.
+	walksRoot bool
 }
 
 func (v *flatVisitor) visit(c *config.Config, pkg *packages.Package, oldFile *bf.File) {
 	if pkg.Rel == "" {
 		v.oldRootFile = oldFile
+		v.loadedRoot = true
+		if pkg.BrokenBuildFile != "" {
+			v.rootBroken = pkg.BrokenBuildFile
+		}
+	} else if oldFile != nil {
+		// Bazel treats the directory as a separate package, so the rules for
+		// it in the root build file can't refer to its files.
+		logging.WarningfAt(oldFile.Path, 0, "build files in subdirectories aren't updated with -experimental_flat, and rules in the root build file can't use sources in %s while it's here; move its rules to the root build file and delete it", pkg.Rel)
 	}
-	g := rules.NewGenerator(c, v.r, v.l, "", oldFile)
+	endResolve := trace.Start(trace.Resolve, pkg.Dir)
+	// All rules are written to the root build file, so its package rule
+	// determines whether they need visibility attributes.
+	g := rules.NewGenerator(c, v.r, v.l, "", v.rootFile())
 	rules, empty := g.GenerateRules(pkg)
+	endResolve()
 	v.rules[pkg.Rel] = rules
 	v.empty = append(v.empty, empty...)
+	// Dependency sources are only used to explain changes in verbose mode.
+	// Don't hold them for the whole repository otherwise.
+	if logging.Enabled(logging.InfoLevel) {
+		for name, sources := range g.DepSources() {
+			v.depSources[name] = sources
+		}
+	}
 }
 
-func (v *flatVisitor) finish() {
-	if v.oldRootFile == nil {
-		var err error
-		v.oldRootFile, err = loadBuildFile(v.c, v.c.RepoRoot)
-		if err != nil && !os.IsNotExist(err) {
-			log.Print(err)
+// rootFile returns the existing build file at the repository root, loading
+// it the first time it's needed. nil is returned if there is none.
+func (v *flatVisitor) rootFile() *bf.File {
+	if v.loadedRoot {
+		return v.oldRootFile
+	}
+	v.loadedRoot = true
+	p, err := walk.FindBuildFile(v.c, v.c.RepoRoot)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Error(err)
+		}
+		return nil
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		v.rootBroken = p
+		if !v.walksRoot {
+			logging.Error(err)
+		}
+		return nil
+	}
+	if v.oldRootFile, err = bf.Parse(p, data); err != nil {
+		v.oldRootFile = nil
+		v.rootBroken = p
+		if !v.walksRoot {
+			walk.LogParseError(p, err)
 		}
 	}
+	return v.oldRootFile
+}
+
+func (v *flatVisitor) finish() {
+	v.rootFile()
 
-	genFile := &bf.File{
-		Path: filepath.Join(v.c.RepoRoot, v.c.DefaultBuildFileName()),
+	genFile := &bf.File{}
+	if v.oldRootFile != nil {
+		genFile.Path = v.oldRootFile.Path
+	} else if v.rootBroken != "" {
+		if !v.c.NewOnParseError {
+			return
+		}
+		genFile.Path = v.rootBroken + config.NewFileSuffix
+	} else {
+		genFile.Path = filepath.Join(v.c.RepoRoot, walk.NewBuildFileName(v.c, v.c.RepoRoot))
 	}
 
 	packageNames := make([]string, 0, len(v.rules))
@@ -190,50 +366,239 @@ func (v *flatVisitor) finish() {
 		rs := v.rules[name]
 		genFile.Stmt = append(genFile.Stmt, rs...)
 	}
+	v.rules = nil
 
-	v.mergeAndEmit(genFile, v.oldRootFile, v.empty)
+	v.mergeAndEmit(v.c, genFile, v.oldRootFile, v.empty, v.depSources)
+	v.checkCycles()
 }
 
 // mergeAndEmit merges "genFile" with "oldFile". "oldFile" may be nil if
 // no file exists. If v.shouldFix is true, deprecated usage of old rules in
-// "oldFile" will be fixed. The resulting merged file will be emitted using
-// the "v.emit" function.
-func (v *visitorBase) mergeAndEmit(genFile, oldFile *bf.File, empty []bf.Expr) {
+// "oldFile" will be fixed. Attributes are merged according to the policies
+// in "c", the configuration for the directory. The resulting merged file will
+// be emitted using the "v.emit" function. In verbose mode, changes to rules
+// are reported, using "sources" to explain new dependencies.
+func (v *visitorBase) mergeAndEmit(c *config.Config, genFile, oldFile *bf.File, empty []bf.Expr, sources rules.DepSources) {
+	endMerge := trace.Start(trace.Merge, genFile.Path)
+	defer endMerge()
+
+	if c.UpdateDepsOnly {
+		v.updateDepsAndEmit(c, genFile, oldFile, empty, sources)
+		return
+	}
+
 	if oldFile == nil {
 		// No existing file, so no merge required.
 		rules.SortLabels(genFile)
-		genFile = merger.FixLoads(genFile)
+		rules.SortAttrs(genFile)
+		genFile = merger.FixPackageVisibility(genFile, c.DefaultVisibility)
+		if len(genFile.Stmt) == 0 && c.EmptyBuildFiles == config.EmptyBuildFilesPackage {
+			genFile.Stmt = []bf.Expr{&bf.CallExpr{X: &bf.LiteralExpr{Token: "package"}}}
+		}
+		genFile = merger.FixLoads(genFile, c.Loads)
+		genFile = merger.AddHeader(genFile, c.BuildFileHeader)
 		bf.Rewrite(genFile, nil) // have buildifier 'format' our rules.
-		if err := v.emit(v.c, genFile); err != nil {
-			log.Print(err)
+		if trace.Enabled() {
+			countChanges(nil, genFile)
+		}
+		if logging.Enabled(logging.InfoLevel) {
+			reportChanges(c, nil, genFile, empty, sources)
 		}
+		v.emitFile(genFile)
 		return
 	}
+	origFile := oldFile
 
 	// Existing file. Fix it or see if it needs fixing before merging.
 	if v.shouldFix {
-		oldFile = merger.FixFile(oldFile)
+		var renames []merger.LabelRename
+		oldFile, renames = v.fixFile(oldFile)
+		for _, r := range renames {
+			// Labels in other repositories can't be fixed here.
+			logging.Warningf("renamed %s to %s", r.Old, r.New)
+		}
 	} else {
-		fixedFile := merger.FixFile(oldFile)
+		fixedFile, _ := v.fixFile(oldFile)
 		if fixedFile != oldFile {
-			log.Printf("%s: warning: file contains rules whose structure is out of date. Consider running 'gazelle fix'.", oldFile.Path)
+			logging.WarningfAt(oldFile.Path, 0, "file contains rules whose structure is out of date. Consider running 'gazelle fix'.")
 		}
 	}
 
 	// Existing file, so merge and replace the old one.
-	mergedFile := merger.MergeWithExisting(genFile, oldFile, empty)
+	mergedFile := merger.MergeWithKindAliases(genFile, oldFile, empty, c.AttrPolicies, c.KindAliases)
 	if mergedFile == nil {
 		// Ignored file. Don't emit.
 		return
 	}
 
 	rules.SortLabels(mergedFile)
-	mergedFile = merger.FixLoads(mergedFile)
+	rules.SortAttrs(mergedFile)
+	mergedFile = merger.FixPackageVisibility(mergedFile, c.DefaultVisibility)
+	mergedFile = merger.FixLoads(mergedFile, c.Loads)
 	bf.Rewrite(mergedFile, nil) // have buildifier 'format' our rules.
-	if err := v.emit(v.c, mergedFile); err != nil {
-		log.Print(err)
+	if trace.Enabled() {
+		countChanges(origFile, mergedFile)
+	}
+	if logging.Enabled(logging.InfoLevel) {
+		reportChanges(c, origFile, mergedFile, empty, sources)
+	}
+	v.emitFile(mergedFile)
+}
+
+// updateDepsAndEmit merges the deps attributes of rules in genFile into the
+// matching rules in oldFile and emits the result, for -update=deps. Nothing
+// else in oldFile is fixed or merged, and no file is created if oldFile is
+// nil.
+func (v *visitorBase) updateDepsAndEmit(c *config.Config, genFile, oldFile *bf.File, empty []bf.Expr, sources rules.DepSources) {
+	if oldFile == nil {
+		return
+	}
+	rules.SortLabels(genFile)
+	updatedFile := merger.UpdateDeps(genFile, oldFile, c.AttrPolicies, c.KindAliases)
+	if updatedFile == nil {
+		// Ignored file. Don't emit.
 		return
 	}
+	bf.Rewrite(updatedFile, nil)
+	if trace.Enabled() {
+		countChanges(oldFile, updatedFile)
+	}
+	if logging.Enabled(logging.InfoLevel) {
+		reportChanges(c, oldFile, updatedFile, empty, sources)
+	}
+	v.emitFile(updatedFile)
+}
+
+// fixFile applies merger.FixFile to oldFile. Files in vendor directories are
+// also cleaned with merger.FixVendorFile. With -library_naming=dirname,
+// libraries are renamed with merger.FixLibraryNames, and the renamed
+// libraries are returned. Aliases for them are added or removed according
+// to -library_aliases. Labels in dependencies are rewritten in the style
+// selected by -short_labels with merger.FixLabels.
+func (v *visitorBase) fixFile(oldFile *bf.File) (*bf.File, []merger.LabelRename) {
+	fixedFile := merger.FixFile(oldFile)
+	if isVendored(v.c, oldFile.Path) {
+		fixedFile = merger.FixVendorFile(fixedFile)
+	}
+	var renames []merger.LabelRename
+	if rel, ok := v.c.RelPath(filepath.Dir(oldFile.Path)); ok {
+		if v.c.LibraryNaming == config.DirNameLibraryNaming && v.c.StructureMode == config.HierarchicalMode {
+			fixedFile, renames = merger.FixLibraryNames(fixedFile, rel, func(rel string) string {
+				return v.l.LibraryLabel(rel).Name
+			})
+			switch v.c.LibraryAliases {
+			case "add":
+				for _, r := range renames {
+					if l, err := resolve.ParseLabel(r.New); err == nil {
+						fixedFile = merger.AddLibraryAlias(fixedFile, l.Name)
+					}
+				}
+			case "remove":
+				fixedFile = merger.RemoveLibraryAliases(fixedFile)
+			}
+		}
+		fixedFile = merger.FixLabels(fixedFile, rel, v.c.ShortLabels)
+	}
+	return fixedFile, renames
+}
+
+// isVendored returns whether path is inside a vendor directory within the
+// repository.
+func isVendored(c *config.Config, path string) bool {
+	rel, ok := c.RelPath(filepath.Dir(path))
+	if !ok {
+		return false
+	}
+	for _, component := range strings.Split(rel, "/") {
+		if component == "vendor" {
+			return true
+		}
+	}
+	return false
+}
+
+// emitFile records the dependencies of rules in f in the import graph and
+// emits f. With -import_cycles=error, f is held until checkCycles instead.
+// Without an import graph, as in init and update-repos, f is emitted
+// right away.
+func (v *visitorBase) emitFile(f *bf.File) {
+	if v.graph == nil {
+		v.writeFile(f)
+		return
+	}
+	if rel, ok := v.c.RelPath(filepath.Dir(f.Path)); ok {
+		v.graph.addFile(f, rel)
+	}
+	if v.c.ImportCycleErrors {
+		v.pending = append(v.pending, f)
+		return
+	}
+	v.writeFile(f)
+}
+
+// checkCycles reports import cycles between rules in the emitted files.
+// Cycles are warnings unless -import_cycles=error is set. In that case, they
+// are errors, and held files are only emitted if there are no cycles. It's
+// called at the end of finish.
+func (v *visitorBase) checkCycles() {
+	cycles := v.graph.cycles()
+	for _, c := range cycles {
+		msg := fmt.Sprintf("import cycle: %s", strings.Join(c, " -> "))
+		if v.c.ImportCycleErrors {
+			logging.Errorf("%s", msg)
+		} else {
+			logging.Warningf("warning: %s", msg)
+		}
+	}
+	pending := v.pending
+	v.pending = nil
+	if v.c.ImportCycleErrors && len(cycles) > 0 {
+		v.cycleErr = true
+		return
+	}
+	for _, f := range pending {
+		v.writeFile(f)
+	}
+}
+
+// writeFile emits f using v.emit. If emit reports the file is out of date,
+// its path is recorded. Other errors are logged.
+func (v *visitorBase) writeFile(f *bf.File) {
+	endWrite := trace.Start(trace.Write, f.Path)
+	defer endWrite()
+
+	switch err := v.emit(v.c, f); err {
+	case nil:
+	case errFileChanged:
+		v.changed = append(v.changed, f.Path)
+	default:
+		logging.Error(err)
+		v.emitErr = true
+	}
+}
+
+func (v *visitorBase) resolver() *resolve.Resolver {
+	return v.r
+}
+
+func (v *visitorBase) result() ([]string, error) {
+	if v.emitErr {
+		return v.changed, errors.New("errors occurred while emitting build files")
+	}
+	if v.cycleErr {
+		return v.changed, errors.New("import cycles found; build files were not written")
+	}
+	if v.r != nil {
+		if imps := v.r.OfflineUnresolved(); len(imps) > 0 {
+			var directives []string
+			for _, imp := range imps {
+				directives = append(directives, fmt.Sprintf("# gazelle:resolve go %s @repo//path:target", imp))
+			}
+			logging.Errorf("%d imports could not be resolved without network access. Add -known_import flags or directives like these to the root build file:\n%s", len(imps), strings.Join(directives, "\n"))
+			return v.changed, errors.New("imports could not be resolved offline")
+		}
+	}
+	return v.changed, nil
 }
 
 func usage(fs *flag.FlagSet) {
@@ -252,19 +617,64 @@ Gazelle defaults to "update".
       if needed.
 	fix - in addition to the changes made in update, Gazelle will make potentially
 	    breaking changes. For example, it may delete obsolete rules or rename
-      existing rules.
+      existing rules. In vendor directories, it also removes rules and loads
+      from build files written for upstream repositories.
+  init - bootstraps a new workspace. Gazelle creates a WORKSPACE file with
+      rules_go boilerplate if there isn't one, and adds a gazelle rule with
+      the Go prefix to the root build file. Run the gazelle rule afterward
+      to generate build files.
+  update-repos - adds or updates go_repository rules in WORKSPACE for the
+      repositories providing the import paths given as arguments. Each rule
+      is pinned to the latest commit. With -to_macro=file.bzl%macro, new rules
+      are written to a macro in a .bzl file, which WORKSPACE loads and calls.
+      With -from_file=Gopkg.lock, rules are added for the repositories pinned
+      in a lock file instead. With -http_archive, rules download archives
+      checked with a sha256 instead of cloning repositories. With -prune,
+      rules for repositories that are no longer imported by this repository
+      are deleted, including repositories only other repositories need.
+  pre-commit - for use in git pre-commit hooks. Reads the paths of staged
+      files from stdin, one per line, like the output of
+      "git diff --cached --name-only". Build files for directories containing
+      those files (and directories depending on them) are updated and staged.
+      Exits with code 4 if any build file was changed, so the commit can be
+      reviewed and made again.
+  clean - removes the rules Gazelle generates (go_library, go_test, and so on,
+      matched by kind and the names Gazelle gives them) from existing build
+      files, along with loads that are no longer needed. Rules marked with
+      "# keep" and other rules are left alone. This is useful before
+      restructuring a repository or switching to hand-written build files.
+  serve - runs a server that answers requests from IDEs and other tools over
+      HTTP with JSON responses: generating rules for a directory, resolving an
+      import path to a label, and describing a rule in a build file. Indexes
+      and caches are kept in memory between requests. The server listens on
+      the address given with -listen.
 
 Gazelle has several output modes which can be selected with the -mode flag. The
 output mode determines what Gazelle does with updated BUILD files.
 
   fix (default) - write updated BUILD files back to disk.
-  print - print updated BUILD files to stdout.
+  print - print updated BUILD files to stdout. Each file is preceded by a
+      "# path/to/BUILD.bazel" header line.
   diff - diff updated BUILD files against existing files in unified format.
+  check - don't write anything. List BUILD files that would be changed and
+      exit with code 4 if there are any. Exit code 1 indicates an error.
+  json - don't write anything. Print a JSON object for each BUILD file
+      describing the Go rules it would contain, for use by IDEs and other tools.
 
 Gazelle accepts a list of paths to Go package directories to process (defaults
 to . if none given). It recursively traverses subdirectories. All directories
 must be under the directory specified by -repo_root; if -repo_root is not given,
-this is the directory containing the WORKSPACE file.
+this is the directory containing the WORKSPACE file. Relative directories that
+aren't under -repo_root from the working directory are interpreted relative to
+-repo_root, so Gazelle may be run from anywhere. -repo_root may be repeated to
+process several repositories at once; each directory is processed in the
+repository that contains it, and repositories are processed entirely if no
+directories are given.
+
+The environment variables GAZELLE_MODE, GAZELLE_PREFIX, and GAZELLE_REPO_ROOT
+set defaults for -mode, -go_prefix, and -repo_root. Settings in a gazelle.json
+file at the repository root take precedence over environment variables, and
+flags take precedence over both.
 
 Gazelle is under active delevopment, and its interface may change
 without notice.
@@ -278,15 +688,230 @@ func main() {
 	log.SetPrefix("gazelle: ")
 	log.SetFlags(0) // don't print timestamps
 
-	c, cmd, emit, err := newConfiguration(os.Args[1:])
+	cs, cmd, emit, opts, err := newConfigurations(os.Args[1:])
+	if errs, ok := err.(config.ValidationErrors); ok {
+		printValidationErrors(os.Stderr, errs)
+		os.Exit(exitError)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	if opts.verbose {
+		logging.SetLevel(logging.InfoLevel)
+	}
+	if cmd != serveCmd {
+		// The server answers requests as they come; there's no end of the run
+		// to report at.
+		logging.Collect()
+	}
+	stopProfiling, err := startProfiling(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
+	results := runRoots(cs, cmd, emit, opts)
+	if err := stopProfiling(); err != nil {
+		logging.Error(err)
+	}
+	if err := writeDiagnostics(os.Stderr, logging.Diagnostics(), opts.errorFormat); err != nil {
+		log.Print(err)
+	}
+
+	exitCode := 0
+	for _, res := range results {
+		if res.err != nil {
+			// Errors have already been logged.
+			exitCode = exitError
+			continue
+		}
+		if len(res.changed) > 0 && cmd == preCommitCmd {
+			log.Print("build files were out of date for the staged changes. These files were updated and\nstaged; review them and commit again:")
+			for _, p := range res.changed {
+				fmt.Println(printPath(res.c, p))
+			}
+			if exitCode == 0 {
+				exitCode = exitStale
+			}
+			continue
+		}
+		if len(res.changed) > 0 {
+			if len(results) > 1 {
+				log.Printf("the following build files in %s are out of date:", res.c.RepoRoot)
+			} else {
+				log.Print("the following build files are out of date:")
+			}
+			for _, p := range res.changed {
+				fmt.Println(printPath(res.c, p))
+			}
+			if exitCode == 0 {
+				exitCode = exitStale
+			}
+		}
+	}
+	os.Exit(exitCode)
+}
+
+// runOptions holds settings that apply to the Gazelle process as a whole
+// rather than to a repository root.
+type runOptions struct {
+	// cpuProfile and memProfile are paths where CPU and heap profiles should
+	// be written. They are empty if profiles were not requested.
+	cpuProfile, memProfile string
+
+	// traceFile is a path where a line should be written each time Gazelle
+	// finishes a stage of work in a directory or file. See package trace.
+	traceFile string
+
+	// verbose determines whether changes to each build file are explained
+	// and whether a table of time spent in each stage is printed at exit.
+	verbose bool
+
+	// stats determines whether a summary of the run, with counts of
+	// directories, packages, and rules changed and the time spent in each
+	// stage, is printed at exit. The summary is printed to stderr, or to
+	// stdout as a JSON object if statsJSON is set.
+	stats, statsJSON bool
+
+	// repos holds the arguments of the update-repos command.
+	repos updateReposOptions
+
+	// listen is the address the serve command's server listens on.
+	listen string
+
+	// errorFormat is how errors and warnings collected during the run are
+	// printed at exit: "text" or "json".
+	errorFormat string
+}
+
+// startProfiling starts the CPU profile, stage tracing, and timing requested
+// in opts. The returned function stops them, writes the heap profile, and
+// prints the timing summary.
+func startProfiling(opts runOptions) (stop func() error, err error) {
+	var cpuFile, traceFile *os.File
+	stop = func() error {
+		var errs []string
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			if err := cpuFile.Close(); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if traceFile != nil {
+			if err := traceFile.Close(); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if opts.traceFile != "" || opts.verbose || opts.stats {
+			trace.Disable()
+		}
+		if opts.memProfile != "" {
+			if err := writeMemProfile(opts.memProfile); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if opts.verbose || opts.stats && !opts.statsJSON {
+			if err := trace.WriteCounts(os.Stderr); err != nil {
+				errs = append(errs, err.Error())
+			}
+			if err := trace.WriteSummary(os.Stderr); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if opts.stats && opts.statsJSON {
+			if err := writeStatsJSON(os.Stdout, trace.Summary()); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if len(errs) > 0 {
+			return errors.New(strings.Join(errs, "; "))
+		}
+		return nil
+	}
+
+	if opts.cpuProfile != "" {
+		cpuFile, err = os.Create(opts.cpuProfile)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			return nil, err
+		}
+	}
+	if opts.traceFile != "" {
+		traceFile, err = os.Create(opts.traceFile)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		trace.Enable(traceFile)
+	} else if opts.verbose || opts.stats {
+		trace.Enable(nil)
+	}
+	return stop, nil
+}
 
-	run(c, cmd, emit)
+func writeMemProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	runtime.GC() // get up-to-date statistics
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-func newConfiguration(args []string) (*config.Config, command, emitFunc, error) {
+// rootResult is the outcome of running Gazelle in one repository root.
+type rootResult struct {
+	c       *config.Config
+	changed []string
+	err     error
+}
+
+// runRoots runs Gazelle in each repository root configured in cs and
+// returns a result for each root, in the same order. An error in one root
+// does not prevent Gazelle from running in the others.
+func runRoots(cs []*config.Config, cmd command, emit emitFunc, opts runOptions) []rootResult {
+	results := make([]rootResult, len(cs))
+	for i, c := range cs {
+		var changed []string
+		var err error
+		switch cmd {
+		case initCmd:
+			changed, err = initWorkspace(c, emit)
+			if err != nil {
+				logging.Error(err)
+			}
+		case updateReposCmd:
+			changed, err = updateRepos(c, opts.repos, emit)
+			if err != nil {
+				logging.Error(err)
+			}
+		case preCommitCmd:
+			changed, err = run(c, cmd, emit)
+			if err == nil && len(changed) > 0 {
+				if err = gitAdd(c.RepoRoot, changed); err != nil {
+					logging.Error(err)
+				}
+			}
+		case serveCmd:
+			if err = serve(c, opts.listen); err != nil {
+				logging.Error(err)
+			}
+		default:
+			changed, err = run(c, cmd, emit)
+		}
+		results[i] = rootResult{c: c, changed: changed, err: err}
+	}
+	return results
+}
+
+// newConfigurations parses command line arguments and returns a
+// configuration for each repository root Gazelle should process, along with
+// the command and emit function to use for all of them.
+func newConfigurations(args []string) ([]*config.Config, command, emitFunc, runOptions, error) {
 	cmd := updateCmd
 	if len(args) > 0 {
 		if c, ok := commandFromName[args[0]]; ok {
@@ -302,12 +927,58 @@ func newConfiguration(args []string) (*config.Config, command, emitFunc, error)
 
 	knownImports := multiFlag{}
 	buildFileName := fs.String("build_file_name", "BUILD.bazel,BUILD", "comma-separated list of valid build file names.\nThe first element of the list is the name of output build files to generate.")
+	buildFileHeader := fs.String("build_file_header", "", "path to a file written at the top of new build files, like a license block or\n\tbuildifier directives. It may only contain comments. Existing files are not changed.")
 	buildTags := fs.String("build_tags", "", "comma-separated list of build tags. If not specified, Gazelle will not\n\tfilter sources with build constraints.")
-	external := fs.String("external", "external", "external: resolve external packages with go_repository\n\tvendored: resolve external packages as packages in vendor/")
-	goPrefix := fs.String("go_prefix", "", "go_prefix of the target workspace")
-	repoRoot := fs.String("repo_root", "", "path to a directory which corresponds to go_prefix, otherwise gazelle searches for it.")
+	external := fs.String("external", "external", "external: resolve external packages with go_repository\n\tvendored: resolve external packages as packages in vendor/\n\thybrid: resolve external packages in vendor/ if present, otherwise with go_repository")
+	proto := fs.String("proto", "legacy", "legacy: don't generate proto rules; compile checked-in .pb.go files and generate\n\ta filegroup of .proto files in directories with .pb.go files\n\tdefault: generate proto_library and go_proto_library rules for .proto files,\n\tand leave .pb.go files generated from them out of go_library rules\n\tpackage: like default, but generate rules for each proto package instead of each directory\n\tdisable_global: don't generate proto rules anywhere; compile checked-in .pb.go files instead\n\tdisable, legacy_filegroup: see the gazelle:proto directive")
+	generate := fs.String("generate", "", "comma-separated list of rule kinds to generate, like go_library,go_test.\n\tOther kinds are neither created nor deleted. By default, all kinds are generated.")
+	goPrefix := fs.String("go_prefix", "", "go_prefix of the target workspace. If not set, Gazelle infers it from\n\tthe root BUILD file, import comments in root .go files, or go.mod.")
+	repoRoots := multiFlag{}
+	fs.Var(&repoRoots, "repo_root", "path to a directory which corresponds to go_prefix, otherwise gazelle searches for it.\n\tMay be repeated to process several repositories in one run.")
+	knownHostFlags := multiFlag{}
+	fs.Var(&knownHostFlags, "known_host", "import path prefix and number of path components that name a repository under it,\n\tlike k8s.io=1, for which external resolution is skipped (can specify multiple times)")
 	fs.Var(&knownImports, "known_import", "import path for which external resolution is skipped (can specify multiple times)")
-	mode := fs.String("mode", "fix", "print: prints all of the updated BUILD files\n\tfix: rewrites all of the BUILD files in place\n\tdiff: computes the rewrite but then just does a diff")
+	resolveWKT := fs.Bool("resolve_wkt", true, "whether imports of well-known protobuf type packages are resolved to\n\t@io_bazel_rules_go//proto/wkt targets")
+	testdata := fs.Bool("testdata", true, "whether go_test rules for packages with a testdata directory get a data\n\tattribute with a glob of that directory")
+	shortLabels := fs.Bool("short_labels", true, "whether labels are shortened to :target for targets in the same package and\n\t//pkg for //pkg:pkg. When false, labels are written in full.")
+	internalVisibility := fs.Bool("internal_visibility", true, "whether libraries and binaries in internal directories are only visible to\n\tthe tree rooted at the internal directory's parent, as in Go")
+	libraryNaming := fs.String("library_naming", config.DefaultLibraryNaming, "how go_library rules are named:\n\tgo_default_library: go_default_library in every directory\n\tdirname: after the directory containing the package, with a _lib suffix for commands.\n\tThe fix command renames existing libraries and rewrites labels of them in the repository.")
+	libraryAliases := fs.String("library_aliases", "", "fix: with -library_naming=dirname, what to do with go_default_library aliases for renamed libraries:\n\tadd: add an alias for each library that is renamed, so labels outside the repository keep working\n\tremove: remove the aliases once they're no longer needed.\n\tBy default, existing aliases are left alone.")
+	binaryNaming := fs.String("binary_naming", config.DirNameBinaryNaming, "how go_binary rules are named:\n\tdirname: after the directory containing the package\n\timportpath: after the last element of the import path, skipping major version suffixes\n\tor a template like {dirname}_bin, where {dirname} and {importpath} are replaced")
+	externalNaming := fs.String("external_naming", resolve.GoDefaultNaming, "how external repositories are named after the import paths of their roots:\n\tgo_default: in reverse-DNS form, like org_golang_x_tools\n\timport_alias: with separators replaced by underscores, like golang_org_x_tools")
+	repoCache := fs.String("repo_cache", "", "file where repository roots found by looking up import paths over the network are\n\tcached across runs. By default, results are only cached for one run.")
+	repoCacheTTL := fs.Duration("repo_cache_ttl", 24*time.Hour, "how long entries in the -repo_cache file are used before they're looked up again")
+	repoRootsFile := fs.String("repo_roots_file", "gazelle-repos.json", "file checked into the repository that records the roots of import paths looked up over the\n\tnetwork, so everyone resolves them the same way. Relative paths are relative to the\n\trepository root. New roots are only recorded if the file exists.")
+	repoLookupInterval := fs.Duration("repo_lookup_interval", 100*time.Millisecond, "minimum time between network lookups of import paths on the same host")
+	repoLookupRetries := fs.Int("repo_lookup_retries", 1, "number of times a failed network lookup of an import path is retried, with exponential\n\tbackoff starting at one second, before the failure is reported")
+	repoLookupJobs := fs.Int("repo_lookup_jobs", 8, "maximum number of network lookups of import paths in flight at once. Lookups start\n\twhile directories are scanned, before rules are generated for them. 0 looks import paths up\n\tone at a time as rules are generated")
+	offline := fs.Bool("offline", false, "whether looking up import paths over the network is forbidden. Imports provided by unknown\n\trepositories are reported as errors unless -offline_heuristic is set.")
+	offlineHeuristic := fs.Bool("offline_heuristic", false, "with -offline, whether repositories providing unknown imports are assumed to be\n\trooted at the first three components of the import paths, like example.com/user/repo")
+	bazelQuery := fs.Bool("bazel_query", false, "whether Go imports are resolved with an index of go_library and go_proto_library rules\n\tbuilt with \"bazel query\", which finds rules declared by macros. Bazel is run in the repository root.")
+	bazelQueryFile := fs.String("bazel_query_file", "", "file with saved output of \"bazel query --output=xml\" to build the -bazel_query index from\n\tinstead of running bazel. Implies -bazel_query.")
+	emptyBuildFiles := fs.String("empty_build_files", "", "whether build files are created in directories without Go packages that have packages\n\tin subdirectories:\n\tempty: create empty build files\n\tpackage: create build files containing only package()")
+	gitignore := fs.Bool("gitignore", false, "whether files and directories matched by .gitignore files are skipped.\n\tDirectories listed in .bazelignore are always skipped.")
+	followSymlinks := fs.Bool("follow_symlinks", false, "whether symbolic links to directories outside the repository are followed.\n\tLinks to directories inside the repository and links that form cycles are never followed.")
+	update := fs.String("update", "all", "which parts of existing build files are updated:\n\tall: rules are created, updated, and deleted as needed\n\tdeps: only the deps attributes of existing rules are updated; srcs and everything else are left alone")
+	newOnParseError := fs.Bool("new_on_parse_error", false, "whether rules for directories with existing build files that can't be parsed are\n\twritten to a new file named like BUILD.bazel"+config.NewFileSuffix+" so they can be merged by hand.\n\tThese directories are skipped either way")
+	importCycles := fs.String("import_cycles", "warn", "how import cycles between rules in the repository, which Bazel rejects, are reported:\n\twarn: print a warning for each cycle\n\terror: print an error for each cycle, and don't write build files if there are any")
+	allowRelativeImports := fs.Bool("allow_relative_imports", false, "whether relative imports like \"./foo\" are reported as warnings instead of errors.\n\tWhen false, rules are not generated for packages with relative imports.")
+	errorFormat := fs.String("error_format", "text", "how errors and warnings are printed after Gazelle finishes, sorted by file and line:\n\ttext: one line per problem, like file:line: message\n\tjson: a JSON list of objects with level, file, line, and message fields")
+	listen := fs.String("listen", "localhost:0", "serve: address the server listens on. With the default, a free port is chosen,\n\tand the address is printed to stderr.")
+	toMacro := fs.String("to_macro", "", "update-repos: write new go_repository rules to a macro in a .bzl file instead of WORKSPACE.\n\tThe value has the form file.bzl%macro_name. WORKSPACE is changed to load and call the macro.")
+	fromFile := fs.String("from_file", "", "update-repos: add or update go_repository rules for the repositories pinned in a lock file\n\tinstead of import paths given as arguments. Supported files are Gopkg.lock, glide.lock,\n\tand vendor.json. Relative paths are relative to the repository root.")
+	httpArchive := fs.Bool("http_archive", false, "update-repos: write go_repository rules that download an archive of each commit over HTTP\n\tinstead of cloning the repository. Each archive is downloaded once to compute its sha256.\n\tOnly GitHub repositories are supported; others are still cloned.")
+	prune := fs.Bool("prune", false, "update-repos: delete go_repository rules for repositories that aren't imported by any\n\tGo package and aren't named in any label. Rules marked with \"# keep\" are never deleted.\n\tOnly this repository is searched, so repositories needed only by other external\n\trepositories are deleted too unless they're kept or pinned with -from_file.")
+	mode := fs.String("mode", "fix", "print: prints all of the updated BUILD files, each preceded by a header line\n\tfix: rewrites all of the BUILD files in place\n\tdiff: computes the rewrite but then just does a diff\n\tcheck: lists files that would change and exits with code 4 if there are any\n\tjson: prints a JSON description of the rules in each BUILD file without writing anything")
+	backupSuffix := fs.String("backup_suffix", "", "fix: save the previous contents of each build file that is rewritten to a file\n\tnamed by appending this suffix, like .orig. By default, no copies are saved.")
+	cpuProfile := fs.String("cpuprofile", "", "write a CPU profile to this file")
+	memProfile := fs.String("memprofile", "", "write a heap profile to this file at exit")
+	traceFile := fs.String("trace", "", "write the time spent in each stage (walk, parse, resolve, merge, write) for\n\teach directory or file to this file, one tab-separated line per stage")
+	stats := fs.Bool("stats", false, "print counts of directories visited, packages scanned, rules created, updated, and deleted,\n\tand unresolved imports, and the time spent in each stage at exit. With -mode json, the summary\n\tis printed as a final JSON object with a Stats field.")
+	verbose := fs.Bool("v", false, "print the rules created, updated, or deleted in each build file and why,\n\tand a table of the time spent in each stage at exit")
+	changedFiles := multiFlag{}
+	fs.Var(&changedFiles, "changed_files", "comma-separated list of files that changed. Rules are only generated for the directories\n\tcontaining them and directories with rules that depend on rules there (can specify multiple times)")
+	since := fs.String("since", "", "git commit, branch, or tag. Like -changed_files, with the files that differ from it in git,\n\tincluding untracked files")
 	flat := fs.Bool("experimental_flat", false, "whether gazelle should generate a single, combined BUILD file.\nThis mode is experimental and may not work yet.")
 	if err := fs.Parse(args); err != nil {
 		if err == flag.ErrHelp {
@@ -318,102 +989,461 @@ func newConfiguration(args []string) (*config.Config, command, emitFunc, error)
 		log.Fatal("Try -help for more information.")
 	}
 
-	var c config.Config
-	var err error
-
-	c.Dirs = fs.Args()
-	if len(c.Dirs) == 0 {
-		c.Dirs = []string{"."}
+	// Defaults are taken from environment variables first, then from a
+	// config file at each repository root, then from flags. setFlags only
+	// contains flags set on the command line, so values from the config file
+	// replace values from the environment.
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	if err := setFlagsFromEnv(fs, setFlags); err != nil {
+		return nil, cmd, nil, runOptions{}, err
 	}
-	for i := range c.Dirs {
-		c.Dirs[i], err = filepath.Abs(c.Dirs[i])
+
+	// When Gazelle is run with "bazel run", the working directory is in the
+	// runfiles tree, not the workspace. Bazel tells us where the workspace is.
+	workspaceDir := os.Getenv(workspaceDirEnv)
+
+	if cmd == initCmd && len(repoRoots) == 0 && workspaceDir == "" {
+		// The workspace may not exist yet. If there's no WORKSPACE file above
+		// the directory being initialized, that directory becomes the root.
+		dir := "."
+		if fs.NArg() > 0 {
+			dir = fs.Arg(0)
+		}
+		absInitDir, err := absDir("", dir)
 		if err != nil {
-			return nil, cmd, nil, err
+			return nil, cmd, nil, runOptions{}, err
+		}
+		if _, err := wspace.Find(absInitDir); err != nil {
+			repoRoots = append(repoRoots, absInitDir)
 		}
 	}
 
-	if *repoRoot != "" {
-		c.RepoRoot = *repoRoot
-	} else if len(c.Dirs) == 1 {
-		c.RepoRoot, err = wspace.Find(c.Dirs[0])
-		if err != nil {
-			return nil, cmd, nil, fmt.Errorf("-repo_root not specified, and WORKSPACE cannot be found: %v", err)
+	var repos updateReposOptions
+	dirArgs := fs.Args()
+	if cmd == updateReposCmd {
+		// Arguments are import paths, not directories.
+		repos.importPaths = dirArgs
+		repos.lockFile = *fromFile
+		repos.httpArchive = *httpArchive
+		repos.prune = *prune
+		dirArgs = nil
+		if repos.lockFile != "" && len(repos.importPaths) > 0 {
+			return nil, cmd, nil, runOptions{}, errors.New("update-repos: import paths may not be given with -from_file")
 		}
-	} else {
-		cwd, err := filepath.Abs(".")
-		if err != nil {
-			return nil, cmd, nil, err
+		if len(repos.importPaths) == 0 && repos.lockFile == "" && !repos.prune {
+			return nil, cmd, nil, runOptions{}, errors.New("update-repos: no import paths given")
 		}
-		c.RepoRoot, err = wspace.Find(cwd)
-		if err != nil {
-			return nil, cmd, nil, fmt.Errorf("-repo_root not specified, and WORKSPACE cannot be found: %v", err)
+		if *toMacro != "" {
+			file, name, err := parseMacroFlag(*toMacro)
+			if err != nil {
+				return nil, cmd, nil, runOptions{}, err
+			}
+			repos.macroFile, repos.macroName = file, name
+		}
+		if *mode == "json" {
+			return nil, cmd, nil, runOptions{}, errors.New("update-repos: -mode=json is not supported")
 		}
+		if *offline {
+			return nil, cmd, nil, runOptions{}, errors.New("update-repos: -offline is not supported, since repositories are looked up over the network")
+		}
+	} else if *toMacro != "" {
+		return nil, cmd, nil, runOptions{}, errors.New("-to_macro may only be used with update-repos")
+	} else if *fromFile != "" {
+		return nil, cmd, nil, runOptions{}, errors.New("-from_file may only be used with update-repos")
+	} else if *httpArchive {
+		return nil, cmd, nil, runOptions{}, errors.New("-http_archive may only be used with update-repos")
+	} else if *prune {
+		return nil, cmd, nil, runOptions{}, errors.New("-prune may only be used with update-repos")
 	}
 
-	for _, dir := range c.Dirs {
-		if !isDescendingDir(dir, c.RepoRoot) {
-			return nil, cmd, nil, fmt.Errorf("dir %q is not a subdirectory of repo root %q", dir, c.RepoRoot)
+	roots, dirs, err := findRepoRoots(workspaceDir, repoRoots, dirArgs)
+	if err != nil {
+		return nil, cmd, nil, runOptions{}, err
+	}
+
+	if cmd == preCommitCmd && len(changedFiles) == 0 && *since == "" {
+		files, err := readLines(os.Stdin)
+		if err != nil {
+			return nil, cmd, nil, runOptions{}, fmt.Errorf("pre-commit: reading staged files from stdin: %v", err)
+		}
+		changedFiles = files
+	}
+	changedMode := len(changedFiles) > 0 || *since != "" || cmd == preCommitCmd
+	var changedPaths []string
+	if changedMode {
+		if cmd != updateCmd && cmd != fixCmd && cmd != preCommitCmd {
+			return nil, cmd, nil, runOptions{}, errors.New("-changed_files and -since may only be used with update, fix, and pre-commit")
+		}
+		if *flat {
+			return nil, cmd, nil, runOptions{}, errors.New("-changed_files and -since may not be used with -experimental_flat")
+		}
+		if len(changedFiles) > 0 && *since != "" {
+			return nil, cmd, nil, runOptions{}, errors.New("-changed_files and -since may not be used together")
+		}
+		for _, arg := range changedFiles {
+			for _, f := range strings.Split(arg, ",") {
+				if f == "" {
+					continue
+				}
+				// The file may have been deleted, so only its directory is
+				// resolved.
+				dir, err := absDir(workspaceDir, filepath.Dir(f))
+				if err != nil {
+					return nil, cmd, nil, runOptions{}, err
+				}
+				changedPaths = append(changedPaths, filepath.Join(dir, filepath.Base(f)))
+			}
 		}
 	}
+	if cmd == serveCmd && len(roots) > 1 {
+		return nil, cmd, nil, runOptions{}, errors.New("serve: only one repository root may be served")
+	}
+
+	depMode, err := config.DependencyModeFromString(*external)
+	if err != nil {
+		return nil, cmd, nil, runOptions{}, err
+	}
 
-	c.ValidBuildFileNames = strings.Split(*buildFileName, ",")
-	if len(c.ValidBuildFileNames) == 0 {
-		return nil, cmd, nil, fmt.Errorf("no valid build file names specified")
+	disabledKinds, err := config.DisabledKindsFromString(*generate)
+	if err != nil {
+		return nil, cmd, nil, runOptions{}, fmt.Errorf("-generate: %v", err)
 	}
 
-	c.SetBuildTags(*buildTags)
-	c.Platforms = config.DefaultPlatformTags
-	c.PreprocessTags()
+	if err := config.CheckBinaryNaming(*binaryNaming); err != nil {
+		return nil, cmd, nil, runOptions{}, err
+	}
 
-	c.GoPrefix = *goPrefix
-	if c.GoPrefix == "" {
-		c.GoPrefix, err = loadGoPrefix(&c)
+	if *libraryNaming != config.DefaultLibraryNaming && *libraryNaming != config.DirNameLibraryNaming {
+		return nil, cmd, nil, runOptions{}, fmt.Errorf("unrecognized library naming convention: %q", *libraryNaming)
+	}
+
+	if *update != "all" && *update != "deps" {
+		return nil, cmd, nil, runOptions{}, fmt.Errorf("-update: got %q; want all or deps", *update)
+	}
+	if *importCycles != "warn" && *importCycles != "error" {
+		return nil, cmd, nil, runOptions{}, fmt.Errorf("-import_cycles: got %q; want warn or error", *importCycles)
+	}
+	if *emptyBuildFiles != "" && *emptyBuildFiles != config.EmptyBuildFilesEmpty && *emptyBuildFiles != config.EmptyBuildFilesPackage {
+		return nil, cmd, nil, runOptions{}, fmt.Errorf("-empty_build_files: got %q; want empty or package", *emptyBuildFiles)
+	}
+	if *emptyBuildFiles != "" && *flat {
+		return nil, cmd, nil, runOptions{}, errors.New("-empty_build_files may not be used with -experimental_flat")
+	}
+	if *errorFormat != "text" && *errorFormat != "json" {
+		return nil, cmd, nil, runOptions{}, fmt.Errorf("-error_format: got %q; want text or json", *errorFormat)
+	}
+	if *libraryAliases != "" && *libraryAliases != "add" && *libraryAliases != "remove" {
+		return nil, cmd, nil, runOptions{}, fmt.Errorf("-library_aliases: got %q; want add or remove", *libraryAliases)
+	}
+	if *libraryAliases != "" && *libraryNaming != config.DirNameLibraryNaming {
+		return nil, cmd, nil, runOptions{}, errors.New("-library_aliases may only be used with -library_naming=dirname")
+	}
+
+	if _, ok := resolve.NamingConvention(*externalNaming); !ok {
+		return nil, cmd, nil, runOptions{}, fmt.Errorf("unrecognized external naming convention: %q", *externalNaming)
+	}
+
+	var knownHosts []config.KnownHost
+	for _, f := range knownHostFlags {
+		h, err := config.ParseKnownHost(f)
 		if err != nil {
-			return nil, cmd, nil, fmt.Errorf("-go_prefix not set and not root BUILD file found")
+			return nil, cmd, nil, runOptions{}, fmt.Errorf("-known_host: %v", err)
 		}
+		knownHosts = append(knownHosts, h)
 	}
 
-	c.DepMode, err = config.DependencyModeFromString(*external)
-	if err != nil {
-		return nil, cmd, nil, err
+	if *offlineHeuristic && !*offline {
+		return nil, cmd, nil, runOptions{}, errors.New("-offline_heuristic may only be used with -offline")
 	}
 
-	if *flat {
-		c.StructureMode = config.FlatMode
-	} else {
-		c.StructureMode = config.HierarchicalMode
+	var repoCacheFile string
+	if *repoCache != "" {
+		if repoCacheFile, err = filepath.Abs(*repoCache); err != nil {
+			return nil, cmd, nil, runOptions{}, err
+		}
+	}
+
+	var bazelQueryFilePath string
+	if *bazelQueryFile != "" {
+		if bazelQueryFilePath, err = filepath.Abs(*bazelQueryFile); err != nil {
+			return nil, cmd, nil, runOptions{}, err
+		}
 	}
 
 	emit, ok := modeFromName[*mode]
 	if !ok {
-		return nil, cmd, nil, fmt.Errorf("unrecognized emit mode: %q", *mode)
+		return nil, cmd, nil, runOptions{}, fmt.Errorf("unrecognized emit mode: %q", *mode)
 	}
+	if cmd == preCommitCmd {
+		emit = preCommitFile
+	}
+
+	var cs []*config.Config
+	for i, root := range roots {
+		// Settings in a config file at the root replace the defaults of flags
+		// that weren't set on the command line.
+		file, err := config.LoadFile(root)
+		if err != nil {
+			return nil, cmd, nil, runOptions{}, err
+		}
+		if file == nil {
+			file = &config.File{}
+		}
+		fileOrFlag := func(name, fileValue, flagValue string) string {
+			if fileValue != "" && !setFlags[name] {
+				return fileValue
+			}
+			return flagValue
+		}
 
-	c.KnownImports = append(c.KnownImports, knownImports...)
+		validBuildFileNames := strings.Split(fileOrFlag("build_file_name", file.BuildFileName, *buildFileName), ",")
+		if len(validBuildFileNames) == 0 {
+			return nil, cmd, nil, runOptions{}, fmt.Errorf("no valid build file names specified")
+		}
+
+		protoMode, err := config.ProtoModeFromString(fileOrFlag("proto", file.Proto, *proto))
+		if err != nil {
+			return nil, cmd, nil, runOptions{}, err
+		}
+
+		c := &config.Config{
+			Dirs:                dirs[i],
+			RepoRoot:            root,
+			ValidBuildFileNames: validBuildFileNames,
+		}
+		c.SetBuildTags(*buildTags)
+		c.Platforms = config.DefaultPlatformTags
+		if len(file.Platforms) > 0 {
+			// The names were checked when the file was parsed.
+			c.Platforms, _ = config.PlatformTagsFromNames(file.Platforms)
+		}
+		c.PreprocessTags()
+		c.ExcludedDirs = file.Exclude
+
+		c.GoPrefix = fileOrFlag("go_prefix", file.Prefix, *goPrefix)
+		if c.GoPrefix == "" && cmd != updateReposCmd {
+			c.GoPrefix, err = loadGoPrefix(c)
+			if err != nil {
+				if len(roots) > 1 {
+					err = fmt.Errorf("in repo root %s: %v", root, err)
+				}
+				return nil, cmd, nil, runOptions{}, err
+			}
+		}
 
-	return &c, cmd, emit, err
+		if changedMode {
+			files := changedPaths
+			if *since != "" {
+				if files, err = gitChangedFiles(root, *since); err != nil {
+					return nil, cmd, nil, runOptions{}, fmt.Errorf("-since: %v", err)
+				}
+			}
+			c.Dirs = []string{root}
+			c.ChangedDirs = changedDirs(root, files)
+		}
+
+		c.DepMode = depMode
+		c.ProtoMode = protoMode
+		c.DisabledKinds = disabledKinds
+		c.BinaryNaming = *binaryNaming
+		c.LibraryNaming = *libraryNaming
+		c.LibraryAliases = *libraryAliases
+		c.ExternalNaming = *externalNaming
+		c.RepoCacheFile = repoCacheFile
+		c.RepoCacheTTL = *repoCacheTTL
+		if *repoRootsFile != "" {
+			c.RepoRootsFile = *repoRootsFile
+			if !filepath.IsAbs(c.RepoRootsFile) {
+				c.RepoRootsFile = filepath.Join(root, c.RepoRootsFile)
+			}
+		}
+		c.RepoLookupInterval = *repoLookupInterval
+		c.RepoLookupRetries = *repoLookupRetries
+		c.RepoLookupJobs = *repoLookupJobs
+		c.Offline = *offline
+		c.OfflineHeuristic = *offlineHeuristic
+		c.BazelQuery = *bazelQuery || *bazelQueryFile != ""
+		c.BazelQueryFile = bazelQueryFilePath
+		if *flat {
+			c.StructureMode = config.FlatMode
+		} else {
+			c.StructureMode = config.HierarchicalMode
+		}
+
+		c.KnownImports = append(c.KnownImports, knownImports...)
+		c.KnownHosts = knownHosts
+		c.ResolveWellKnownTypes = *resolveWKT
+		c.GenerateTestdata = *testdata
+		c.ShortLabels = *shortLabels
+		c.InternalVisibility = *internalVisibility
+		c.UseGitignore = *gitignore
+		c.EmptyBuildFiles = *emptyBuildFiles
+		c.FollowSymlinks = *followSymlinks
+		c.AllowRelativeImports = *allowRelativeImports
+		c.ImportCycleErrors = *importCycles == "error"
+		c.UpdateDepsOnly = *update == "deps"
+		c.NewOnParseError = *newOnParseError
+		c.BackupSuffix = *backupSuffix
+
+		// A header path in the config file is relative to the repository root.
+		headerPath := *buildFileHeader
+		if file.BuildFileHeader != "" && !setFlags["build_file_header"] {
+			headerPath = filepath.Join(root, filepath.FromSlash(file.BuildFileHeader))
+		}
+		if headerPath != "" {
+			data, err := ioutil.ReadFile(headerPath)
+			if err != nil {
+				return nil, cmd, nil, runOptions{}, fmt.Errorf("-build_file_header: %v", err)
+			}
+			if c.BuildFileHeader, err = config.ParseBuildFileHeader(headerPath, data); err != nil {
+				return nil, cmd, nil, runOptions{}, err
+			}
+		}
+
+		if cmd != updateReposCmd {
+			if err := validateConfig(c, cmd); err != nil {
+				if len(roots) > 1 {
+					for _, e := range err {
+						e.Problem = fmt.Sprintf("in repo root %s: %s", root, e.Problem)
+					}
+				}
+				return nil, cmd, nil, runOptions{}, err
+			}
+		}
+		cs = append(cs, c)
+	}
+
+	opts := runOptions{
+		cpuProfile:  *cpuProfile,
+		memProfile:  *memProfile,
+		traceFile:   *traceFile,
+		verbose:     *verbose,
+		stats:       *stats,
+		statsJSON:   *mode == "json",
+		repos:       repos,
+		listen:      *listen,
+		errorFormat: *errorFormat,
+	}
+	return cs, cmd, emit, opts, nil
 }
 
-func loadBuildFile(c *config.Config, dir string) (*bf.File, error) {
-	var buildPath string
-	for _, base := range c.ValidBuildFileNames {
-		p := filepath.Join(dir, base)
-		fi, err := os.Stat(p)
-		if err == nil {
-			if fi.Mode().IsRegular() {
-				buildPath = p
-				break
+// findRepoRoots returns the absolute paths of the repository roots Gazelle
+// should process and, for each root, the absolute paths of the directories
+// to process within it.
+//
+// repoRootFlags are the values of -repo_root. If none are given, the root is
+// the workspace Bazel reported in workspaceDir, or the directory containing
+// the WORKSPACE file above the directories being processed.
+//
+// args are the directories named on the command line. Relative directories
+// are interpreted relative to workspaceDir, or the working directory if that
+// is empty. If a relative directory isn't inside any root that way, it's
+// interpreted relative to each root in turn, so Gazelle can be run with
+// -repo_root from anywhere. If no directories are given, the current
+// directory is processed, unless there are several roots, in which case each
+// root is processed entirely.
+func findRepoRoots(workspaceDir string, repoRootFlags, args []string) (roots []string, dirs [][]string, err error) {
+	for _, r := range repoRootFlags {
+		root, err := absDir(workspaceDir, r)
+		if err != nil {
+			return nil, nil, err
+		}
+		roots = append(roots, root)
+	}
+
+	if len(args) == 0 && len(roots) > 1 {
+		for _, root := range roots {
+			dirs = append(dirs, []string{root})
+		}
+		return roots, dirs, nil
+	}
+
+	explicit := len(args) > 0
+	if !explicit {
+		args = []string{"."}
+	}
+	var absDirs []string
+	for _, arg := range args {
+		dir, err := absDir(workspaceDir, arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if explicit && !filepath.IsAbs(arg) && findRoot(roots, dir) < 0 {
+			for _, root := range roots {
+				if fi, err := os.Stat(filepath.Join(root, arg)); err == nil && fi.IsDir() {
+					dir, err = absDir(root, arg)
+					if err != nil {
+						return nil, nil, err
+					}
+					break
+				}
 			}
-			continue
 		}
-		if !os.IsNotExist(err) {
-			return nil, err
+		absDirs = append(absDirs, dir)
+	}
+
+	if len(roots) == 0 {
+		var root string
+		if workspaceDir != "" {
+			root, err = absDir("", workspaceDir)
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			searchDir := absDirs[0]
+			if len(absDirs) > 1 {
+				searchDir, err = absDir("", ".")
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			root, err = wspace.Find(searchDir)
+			if err != nil {
+				return nil, nil, fmt.Errorf("-repo_root not specified, and WORKSPACE cannot be found: %v", err)
+			}
+		}
+		roots = []string{root}
+	}
+
+	dirs = make([][]string, len(roots))
+	for _, dir := range absDirs {
+		i := findRoot(roots, dir)
+		if i < 0 {
+			if len(roots) == 1 {
+				return nil, nil, fmt.Errorf("dir %q is not a subdirectory of repo root %q", dir, roots[0])
+			}
+			return nil, nil, fmt.Errorf("dir %q is not a subdirectory of any repo root", dir)
 		}
+		dirs[i] = append(dirs[i], dir)
 	}
-	if buildPath == "" {
-		return nil, os.ErrNotExist
+	for i, root := range roots {
+		if len(dirs[i]) == 0 {
+			return nil, nil, fmt.Errorf("repo root %q does not contain any of the directories to process", root)
+		}
 	}
+	return roots, dirs, nil
+}
 
+// findRoot returns the index of the root in roots that contains dir, or -1
+// if no root contains it. If roots are nested, the innermost root is chosen.
+func findRoot(roots []string, dir string) int {
+	best := -1
+	for i, root := range roots {
+		if isDescendingDir(dir, root) && (best < 0 || len(root) > len(roots[best])) {
+			best = i
+		}
+	}
+	return best
+}
+
+func loadBuildFile(c *config.Config, dir string) (*bf.File, error) {
+	buildPath, err := walk.FindBuildFile(c, dir)
+	if err != nil {
+		return nil, err
+	}
 	data, err := ioutil.ReadFile(buildPath)
 	if err != nil {
 		return nil, err
@@ -421,11 +1451,55 @@ func loadBuildFile(c *config.Config, dir string) (*bf.File, error) {
 	return bf.Parse(buildPath, data)
 }
 
+// loadGoPrefix infers the Go prefix of the repository when -go_prefix is not
+// set. It looks for a go_prefix rule in the root build file, then for import
+// comments in .go files in the repository root, then for a module statement
+// in go.mod. An error is returned if none of these are found.
 func loadGoPrefix(c *config.Config) (string, error) {
-	f, err := loadBuildFile(c, c.RepoRoot)
-	if err != nil {
-		return "", err
+	// A root build file that can't be read doesn't stop the prefix from
+	// being found elsewhere. Walk reports its errors later.
+	f, buildErr := loadBuildFile(c, c.RepoRoot)
+	if buildErr == nil {
+		if prefix, err := goPrefixFromBuildFile(f); err != nil || prefix != "" {
+			return prefix, err
+		}
+	} else if os.IsNotExist(buildErr) {
+		buildErr = nil
+	}
+	if prefix, err := goPrefixFromImportComments(c.RepoRoot); err != nil || prefix != "" {
+		return prefix, err
+	}
+	if prefix, err := goPrefixFromGoMod(c.RepoRoot); err != nil || prefix != "" {
+		return prefix, err
 	}
+	if buildErr != nil {
+		return "", buildErr
+	}
+	// Config.Validate reports the missing prefix.
+	return "", nil
+}
+
+// validateConfig checks c with Config.Validate. init is allowed to set up
+// a repository for -external=vendored before dependencies are vendored, so
+// the vendor directory is not required for that command.
+func validateConfig(c *config.Config, cmd command) config.ValidationErrors {
+	err := c.Validate()
+	if err == nil {
+		return nil
+	}
+	var errs config.ValidationErrors
+	for _, e := range err.(config.ValidationErrors) {
+		if cmd == initCmd && e.Option == "-external" {
+			continue
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// goPrefixFromBuildFile returns the argument of a go_prefix rule in f.
+// An empty string is returned if there is no such rule.
+func goPrefixFromBuildFile(f *bf.File) (string, error) {
 	for _, s := range f.Stmt {
 		c, ok := s.(*bf.CallExpr)
 		if !ok {
@@ -447,7 +1521,53 @@ func loadGoPrefix(c *config.Config) (string, error) {
 		}
 		return v.Value, nil
 	}
-	return "", errors.New("-go_prefix not set, and no go_prefix in root BUILD file")
+	return "", nil
+}
+
+// workspaceDirEnv is the environment variable "bazel run" sets to the
+// absolute path of the workspace root.
+const workspaceDirEnv = "BUILD_WORKSPACE_DIRECTORY"
+
+// envFlags maps environment variables to the flags they set defaults for.
+// CI pipelines can set these instead of changing the command line of each
+// job that runs Gazelle.
+var envFlags = []struct{ env, flag string }{
+	{"GAZELLE_MODE", "mode"},
+	{"GAZELLE_PREFIX", "go_prefix"},
+	{"GAZELLE_REPO_ROOT", "repo_root"},
+}
+
+// setFlagsFromEnv sets flags in fs from the environment variables in
+// envFlags, unless they are in setFlags or the variables are empty.
+func setFlagsFromEnv(fs *flag.FlagSet, setFlags map[string]bool) error {
+	for _, ef := range envFlags {
+		value := os.Getenv(ef.env)
+		if value == "" || setFlags[ef.flag] {
+			continue
+		}
+		if err := fs.Set(ef.flag, value); err != nil {
+			return fmt.Errorf("%s: %v", ef.env, err)
+		}
+	}
+	return nil
+}
+
+// absDir returns an absolute path for dir with symbolic links resolved.
+// If dir is relative and base is not empty, dir is interpreted relative to
+// base instead of the working directory. Resolving links lets Gazelle
+// compare paths when it's run from a runfiles tree full of symbolic links.
+func absDir(base, dir string) (string, error) {
+	if base != "" && !filepath.IsAbs(dir) {
+		dir = filepath.Join(base, dir)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	return dir, nil
 }
 
 func isDescendingDir(dir, root string) bool {
@@ -458,5 +1578,5 @@ func isDescendingDir(dir, root string) bool {
 	if rel == "." {
 		return true
 	}
-	return !strings.HasPrefix(rel, "..")
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
@@ -0,0 +1,86 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+)
+
+// pipelineDepth is the number of packages a pipeline holds back from its
+// visitor while the repositories they import from are looked up.
+const pipelineDepth = 32
+
+// pipeline passes packages from packages.Walk to a visitor a few packages
+// late. The external imports of each package are queued with a Prefetcher
+// as soon as the package is scanned, so by the time rules are generated
+// for it, its imports are usually resolved or in flight. Packages are
+// visited in the order they were scanned, and everything runs on the
+// calling goroutine except the lookups themselves.
+type pipeline struct {
+	v       visitor
+	p       *resolve.Prefetcher
+	pending []pipelineEntry
+}
+
+type pipelineEntry struct {
+	c       *config.Config
+	pkg     *packages.Package
+	oldFile *bf.File
+}
+
+// newPipeline returns a pipeline that visits packages with v. If p is nil,
+// packages are visited as soon as they're added.
+func newPipeline(v visitor, p *resolve.Prefetcher) *pipeline {
+	return &pipeline{v: v, p: p}
+}
+
+// add queues the external imports of pkg and visits the oldest pending
+// package if there are more than pipelineDepth. It may be passed to
+// packages.Walk.
+func (pl *pipeline) add(c *config.Config, pkg *packages.Package, oldFile *bf.File) {
+	if pl.p == nil {
+		pl.v.visit(c, pkg, oldFile)
+		return
+	}
+	for _, p := range append([]*packages.Package{pkg}, pkg.Secondary...) {
+		for _, t := range p.Targets() {
+			t.Imports.Map(func(imp string) (string, error) {
+				pl.p.AddGo(c, imp, p.Rel)
+				return imp, nil
+			})
+		}
+	}
+	pl.pending = append(pl.pending, pipelineEntry{c, pkg, oldFile})
+	if len(pl.pending) > pipelineDepth {
+		e := pl.pending[0]
+		pl.pending = pl.pending[1:]
+		pl.v.visit(e.c, e.pkg, e.oldFile)
+	}
+}
+
+// finish visits the pending packages, stops the Prefetcher, and calls the
+// visitor's finish method.
+func (pl *pipeline) finish() {
+	for _, e := range pl.pending {
+		pl.v.visit(e.c, e.pkg, e.oldFile)
+	}
+	pl.pending = nil
+	pl.p.Close()
+	pl.v.finish()
+}
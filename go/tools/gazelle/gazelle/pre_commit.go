@@ -0,0 +1,58 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+)
+
+// preCommitFile is the emit function for the pre-commit command. Like
+// fixFile, it writes file to disk, but only if it's out of date, in which
+// case it returns errFileChanged so the path is recorded and staged.
+func preCommitFile(c *config.Config, file *bf.File) error {
+	if err := checkFile(c, file); err != errFileChanged {
+		return err
+	}
+	if err := fixFile(c, file); err != nil {
+		return err
+	}
+	return errFileChanged
+}
+
+// gitAdd stages the files at the absolute paths in files in the git
+// repository containing root.
+func gitAdd(root string, files []string) error {
+	_, err := gitOutput(root, append([]string{"add", "--"}, files...)...)
+	return err
+}
+
+// readLines returns the non-empty lines read from r, with surrounding
+// space removed.
+func readLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,63 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+func TestPreCommitFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "BUILD.bazel")
+	if err := ioutil.WriteFile(path, []byte("# out of date\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	c := defaultConfig(dir)
+	f := &bf.File{Path: path}
+	if err := preCommitFile(c, f); err != errFileChanged {
+		t.Fatalf("first preCommitFile: got %v; want errFileChanged", err)
+	}
+	if buf, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if got, want := string(buf), bf.FormatString(f); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if err := preCommitFile(c, f); err != nil {
+		t.Errorf("second preCommitFile: got %v; want nil", err)
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	got, err := readLines(strings.NewReader("a/a.go\n\n  b/BUILD.bazel \nc.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/a.go", "b/BUILD.bazel", "c.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,111 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// goPrefixFromImportComments returns the import path named in import
+// comments (for example, package foo // import "example.com/foo") in
+// non-test .go files in dir. An empty string is returned if no file has an
+// import comment. An error is returned if files disagree.
+func goPrefixFromImportComments(dir string) (string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var prefix, prefixFile string
+	fset := token.NewFileSet()
+	for _, fi := range infos {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		f, err := parser.ParseFile(fset, path, nil, parser.PackageClauseOnly|parser.ParseComments)
+		if err != nil {
+			// Malformed files are reported when packages are walked.
+			continue
+		}
+		line := fset.Position(f.Name.End()).Line
+		for _, cg := range f.Comments {
+			if fset.Position(cg.Pos()).Line != line || cg.Pos() < f.Name.End() {
+				continue
+			}
+			text := cg.List[0].Text
+			if strings.HasPrefix(text, "//") {
+				text = text[len("//"):]
+			} else {
+				text = strings.TrimSuffix(text[len("/*"):], "*/")
+			}
+			text = strings.TrimSpace(text)
+			if !strings.HasPrefix(text, "import ") {
+				continue
+			}
+			importPath, err := strconv.Unquote(strings.TrimSpace(text[len("import "):]))
+			if err != nil {
+				return "", fmt.Errorf("%s: invalid import comment: %s", path, cg.List[0].Text)
+			}
+			if prefix != "" && importPath != prefix {
+				return "", fmt.Errorf("found import comments %q (%s) and %q (%s)", prefix, prefixFile, importPath, name)
+			}
+			prefix, prefixFile = importPath, name
+		}
+	}
+	return prefix, nil
+}
+
+// goPrefixFromGoMod returns the module path declared in go.mod in dir.
+// An empty string is returned if there is no go.mod file or if it has no
+// module statement.
+func goPrefixFromGoMod(dir string) (string, error) {
+	f, err := os.Open(filepath.Join(dir, "go.mod"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "module" {
+			continue
+		}
+		modPath := fields[1]
+		if strings.HasPrefix(modPath, `"`) || strings.HasPrefix(modPath, "`") {
+			if modPath, err = strconv.Unquote(modPath); err != nil {
+				return "", fmt.Errorf("%s: invalid module path: %s", f.Name(), fields[1])
+			}
+		}
+		return modPath, nil
+	}
+	return "", scanner.Err()
+}
@@ -0,0 +1,126 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGoPrefixFromImportComments(t *testing.T) {
+	for _, tc := range []struct {
+		desc, want, wantErr string
+		files               []fileSpec
+	}{
+		{
+			desc:  "no comments",
+			files: []fileSpec{{path: "foo.go", content: "package foo\n"}},
+		},
+		{
+			desc: "comment",
+			want: "example.com/foo",
+			files: []fileSpec{
+				{path: "foo.go", content: `package foo // import "example.com/foo"` + "\n"},
+				{path: "bar.go", content: "package foo\n"},
+			},
+		},
+		{
+			desc: "block comment",
+			want: "example.com/foo",
+			files: []fileSpec{
+				{path: "foo.go", content: `package foo /* import "example.com/foo" */` + "\n"},
+			},
+		},
+		{
+			desc: "test comment ignored",
+			files: []fileSpec{
+				{path: "foo_test.go", content: `package foo // import "example.com/foo"` + "\n"},
+			},
+		},
+		{
+			desc:    "conflict",
+			wantErr: "found import comments",
+			files: []fileSpec{
+				{path: "a.go", content: `package foo // import "example.com/a"` + "\n"},
+				{path: "b.go", content: `package foo // import "example.com/b"` + "\n"},
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, err := createFiles(tc.files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			got, err := goPrefixFromImportComments(dir)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v; want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGoPrefixFromGoMod(t *testing.T) {
+	for _, tc := range []struct {
+		desc, want string
+		files      []fileSpec
+	}{
+		{
+			desc: "no go.mod",
+		},
+		{
+			desc:  "no module",
+			files: []fileSpec{{path: "go.mod", content: "require example.com/bar v1.0.0\n"}},
+		},
+		{
+			desc:  "module",
+			want:  "example.com/foo",
+			files: []fileSpec{{path: "go.mod", content: "// comment\nmodule example.com/foo // trailing\n"}},
+		},
+		{
+			desc:  "quoted module",
+			want:  "example.com/foo",
+			files: []fileSpec{{path: "go.mod", content: `module "example.com/foo"` + "\n"}},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, err := createFiles(tc.files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			got, err := goPrefixFromGoMod(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
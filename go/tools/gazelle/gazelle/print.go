@@ -16,13 +16,42 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"io"
 	"os"
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
 )
 
+// printFile writes the contents of f to stdout, preceded by a header comment
+// naming the file. The path in the header is relative to the repository root
+// and uses slashes, so tools consuming the output (editor plugins, code review
+// bots) can tell where one file ends and the next begins.
 func printFile(c *config.Config, f *bf.File) error {
+	if _, err := fmt.Fprintf(os.Stdout, "# %s\n", printPath(c, f.Path)); err != nil {
+		return err
+	}
 	_, err := os.Stdout.Write(bf.Format(f))
 	return err
 }
+
+// printPath returns the path of a build file relative to the repository root.
+// If the path can't be made relative, it is returned unchanged.
+func printPath(c *config.Config, path string) string {
+	if rel, ok := c.RelPath(path); ok {
+		return rel
+	}
+	return path
+}
+
+// printValidationErrors writes each problem in errs to w, followed by an
+// indented suggestion for fixing it.
+func printValidationErrors(w io.Writer, errs config.ValidationErrors) {
+	for _, e := range errs {
+		fmt.Fprintf(w, "gazelle: %s\n", e.Problem)
+		if e.Suggestion != "" {
+			fmt.Fprintf(w, "\t%s\n", e.Suggestion)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/trace"
+)
+
+// reportChanges logs the rules that were created, updated, or deleted in
+// newFile compared with oldFile, which may be nil, along with the reason for
+// each change where Gazelle knows it. "empty" is the list of empty rules
+// passed to the merger; rules deleted because they match one of these have
+// no sources. "sources" tells which files import each dependency.
+func reportChanges(c *config.Config, oldFile, newFile *bf.File, empty []bf.Expr, sources rules.DepSources) {
+	for _, msg := range describeChanges(oldFile, newFile, empty, sources) {
+		logging.Infof("%s: %s", printPath(c, newFile.Path), msg)
+	}
+}
+
+// writeDiagnostics prints the errors and warnings collected during a run to
+// w in the format named by -error_format. Nothing is printed in text format
+// if there are no diagnostics; in json format, an empty list is printed.
+func writeDiagnostics(w io.Writer, ds []logging.Diagnostic, format string) error {
+	if format == "json" {
+		if ds == nil {
+			ds = []logging.Diagnostic{}
+		}
+		data, err := json.MarshalIndent(ds, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+	l := log.New(w, log.Prefix(), 0)
+	for _, d := range ds {
+		l.Print(d.String())
+	}
+	return nil
+}
+
+// countChanges adds the numbers of rules created, updated, and deleted in
+// newFile compared with oldFile, which may be nil, to the run's counters.
+func countChanges(oldFile, newFile *bf.File) {
+	for _, rc := range merger.DiffRules(oldFile, newFile) {
+		switch rc.Op {
+		case merger.RuleCreated:
+			trace.Count(trace.RulesCreated, 1)
+		case merger.RuleUpdated:
+			trace.Count(trace.RulesUpdated, 1)
+		case merger.RuleDeleted:
+			trace.Count(trace.RulesDeleted, 1)
+		}
+	}
+}
+
+// describeChanges returns one message per change reported by reportChanges.
+func describeChanges(oldFile, newFile *bf.File, empty []bf.Expr, sources rules.DepSources) []string {
+	emptyRules := make(map[string]bool)
+	for _, e := range empty {
+		if call, ok := e.(*bf.CallExpr); ok {
+			r := bf.Rule{Call: call}
+			emptyRules[r.Kind()+" "+r.Name()] = true
+		}
+	}
+
+	var msgs []string
+	for _, rc := range merger.DiffRules(oldFile, newFile) {
+		rule := fmt.Sprintf("%s %q", rc.Kind, rc.Name)
+		switch rc.Op {
+		case merger.RuleCreated:
+			msg := "created " + rule
+			for _, a := range rc.Attrs {
+				if a.Name == "srcs" && len(a.Added) > 0 {
+					msg += " for " + strings.Join(a.Added, ", ")
+				}
+			}
+			msgs = append(msgs, msg)
+
+		case merger.RuleDeleted:
+			if emptyRules[rc.Kind+" "+rc.Name] {
+				msgs = append(msgs, fmt.Sprintf("deleted %s: no source files", rule))
+			} else {
+				msgs = append(msgs, fmt.Sprintf("deleted %s: obsolete", rule))
+			}
+
+		case merger.RuleUpdated:
+			for _, a := range rc.Attrs {
+				for _, s := range a.Added {
+					msgs = append(msgs, fmt.Sprintf("updated %s: %s", rule, describeAdded(a.Name, s, sources[rc.Name])))
+				}
+				for _, s := range a.Removed {
+					msgs = append(msgs, fmt.Sprintf("updated %s: %s", rule, describeRemoved(a.Name, s)))
+				}
+				if len(a.Added) == 0 && len(a.Removed) == 0 {
+					msgs = append(msgs, fmt.Sprintf("updated %s: %s", rule, describeReplaced(a)))
+				}
+			}
+		}
+	}
+	return msgs
+}
+
+func describeAdded(attr, value string, deps map[string][]string) string {
+	switch attr {
+	case "deps":
+		if files := deps[value]; len(files) > 0 {
+			return fmt.Sprintf("added dep %s: imported by %s", value, strings.Join(files, ", "))
+		}
+		return "added dep " + value
+	case "srcs":
+		return "added src " + value
+	default:
+		return fmt.Sprintf("added %q to %s", value, attr)
+	}
+}
+
+func describeRemoved(attr, value string) string {
+	switch attr {
+	case "deps":
+		return fmt.Sprintf("removed dep %s: no longer imported", value)
+	case "srcs":
+		return fmt.Sprintf("removed src %s: no longer in the package", value)
+	default:
+		return fmt.Sprintf("removed %q from %s", value, attr)
+	}
+}
+
+func describeReplaced(a merger.AttrChange) string {
+	switch {
+	case a.Old == "":
+		return fmt.Sprintf("set %s to %s", a.Name, a.New)
+	case a.New == "":
+		return fmt.Sprintf("removed %s", a.Name)
+	default:
+		return fmt.Sprintf("changed %s from %s to %s", a.Name, a.Old, a.New)
+	}
+}
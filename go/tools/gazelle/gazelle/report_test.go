@@ -0,0 +1,193 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/trace"
+)
+
+func TestDescribeChanges(t *testing.T) {
+	oldFile, err := bf.Parse("BUILD.bazel", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "old.go",
+    ],
+    importpath = "example.com/repo/a",
+    deps = ["//b:go_default_library"],
+)
+
+go_binary(
+    name = "a",
+    library = ":go_default_library",
+)
+
+cgo_library(
+    name = "cgo_default_library",
+    srcs = ["c.go"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFile, err := bf.Parse("BUILD.bazel", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "new.go",
+    ],
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+    deps = ["//c:go_default_library"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["a_test.go"],
+    library = ":go_default_library",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := bf.Parse("empty", []byte(`go_binary(name = "a")`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := rules.DepSources{
+		"go_default_library": {
+			"//c:go_default_library": {"a.go", "new.go"},
+		},
+	}
+
+	got := describeChanges(oldFile, newFile, empty.Stmt, sources)
+	want := []string{
+		`updated go_library "go_default_library": added src new.go`,
+		`updated go_library "go_default_library": removed src old.go: no longer in the package`,
+		`updated go_library "go_default_library": added "//visibility:public" to visibility`,
+		`updated go_library "go_default_library": added dep //c:go_default_library: imported by a.go, new.go`,
+		`updated go_library "go_default_library": removed dep //b:go_default_library: no longer imported`,
+		`created go_test "go_default_test" for a_test.go`,
+		`deleted go_binary "a": no source files`,
+		`deleted cgo_library "cgo_default_library": obsolete`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestRunStats(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"WORKSPACE":        "",
+		"cmd/main.go":      "package main\n\nimport _ \"example.com/repo/lib\"\n",
+		"lib/lib.go":       "package lib\n\nimport _ \"example.com/missing\"\n",
+		"lib/lib_test.go":  "package lib\n",
+		"docs/README.md":   "",
+		"lib/testdata/x":   "",
+		"cmd/BUILD.bazel":  "",
+		"docs/BUILD.bazel": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := defaultConfig(dir)
+	c.GoPrefix = "example.com/repo"
+	c.DepMode = config.ExternalMode
+	c.Offline = true
+	trace.Enable(nil)
+	defer trace.Disable()
+	discard := func(*config.Config, *bf.File) error { return nil }
+	// run reports an error for the import that can't be resolved offline.
+	run(c, updateCmd, discard)
+
+	got := trace.Summary()
+	got.Stages = nil
+	want := trace.Stats{
+		Dirs:              5,
+		Packages:          2,
+		RulesCreated:      4,
+		UnresolvedImports: 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestWriteDiagnostics(t *testing.T) {
+	ds := []logging.Diagnostic{
+		{Level: logging.ErrorLevel, File: "a/BUILD", Line: 3, Message: "bad"},
+		{Level: logging.WarningLevel, File: "b/b.go", Message: "odd"},
+	}
+	for _, tc := range []struct {
+		format, want string
+	}{
+		{
+			format: "text",
+			want:   "a/BUILD:3: bad\nb/b.go: warning: odd\n",
+		}, {
+			format: "json",
+			want: `[
+	{
+		"level": "error",
+		"file": "a/BUILD",
+		"line": 3,
+		"message": "bad"
+	},
+	{
+		"level": "warning",
+		"file": "b/b.go",
+		"message": "odd"
+	}
+]
+`,
+		},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeDiagnostics(&buf, ds, tc.format); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+)
+
+// serve runs a server on addr that answers requests about the repository
+// configured by c. It only returns if the server can't be started or fails.
+//
+// The server keeps a labeler, a resolver with its cache of external
+// repositories, and an index of .proto files in memory, so requests are much
+// faster than running Gazelle again. Requests are GETs or POSTs with
+// parameters in the query string or form, and responses are JSON objects:
+//
+//	/generate?path=dir[&write=true]
+//	    Generates and merges rules for dir (a slash-separated path relative
+//	    to the repository root) and its subdirectories. The response has
+//	    a Files field with an object for each build file, like those printed
+//	    in JSON mode. Build files are only written if write is true.
+//	/resolve?import=importpath[&from=dir]
+//	    Resolves a Go import path imported by the package in dir. The
+//	    response has a Label field.
+//	/rule?path=dir&name=name
+//	    Describes a rule in the existing build file in dir. The response is
+//	    an object like the rules printed in JSON mode.
+//	/reload
+//	    Discards the resolver's cache and rebuilds the indexes of .proto
+//	    files, secondary packages, and rules found with bazel query, for
+//	    example, after files were added outside of Gazelle.
+//
+// Failed requests get a response with an Error field and a status other
+// than 200.
+func serve(c *config.Config, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving %s at http://%s", c.RepoRoot, ln.Addr())
+	return http.Serve(ln, newServer(c).handler())
+}
+
+// server handles requests for the serve command.
+type server struct {
+	// mu is held while a request is handled. Gazelle's packages are not
+	// safe for concurrent use, so requests are handled one at a time.
+	mu sync.Mutex
+
+	c *config.Config
+	l resolve.Labeler
+	r *resolve.Resolver
+}
+
+func newServer(c *config.Config) *server {
+	s := &server{c: c}
+	s.reload()
+	return s
+}
+
+// reload creates a new labeler and resolver with new indexes of .proto
+// files, secondary packages, and, with -bazel_query, rules in the
+// repository.
+func (s *server) reload() {
+	s.l = resolve.NewLabeler(s.c)
+	s.r = resolve.NewResolver(s.c, s.l)
+	s.r.SetProtoIndex(packages.IndexProtos(s.c))
+	s.r.SetSecondaryIndex(packages.IndexSecondaryPackages(s.c))
+	if s.c.BazelQuery {
+		s.r.SetGoIndex(resolve.QueryGoIndex(s.c))
+	}
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/generate", s.locked(s.handleGenerate))
+	mux.HandleFunc("/resolve", s.locked(s.handleResolve))
+	mux.HandleFunc("/rule", s.locked(s.handleRule))
+	mux.HandleFunc("/reload", s.locked(s.handleReload))
+	return mux
+}
+
+// locked wraps h so that it's called with s.mu held.
+func (s *server) locked(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		h(w, req)
+	}
+}
+
+// generateResponse is the response to a /generate request.
+type generateResponse struct {
+	Files []buildFileJSON
+
+	// Error is set if any file could not be written or some imports could
+	// not be resolved. Files are still described.
+	Error string `json:",omitempty"`
+}
+
+func (s *server) handleGenerate(w http.ResponseWriter, req *http.Request) {
+	dir, err := s.dir(req.FormValue("path"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	write := false
+	if v := req.FormValue("write"); v != "" {
+		if write, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("write: %v", err))
+			return
+		}
+	}
+
+	c := *s.c
+	c.Dirs = []string{dir}
+	resp := generateResponse{Files: []buildFileJSON{}}
+	emit := func(c *config.Config, f *bf.File) error {
+		resp.Files = append(resp.Files, describeFile(c, f))
+		if write {
+			return fixFile(c, f)
+		}
+		return nil
+	}
+	v := newVisitorWithResolver(&c, updateCmd, emit, s.l, s.r)
+	pl := newPipeline(v, s.r.NewPrefetcher(c.RepoLookupJobs))
+	packages.Walk(&c, dir, pl.add)
+	pl.finish()
+	if _, err := v.result(); err != nil {
+		resp.Error = err.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// resolveResponse is the response to a /resolve request.
+type resolveResponse struct {
+	Label string
+}
+
+func (s *server) handleResolve(w http.ResponseWriter, req *http.Request) {
+	imp := req.FormValue("import")
+	if imp == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("import must be set"))
+		return
+	}
+	from := req.FormValue("from")
+	if _, err := s.dir(from); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if from = path.Clean(from); from == "." {
+		from = ""
+	}
+	label, err := s.r.ResolveGo(imp, from)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resolveResponse{Label: label.FullString()})
+}
+
+func (s *server) handleRule(w http.ResponseWriter, req *http.Request) {
+	dir, err := s.dir(req.FormValue("path"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	name := req.FormValue("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("name must be set"))
+		return
+	}
+	f, err := loadBuildFile(s.c, dir)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no build file in %s", req.FormValue("path")))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, r := range f.Rules("") {
+		if r.Name() == name {
+			writeJSON(w, http.StatusOK, describeRule(r))
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("no rule named %q in %s", name, printPath(s.c, f.Path)))
+}
+
+func (s *server) handleReload(w http.ResponseWriter, req *http.Request) {
+	s.reload()
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// dir returns the absolute path of the directory named by rel, a
+// slash-separated path relative to the repository root. An error is
+// returned if rel is outside the repository or isn't a directory.
+func (s *server) dir(rel string) (string, error) {
+	if path.IsAbs(rel) || filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" || strings.HasPrefix(path.Clean(rel), "..") {
+		return "", fmt.Errorf("path %q must be relative to the repository root", rel)
+	}
+	dir := filepath.Join(s.c.RepoRoot, filepath.FromSlash(rel))
+	if st, err := os.Stat(dir); err != nil {
+		return "", err
+	} else if !st.IsDir() {
+		return "", fmt.Errorf("path %q is not a directory", rel)
+	}
+	return dir, nil
+}
+
+// errorResponse is the response to a request that failed.
+type errorResponse struct {
+	Error string
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
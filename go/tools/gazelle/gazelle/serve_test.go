@@ -0,0 +1,112 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+)
+
+func TestServe(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"WORKSPACE":    "",
+		"lib/lib.go":   "package lib\n\nimport _ \"example.com/repo/util\"\n",
+		"util/util.go": "package util\n",
+		"util/BUILD.bazel": `go_library(
+    name = "go_default_library",
+    srcs = ["util.go"],
+    importpath = "example.com/repo/util",
+)
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := defaultConfig(dir)
+	c.GoPrefix = "example.com/repo"
+	c.DepMode = config.VendorMode
+	ts := httptest.NewServer(newServer(c).handler())
+	defer ts.Close()
+
+	get := func(endpoint string, query url.Values, wantStatus int, resp interface{}) {
+		u := ts.URL + endpoint + "?" + query.Encode()
+		r, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		if r.StatusCode != wantStatus {
+			t.Errorf("GET %s: got status %d; want %d", u, r.StatusCode, wantStatus)
+		}
+		if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+			t.Errorf("GET %s: %v", u, err)
+		}
+	}
+
+	var resolved resolveResponse
+	get("/resolve", url.Values{"import": {"example.com/repo/util"}, "from": {"lib"}}, http.StatusOK, &resolved)
+	if want := "//util:go_default_library"; resolved.Label != want {
+		t.Errorf("/resolve: got label %q; want %q", resolved.Label, want)
+	}
+
+	var failed errorResponse
+	get("/resolve", url.Values{"import": {"fmt"}}, http.StatusNotFound, &failed)
+	if failed.Error == "" {
+		t.Errorf("/resolve: got no error for a standard import")
+	}
+
+	var generated generateResponse
+	get("/generate", url.Values{"path": {"lib"}}, http.StatusOK, &generated)
+	if len(generated.Files) != 1 || generated.Files[0].Path != "lib/BUILD.bazel" || len(generated.Files[0].Rules) != 1 {
+		t.Fatalf("/generate: got %+v; want one file with one rule", generated)
+	}
+	if got, want := generated.Files[0].Rules[0].Deps, []string{"//util:go_default_library"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("/generate: got deps %q; want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lib", "BUILD.bazel")); !os.IsNotExist(err) {
+		t.Errorf("/generate: build file was written without write=true")
+	}
+
+	get("/generate", url.Values{"path": {"../outside"}}, http.StatusBadRequest, &failed)
+
+	var rule ruleJSON
+	get("/rule", url.Values{"path": {"util"}, "name": {"go_default_library"}}, http.StatusOK, &rule)
+	if rule.Kind != "go_library" || !reflect.DeepEqual(rule.Srcs, []string{"util.go"}) {
+		t.Errorf("/rule: got %+v; want go_library with srcs util.go", rule)
+	}
+	get("/rule", url.Values{"path": {"util"}, "name": {"missing"}}, http.StatusNotFound, &failed)
+}
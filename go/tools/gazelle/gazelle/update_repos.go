@@ -0,0 +1,382 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/walk"
+	"golang.org/x/tools/go/vcs"
+)
+
+// goRepositoryFile is the .bzl file go_repository is loaded from.
+const goRepositoryFile = "@io_bazel_rules_go//go:def.bzl"
+
+// updateReposOptions holds the arguments of the update-repos command.
+type updateReposOptions struct {
+	// importPaths are import paths of packages in the repositories that
+	// should be added or updated.
+	importPaths []string
+
+	// macroFile is the slash-separated path, relative to the repository root,
+	// of a .bzl file that go_repository rules are written to. macroName is
+	// the function in that file that declares them. Both are empty if rules
+	// are written to WORKSPACE.
+	macroFile, macroName string
+
+	// lockFile is the path to a dependency manager's lock file, like
+	// Gopkg.lock. If set, rules are added or updated for each repository
+	// pinned in the file, at the pinned revision. Relative paths are
+	// relative to the repository root.
+	lockFile string
+
+	// httpArchive is set if rules should download an archive of each
+	// repository over HTTP, checked with a sha256, instead of cloning it.
+	httpArchive bool
+
+	// prune is set if go_repository rules for repositories that are no longer
+	// imported should be deleted. Only this repository's sources are
+	// searched, since other external repositories haven't been fetched, so
+	// indirect dependencies are deleted unless they're kept or pinned in
+	// lockFile.
+	prune bool
+}
+
+// parseMacroFlag parses the value of the -to_macro flag, which has the form
+// file.bzl%macro_name.
+func parseMacroFlag(s string) (file, name string, err error) {
+	i := strings.LastIndex(s, "%")
+	if i < 0 {
+		return "", "", fmt.Errorf("-to_macro: %q must have the form file.bzl%%macro_name", s)
+	}
+	file, name = path.Clean(filepath.ToSlash(s[:i])), s[i+1:]
+	if !strings.HasSuffix(file, ".bzl") || path.IsAbs(file) || strings.HasPrefix(file, "../") {
+		return "", "", fmt.Errorf("-to_macro: %q must be a .bzl file in the repository", s[:i])
+	}
+	if !isIdentifier(name) {
+		return "", "", fmt.Errorf("-to_macro: %q is not a valid macro name", name)
+	}
+	return file, name, nil
+}
+
+// isIdentifier returns whether s is a valid Skylark identifier.
+func isIdentifier(s string) bool {
+	if s == "" || '0' <= s[0] && s[0] <= '9' {
+		return false
+	}
+	for _, r := range s {
+		if r != '_' && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// macroLabel returns the label WORKSPACE uses to load the .bzl file at the
+// slash-separated path file, relative to the repository root.
+func macroLabel(file string) string {
+	dir := path.Dir(file)
+	if dir == "." {
+		dir = ""
+	}
+	return fmt.Sprintf("//%s:%s", dir, path.Base(file))
+}
+
+// repoRootForImportPath and lsRemote find the repository that provides an
+// import path and the commit at the head of its default branch. They access
+// the network and may be replaced in tests.
+var (
+	repoRootForImportPath = vcs.RepoRootForImportPath
+	lsRemote              = gitLsRemote
+)
+
+// updateRepos adds go_repository rules for the repositories that provide
+// opts.importPaths to the WORKSPACE file in c.RepoRoot, or updates them to
+// the latest commit if they are already declared. If opts.macroFile is set,
+// new rules are added to a macro in that file instead, and WORKSPACE is
+// changed to load and call the macro. Rules already declared in WORKSPACE
+// are updated there. If opts.lockFile is set, rules are generated for the
+// repositories pinned in that file instead of opts.importPaths. If
+// opts.httpArchive is set, rules download archives instead. If opts.prune
+// is set, rules for repositories that aren't used by the repository in
+// c.RepoRoot are deleted from WORKSPACE and the macro. Files are emitted
+// with emit, so -mode applies as it does for other commands.
+func updateRepos(c *config.Config, opts updateReposOptions, emit emitFunc) ([]string, error) {
+	v := &visitorBase{c: c, emit: emit}
+
+	var genRules []*bf.CallExpr
+	var err error
+	if opts.lockFile != "" {
+		lockFile := opts.lockFile
+		if !filepath.IsAbs(lockFile) {
+			lockFile = filepath.Join(c.RepoRoot, lockFile)
+		}
+		genRules, err = importLockFile(c, lockFile)
+	} else {
+		genRules, err = newRepoRules(c, opts.importPaths)
+	}
+	if err == nil && opts.httpArchive {
+		genRules, err = toArchiveRules(genRules)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	workspacePath := filepath.Join(c.RepoRoot, "WORKSPACE")
+	workspace, err := loadFile(workspacePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s does not exist; run gazelle init to create it", workspacePath)
+		}
+		return nil, err
+	}
+
+	// Rules already declared in WORKSPACE stay there. If there's a macro,
+	// everything else goes into it.
+	workspaceRules, macroRules := genRules, []*bf.CallExpr(nil)
+	if opts.macroFile != "" {
+		declared := make(map[string]bool)
+		for _, r := range workspace.Rules("go_repository") {
+			declared[r.Name()] = true
+		}
+		workspaceRules = nil
+		for _, r := range genRules {
+			if declared[(&bf.Rule{Call: r}).Name()] {
+				workspaceRules = append(workspaceRules, r)
+			} else {
+				macroRules = append(macroRules, r)
+			}
+		}
+	}
+
+	var macro *bf.File
+	if opts.macroFile != "" {
+		macroPath := filepath.Join(c.RepoRoot, filepath.FromSlash(opts.macroFile))
+		macro, err = loadFile(macroPath)
+		if os.IsNotExist(err) && len(macroRules) > 0 {
+			macro = &bf.File{Path: macroPath}
+		} else if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if workspace, err = merger.MergeRepos(workspaceRules, workspace, ""); err != nil {
+		return nil, err
+	}
+	if macro != nil {
+		if macro, err = merger.MergeRepos(macroRules, macro, opts.macroName); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.prune {
+		used := findRepoUsage(c, workspace, macro)
+		for _, r := range genRules {
+			// Repositories named on the command line or in the lock file are
+			// wanted even if nothing imports them yet.
+			used.names[(&bf.Rule{Call: r}).Name()] = true
+		}
+		var pruned []string
+		if workspace, pruned, err = merger.PruneRepos(workspace, "", used.isUsed); err != nil {
+			return nil, err
+		}
+		for _, name := range pruned {
+			logging.Infof("%s: deleted go_repository %s, which is no longer imported", workspacePath, name)
+		}
+		if macro != nil {
+			if macro, pruned, err = merger.PruneRepos(macro, opts.macroName, used.isUsed); err != nil {
+				return nil, err
+			}
+			for _, name := range pruned {
+				logging.Infof("%s: deleted go_repository %s, which is no longer imported", macro.Path, name)
+			}
+		}
+	}
+
+	if len(workspaceRules) > 0 {
+		workspace = merger.EnsureLoad(workspace, goRepositoryFile, "go_repository")
+	}
+	if macro != nil {
+		if len(macroRules) > 0 {
+			macro = merger.EnsureLoad(macro, goRepositoryFile, "go_repository")
+		}
+		bf.Rewrite(macro, nil)
+		v.emitFile(macro)
+
+		workspace = merger.EnsureLoad(workspace, macroLabel(opts.macroFile), opts.macroName)
+		if !merger.HasMacroCall(workspace, opts.macroName) {
+			call := &bf.CallExpr{X: &bf.LiteralExpr{Token: opts.macroName}}
+			workspace.Stmt = append(workspace.Stmt, call)
+		}
+	}
+	bf.Rewrite(workspace, nil)
+	v.emitFile(workspace)
+
+	return v.result()
+}
+
+// repoUsage records which external repositories are used by the packages
+// and build files in a repository.
+type repoUsage struct {
+	// imports contains each import path imported by a Go file, together with
+	// all of its prefixes. A go_repository rule is used if its importpath is
+	// in this set.
+	imports map[string]bool
+
+	// names contains the names of repositories referenced in labels, like
+	// "com_github_pkg_errors" in "@com_github_pkg_errors//:go_default_library".
+	names map[string]bool
+}
+
+// findRepoUsage walks the Go packages and build files in c.RepoRoot and
+// records the imports and repository labels they use. Build files are read
+// in every directory, not just those with Go packages, since any rule may
+// refer to an external repository. Labels in files are recorded as well;
+// these are WORKSPACE and .bzl files, which the walk doesn't visit. nil
+// files are ignored.
+func findRepoUsage(c *config.Config, files ...*bf.File) repoUsage {
+	u := repoUsage{imports: make(map[string]bool), names: make(map[string]bool)}
+	walk.Walk(c, c.RepoRoot, walk.Funcs{
+		OnBuildFile: func(_ *walk.Dir, f *bf.File) {
+			u.addLabels(f)
+		},
+	})
+	packages.Walk(c, c.RepoRoot, func(c *config.Config, pkg *packages.Package, _ *bf.File) {
+		for _, p := range append([]*packages.Package{pkg}, pkg.Secondary...) {
+			for _, t := range p.Targets() {
+				for imp := range t.ImportedBy {
+					for ; imp != "." && imp != "/" && !u.imports[imp]; imp = path.Dir(imp) {
+						u.imports[imp] = true
+					}
+				}
+			}
+		}
+	})
+	for _, f := range files {
+		if f != nil {
+			u.addLabels(f)
+		}
+	}
+	return u
+}
+
+// addLabels records the repositories named in labels in string literals
+// in f.
+func (u repoUsage) addLabels(f *bf.File) {
+	bf.Walk(f, func(x bf.Expr, _ []bf.Expr) {
+		s, ok := x.(*bf.StringExpr)
+		if !ok || !strings.HasPrefix(s.Value, "@") {
+			return
+		}
+		if i := strings.IndexAny(s.Value, "/:"); i > 1 {
+			u.names[s.Value[1:i]] = true
+		}
+	})
+}
+
+// isUsed returns whether the go_repository rule r is used, either because
+// a package imports something from it or because a label refers to it.
+func (u repoUsage) isUsed(r *bf.Rule) bool {
+	return u.names[r.Name()] || u.imports[r.AttrString("importpath")]
+}
+
+// newRepoRules returns a go_repository rule for each repository that
+// provides one of importPaths. Each rule is pinned to the commit at the
+// head of the repository's default branch.
+func newRepoRules(c *config.Config, importPaths []string) ([]*bf.CallExpr, error) {
+	repoName := resolve.RepoNamerForConfig(c)
+	var rules []*bf.CallExpr
+	seen := make(map[string]bool)
+	for _, imp := range importPaths {
+		root, err := repoRootForImportPath(imp, false)
+		if err != nil {
+			return nil, err
+		}
+		if seen[root.Root] {
+			continue
+		}
+		seen[root.Root] = true
+		if root.VCS.Cmd != "git" {
+			return nil, fmt.Errorf("%s: only git repositories are supported, not %s", root.Root, root.VCS.Cmd)
+		}
+		commit, err := lsRemote(root.Repo)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, newRepoRule(repoName(root.Root), commit, root.Root))
+	}
+	return rules, nil
+}
+
+// newRepoRule returns a go_repository rule for the repository at
+// importPath, pinned to commit.
+func newRepoRule(name, commit, importPath string) *bf.CallExpr {
+	return &bf.CallExpr{
+		X: &bf.LiteralExpr{Token: "go_repository"},
+		List: []bf.Expr{
+			repoAttr("name", name),
+			repoAttr("commit", commit),
+			repoAttr("importpath", importPath),
+		},
+		ForceMultiLine: true,
+	}
+}
+
+func repoAttr(key, value string) *bf.BinaryExpr {
+	return &bf.BinaryExpr{
+		X:  &bf.LiteralExpr{Token: key},
+		Op: "=",
+		Y:  &bf.StringExpr{Value: value},
+	}
+}
+
+// gitLsRemote returns the commit at HEAD in the remote git repository.
+func gitLsRemote(remote string) (string, error) {
+	cmd := exec.Command("git", "ls-remote", remote, "HEAD")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote %s: %v: %s", remote, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("git ls-remote %s: no HEAD found", remote)
+	}
+	return fields[0], nil
+}
+
+// loadFile reads and parses the file at path.
+func loadFile(path string) (*bf.File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return bf.Parse(path, data)
+}
@@ -0,0 +1,267 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+const updateReposWorkspace = `git_repository(
+    name = "io_bazel_rules_go",
+    remote = "https://github.com/bazelbuild/rules_go.git",
+    tag = "0.7.0",
+)
+
+load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies", "go_register_toolchains")
+
+go_rules_dependencies()
+
+go_register_toolchains()
+`
+
+// stubRepoLookup replaces the functions update-repos uses to look up
+// repositories with stubs that don't access the network. The returned
+// function restores them.
+func stubRepoLookup() func() {
+	oldRepoRoot, oldLsRemote := repoRootForImportPath, lsRemote
+	repoRootForImportPath = func(importPath string, verbose bool) (*vcs.RepoRoot, error) {
+		var root string
+		switch {
+		case strings.HasPrefix(importPath, "golang.org/x/tools"):
+			root = "golang.org/x/tools"
+		case strings.HasPrefix(importPath, "github.com/pkg/errors"):
+			root = "github.com/pkg/errors"
+		default:
+			return nil, fmt.Errorf("unknown import path: %s", importPath)
+		}
+		return &vcs.RepoRoot{VCS: vcs.ByCmd("git"), Repo: "https://" + root, Root: root}, nil
+	}
+	lsRemote = func(remote string) (string, error) {
+		return "0123abc", nil
+	}
+	return func() {
+		repoRootForImportPath, lsRemote = oldRepoRoot, oldLsRemote
+	}
+}
+
+func TestUpdateRepos(t *testing.T) {
+	defer stubRepoLookup()()
+	dir, err := createFiles([]fileSpec{{path: "WORKSPACE", content: updateReposWorkspace}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"update-repos", "golang.org/x/tools/go/vcs", "golang.org/x/tools"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "WORKSPACE",
+		content: `git_repository(
+    name = "io_bazel_rules_go",
+    remote = "https://github.com/bazelbuild/rules_go.git",
+    tag = "0.7.0",
+)
+
+load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies", "go_register_toolchains", "go_repository")
+
+go_rules_dependencies()
+
+go_register_toolchains()
+
+go_repository(
+    name = "org_golang_x_tools",
+    commit = "0123abc",
+    importpath = "golang.org/x/tools",
+)
+`,
+	}})
+}
+
+func TestUpdateReposToMacro(t *testing.T) {
+	defer stubRepoLookup()()
+	dir, err := createFiles([]fileSpec{{
+		path: "WORKSPACE",
+		content: updateReposWorkspace + `
+go_repository(
+    name = "com_github_pkg_errors",
+    commit = "old",
+    importpath = "github.com/pkg/errors",
+)
+`,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"update-repos", "-to_macro", "deps.bzl%go_dependencies", "golang.org/x/tools", "github.com/pkg/errors"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "WORKSPACE",
+			content: `git_repository(
+    name = "io_bazel_rules_go",
+    remote = "https://github.com/bazelbuild/rules_go.git",
+    tag = "0.7.0",
+)
+
+load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies", "go_register_toolchains", "go_repository")
+load("//:deps.bzl", "go_dependencies")
+
+go_rules_dependencies()
+
+go_register_toolchains()
+
+go_repository(
+    name = "com_github_pkg_errors",
+    commit = "0123abc",
+    importpath = "github.com/pkg/errors",
+)
+
+go_dependencies()
+`,
+		}, {
+			path: "deps.bzl",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_repository")
+
+def go_dependencies():
+    go_repository(
+        name = "org_golang_x_tools",
+        commit = "0123abc",
+        importpath = "golang.org/x/tools",
+    )
+`,
+		},
+	})
+}
+
+func TestUpdateReposPrune(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{
+			path: "WORKSPACE",
+			content: updateReposWorkspace + `
+go_repository(
+    name = "com_github_pkg_errors",
+    commit = "abc",
+    importpath = "github.com/pkg/errors",
+)
+
+go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+
+go_repository(
+    name = "org_golang_x_net",
+    commit = "abc",
+    importpath = "golang.org/x/net",
+)
+
+go_repository(
+    name = "org_golang_x_sys",
+    commit = "abc",
+    importpath = "golang.org/x/sys",
+)  # keep
+`,
+		}, {
+			path: "foo/foo.go",
+			content: `package foo
+
+import _ "github.com/pkg/errors/sub"
+`,
+		}, {
+			path: "bar/BUILD",
+			content: `filegroup(
+    name = "bar",
+    srcs = ["@org_golang_x_net//:files"],
+)
+`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, []string{"update-repos", "-prune"}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "WORKSPACE",
+		content: updateReposWorkspace + `
+go_repository(
+    name = "com_github_pkg_errors",
+    commit = "abc",
+    importpath = "github.com/pkg/errors",
+)
+
+go_repository(
+    name = "org_golang_x_net",
+    commit = "abc",
+    importpath = "golang.org/x/net",
+)
+
+go_repository(
+    name = "org_golang_x_sys",
+    commit = "abc",
+    importpath = "golang.org/x/sys",
+)  # keep
+`,
+	}})
+}
+
+func TestParseMacroFlag(t *testing.T) {
+	for _, tc := range []struct {
+		flag, file, name string
+		wantErr          bool
+	}{
+		{flag: "deps.bzl%go_dependencies", file: "deps.bzl", name: "go_dependencies"},
+		{flag: "build/./deps.bzl%deps2", file: "build/deps.bzl", name: "deps2"},
+		{flag: "deps.bzl", wantErr: true},
+		{flag: "deps.txt%deps", wantErr: true},
+		{flag: "../deps.bzl%deps", wantErr: true},
+		{flag: "/deps.bzl%deps", wantErr: true},
+		{flag: "deps.bzl%", wantErr: true},
+		{flag: "deps.bzl%2deps", wantErr: true},
+		{flag: "deps.bzl%go-deps", wantErr: true},
+	} {
+		file, name, err := parseMacroFlag(tc.flag)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseMacroFlag(%q): got success; want error", tc.flag)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMacroFlag(%q): got error %v; want success", tc.flag, err)
+		} else if file != tc.file || name != tc.name {
+			t.Errorf("parseMacroFlag(%q) = %q, %q; want %q, %q", tc.flag, file, name, tc.file, tc.name)
+		}
+	}
+	if got, want := macroLabel("build/deps.bzl"), "//build:deps.bzl"; got != want {
+		t.Errorf("macroLabel: got %q; want %q", got, want)
+	}
+}
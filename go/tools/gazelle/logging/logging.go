@@ -0,0 +1,195 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging provides a leveled logger for Gazelle. Messages are
+// written with the standard log package, so its prefix, flags, and output
+// apply. Errors and warnings are always written; informational messages are
+// only written when the level is raised with SetLevel, which Gazelle does
+// when -v is given.
+//
+// Errors and warnings may carry the location of the file that caused them.
+// After Collect is called, they're held as Diagnostics instead of being
+// written, so they can be reported together at the end of a run.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Level determines which messages are written. Messages at or below the
+// current level are written; others are discarded.
+type Level int
+
+const (
+	// ErrorLevel is the level for problems that prevent Gazelle from processing
+	// a file or directory.
+	ErrorLevel Level = iota
+
+	// WarningLevel is the level for problems Gazelle can work around, like
+	// unsupported files and directives that are ignored.
+	WarningLevel
+
+	// InfoLevel is the level for explanations of what Gazelle is doing, like
+	// changes to rules in each build file.
+	InfoLevel
+)
+
+var level = WarningLevel
+
+var levelNames = []string{"error", "warning", "info"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// MarshalText returns the name of the level, like "warning". Levels are
+// written this way in JSON.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Diagnostic is an error or warning, along with the location of the problem
+// it describes. File is the path to a build file or source file, or empty if
+// the problem isn't about a particular file. Line is the 1-based line in
+// File, or 0 if it's unknown.
+type Diagnostic struct {
+	Level   Level  `json:"level"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+// String formats d like a compiler error: "file:line: message". Warnings
+// with a location are marked "warning:" after the location.
+func (d Diagnostic) String() string {
+	if d.File == "" {
+		return d.Message
+	}
+	loc := d.File
+	if d.Line > 0 {
+		loc = fmt.Sprintf("%s:%d", d.File, d.Line)
+	}
+	if d.Level == WarningLevel {
+		return fmt.Sprintf("%s: warning: %s", loc, d.Message)
+	}
+	return fmt.Sprintf("%s: %s", loc, d.Message)
+}
+
+var (
+	mu          sync.Mutex
+	collecting  bool
+	diagnostics []Diagnostic
+)
+
+// Collect causes errors and warnings to be held instead of written. They're
+// returned by Diagnostics. Informational messages are still written as
+// they occur.
+func Collect() {
+	mu.Lock()
+	defer mu.Unlock()
+	collecting = true
+}
+
+// Diagnostics returns the errors and warnings held since Collect was called,
+// sorted by file and line. Diagnostics without a file come first, in the
+// order they were reported. Collection stops, so later messages are written
+// as they occur.
+func Diagnostics() []Diagnostic {
+	mu.Lock()
+	defer mu.Unlock()
+	ds := diagnostics
+	collecting = false
+	diagnostics = nil
+	sort.Stable(byLocation(ds))
+	return ds
+}
+
+type byLocation []Diagnostic
+
+func (s byLocation) Len() int      { return len(s) }
+func (s byLocation) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLocation) Less(i, j int) bool {
+	if s[i].File != s[j].File {
+		return s[i].File < s[j].File
+	}
+	return s[i].Line < s[j].Line
+}
+
+// SetLevel sets the level of messages that are written.
+func SetLevel(l Level) {
+	level = l
+}
+
+// Enabled returns whether messages at level l are written. This may be
+// used to avoid doing work to build messages that won't be written.
+func Enabled(l Level) bool {
+	return l <= level
+}
+
+// Errorf writes an error message, formatted like fmt.Sprintf.
+func Errorf(format string, args ...interface{}) {
+	output(Diagnostic{Level: ErrorLevel, Message: fmt.Sprintf(format, args...)})
+}
+
+// Error writes err as an error message.
+func Error(err error) {
+	output(Diagnostic{Level: ErrorLevel, Message: err.Error()})
+}
+
+// ErrorfAt writes an error message about line of file, formatted like
+// fmt.Sprintf. line may be 0 if it's unknown.
+func ErrorfAt(file string, line int, format string, args ...interface{}) {
+	output(Diagnostic{Level: ErrorLevel, File: file, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// Warningf writes a warning message, formatted like fmt.Sprintf.
+func Warningf(format string, args ...interface{}) {
+	output(Diagnostic{Level: WarningLevel, Message: fmt.Sprintf(format, args...)})
+}
+
+// WarningfAt writes a warning message about line of file, formatted like
+// fmt.Sprintf. line may be 0 if it's unknown.
+func WarningfAt(file string, line int, format string, args ...interface{}) {
+	output(Diagnostic{Level: WarningLevel, File: file, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// Infof writes an informational message, formatted like fmt.Sprintf.
+func Infof(format string, args ...interface{}) {
+	output(Diagnostic{Level: InfoLevel, Message: fmt.Sprintf(format, args...)})
+}
+
+func output(d Diagnostic) {
+	if !Enabled(d.Level) {
+		return
+	}
+	if d.Level < InfoLevel {
+		mu.Lock()
+		if collecting {
+			diagnostics = append(diagnostics, d)
+			mu.Unlock()
+			return
+		}
+		mu.Unlock()
+	}
+	// Skip output and the exported function that called it, so file and
+	// line flags refer to the caller.
+	log.Output(3, d.String())
+}
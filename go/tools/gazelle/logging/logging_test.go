@@ -0,0 +1,106 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		SetLevel(WarningLevel)
+	}()
+
+	for _, tc := range []struct {
+		desc  string
+		level Level
+		want  string
+	}{
+		{
+			desc:  "error",
+			level: ErrorLevel,
+			want:  "e1\ne2\n",
+		}, {
+			desc:  "warning",
+			level: WarningLevel,
+			want:  "e1\ne2\nw\n",
+		}, {
+			desc:  "info",
+			level: InfoLevel,
+			want:  "e1\ne2\nw\ni\n",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			buf.Reset()
+			SetLevel(tc.level)
+			Errorf("e%d", 1)
+			Error(errors.New("e2"))
+			Warningf("w")
+			Infof("i")
+			if got := buf.String(); got != tc.want {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCollect(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		SetLevel(WarningLevel)
+	}()
+	SetLevel(InfoLevel)
+
+	Collect()
+	WarningfAt("b/BUILD.bazel", 3, "unknown directive")
+	ErrorfAt("a/a.go", 0, "error reading go file")
+	Infof("info")
+	Errorf("general")
+	WarningfAt("b/BUILD.bazel", 1, "first")
+	got := Diagnostics()
+	want := []Diagnostic{
+		{Level: ErrorLevel, Message: "general"},
+		{Level: ErrorLevel, File: "a/a.go", Message: "error reading go file"},
+		{Level: WarningLevel, File: "b/BUILD.bazel", Line: 1, Message: "first"},
+		{Level: WarningLevel, File: "b/BUILD.bazel", Line: 3, Message: "unknown directive"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	if got, want := buf.String(), "info\n"; got != want {
+		t.Errorf("written while collecting: got %q; want %q", got, want)
+	}
+
+	buf.Reset()
+	WarningfAt("c/c.go", 7, "after")
+	if got, want := buf.String(), "c/c.go:7: warning: after\n"; got != want {
+		t.Errorf("written after collecting: got %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,250 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"sort"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+// ChangeOp describes what happened to a rule.
+type ChangeOp int
+
+const (
+	// RuleCreated means a rule is in the new file but not the old file.
+	RuleCreated ChangeOp = iota
+
+	// RuleUpdated means a rule is in both files with different attributes.
+	RuleUpdated
+
+	// RuleDeleted means a rule is in the old file but not the new file.
+	RuleDeleted
+)
+
+// RuleChange describes how a rule differs between two versions of a build
+// file. Rules are identified by kind and name.
+type RuleChange struct {
+	Kind, Name string
+	Op         ChangeOp
+
+	// Attrs lists the attributes that differ, in the order they appear in the
+	// new rule followed by attributes that were removed. For created rules,
+	// every attribute is listed. For deleted rules, Attrs is empty.
+	Attrs []AttrChange
+}
+
+// AttrChange describes how an attribute differs between two versions of a
+// rule.
+type AttrChange struct {
+	Name string
+
+	// Added and Removed are sorted lists of strings that were added to or
+	// removed from the attribute. These are set when both values are absent,
+	// lists of strings, selects of lists of strings, or a sum of these.
+	// Strings are compared regardless of which select condition they
+	// appear under.
+	Added, Removed []string
+
+	// Old and New are the formatted old and new values when the attribute
+	// changed in a way that Added and Removed can't describe, like a scalar
+	// attribute with a new value. Either may be empty if the attribute was
+	// not set in that version.
+	Old, New string
+}
+
+// DiffRules returns a list of changes to named rules between oldFile and
+// newFile. Either file may be nil. Created and updated rules are listed in
+// the order they appear in newFile, followed by deleted rules in the order
+// they appear in oldFile. Statements that aren't named rules, like loads,
+// are not compared.
+func DiffRules(oldFile, newFile *bf.File) []RuleChange {
+	type ruleKey struct{ kind, name string }
+	oldRules := make(map[ruleKey]*bf.Rule)
+	for _, r := range namedRules(oldFile) {
+		oldRules[ruleKey{r.Kind(), r.Name()}] = r
+	}
+
+	var changes []RuleChange
+	seen := make(map[ruleKey]bool)
+	for _, r := range namedRules(newFile) {
+		key := ruleKey{r.Kind(), r.Name()}
+		seen[key] = true
+		old, ok := oldRules[key]
+		if !ok {
+			changes = append(changes, RuleChange{
+				Kind:  key.kind,
+				Name:  key.name,
+				Op:    RuleCreated,
+				Attrs: diffAttrs(nil, r),
+			})
+			continue
+		}
+		if attrs := diffAttrs(old, r); len(attrs) > 0 {
+			changes = append(changes, RuleChange{
+				Kind:  key.kind,
+				Name:  key.name,
+				Op:    RuleUpdated,
+				Attrs: attrs,
+			})
+		}
+	}
+	for _, r := range namedRules(oldFile) {
+		key := ruleKey{r.Kind(), r.Name()}
+		if !seen[key] {
+			seen[key] = true
+			changes = append(changes, RuleChange{Kind: key.kind, Name: key.name, Op: RuleDeleted})
+		}
+	}
+	return changes
+}
+
+func namedRules(f *bf.File) []*bf.Rule {
+	if f == nil {
+		return nil
+	}
+	var rules []*bf.Rule
+	for _, r := range f.Rules("") {
+		if r.Kind() != "load" && r.Name() != "" {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// diffAttrs compares the attributes of two rules other than name. old may
+// be nil, in which case every attribute of new is reported.
+func diffAttrs(old, new *bf.Rule) []AttrChange {
+	var keys []string
+	seen := map[string]bool{"name": true}
+	for _, k := range new.AttrKeys() {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	if old != nil {
+		for _, k := range old.AttrKeys() {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	var changes []AttrChange
+	for _, k := range keys {
+		var oldExpr bf.Expr
+		if old != nil {
+			oldExpr = old.Attr(k)
+		}
+		newExpr := new.Attr(k)
+
+		oldStrs, oldOk := ListStrings(oldExpr)
+		newStrs, newOk := ListStrings(newExpr)
+		if oldOk && newOk {
+			added := difference(newStrs, oldStrs)
+			removed := difference(oldStrs, newStrs)
+			if len(added) > 0 || len(removed) > 0 {
+				changes = append(changes, AttrChange{Name: k, Added: added, Removed: removed})
+			}
+			continue
+		}
+
+		oldStr, newStr := formatExpr(oldExpr), formatExpr(newExpr)
+		if oldStr != newStr {
+			changes = append(changes, AttrChange{Name: k, Old: oldStr, New: newStr})
+		}
+	}
+	return changes
+}
+
+// ListStrings returns the strings in a list, a select of lists, or a sum of
+// these, in the order they appear. false is returned for other expressions.
+// nil is treated as an empty list.
+func ListStrings(e bf.Expr) ([]string, bool) {
+	switch e := e.(type) {
+	case nil:
+		return nil, true
+	case *bf.ListExpr:
+		var strs []string
+		for _, x := range e.List {
+			s, ok := x.(*bf.StringExpr)
+			if !ok {
+				return nil, false
+			}
+			strs = append(strs, s.Value)
+		}
+		return strs, true
+	case *bf.BinaryExpr:
+		if e.Op != "+" {
+			return nil, false
+		}
+		x, ok := ListStrings(e.X)
+		if !ok {
+			return nil, false
+		}
+		y, ok := ListStrings(e.Y)
+		if !ok {
+			return nil, false
+		}
+		return append(x, y...), true
+	case *bf.CallExpr:
+		_, dict, err := exprListAndDict(e)
+		if err != nil || dict == nil {
+			return nil, false
+		}
+		var strs []string
+		for _, entry := range dict.List {
+			kv, ok := entry.(*bf.KeyValueExpr)
+			if !ok {
+				return nil, false
+			}
+			values, ok := ListStrings(kv.Value)
+			if !ok {
+				return nil, false
+			}
+			strs = append(strs, values...)
+		}
+		return strs, true
+	}
+	return nil, false
+}
+
+// difference returns the strings in a that are not in b, sorted and without
+// duplicates.
+func difference(a, b []string) []string {
+	bSet := make(map[string]bool)
+	for _, s := range b {
+		bSet[s] = true
+	}
+	var diff []string
+	for _, s := range a {
+		if !bSet[s] {
+			bSet[s] = true
+			diff = append(diff, s)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+func formatExpr(e bf.Expr) string {
+	if e == nil {
+		return ""
+	}
+	return bf.FormatString(e)
+}
@@ -0,0 +1,134 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+func TestDiffRules(t *testing.T) {
+	oldFile, err := bf.Parse("old", []byte(`
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+    ],
+    importpath = "example.com/old",
+    deps = ["//c:go_default_library"] + select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": ["//d:go_default_library"],
+        "//conditions:default": [],
+    }),
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["a_test.go"],
+)
+
+go_binary(
+    name = "unchanged",
+    srcs = ["main.go"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFile, err := bf.Parse("new", []byte(`
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "c.go",
+    ],
+    importpath = "example.com/new",
+    deps = [
+        "//c:go_default_library",
+        "//d:go_default_library",
+        "//e:go_default_library",
+    ],
+)
+
+go_binary(
+    name = "unchanged",
+    srcs = ["main.go"],
+)
+
+go_test(
+    name = "go_default_xtest",
+    srcs = ["b_test.go"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := DiffRules(oldFile, newFile)
+	want := []RuleChange{
+		{
+			Kind: "go_library",
+			Name: "go_default_library",
+			Op:   RuleUpdated,
+			Attrs: []AttrChange{
+				{Name: "srcs", Added: []string{"c.go"}, Removed: []string{"b.go"}},
+				{Name: "importpath", Old: `"example.com/old"`, New: `"example.com/new"`},
+				{Name: "deps", Added: []string{"//e:go_default_library"}},
+			},
+		}, {
+			Kind: "go_test",
+			Name: "go_default_xtest",
+			Op:   RuleCreated,
+			Attrs: []AttrChange{
+				{Name: "srcs", Added: []string{"b_test.go"}},
+			},
+		}, {
+			Kind: "go_test",
+			Name: "go_default_test",
+			Op:   RuleDeleted,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestDiffRulesNilFile(t *testing.T) {
+	f, err := bf.Parse("new", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := DiffRules(f, f); len(got) != 0 {
+		t.Errorf("same file: got %#v; want no changes", got)
+	}
+	if got := DiffRules(f, nil); len(got) != 1 || got[0].Op != RuleDeleted {
+		t.Errorf("nil new file: got %#v; want one deleted rule", got)
+	}
+	if got := DiffRules(nil, f); len(got) != 1 || got[0].Op != RuleCreated {
+		t.Errorf("nil old file: got %#v; want one created rule", got)
+	}
+}
@@ -0,0 +1,107 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+// deletedStmtComments returns comment blocks that should replace stmt when
+// it is deleted from a file. The parser attaches comments directly above a
+// statement to that statement, so license headers, TODOs, and directives
+// for buildifier or Gazelle would be lost along with a deleted rule if
+// they weren't separated from it by a blank line. Comments before and after
+// stmt become standalone blocks. Suffix comments, which are on the same line
+// as stmt and describe it, are dropped. Like the parser, the blocks hold
+// their comments in After. nil is returned if there are no comments to
+// preserve.
+func deletedStmtComments(stmt bf.Expr) []bf.Expr {
+	c := stmt.Comment()
+	var blocks []bf.Expr
+	if len(c.Before) > 0 {
+		blocks = append(blocks, &bf.CommentBlock{
+			Comments: bf.Comments{After: append([]bf.Comment(nil), c.Before...)},
+		})
+	}
+	if len(c.After) > 0 {
+		blocks = append(blocks, &bf.CommentBlock{
+			Comments: bf.Comments{After: append([]bf.Comment(nil), c.After...)},
+		})
+	}
+	return blocks
+}
+
+// insertLeadingStmts returns a copy of stmts with ins inserted at the top,
+// after any leading comment blocks. Comments attached to the statement
+// that was first are moved to the first inserted statement, since they
+// usually describe the file rather than that statement. ins must not be
+// empty, and its statements must not be shared with another file.
+func insertLeadingStmts(stmts []bf.Expr, ins []bf.Expr) []bf.Expr {
+	i := 0
+	for i < len(stmts) {
+		if _, ok := stmts[i].(*bf.CommentBlock); !ok {
+			break
+		}
+		i++
+	}
+
+	fixed := make([]bf.Expr, 0, len(stmts)+len(ins))
+	fixed = append(fixed, stmts[:i]...)
+	fixed = append(fixed, ins...)
+	if i < len(stmts) {
+		if call, ok := stmts[i].(*bf.CallExpr); ok && len(call.Before) > 0 {
+			moved := *call
+			moved.Before = nil
+			insCom := ins[0].Comment()
+			insCom.Before = append(append([]bf.Comment(nil), call.Before...), insCom.Before...)
+			fixed = append(fixed, &moved)
+			i++
+		}
+	}
+	return append(fixed, stmts[i:]...)
+}
+
+// AddHeader returns a copy of f with header inserted at the top. header
+// should contain only comment lines and blank lines, as checked by
+// config.ParseBuildFileHeader. Each group of lines separated by blank lines
+// becomes a separate comment block, so the blank lines are kept. f is
+// returned if header is empty. This is used for new files; Gazelle leaves
+// comments at the top of existing files alone.
+func AddHeader(f *bf.File, header string) *bf.File {
+	var blocks []bf.Expr
+	var block *bf.CommentBlock
+	for _, line := range strings.Split(header, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			block = nil
+			continue
+		}
+		if block == nil {
+			block = &bf.CommentBlock{}
+			blocks = append(blocks, block)
+		}
+		block.After = append(block.After, bf.Comment{Token: line})
+	}
+	if len(blocks) == 0 {
+		return f
+	}
+
+	fixedFile := *f
+	fixedFile.Stmt = append(blocks, f.Stmt...)
+	return &fixedFile
+}
@@ -0,0 +1,97 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+func comments(tokens ...string) []bf.Comment {
+	var cs []bf.Comment
+	for _, t := range tokens {
+		cs = append(cs, bf.Comment{Token: t})
+	}
+	return cs
+}
+
+func TestDeletedStmtComments(t *testing.T) {
+	rule := &bf.CallExpr{X: &bf.LiteralExpr{Token: "go_binary"}}
+	if got := deletedStmtComments(rule); got != nil {
+		t.Errorf("without comments: got %#v; want nil", got)
+	}
+
+	rule.Before = comments("# TODO: remove", "# buildifier: leave-alone")
+	rule.Suffix = comments("# about the rule")
+	rule.After = comments("# end of file")
+	want := []bf.Expr{
+		&bf.CommentBlock{Comments: bf.Comments{After: comments("# TODO: remove", "# buildifier: leave-alone")}},
+		&bf.CommentBlock{Comments: bf.Comments{After: comments("# end of file")}},
+	}
+	if got := deletedStmtComments(rule); !reflect.DeepEqual(got, want) {
+		t.Errorf("with comments: got %#v; want %#v", got, want)
+	}
+}
+
+func TestInsertLeadingStmts(t *testing.T) {
+	header := &bf.CommentBlock{Comments: bf.Comments{Before: comments("# Copyright")}}
+	load := &bf.CallExpr{X: &bf.LiteralExpr{Token: "load"}}
+	rule := &bf.CallExpr{
+		Comments: bf.Comments{Before: comments("# gazelle:prefix example.com/a")},
+		X:        &bf.LiteralExpr{Token: "go_library"},
+	}
+
+	got := insertLeadingStmts([]bf.Expr{header, rule}, []bf.Expr{load})
+	if len(got) != 3 || got[0] != header || got[1] != load {
+		t.Fatalf("got %#v; want header, load, rule", got)
+	}
+	if want := comments("# gazelle:prefix example.com/a"); !reflect.DeepEqual(load.Before, want) {
+		t.Errorf("load comments: got %#v; want %#v", load.Before, want)
+	}
+	if moved := got[2].(*bf.CallExpr); moved == rule || len(moved.Before) != 0 || moved.X != rule.X {
+		t.Errorf("rule: got %#v; want copy of rule without comments", moved)
+	}
+	if len(rule.Before) != 1 {
+		t.Errorf("original rule was modified")
+	}
+}
+
+func TestAddHeader(t *testing.T) {
+	rule := &bf.CallExpr{X: &bf.LiteralExpr{Token: "go_library"}}
+	f := &bf.File{Path: "BUILD.bazel", Stmt: []bf.Expr{rule}}
+	if got := AddHeader(f, ""); got != f {
+		t.Errorf("empty header: got %#v; want original file", got)
+	}
+
+	got := AddHeader(f, "# Copyright 2017 Example\n# All rights reserved.\n\n# buildifier: disable=load")
+	want := []bf.Expr{
+		&bf.CommentBlock{Comments: bf.Comments{After: comments("# Copyright 2017 Example", "# All rights reserved.")}},
+		&bf.CommentBlock{Comments: bf.Comments{After: comments("# buildifier: disable=load")}},
+		rule,
+	}
+	if !reflect.DeepEqual(got.Stmt, want) {
+		t.Errorf("got %#v; want %#v", got.Stmt, want)
+	}
+	wantText := "# Copyright 2017 Example\n# All rights reserved.\n\n# buildifier: disable=load\n\ngo_library()\n"
+	if text := string(bf.Format(got)); text != wantText {
+		t.Errorf("got:\n%s\nwant:\n%s", text, wantText)
+	}
+	if got.Path != f.Path || len(f.Stmt) != 1 {
+		t.Errorf("original file was modified or path was lost")
+	}
+}
@@ -0,0 +1,209 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+// The tests in this file check that rules Gazelle doesn't generate are never
+// reordered, rewritten, or deleted when build files are fixed and merged.
+// Each case has an existing file mixing Go rules with other rules, along
+// with generated and empty rules that have the same names or kinds as some
+// of the other rules. The other rules must come out of every step exactly as
+// they went in, in the same order.
+
+// nonGoRules are rules Gazelle doesn't manage. Their lists are unsorted and
+// their labels aren't in the form Gazelle writes, so any attempt to merge or
+// fix them would show up as a change.
+const nonGoRules = `
+cc_library(
+    name = "cgo_helpers",
+    srcs = ["b.c", "a.c"],
+    visibility = ["//visibility:public"],
+    deps = [
+        "//foo:z",
+        ":y",
+        "//foo:a",
+    ],
+)
+
+filegroup(
+    name = "testdata",
+    srcs = glob(["testdata/**"]),
+    visibility = ["//visibility:public"],
+)
+
+sh_test(
+    name = "integration_test",
+    srcs = ["test.sh"],
+    data = [":testdata"],
+    deps = ["//foo:go_default_library"],
+)
+
+custom_rule(
+    name = "go_default_xtest",
+    srcs = [],
+    deps = ["//foo:go_default_library"],
+)
+`
+
+var conformanceCases = []struct {
+	desc, previous, current, empty string
+}{
+	{
+		desc:     "no go rules",
+		previous: nonGoRules,
+		current: `
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+	}, {
+		desc: "interleaved with go rules",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+load("//tools:defs.bzl", "custom_rule")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "old.go",
+        "lib.go",
+    ],
+    importpath = "example.com/foo",
+    visibility = ["//visibility:public"],
+)
+` + nonGoRules + `
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    library = ":go_default_library",
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+		empty: `
+go_test(name = "go_default_test")
+`,
+	}, {
+		desc:     "same kinds and names as empty rules",
+		previous: nonGoRules,
+		empty: `
+filegroup(name = "testdata")
+
+go_test(name = "integration_test")
+
+go_test(name = "go_default_xtest")
+
+cc_library(name = "cgo_helpers")
+`,
+	}, {
+		desc:     "same kinds and names as generated rules",
+		previous: nonGoRules,
+		current: `
+filegroup(
+    name = "testdata",
+    srcs = ["a.proto"],
+)
+
+custom_rule(
+    name = "go_default_xtest",
+    srcs = ["x_test.go"],
+)
+`,
+	},
+}
+
+func TestConformanceNonGoRules(t *testing.T) {
+	for _, tc := range conformanceCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			oldFile, err := bf.Parse("previous", []byte(tc.previous))
+			if err != nil {
+				t.Fatal(err)
+			}
+			genFile, err := bf.Parse("current", []byte(tc.current))
+			if err != nil {
+				t.Fatal(err)
+			}
+			emptyFile, err := bf.Parse("empty", []byte(tc.empty))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := nonGoCalls(oldFile)
+			if len(want) == 0 {
+				t.Fatal("test case has no rules Gazelle doesn't manage")
+			}
+
+			// Run the steps in the order Gazelle does, checking after each one.
+			f := oldFile
+			for _, step := range []struct {
+				name string
+				fn   func(*bf.File) *bf.File
+			}{
+				{"FixFile", FixFile},
+				{"FixPackageVisibility", func(f *bf.File) *bf.File {
+					return FixPackageVisibility(f, []string{"//visibility:public"})
+				}},
+				{"MergeWithExisting", func(f *bf.File) *bf.File {
+					return MergeWithExisting(genFile, f, emptyFile.Stmt, nil)
+				}},
+				{"FixLoads", func(f *bf.File) *bf.File {
+					return FixLoads(f, nil)
+				}},
+				{"FixLabels", func(f *bf.File) *bf.File {
+					return FixLabels(f, "foo", true)
+				}},
+			} {
+				f = step.fn(f)
+				if f == nil {
+					t.Fatalf("after %s: got nil file", step.name)
+				}
+				if got := nonGoCalls(f); !reflect.DeepEqual(got, want) {
+					t.Fatalf("after %s: got rules:\n%s\nwant:\n%s", step.name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// nonGoCalls returns the formatted calls in f that aren't loads, package
+// declarations, or rules Gazelle manages, in order.
+func nonGoCalls(f *bf.File) []string {
+	var calls []string
+	for _, stmt := range f.Stmt {
+		c, ok := stmt.(*bf.CallExpr)
+		if !ok || kind(c) == "load" || kind(c) == "package" || isGazelleRule(c) {
+			continue
+		}
+		calls = append(calls, bf.FormatString(c))
+	}
+	return calls
+}
@@ -16,11 +16,13 @@ limitations under the License.
 package merger
 
 import (
-	"log"
+	"fmt"
 	"sort"
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
 )
 
 // Much of this file could be simplified by using
@@ -34,7 +36,162 @@ import (
 // FixLoads should be called after this, since it will fix load
 // statements that may be broken by transformations applied by this function.
 func FixFile(oldFile *bf.File) *bf.File {
-	return squashCgoLibrary(oldFile)
+	return removeRedundantVisibility(squashCgoLibrary(oldFile))
+}
+
+// removeRedundantVisibility removes visibility attributes from rules of kinds
+// Gazelle generates when they're the same as the default_visibility set by
+// the package rule in oldFile. Older versions of Gazelle set visibility on
+// some new rules even when a default was set. Rules and attributes marked
+// with "# keep" are not changed. If nothing needs to be removed, oldFile is
+// returned.
+func removeRedundantVisibility(oldFile *bf.File) *bf.File {
+	var defaultVis []string
+	for _, r := range oldFile.Rules("package") {
+		if vis, ok := ListStrings(r.Attr("default_visibility")); ok && len(vis) > 0 {
+			defaultVis = vis
+		}
+	}
+	if defaultVis == nil {
+		return oldFile
+	}
+
+	var fixedFile *bf.File
+	for i, stmt := range oldFile.Stmt {
+		c, ok := stmt.(*bf.CallExpr)
+		if !ok || shouldKeep(c) || !isGazelleRule(c) {
+			continue
+		}
+		r := bf.Rule{Call: c}
+		vis := r.AttrDefn("visibility")
+		if vis == nil || shouldKeep(vis) {
+			continue
+		}
+		if strs, ok := ListStrings(vis.Y); !ok || !sameStrings(strs, defaultVis) {
+			continue
+		}
+
+		fixedCall := *c
+		fixedCall.List = make([]bf.Expr, 0, len(c.List)-1)
+		for _, arg := range c.List {
+			if arg != vis {
+				fixedCall.List = append(fixedCall.List, arg)
+			}
+		}
+		if fixedFile == nil {
+			copied := *oldFile
+			copied.Stmt = append([]bf.Expr{}, oldFile.Stmt...)
+			fixedFile = &copied
+		}
+		fixedFile.Stmt[i] = &fixedCall
+	}
+	if fixedFile == nil {
+		return oldFile
+	}
+	return fixedFile
+}
+
+// FixPackageVisibility makes sure oldFile has a package declaration whose
+// default_visibility is visibility, as set with the default_visibility
+// directive. An existing declaration is updated, unless it or its
+// default_visibility attribute is marked with "# keep". Otherwise, a new
+// declaration is added after the load statements at the top of the file.
+// Visibility attributes of generated rules that match the default are then
+// removed. If visibility is empty or nothing needs to change, oldFile is
+// returned.
+func FixPackageVisibility(oldFile *bf.File, visibility []string) *bf.File {
+	if len(visibility) == 0 {
+		return oldFile
+	}
+
+	newVis := &bf.ListExpr{List: make([]bf.Expr, len(visibility))}
+	for i, v := range visibility {
+		newVis.List[i] = &bf.StringExpr{Value: v}
+	}
+
+	fixedFile := oldFile
+	pkgIndex := -1
+	for i, stmt := range oldFile.Stmt {
+		if c, ok := stmt.(*bf.CallExpr); ok && kind(c) == "package" {
+			pkgIndex = i
+			break
+		}
+	}
+	if pkgIndex >= 0 {
+		c := oldFile.Stmt[pkgIndex].(*bf.CallExpr)
+		r := bf.Rule{Call: c}
+		attr := r.AttrDefn("default_visibility")
+		oldVis, _ := ListStrings(r.Attr("default_visibility"))
+		if !shouldKeep(c) && (attr == nil || !shouldKeep(attr)) && !sameStrings(oldVis, visibility) {
+			fixedAttr := &bf.BinaryExpr{X: &bf.LiteralExpr{Token: "default_visibility"}, Op: "=", Y: newVis}
+			fixedCall := *c
+			fixedCall.List = append([]bf.Expr{}, c.List...)
+			if attr == nil {
+				fixedCall.List = append(fixedCall.List, fixedAttr)
+			} else {
+				fixedAttr.Comments = attr.Comments
+				for i, arg := range fixedCall.List {
+					if arg == attr {
+						fixedCall.List[i] = fixedAttr
+					}
+				}
+			}
+			copied := *oldFile
+			copied.Stmt = append([]bf.Expr{}, oldFile.Stmt...)
+			copied.Stmt[pkgIndex] = &fixedCall
+			fixedFile = &copied
+		}
+	} else {
+		pkg := &bf.CallExpr{
+			X: &bf.LiteralExpr{Token: "package"},
+			List: []bf.Expr{&bf.BinaryExpr{
+				X:  &bf.LiteralExpr{Token: "default_visibility"},
+				Op: "=",
+				Y:  newVis,
+			}},
+		}
+
+		// The package declaration goes after leading loads. If there are none,
+		// it goes at the top, and loads added later are inserted above it.
+		i, hasLoads := 0, false
+		for ; i < len(oldFile.Stmt); i++ {
+			if _, ok := oldFile.Stmt[i].(*bf.CommentBlock); ok && !hasLoads {
+				continue
+			}
+			if _, _, ok := loadFile(oldFile.Stmt[i]); !ok {
+				break
+			}
+			hasLoads = true
+		}
+		copied := *oldFile
+		if hasLoads {
+			copied.Stmt = make([]bf.Expr, 0, len(oldFile.Stmt)+1)
+			copied.Stmt = append(copied.Stmt, oldFile.Stmt[:i]...)
+			copied.Stmt = append(copied.Stmt, pkg)
+			copied.Stmt = append(copied.Stmt, oldFile.Stmt[i:]...)
+		} else {
+			copied.Stmt = insertLeadingStmts(oldFile.Stmt, []bf.Expr{pkg})
+		}
+		fixedFile = &copied
+	}
+	return removeRedundantVisibility(fixedFile)
+}
+
+// sameStrings returns whether a and b contain the same strings, ignoring
+// order and duplicates.
+func sameStrings(a, b []string) bool {
+	aSet := make(map[string]bool)
+	for _, s := range a {
+		aSet[s] = true
+	}
+	bSet := make(map[string]bool)
+	for _, s := range b {
+		if !aSet[s] {
+			return false
+		}
+		bSet[s] = true
+	}
+	return len(aSet) == len(bSet)
 }
 
 // squashCgoLibrary removes cgo_library rules with the default name and
@@ -58,7 +215,7 @@ func squashCgoLibrary(oldFile *bf.File) *bf.File {
 		r := bf.Rule{Call: c}
 		if r.Kind() == "cgo_library" && r.Name() == config.DefaultCgoLibName && !shouldKeep(c) {
 			if cgoLibrary.Call != nil {
-				log.Printf("%s: when fixing existing file, multiple cgo_library rules with default name found", oldFile.Path)
+				logging.WarningfAt(oldFile.Path, startLine(c), "when fixing existing file, multiple cgo_library rules with default name found")
 				continue
 			}
 			cgoLibrary = r
@@ -67,7 +224,7 @@ func squashCgoLibrary(oldFile *bf.File) *bf.File {
 		}
 		if r.Kind() == "go_library" && r.Name() == config.DefaultLibName {
 			if goLibrary.Call != nil {
-				log.Printf("%s: when fixing existing file, multiple go_library rules with default name referencing cgo_library found", oldFile.Path)
+				logging.WarningfAt(oldFile.Path, startLine(c), "when fixing existing file, multiple go_library rules with default name referencing cgo_library found")
 				continue
 			}
 			goLibrary = r
@@ -82,7 +239,10 @@ func squashCgoLibrary(oldFile *bf.File) *bf.File {
 	// If go_library has a '# keep' comment, just delete cgo_library.
 	if goLibrary.Call != nil && shouldKeep(goLibrary.Call) {
 		fixedFile := *oldFile
-		fixedFile.Stmt = append(fixedFile.Stmt[:cgoLibraryIndex], fixedFile.Stmt[cgoLibraryIndex+1:]...)
+		fixedFile.Stmt = make([]bf.Expr, 0, len(oldFile.Stmt))
+		fixedFile.Stmt = append(fixedFile.Stmt, oldFile.Stmt[:cgoLibraryIndex]...)
+		fixedFile.Stmt = append(fixedFile.Stmt, deletedStmtComments(cgoLibrary.Call)...)
+		fixedFile.Stmt = append(fixedFile.Stmt, oldFile.Stmt[cgoLibraryIndex+1:]...)
 		return &fixedFile
 	}
 
@@ -108,7 +268,7 @@ func squashCgoLibrary(oldFile *bf.File) *bf.File {
 	fixedGoLibraryExpr.Comments.Suffix = append(fixedGoLibraryExpr.Comments.Suffix, cgoLibrary.Call.Comments.Suffix...)
 	fixedGoLibraryExpr.Comments.After = append(fixedGoLibraryExpr.Comments.After, cgoLibrary.Call.Comments.After...)
 
-	for _, key := range []string{"cdeps", "clinkopts", "copts", "data", "deps", "gc_goopts", "srcs"} {
+	for _, key := range []string{"cdeps", "clinkopts", "copts", "data", "deps", "gc_goopts", "srcs", "x_defs"} {
 		goLibraryAttr := fixedGoLibrary.Attr(key)
 		cgoLibraryAttr := cgoLibrary.Attr(key)
 		if cgoLibraryAttr == nil {
@@ -144,7 +304,14 @@ func squashCgoLibrary(oldFile *bf.File) *bf.File {
 //   * calls to select with a dict argument. The dict keys must be strings,
 //     and the values must be lists.
 //   * lists combined with select using +. The list must be the left operand.
+//   * dicts with string keys, like x_defs.
 func squashExpr(x, y bf.Expr) (bf.Expr, error) {
+	if xKV, yKV, ok, err := keyValueDicts(x, y); err != nil {
+		return nil, err
+	} else if ok {
+		return squashKeyValueDict(xKV, yKV)
+	}
+
 	xList, xDict, err := exprListAndDict(x)
 	if err != nil {
 		return nil, err
@@ -181,6 +348,44 @@ func squashExpr(x, y bf.Expr) (bf.Expr, error) {
 	}, nil
 }
 
+// squashKeyValueDict combines dicts with string keys, like x_defs. Entries in
+// x take precedence over entries in y with the same key; a warning is logged
+// if their values differ.
+func squashKeyValueDict(x, y *bf.DictExpr) (*bf.DictExpr, error) {
+	if x == nil {
+		return y, nil
+	}
+	if y == nil {
+		return x, nil
+	}
+
+	squashed := *x
+	squashed.List = append([]bf.Expr{}, x.List...)
+	xValues := make(map[string]bf.Expr)
+	for _, e := range x.List {
+		kv, key, err := keyValueEntry(e)
+		if err != nil {
+			return nil, err
+		}
+		xValues[key] = kv.Value
+	}
+	for _, e := range y.List {
+		kv, key, err := keyValueEntry(e)
+		if err != nil {
+			return nil, err
+		}
+		xValue, ok := xValues[key]
+		if !ok {
+			squashed.List = append(squashed.List, kv)
+			continue
+		}
+		if xStr, yStr := bf.FormatString(xValue), bf.FormatString(kv.Value); xStr != yStr {
+			logging.Warningf("dict key %q: conflicting values %s and %s; keeping %s", key, xStr, yStr, xStr)
+		}
+	}
+	return &squashed, nil
+}
+
 func squashList(x, y *bf.ListExpr) *bf.ListExpr {
 	if x == nil {
 		return y
@@ -248,10 +453,87 @@ func squashDict(x, y *bf.DictExpr) (*bf.DictExpr, error) {
 	return &squashed, nil
 }
 
+// FixVendorFile removes rules and load statements from a build file in a
+// vendor directory that would conflict with rules generated by Gazelle.
+// Vendored code sometimes ships with build files written for the upstream
+// repository. These often load macros from files that don't exist in the
+// vendoring repository. Loads of files other than the ones Gazelle knows
+// about are removed, along with any rules that use symbols they loaded.
+// Statements with "# keep" comments are preserved.
+//
+// FixLoads should be called after this, since the remaining rules may need
+// symbols that are no longer loaded.
+func FixVendorFile(oldFile *bf.File) *bf.File {
+	otherLoadedKinds := make(map[string]bool)
+	var removed []int
+	for i, stmt := range oldFile.Stmt {
+		c, ok := stmt.(*bf.CallExpr)
+		if !ok {
+			continue
+		}
+		x, ok := c.X.(*bf.LiteralExpr)
+		if !ok || x.Token != "load" || len(c.List) == 0 {
+			continue
+		}
+		label, ok := c.List[0].(*bf.StringExpr)
+		if !ok || knownFiles[label.Value] || shouldKeep(c) {
+			continue
+		}
+		for _, arg := range c.List[1:] {
+			if local, _, ok := loadBinding(arg); ok {
+				otherLoadedKinds[local] = true
+			}
+		}
+		removed = append(removed, i)
+	}
+	if len(removed) == 0 {
+		return oldFile
+	}
+
+	for i, stmt := range oldFile.Stmt {
+		c, ok := stmt.(*bf.CallExpr)
+		if !ok || shouldKeep(c) {
+			continue
+		}
+		if x, ok := c.X.(*bf.LiteralExpr); ok && otherLoadedKinds[x.Token] {
+			removed = append(removed, i)
+		}
+	}
+	sort.Ints(removed)
+
+	fixedFile := *oldFile
+	fixedFile.Stmt = make([]bf.Expr, 0, len(oldFile.Stmt))
+	for i, stmt := range oldFile.Stmt {
+		if len(removed) > 0 && removed[0] == i {
+			removed = removed[1:]
+			fixedFile.Stmt = append(fixedFile.Stmt, deletedStmtComments(stmt)...)
+			continue
+		}
+		fixedFile.Stmt = append(fixedFile.Stmt, stmt)
+	}
+	return &fixedFile
+}
+
 // FixLoads removes loads of unused go rules and adds loads of newly used rules.
 // This should be called after FixFile and MergeWithExisting, since symbols
-// may be introduced that aren't loaded.
-func FixLoads(oldFile *bf.File) *bf.File {
+// may be introduced that aren't loaded. Duplicate loads are cleaned up first
+// with dedupLoads.
+//
+// extraLoads lists files whose loads are managed in addition to the files
+// Gazelle knows about, usually from "# gazelle:load" directives. Loads for
+// these files are ordered after loads for known files. A kind listed in
+// extraLoads is loaded from the file listed there, even if Gazelle knows
+// the kind from another file.
+func FixLoads(oldFile *bf.File, extraLoads []config.LoadInfo) *bf.File {
+	allLoads := knownLoads
+	if len(extraLoads) > 0 {
+		allLoads = make([]config.LoadInfo, 0, len(knownLoads)+len(extraLoads))
+		allLoads = append(allLoads, knownLoads...)
+		allLoads = append(allLoads, extraLoads...)
+	}
+	files, fileSet, kindFiles := loadTables(allLoads)
+	oldFile = dedupLoads(oldFile)
+
 	// Make a list of load statements in the file. Keep track of loads of known
 	// files, since these may be changed. Keep track of known symbols loaded from
 	// unknown files; we will not add loads for these.
@@ -263,38 +545,18 @@ func FixLoads(oldFile *bf.File) *bf.File {
 	var loads []loadInfo
 	otherLoadedKinds := make(map[string]bool)
 	for i, stmt := range oldFile.Stmt {
-		c, ok := stmt.(*bf.CallExpr)
-		if !ok {
-			continue
-		}
-		x, ok := c.X.(*bf.LiteralExpr)
-		if !ok || x.Token != "load" {
-			continue
-		}
-
-		if len(c.List) == 0 {
-			continue
-		}
-		label, ok := c.List[0].(*bf.StringExpr)
+		c, file, ok := loadFile(stmt)
 		if !ok {
 			continue
 		}
 
-		if knownFiles[label.Value] {
-			loads = append(loads, loadInfo{index: i, file: label.Value, old: c})
+		if fileSet[file] {
+			loads = append(loads, loadInfo{index: i, file: file, old: c})
 			continue
 		}
 		for _, arg := range c.List[1:] {
-			switch sym := arg.(type) {
-			case *bf.StringExpr:
-				otherLoadedKinds[sym.Value] = true
-			case *bf.BinaryExpr:
-				if sym.Op != "=" {
-					continue
-				}
-				if x, ok := sym.X.(*bf.LiteralExpr); ok {
-					otherLoadedKinds[x.Token] = true
-				}
+			if local, _, ok := loadBinding(arg); ok {
+				otherLoadedKinds[local] = true
 			}
 		}
 	}
@@ -312,7 +574,7 @@ func FixLoads(oldFile *bf.File) *bf.File {
 		}
 
 		kind := x.Token
-		if file, ok := knownKinds[kind]; ok && !otherLoadedKinds[kind] {
+		if file, ok := kindFiles[kind]; ok && !otherLoadedKinds[kind] {
 			if usedKinds[file] == nil {
 				usedKinds[file] = make(map[string]bool)
 			}
@@ -321,11 +583,10 @@ func FixLoads(oldFile *bf.File) *bf.File {
 	}
 
 	// Fix the load statements. The order is important, so we iterate over
-	// knownLoads instead of knownFiles.
+	// files instead of fileSet.
 	changed := false
 	var newFirstLoads []*bf.CallExpr
-	for _, l := range knownLoads {
-		file := l.file
+	for _, file := range files {
 		first := true
 		for i, _ := range loads {
 			li := &loads[i]
@@ -333,15 +594,15 @@ func FixLoads(oldFile *bf.File) *bf.File {
 				continue
 			}
 			if first {
-				li.fixed = fixLoad(li.old, file, usedKinds[file])
+				li.fixed = fixLoad(li.old, file, usedKinds[file], kindFiles)
 				first = false
 			} else {
-				li.fixed = fixLoad(li.old, file, nil)
+				li.fixed = fixLoad(li.old, file, nil, kindFiles)
 			}
 			changed = changed || li.fixed != li.old
 		}
 		if first {
-			load := fixLoad(nil, file, usedKinds[file])
+			load := fixLoad(nil, file, usedKinds[file], kindFiles)
 			if load != nil {
 				newFirstLoads = append(newFirstLoads, load)
 				changed = true
@@ -352,26 +613,575 @@ func FixLoads(oldFile *bf.File) *bf.File {
 		return oldFile
 	}
 
-	// Rebuild the file.
+	// Rebuild the file. New loads go at the top, after comment blocks like
+	// license headers.
 	fixedFile := *oldFile
-	fixedFile.Stmt = make([]bf.Expr, 0, len(oldFile.Stmt)+len(newFirstLoads))
-	for _, l := range newFirstLoads {
-		fixedFile.Stmt = append(fixedFile.Stmt, l)
-	}
+	fixedFile.Stmt = make([]bf.Expr, 0, len(oldFile.Stmt))
 	loadIndex := 0
 	for i, stmt := range oldFile.Stmt {
 		if loadIndex < len(loads) && i == loads[loadIndex].index {
 			if loads[loadIndex].fixed != nil {
 				fixedFile.Stmt = append(fixedFile.Stmt, loads[loadIndex].fixed)
+			} else {
+				fixedFile.Stmt = append(fixedFile.Stmt, deletedStmtComments(stmt)...)
 			}
 			loadIndex++
 			continue
 		}
 		fixedFile.Stmt = append(fixedFile.Stmt, stmt)
 	}
+	if len(newFirstLoads) > 0 {
+		ins := make([]bf.Expr, len(newFirstLoads))
+		for i, l := range newFirstLoads {
+			ins[i] = l
+		}
+		fixedFile.Stmt = insertLeadingStmts(fixedFile.Stmt, ins)
+	}
 	return &fixedFile
 }
 
+// FixLabels rewrites labels in the deps attributes of Go rules in oldFile in
+// the same style that Gazelle generates them. pkgRel is the slash-separated
+// path to the directory containing oldFile, relative to the repository root.
+// When short is true, labels for targets in the same package become relative
+// (":target"), and target names matching the last component of the package
+// are dropped ("//pkg" instead of "//pkg:pkg"). When short is false, labels
+// are written in full ("//pkg:target"). Labels marked with "# keep" are not
+// changed. If nothing needs to be rewritten, oldFile is returned.
+func FixLabels(oldFile *bf.File, pkgRel string, short bool) *bf.File {
+	fixLabel := func(s string) string {
+		l, err := resolve.ParseLabel(s)
+		if err != nil {
+			return s
+		}
+		if l.Relative {
+			l.Pkg = pkgRel
+			l.Relative = false
+		}
+		if !short {
+			return l.FullString()
+		}
+		l.Relative = l.Repo == "" && l.Pkg == pkgRel
+		return l.String()
+	}
+
+	var fixedFile *bf.File
+	for i, stmt := range oldFile.Stmt {
+		c, ok := stmt.(*bf.CallExpr)
+		if !ok || shouldKeep(c) {
+			continue
+		}
+		r := bf.Rule{Call: c}
+		if knownKinds[r.Kind()] == "" {
+			continue
+		}
+		deps := r.AttrDefn("deps")
+		if deps == nil || shouldKeep(deps) {
+			continue
+		}
+		fixedDeps, changed := fixLabelsExpr(deps.Y, fixLabel)
+		if !changed {
+			continue
+		}
+
+		fixedDepsAttr := *deps
+		fixedDepsAttr.Y = fixedDeps
+		fixedCall := *c
+		fixedCall.List = make([]bf.Expr, len(c.List))
+		for j, arg := range c.List {
+			if arg == deps {
+				arg = &fixedDepsAttr
+			}
+			fixedCall.List[j] = arg
+		}
+		if fixedFile == nil {
+			copied := *oldFile
+			copied.Stmt = append([]bf.Expr{}, oldFile.Stmt...)
+			fixedFile = &copied
+		}
+		fixedFile.Stmt[i] = &fixedCall
+	}
+	if fixedFile == nil {
+		return oldFile
+	}
+	return fixedFile
+}
+
+// LabelRename describes a library renamed by FixLibraryNames. Old and New
+// are full labels, like "//foo:go_default_library" and "//foo:foo".
+type LabelRename struct {
+	Old, New string
+}
+
+// FixLibraryNames renames the go_library named DefaultLibName in oldFile
+// after its directory, and rewrites labels of DefaultLibName targets in the
+// repository in the deps, embed, and library attributes of rules in oldFile
+// to match. pkgRel is the slash-separated path to the directory containing
+// oldFile, relative to the repository root. libName returns the new name of
+// the library in a directory.
+//
+// The library of a command, referenced by a go_binary, or a library whose
+// new name is already taken in oldFile gets a "_lib" suffix. Libraries
+// of commands are private, so labels of them in other directories aren't
+// expected. Rules and labels marked with "# keep" are not changed.
+//
+// The renamed library is returned along with the fixed file, so the change
+// can be reported to users of the library outside the repository. If
+// nothing needs to be changed, oldFile is returned.
+func FixLibraryNames(oldFile *bf.File, pkgRel string, libName func(rel string) string) (*bf.File, []LabelRename) {
+	localName := ""
+	names := make(map[string]bool)
+	for _, stmt := range oldFile.Stmt {
+		c, ok := stmt.(*bf.CallExpr)
+		if !ok {
+			continue
+		}
+		r := bf.Rule{Call: c}
+		names[r.Name()] = true
+		if r.Kind() == "go_library" && r.Name() == config.DefaultLibName && !shouldKeep(c) {
+			localName = libName(pkgRel)
+		}
+	}
+	if localName != "" && (names[localName] || hasBinaryOf(oldFile, config.DefaultLibName)) {
+		localName += "_lib"
+	}
+
+	fixLabel := func(s string) string {
+		l, err := resolve.ParseLabel(s)
+		if err != nil || l.Repo != "" || l.Name != config.DefaultLibName {
+			return s
+		}
+		if l.Relative || l.Pkg == pkgRel {
+			if localName == "" {
+				return s
+			}
+			l.Name = localName
+		} else {
+			l.Name = libName(l.Pkg)
+		}
+		if l.Relative {
+			return l.String()
+		}
+		return l.FullString()
+	}
+
+	var fixedFile *bf.File
+	for i, stmt := range oldFile.Stmt {
+		c, ok := stmt.(*bf.CallExpr)
+		if !ok || shouldKeep(c) {
+			continue
+		}
+		r := bf.Rule{Call: c}
+		rename := localName != "" && r.Kind() == "go_library" && r.Name() == config.DefaultLibName
+		fixedCall := *c
+		fixedCall.List = make([]bf.Expr, len(c.List))
+		changed := false
+		for j, arg := range c.List {
+			fixedCall.List[j] = arg
+			attr, ok := arg.(*bf.BinaryExpr)
+			if !ok || attr.Op != "=" || shouldKeep(attr) {
+				continue
+			}
+			key, ok := attr.X.(*bf.LiteralExpr)
+			if !ok {
+				continue
+			}
+			var value bf.Expr
+			switch key.Token {
+			case "name":
+				name, ok := attr.Y.(*bf.StringExpr)
+				if !rename || !ok {
+					continue
+				}
+				fixedName := *name
+				fixedName.Value = localName
+				value = &fixedName
+			case "deps", "embed", "library":
+				if value, ok = fixLabelsExpr(attr.Y, fixLabel); !ok {
+					continue
+				}
+			default:
+				continue
+			}
+			fixedAttr := *attr
+			fixedAttr.Y = value
+			fixedCall.List[j] = &fixedAttr
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		if fixedFile == nil {
+			copied := *oldFile
+			copied.Stmt = append([]bf.Expr{}, oldFile.Stmt...)
+			fixedFile = &copied
+		}
+		fixedFile.Stmt[i] = &fixedCall
+	}
+	if fixedFile == nil {
+		return oldFile, nil
+	}
+	var renames []LabelRename
+	if localName != "" {
+		renames = []LabelRename{{
+			Old: resolve.Label{Pkg: pkgRel, Name: config.DefaultLibName}.FullString(),
+			New: resolve.Label{Pkg: pkgRel, Name: localName}.FullString(),
+		}}
+	}
+	return fixedFile, renames
+}
+
+// AddLibraryAlias adds an alias named DefaultLibName for the go_library
+// named "name" in oldFile, right after the library, so labels of a library
+// renamed by FixLibraryNames keep working outside the repository for a
+// deprecation period. The alias gets the library's visibility. If there's no
+// such library, or oldFile already has a rule named DefaultLibName, oldFile
+// is returned. RemoveLibraryAliases removes the alias later.
+func AddLibraryAlias(oldFile *bf.File, name string) *bf.File {
+	libIndex := -1
+	for i, stmt := range oldFile.Stmt {
+		c, ok := stmt.(*bf.CallExpr)
+		if !ok {
+			continue
+		}
+		r := bf.Rule{Call: c}
+		if r.Name() == config.DefaultLibName {
+			return oldFile
+		}
+		if r.Kind() == "go_library" && r.Name() == name {
+			libIndex = i
+		}
+	}
+	if libIndex < 0 {
+		return oldFile
+	}
+
+	var aliasExpr bf.CallExpr
+	alias := bf.Rule{&aliasExpr}
+	alias.SetKind("alias")
+	alias.SetAttr("name", &bf.StringExpr{Value: config.DefaultLibName})
+	alias.SetAttr("actual", &bf.StringExpr{Value: ":" + name})
+	lib := bf.Rule{Call: oldFile.Stmt[libIndex].(*bf.CallExpr)}
+	if vis := lib.Attr("visibility"); vis != nil {
+		alias.SetAttr("visibility", vis)
+	}
+	aliasExpr.Comments.Before = []bf.Comment{{Token: fmt.Sprintf("# Deprecated: use :%s instead.", name)}}
+
+	fixedFile := *oldFile
+	fixedFile.Stmt = make([]bf.Expr, 0, len(oldFile.Stmt)+1)
+	fixedFile.Stmt = append(fixedFile.Stmt, oldFile.Stmt[:libIndex+1]...)
+	fixedFile.Stmt = append(fixedFile.Stmt, &aliasExpr)
+	fixedFile.Stmt = append(fixedFile.Stmt, oldFile.Stmt[libIndex+1:]...)
+	return &fixedFile
+}
+
+// RemoveLibraryAliases removes aliases added by AddLibraryAlias: aliases
+// named DefaultLibName whose actual target is a go_library in oldFile.
+// Aliases marked with "# keep" are not removed. If nothing is removed,
+// oldFile is returned.
+func RemoveLibraryAliases(oldFile *bf.File) *bf.File {
+	libraries := make(map[string]bool)
+	for _, r := range oldFile.Rules("go_library") {
+		libraries[":"+r.Name()] = true
+	}
+	fixedFile := *oldFile
+	fixedFile.Stmt = make([]bf.Expr, 0, len(oldFile.Stmt))
+	for _, stmt := range oldFile.Stmt {
+		if c, ok := stmt.(*bf.CallExpr); ok && !shouldKeep(c) {
+			r := bf.Rule{Call: c}
+			if r.Kind() == "alias" && r.Name() == config.DefaultLibName && libraries[r.AttrString("actual")] {
+				// The deprecation comment added with the alias goes, too.
+				continue
+			}
+		}
+		fixedFile.Stmt = append(fixedFile.Stmt, stmt)
+	}
+	if len(fixedFile.Stmt) == len(oldFile.Stmt) {
+		return oldFile
+	}
+	return &fixedFile
+}
+
+// hasBinaryOf returns whether f contains a go_binary that embeds the
+// library named "name" in the same file, with the library or embed
+// attribute.
+func hasBinaryOf(f *bf.File, name string) bool {
+	for _, r := range f.Rules("go_binary") {
+		if r.AttrString("library") == ":"+name {
+			return true
+		}
+		for _, e := range r.AttrStrings("embed") {
+			if e == ":"+name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fixLabelsExpr applies fix to each string in e, which may be a list,
+// a call to select, or a sum of these. e is not modified; a copy is returned
+// along with true if any string was changed.
+func fixLabelsExpr(e bf.Expr, fix func(string) string) (bf.Expr, bool) {
+	switch e := e.(type) {
+	case *bf.StringExpr:
+		if shouldKeep(e) {
+			return e, false
+		}
+		s := fix(e.Value)
+		if s == e.Value {
+			return e, false
+		}
+		fixed := *e
+		fixed.Value = s
+		return &fixed, true
+
+	case *bf.ListExpr:
+		fixed := *e
+		fixed.List = make([]bf.Expr, len(e.List))
+		anyChanged := false
+		for i, elem := range e.List {
+			var changed bool
+			fixed.List[i], changed = fixLabelsExpr(elem, fix)
+			anyChanged = anyChanged || changed
+		}
+		if !anyChanged {
+			return e, false
+		}
+		return &fixed, true
+
+	case *bf.BinaryExpr:
+		if e.Op != "+" {
+			return e, false
+		}
+		x, xChanged := fixLabelsExpr(e.X, fix)
+		y, yChanged := fixLabelsExpr(e.Y, fix)
+		if !xChanged && !yChanged {
+			return e, false
+		}
+		fixed := *e
+		fixed.X, fixed.Y = x, y
+		return &fixed, true
+
+	case *bf.CallExpr:
+		x, ok := e.X.(*bf.LiteralExpr)
+		if !ok || x.Token != "select" || len(e.List) != 1 {
+			return e, false
+		}
+		d, ok := e.List[0].(*bf.DictExpr)
+		if !ok {
+			return e, false
+		}
+		fixedDict := *d
+		fixedDict.List = make([]bf.Expr, len(d.List))
+		anyChanged := false
+		for i, entry := range d.List {
+			fixedDict.List[i] = entry
+			kv, ok := entry.(*bf.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			v, changed := fixLabelsExpr(kv.Value, fix)
+			if changed {
+				fixedKV := *kv
+				fixedKV.Value = v
+				fixedDict.List[i] = &fixedKV
+				anyChanged = true
+			}
+		}
+		if !anyChanged {
+			return e, false
+		}
+		fixed := *e
+		fixed.List = []bf.Expr{&fixedDict}
+		return &fixed, true
+	}
+	return e, false
+}
+
+// dedupLoads merges load statements for the same file into the first such
+// statement, and removes symbols that are loaded more than once. When a
+// symbol is loaded twice under the same name from the same file, the second
+// copy is dropped. When a name is bound to a different symbol later in the
+// file, the earlier binding is shadowed and dropped. Comments on removed
+// statements and symbols are moved to the statement or symbol that
+// replaces them. If nothing changes, oldFile is returned.
+func dedupLoads(oldFile *bf.File) *bf.File {
+	type binding struct {
+		load, arg   int
+		file, local string
+		symbol      string
+	}
+	var loads []*bf.CallExpr
+	loadIndex := make(map[int]int) // statement index to index in loads
+	firstLoad := make(map[string]int)
+	deleted := make(map[int]bool)
+	changed := false
+	for i, stmt := range oldFile.Stmt {
+		c, file, ok := loadFile(stmt)
+		if !ok {
+			continue
+		}
+		if j, ok := firstLoad[file]; ok {
+			first := loads[j]
+			first.List = append(first.List, c.List[1:]...)
+			moveComments(&first.Comments, &c.Comments)
+			deleted[i] = true
+			changed = true
+			continue
+		}
+		copied := *c
+		copied.List = append([]bf.Expr{}, c.List...)
+		copied.Comments = copyComments(c.Comments)
+		firstLoad[file] = len(loads)
+		loadIndex[i] = len(loads)
+		loads = append(loads, &copied)
+	}
+
+	bound := make(map[string]binding)
+	dropped := make(map[[2]int]bool)
+	for li, l := range loads {
+		file := l.List[0].(*bf.StringExpr).Value
+		for ai, arg := range l.List[1:] {
+			ai++
+			local, symbol, ok := loadBinding(arg)
+			if !ok {
+				continue
+			}
+			b := binding{load: li, arg: ai, file: file, local: local, symbol: symbol}
+			prev, ok := bound[local]
+			if !ok {
+				bound[local] = b
+				continue
+			}
+			changed = true
+			if prev.file == file && prev.symbol == symbol {
+				// Duplicate: keep the first copy.
+				prevLoad := loads[prev.load]
+				prevLoad.List[prev.arg] = withComments(prevLoad.List[prev.arg], arg)
+				dropped[[2]int{li, ai}] = true
+				continue
+			}
+			// Shadowed: keep the later binding.
+			prevLoad := loads[prev.load]
+			l.List[ai] = withComments(arg, prevLoad.List[prev.arg])
+			dropped[[2]int{prev.load, prev.arg}] = true
+			bound[local] = b
+		}
+	}
+	if !changed {
+		return oldFile
+	}
+
+	fixedFile := *oldFile
+	fixedFile.Stmt = make([]bf.Expr, 0, len(oldFile.Stmt))
+	for i, stmt := range oldFile.Stmt {
+		if deleted[i] {
+			continue
+		}
+		li, ok := loadIndex[i]
+		if !ok {
+			fixedFile.Stmt = append(fixedFile.Stmt, stmt)
+			continue
+		}
+		l := loads[li]
+		args := l.List[:1]
+		for ai, arg := range l.List[1:] {
+			if !dropped[[2]int{li, ai + 1}] {
+				args = append(args, arg)
+			}
+		}
+		if len(args) == 1 {
+			fixedFile.Stmt = append(fixedFile.Stmt, deletedStmtComments(l)...)
+			continue
+		}
+		l.List = args
+		fixedFile.Stmt = append(fixedFile.Stmt, l)
+	}
+	return &fixedFile
+}
+
+// loadFile returns stmt as a load statement and the label of the file it
+// loads. false is returned if stmt is not a load statement.
+func loadFile(stmt bf.Expr) (*bf.CallExpr, string, bool) {
+	c, ok := stmt.(*bf.CallExpr)
+	if !ok {
+		return nil, "", false
+	}
+	x, ok := c.X.(*bf.LiteralExpr)
+	if !ok || x.Token != "load" || len(c.List) == 0 {
+		return nil, "", false
+	}
+	label, ok := c.List[0].(*bf.StringExpr)
+	if !ok {
+		return nil, "", false
+	}
+	return c, label.Value, true
+}
+
+// loadBinding returns the name an argument of a load statement binds and
+// the symbol it binds that name to. For "x", both are x. For y = "x", the
+// name is y and the symbol is x.
+func loadBinding(arg bf.Expr) (local, symbol string, ok bool) {
+	switch arg := arg.(type) {
+	case *bf.StringExpr:
+		return arg.Value, arg.Value, true
+	case *bf.BinaryExpr:
+		if arg.Op != "=" {
+			return "", "", false
+		}
+		x, ok := arg.X.(*bf.LiteralExpr)
+		if !ok {
+			return "", "", false
+		}
+		y, ok := arg.Y.(*bf.StringExpr)
+		if !ok {
+			return "", "", false
+		}
+		return x.Token, y.Value, true
+	}
+	return "", "", false
+}
+
+// withComments returns a copy of keep with the comments of drop added to its
+// own. keep is returned if drop has no comments.
+func withComments(keep, drop bf.Expr) bf.Expr {
+	dc := drop.Comment()
+	if len(dc.Before) == 0 && len(dc.Suffix) == 0 && len(dc.After) == 0 {
+		return keep
+	}
+	var copied bf.Expr
+	switch keep := keep.(type) {
+	case *bf.StringExpr:
+		c := *keep
+		copied = &c
+	case *bf.BinaryExpr:
+		c := *keep
+		copied = &c
+	default:
+		return keep
+	}
+	*copied.Comment() = copyComments(*keep.Comment())
+	moveComments(copied.Comment(), dc)
+	return copied
+}
+
+// copyComments returns a copy of c that doesn't share storage with it.
+func copyComments(c bf.Comments) bf.Comments {
+	return bf.Comments{
+		Before: append([]bf.Comment(nil), c.Before...),
+		Suffix: append([]bf.Comment(nil), c.Suffix...),
+		After:  append([]bf.Comment(nil), c.After...),
+	}
+}
+
+// moveComments appends the comments in from to the comments in to.
+func moveComments(to, from *bf.Comments) {
+	to.Before = append(to.Before, from.Before...)
+	to.Suffix = append(to.Suffix, from.Suffix...)
+	to.After = append(to.After, from.After...)
+}
+
 // knownLoads is a list of files Gazelle will generate loads from and
 // the symbols it knows about.  All symbols Gazelle ever generated
 // loads for are present, including symbols it no longer uses (e.g.,
@@ -379,17 +1189,17 @@ func FixLoads(oldFile *bf.File) *bf.File {
 // included. The order of the files here will match the order of
 // generated load statements. The symbols should be sorted
 // lexicographically.
-var knownLoads = []struct {
-	file  string
-	kinds []string
-}{
+var knownLoads = []config.LoadInfo{
 	{
 		"@io_bazel_rules_go//go:def.bzl",
 		[]string{
 			"cgo_library",
+			"gazelle",
 			"go_binary",
 			"go_library",
+			"go_path",
 			"go_prefix",
+			"go_source",
 			"go_test",
 		},
 	}, {
@@ -409,23 +1219,34 @@ var knownFiles map[string]bool
 var knownKinds map[string]string
 
 func init() {
-	knownFiles = make(map[string]bool)
-	knownKinds = make(map[string]string)
-	for _, l := range knownLoads {
-		knownFiles[l.file] = true
-		for _, k := range l.kinds {
-			knownKinds[k] = l.file
+	_, knownFiles, knownKinds = loadTables(knownLoads)
+}
+
+// loadTables returns the files in loads in order without duplicates, the
+// same files as a set, and a map from kinds to the files they are loaded
+// from. When a kind is listed for more than one file, the last file wins.
+func loadTables(loads []config.LoadInfo) (files []string, fileSet map[string]bool, kinds map[string]string) {
+	fileSet = make(map[string]bool)
+	kinds = make(map[string]string)
+	for _, l := range loads {
+		if !fileSet[l.File] {
+			fileSet[l.File] = true
+			files = append(files, l.File)
+		}
+		for _, k := range l.Kinds {
+			kinds[k] = l.File
 		}
 	}
+	return files, fileSet, kinds
 }
 
 // fixLoad updates a load statement. load must be a load statement for
 // the Go rules or nil. If nil, a new statement may be created. Symbols in
-// kinds are added if they are not already present, symbols in knownKinds
+// kinds are added if they are not already present, symbols in kindFiles
 // are removed if they are not in kinds, and other symbols and arguments
 // are preserved. nil is returned if the statement should be deleted because
 // it is empty.
-func fixLoad(load *bf.CallExpr, file string, kinds map[string]bool) *bf.CallExpr {
+func fixLoad(load *bf.CallExpr, file string, kinds map[string]bool, kindFiles map[string]string) *bf.CallExpr {
 	var fixed bf.CallExpr
 	if load == nil {
 		fixed = bf.CallExpr{
@@ -445,7 +1266,7 @@ func fixLoad(load *bf.CallExpr, file string, kinds map[string]bool) *bf.CallExpr
 	var added, removed int
 	for _, arg := range fixed.List[1:] {
 		if s, ok := arg.(*bf.StringExpr); ok {
-			if knownKinds[s.Value] == "" || kinds != nil && kinds[s.Value] {
+			if kindFiles[s.Value] == "" || kinds != nil && kinds[s.Value] {
 				symbols = append(symbols, s)
 				loadedKinds[s.Value] = true
 			} else {
@@ -472,7 +1293,7 @@ func fixLoad(load *bf.CallExpr, file string, kinds map[string]bool) *bf.CallExpr
 	}
 
 	sort.Stable(byString(symbols))
-	fixed.List = fixed.List[:1]
+	fixed.List = []bf.Expr{fixed.List[0]}
 	for _, sym := range symbols {
 		fixed.List = append(fixed.List, sym)
 	}
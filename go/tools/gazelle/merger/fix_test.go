@@ -16,9 +16,12 @@ limitations under the License.
 package merger
 
 import (
+	"path"
+	"reflect"
 	"testing"
 
 	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
 )
 
 type fixTestCase struct {
@@ -174,6 +177,97 @@ go_library(
 )
 # after go_library
 # after cgo_library
+`,
+		}, {
+			desc: "cgo_library x_defs merged with go_library",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    library = ":cgo_default_library",
+    x_defs = {
+        "a": "pure",
+        "b": "pure",
+    },
+)
+
+cgo_library(
+    name = "cgo_default_library",
+    x_defs = {
+        "b": "cgo",
+        "c": "cgo",
+    },
+)
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    x_defs = {
+        "a": "pure",
+        "b": "pure",
+        "c": "cgo",
+    },
+    cgo = True,
+)
+`,
+		},
+		{
+			desc: "visibility matching default removed",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+package(default_visibility = ["//foo:__subpackages__"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    visibility = ["//foo:__subpackages__"],
+)
+
+go_library(
+    name = "go_public_library",
+    srcs = ["public.go"],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_kept_library",
+    srcs = ["kept.go"],
+    visibility = ["//foo:__subpackages__"],  # keep
+)
+
+sh_binary(
+    name = "tool",
+    srcs = ["tool.sh"],
+    visibility = ["//foo:__subpackages__"],
+)
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+package(default_visibility = ["//foo:__subpackages__"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+
+go_library(
+    name = "go_public_library",
+    srcs = ["public.go"],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_kept_library",
+    srcs = ["kept.go"],
+    visibility = ["//foo:__subpackages__"],  # keep
+)
+
+sh_binary(
+    name = "tool",
+    srcs = ["tool.sh"],
+    visibility = ["//foo:__subpackages__"],
+)
 `,
 		},
 	} {
@@ -183,6 +277,382 @@ go_library(
 	}
 }
 
+func TestFixVendorFile(t *testing.T) {
+	for _, tc := range []fixTestCase{
+		{
+			desc: "no unknown loads",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+)
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+)
+`,
+		}, {
+			desc: "unknown loads and rules removed",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("//build:go.bzl", "go_library_with_deps", my_test = "go_test")
+
+go_library(
+    name = "go_default_library",
+)
+
+go_library_with_deps(
+    name = "lib",
+)
+
+my_test(
+    name = "lib_test",
+)
+
+cc_library(
+    name = "c",
+)
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+)
+
+cc_library(
+    name = "c",
+)
+`,
+		}, {
+			desc: "keep",
+			old: `load("//build:go.bzl", "go_library_with_deps")
+load("//build:other.bzl", "other")  # keep
+
+go_library_with_deps(
+    name = "lib",
+)  # keep
+
+other(
+    name = "other",
+)
+`,
+			want: `load("//build:other.bzl", "other")  # keep
+
+go_library_with_deps(
+    name = "lib",
+)  # keep
+
+other(
+    name = "other",
+)
+`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			testFix(t, tc, FixVendorFile)
+		})
+	}
+}
+
+func TestFixLabels(t *testing.T) {
+	old := `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    deps = [
+        "//foo/bar:go_default_library",
+        "//foo/baz:go_default_library",
+        "//foo/bar:bar",
+        "//foo/baz:baz",  # keep
+        "@org_golang_x_net//context:context",
+    ] + select({
+        "linux_amd64": ["//foo/bar:other"],
+        "//conditions:default": [],
+    }),
+)
+
+filegroup(
+    name = "all",
+    deps = ["//foo/baz:baz"],
+)
+`
+	for _, tc := range []struct {
+		fixTestCase
+		short bool
+	}{
+		{
+			fixTestCase: fixTestCase{
+				desc: "short",
+				old:  old,
+				want: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    deps = [
+        ":go_default_library",
+        "//foo/baz:go_default_library",
+        ":bar",
+        "//foo/baz:baz",  # keep
+        "@org_golang_x_net//context",
+    ] + select({
+        "linux_amd64": [":other"],
+        "//conditions:default": [],
+    }),
+)
+
+filegroup(
+    name = "all",
+    deps = ["//foo/baz:baz"],
+)
+`,
+			},
+			short: true,
+		}, {
+			fixTestCase: fixTestCase{
+				desc: "full",
+				old: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    deps = [
+        ":go_default_library",
+        "//foo/baz",
+        "@org_golang_x_net//context",
+    ],
+)
+`,
+				want: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    deps = [
+        "//foo/bar:go_default_library",
+        "//foo/baz:baz",
+        "@org_golang_x_net//context:context",
+    ],
+)
+`,
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			testFix(t, tc.fixTestCase, func(f *bf.File) *bf.File {
+				return FixLabels(f, "foo/bar", tc.short)
+			})
+		})
+	}
+}
+
+func TestFixLabelsUnchanged(t *testing.T) {
+	f := &bf.File{Stmt: []bf.Expr{&bf.CallExpr{
+		X: &bf.LiteralExpr{Token: "go_library"},
+		List: []bf.Expr{&bf.BinaryExpr{
+			X:  &bf.LiteralExpr{Token: "deps"},
+			Op: "=",
+			Y:  &bf.ListExpr{List: []bf.Expr{&bf.StringExpr{Value: ":go_default_library"}}},
+		}},
+	}}}
+	if got := FixLabels(f, "foo/bar", true); got != f {
+		t.Errorf("FixLabels returned a new file; want the original")
+	}
+	if got := FixLabels(f, "foo/bar", false); got == f {
+		t.Errorf("FixLabels returned the original file; want a new file")
+	}
+}
+
+func TestFixLibraryNames(t *testing.T) {
+	libName := func(rel string) string {
+		if rel == "" {
+			return "repo"
+		}
+		return path.Base(rel)
+	}
+	for _, tc := range []struct {
+		fixTestCase
+		renames []LabelRename
+	}{
+		{
+			fixTestCase: fixTestCase{
+				desc: "library",
+				old: `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+    deps = [
+        "//:go_default_library",
+        "//foo/baz:go_default_library",
+        "//foo/keep:go_default_library",  # keep
+        "@org_golang_x_net//context:go_default_library",
+    ],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["bar_test.go"],
+    library = ":go_default_library",
+)
+`,
+				want: `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "bar",
+    srcs = ["bar.go"],
+    deps = [
+        "//:repo",
+        "//foo/baz:baz",
+        "//foo/keep:go_default_library",  # keep
+        "@org_golang_x_net//context:go_default_library",
+    ],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["bar_test.go"],
+    library = ":bar",
+)
+`,
+			},
+			renames: []LabelRename{{Old: "//foo/bar:go_default_library", New: "//foo/bar:bar"}},
+		}, {
+			fixTestCase: fixTestCase{
+				desc: "command",
+				old: `load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    visibility = ["//visibility:private"],
+)
+
+go_binary(
+    name = "bar",
+    library = ":go_default_library",
+)
+`,
+				want: `load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "bar_lib",
+    srcs = ["main.go"],
+    visibility = ["//visibility:private"],
+)
+
+go_binary(
+    name = "bar",
+    library = ":bar_lib",
+)
+`,
+			},
+			renames: []LabelRename{{Old: "//foo/bar:go_default_library", New: "//foo/bar:bar_lib"}},
+		}, {
+			fixTestCase: fixTestCase{
+				desc: "kept library",
+				old: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+)  # keep
+
+filegroup(
+    name = "all",
+    srcs = [":go_default_library"],
+)
+`,
+				want: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+)  # keep
+
+filegroup(
+    name = "all",
+    srcs = [":go_default_library"],
+)
+`,
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var renames []LabelRename
+			testFix(t, tc.fixTestCase, func(f *bf.File) *bf.File {
+				var fixed *bf.File
+				fixed, renames = FixLibraryNames(f, "foo/bar", libName)
+				return fixed
+			})
+			if !reflect.DeepEqual(renames, tc.renames) {
+				t.Errorf("got renames %#v; want %#v", renames, tc.renames)
+			}
+		})
+	}
+}
+
+func TestLibraryAliases(t *testing.T) {
+	renamed := `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "bar",
+    srcs = ["bar.go"],
+    visibility = ["//visibility:public"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["bar_test.go"],
+    library = ":bar",
+)
+`
+	aliased := `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "bar",
+    srcs = ["bar.go"],
+    visibility = ["//visibility:public"],
+)
+
+# Deprecated: use :bar instead.
+alias(
+    name = "go_default_library",
+    actual = ":bar",
+    visibility = ["//visibility:public"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["bar_test.go"],
+    library = ":bar",
+)
+`
+	t.Run("add", func(t *testing.T) {
+		testFix(t, fixTestCase{old: renamed, want: aliased}, func(f *bf.File) *bf.File {
+			return AddLibraryAlias(f, "bar")
+		})
+	})
+	t.Run("add twice", func(t *testing.T) {
+		testFix(t, fixTestCase{old: aliased, want: aliased}, func(f *bf.File) *bf.File {
+			return AddLibraryAlias(f, "bar")
+		})
+	})
+	t.Run("remove", func(t *testing.T) {
+		testFix(t, fixTestCase{old: aliased, want: renamed}, func(f *bf.File) *bf.File {
+			return RemoveLibraryAliases(f)
+		})
+	})
+	t.Run("remove other", func(t *testing.T) {
+		other := `alias(
+    name = "go_default_library",
+    actual = "//other:lib",
+)
+`
+		testFix(t, fixTestCase{old: other, want: other}, func(f *bf.File) *bf.File {
+			return RemoveLibraryAliases(f)
+		})
+	})
+}
+
 func TestFixLoads(t *testing.T) {
 	for _, tc := range []fixTestCase{
 		{
@@ -335,11 +805,289 @@ go_proto_library(
 grpc_proto_library(
     name = "bar_go_proto",
 )
+`,
+		}, {
+			desc: "new load after header",
+			old: `# Copyright 2017 Example Authors.
+
+go_library(
+    name = "go_default_library",
+)
+`,
+			want: `# Copyright 2017 Example Authors.
+
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+)
+`,
+		}, {
+			desc: "new load takes first statement comments",
+			old: `# gazelle:prefix example.com/a
+go_library(
+    name = "go_default_library",
+)
+`,
+			want: `# gazelle:prefix example.com/a
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+)
+`,
+		}, {
+			desc: "deleted load keeps comments",
+			old: `# Keep this comment.
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+go_rule()
+`,
+			want: `# Keep this comment.
+
+go_rule()
+`,
+		}, {
+			desc: "duplicate loads merged",
+			old: `# Go rules
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# Tests
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_library(
+    name = "go_default_library",
+)
+
+go_test(
+    name = "go_default_test",
+)
+`,
+			want: `# Go rules
+# Tests
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "go_default_library",
+)
+
+go_test(
+    name = "go_default_test",
+)
+`,
+		}, {
+			desc: "duplicate symbol dropped",
+			old: `load(
+    "@io_bazel_rules_go//go:def.bzl",
+    "go_library",
+    "go_test",
+    "go_library",  # duplicate
+)
+
+go_library(
+    name = "go_default_library",
+)
+
+go_test(
+    name = "go_default_test",
+)
+`,
+			want: `load(
+    "@io_bazel_rules_go//go:def.bzl",
+    "go_library",  # duplicate
+    "go_test",
+)
+
+go_library(
+    name = "go_default_library",
+)
+
+go_test(
+    name = "go_default_test",
+)
+`,
+		}, {
+			desc: "shadowed symbol dropped",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("//build:defs.bzl", go_library = "go_team_library")
+
+go_library(
+    name = "go_default_library",
+)
+`,
+			want: `load(
+    "//build:defs.bzl",
+    go_library = "go_team_library",
+)
+
+go_library(
+    name = "go_default_library",
+)
+`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			testFix(t, tc, func(f *bf.File) *bf.File {
+				return FixLoads(f, nil)
+			})
+		})
+	}
+}
+
+func TestFixLoadsExtraLoads(t *testing.T) {
+	extraLoads := []config.LoadInfo{
+		{File: "@team//build:defs.bzl", Kinds: []string{"go_proto_compiler"}},
+		{File: "//build:go.bzl", Kinds: []string{"go_library"}},
+	}
+	for _, tc := range []fixTestCase{
+		{
+			desc: "add extra load",
+			old: `go_proto_compiler(
+    name = "compiler",
+)
+
+go_test(
+    name = "go_default_test",
+)
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_test")
+load("@team//build:defs.bzl", "go_proto_compiler")
+
+go_proto_compiler(
+    name = "compiler",
+)
+
+go_test(
+    name = "go_default_test",
+)
+`,
+		}, {
+			desc: "remove unused extra load",
+			old: `load("@team//build:defs.bzl", "go_proto_compiler", "other_macro")
+
+go_test(
+    name = "go_default_test",
+)
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_test")
+load("@team//build:defs.bzl", "other_macro")
+
+go_test(
+    name = "go_default_test",
+)
+`,
+		}, {
+			desc: "override known kind",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "go_default_library",
+)
+
+go_test(
+    name = "go_default_test",
+)
+`,
+			want: `load("//build:go.bzl", "go_library")
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_library(
+    name = "go_default_library",
+)
+
+go_test(
+    name = "go_default_test",
+)
+`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			testFix(t, tc, func(f *bf.File) *bf.File {
+				return FixLoads(f, extraLoads)
+			})
+		})
+	}
+}
+
+func TestFixPackageVisibility(t *testing.T) {
+	for _, tc := range []fixTestCase{
+		{
+			desc: "add after loads",
+			old: `# Copyright header
+
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    visibility = ["//foo:__subpackages__"],
+)
+`,
+			want: `# Copyright header
+
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+package(default_visibility = ["//foo:__subpackages__"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+`,
+		}, {
+			desc: "add without loads",
+			old: `go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+`,
+			want: `package(default_visibility = ["//foo:__subpackages__"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+`,
+		}, {
+			desc: "update existing",
+			old: `package(
+    default_visibility = ["//visibility:public"],
+    features = ["-layering_check"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    visibility = ["//visibility:public"],
+)
+`,
+			want: `package(
+    default_visibility = ["//foo:__subpackages__"],
+    features = ["-layering_check"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			desc: "keep existing",
+			old: `package(
+    default_visibility = ["//visibility:public"],  # keep
+)
+`,
+			want: `package(
+    default_visibility = ["//visibility:public"],  # keep
+)
 `,
 		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
-			testFix(t, tc, FixLoads)
+			testFix(t, tc, func(f *bf.File) *bf.File {
+				return FixPackageVisibility(f, []string{"//foo:__subpackages__"})
+			})
 		})
 	}
 }
@@ -24,6 +24,7 @@ import (
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 )
 
 const keep = "# keep" // marker in srcs or deps to tell gazelle to preserve.
@@ -34,9 +35,36 @@ var (
 		"clinkopts":  true,
 		"copts":      true,
 		"deps":       true,
+		"embed":      true,
+		"embedsrcs":  true,
 		"importpath": true,
 		"library":    true,
+		"proto":      true,
 		"srcs":       true,
+		"x_defs":     true,
+	}
+
+	// preservedFields are attributes that are never changed in existing
+	// rules, even when Gazelle generates a value for them or a policy is set
+	// with "# gazelle:attr". Generated values are only added to rules that
+	// don't have the attribute yet. tags is handled similarly, except that
+	// generated tags are added to existing tags; see mergeRule.
+	//
+	// The mode attributes of binaries and tests (msan, pure, race, static)
+	// are preserved, too, so values written by hand, including selects,
+	// are never stripped. So is rundir, since tests that read fixtures
+	// with relative paths depend on it, and so is testonly.
+	preservedFields = map[string]bool{
+		"flaky":       true,
+		"msan":        true,
+		"pure":        true,
+		"race":        true,
+		"rundir":      true,
+		"shard_count": true,
+		"size":        true,
+		"static":      true,
+		"testonly":    true,
+		"timeout":     true,
 	}
 )
 
@@ -45,12 +73,18 @@ var (
 //
 // "genFile" is a file generated by Gazelle. It must not be nil.
 // "oldFile" is the existing file. It may be nil if no file was found.
-// "empty" is a list of rules that may be deleted.
+// "empty" is a list of rules that may be deleted. These are generated rules
+// with no attributes other than name, because their sources no longer
+// exist. Matching rules in "oldFile" are deleted unless they are marked
+// with "# keep" or still have sources after merging, for example, sources
+// marked with "# keep".
+// "policies" overrides how attributes are merged, keyed by attribute name.
+// It may be nil; attributes without a policy are merged using the defaults.
 //
 // If "oldFile" is nil, "genFile" will be returned. If "oldFile" contains
 // a "# gazelle:ignore" comment, nil will be returned. If an error occurs,
 // it will be logged, and nil will be returned.
-func MergeWithExisting(genFile, oldFile *bf.File, empty []bf.Expr) *bf.File {
+func MergeWithExisting(genFile, oldFile *bf.File, empty []bf.Expr, policies map[string]config.AttrPolicy) *bf.File {
 	if oldFile == nil {
 		return genFile
 	}
@@ -61,11 +95,12 @@ func MergeWithExisting(genFile, oldFile *bf.File, empty []bf.Expr) *bf.File {
 	mergedFile := *oldFile
 	mergedFile.Stmt = make([]bf.Expr, 0, len(oldFile.Stmt))
 	for _, s := range oldFile.Stmt {
-		if oldRule, ok := s.(*bf.CallExpr); ok {
+		if oldRule, ok := s.(*bf.CallExpr); ok && isGazelleRule(oldRule) && !shouldKeep(oldRule) {
 			if _, genRule := match(empty, oldRule); genRule != nil {
-				s = mergeRule(genRule, oldRule)
-				if s == nil {
-					// Deleted empty rule
+				s = mergeRule(genRule, oldRule, policies)
+				if s == nil || !hasSrcs(s) {
+					// Deleted empty rule. Keep comments around it.
+					mergedFile.Stmt = append(mergedFile.Stmt, deletedStmtComments(oldRule)...)
 					continue
 				}
 			}
@@ -84,12 +119,17 @@ func MergeWithExisting(genFile, oldFile *bf.File, empty []bf.Expr) *bf.File {
 			mergedFile.Stmt = append(mergedFile.Stmt, genRule)
 			continue
 		}
+		if kind(oldRule) != "load" && !isGazelleRule(oldRule) {
+			// A rule Gazelle doesn't manage has this kind and name. Leave it
+			// alone rather than merging into it.
+			continue
+		}
 
 		var mergedRule bf.Expr
 		if kind(oldRule) == "load" {
 			mergedRule = mergeLoad(genRule, oldRule, oldFile)
 		} else {
-			mergedRule = mergeRule(genRule, oldRule)
+			mergedRule = mergeRule(genRule, oldRule, policies)
 		}
 		mergedFile.Stmt[i] = mergedRule
 	}
@@ -97,10 +137,214 @@ func MergeWithExisting(genFile, oldFile *bf.File, empty []bf.Expr) *bf.File {
 	return &mergedFile
 }
 
+// MergeWithKindAliases is like MergeWithExisting, but calls in "oldFile" to
+// macros named in "aliases" are merged as if they were rules of the kinds the
+// macros wrap. For example, with an alias from "team_go_library" to
+// "go_library", a generated go_library rule is merged into an existing
+// team_go_library call with the same name. Merged calls keep their macro
+// names, and calls that end up empty are deleted like other rules.
+func MergeWithKindAliases(genFile, oldFile *bf.File, empty []bf.Expr, policies map[string]config.AttrPolicy, aliases map[string]string) *bf.File {
+	if oldFile == nil || len(aliases) == 0 {
+		return MergeWithExisting(genFile, oldFile, empty, policies)
+	}
+
+	// Rename aliased calls to the kinds they wrap, and remember which ones
+	// were renamed so their macro names can be restored after merging.
+	macros := make(map[string]string)
+	unaliased := *oldFile
+	unaliased.Stmt = make([]bf.Expr, len(oldFile.Stmt))
+	for i, s := range oldFile.Stmt {
+		unaliased.Stmt[i] = s
+		c, ok := s.(*bf.CallExpr)
+		if !ok {
+			continue
+		}
+		macro := kind(c)
+		wrapped, ok := aliases[macro]
+		if !ok {
+			continue
+		}
+		renamed := setKind(c, wrapped)
+		macros[wrapped+" "+name(c)] = macro
+		unaliased.Stmt[i] = renamed
+	}
+	if len(macros) == 0 {
+		return MergeWithExisting(genFile, oldFile, empty, policies)
+	}
+
+	mergedFile := MergeWithExisting(genFile, &unaliased, empty, policies)
+	if mergedFile == nil {
+		return nil
+	}
+	for i, s := range mergedFile.Stmt {
+		c, ok := s.(*bf.CallExpr)
+		if !ok {
+			continue
+		}
+		if macro, ok := macros[kind(c)+" "+name(c)]; ok {
+			mergedFile.Stmt[i] = setKind(c, macro)
+		}
+	}
+	return mergedFile
+}
+
+// UpdateDeps returns a copy of oldFile where the deps attribute of each rule
+// Gazelle manages is merged with the deps of the rule with the same kind and
+// name in genFile, as MergeWithExisting would merge it. Nothing else is
+// changed: other attributes are left alone, and rules are neither added nor
+// deleted, so sources can be managed by hand. Calls to macros named in
+// "aliases" are matched by the kinds they wrap. "policies" may set a policy
+// for deps, as with MergeWithExisting.
+//
+// If oldFile contains a "# gazelle:ignore" comment, nil is returned.
+func UpdateDeps(genFile, oldFile *bf.File, policies map[string]config.AttrPolicy, aliases map[string]string) *bf.File {
+	if shouldIgnore(oldFile) {
+		return nil
+	}
+	updatedFile := *oldFile
+	updatedFile.Stmt = append([]bf.Expr(nil), oldFile.Stmt...)
+	for i, stmt := range oldFile.Stmt {
+		old, ok := stmt.(*bf.CallExpr)
+		if !ok || shouldKeep(old) {
+			continue
+		}
+		c := old
+		if wrapped, ok := aliases[kind(c)]; ok {
+			c = setKind(c, wrapped)
+		}
+		if !isGazelleRule(c) {
+			continue
+		}
+		if _, gen := match(genFile.Stmt, c); gen != nil {
+			updatedFile.Stmt[i] = mergeDeps(gen, old, policies)
+		}
+	}
+	return &updatedFile
+}
+
+// mergeDeps returns a copy of old with its deps attribute merged with the
+// deps of gen. Other attributes are copied from old unchanged.
+func mergeDeps(gen, old *bf.CallExpr, policies map[string]config.AttrPolicy) *bf.CallExpr {
+	genExpr := (&bf.Rule{Call: gen}).Attr("deps")
+	oldAttr := (&bf.Rule{Call: old}).AttrDefn("deps")
+	policy, hasPolicy := policies["deps"]
+
+	var mergedExpr bf.Expr
+	switch {
+	case oldAttr == nil:
+		if genExpr == nil || hasPolicy && policy == config.KeepAttr {
+			return old
+		}
+		mergedExpr = genExpr
+	case shouldKeep(oldAttr):
+		return old
+	case hasPolicy:
+		mergedExpr = mergeAttrWithPolicy(genExpr, oldAttr.Y, policy)
+	default:
+		var err error
+		mergedExpr, err = mergeExpr(genExpr, oldAttr.Y, false)
+		if err != nil {
+			logging.Infof("%s %q: replacing attribute %q with generated value: %v", kind(old), name(old), "deps", err)
+			mergedExpr = genExpr
+		}
+	}
+
+	merged := *old
+	merged.List = nil
+	for _, a := range old.List {
+		if a != bf.Expr(oldAttr) {
+			merged.List = append(merged.List, a)
+			continue
+		}
+		if mergedExpr != nil {
+			mergedAttr := *oldAttr
+			mergedAttr.Y = mergedExpr
+			merged.List = append(merged.List, &mergedAttr)
+		}
+	}
+	if oldAttr == nil {
+		merged.List = append(merged.List, &bf.BinaryExpr{X: &bf.LiteralExpr{Token: "deps"}, Op: "=", Y: mergedExpr})
+	}
+	return &merged
+}
+
+// RemoveRules returns a copy of oldFile without the rules that have the
+// same kinds and names as rules in "genRules", which are usually the rules
+// Gazelle generates for the directory, including empty ones. Calls to macros
+// named in "aliases" are matched by the kinds they wrap. Rules marked with
+// "# keep" and rules Gazelle doesn't manage are not removed, and comments
+// around removed rules are kept. Loads aren't changed; FixLoads should be
+// called afterward. If nothing is removed, or if oldFile has a
+// "# gazelle:ignore" comment, oldFile is returned.
+func RemoveRules(oldFile *bf.File, genRules []bf.Expr, aliases map[string]string) *bf.File {
+	if shouldIgnore(oldFile) {
+		return oldFile
+	}
+	var fixedFile *bf.File
+	for i, stmt := range oldFile.Stmt {
+		if !shouldRemove(stmt, genRules, aliases) {
+			if fixedFile != nil {
+				fixedFile.Stmt = append(fixedFile.Stmt, stmt)
+			}
+			continue
+		}
+		if fixedFile == nil {
+			fixedFile = &bf.File{}
+			*fixedFile = *oldFile
+			fixedFile.Stmt = append([]bf.Expr(nil), oldFile.Stmt[:i]...)
+		}
+		fixedFile.Stmt = append(fixedFile.Stmt, deletedStmtComments(stmt)...)
+	}
+	if fixedFile == nil {
+		return oldFile
+	}
+	return fixedFile
+}
+
+// shouldRemove returns whether RemoveRules should remove stmt.
+func shouldRemove(stmt bf.Expr, genRules []bf.Expr, aliases map[string]string) bool {
+	c, ok := stmt.(*bf.CallExpr)
+	if !ok || shouldKeep(c) {
+		return false
+	}
+	if wrapped, ok := aliases[kind(c)]; ok {
+		c = setKind(c, wrapped)
+	}
+	if !isGazelleRule(c) {
+		return false
+	}
+	_, genRule := match(genRules, c)
+	return genRule != nil
+}
+
+// isGazelleRule returns whether c is a call to a rule Gazelle generates,
+// merges, and deletes. Other calls, like cc_library, sh_test, filegroups
+// other than the legacy proto filegroup, and unknown rules and macros, are
+// never changed, moved, or deleted by merging and fixing.
+func isGazelleRule(c *bf.CallExpr) bool {
+	k := kind(c)
+	return knownKinds[k] != "" || k == "proto_library" || (k == "filegroup" && name(c) == config.DefaultProtosName)
+}
+
+// setKind returns a copy of the call c with its function name replaced by
+// kind. c must be a call to a plain name, like a rule or macro.
+func setKind(c *bf.CallExpr, kind string) *bf.CallExpr {
+	renamed := *c
+	if x, ok := c.X.(*bf.LiteralExpr); ok {
+		lit := *x
+		lit.Token = kind
+		renamed.X = &lit
+	} else {
+		renamed.X = &bf.LiteralExpr{Token: kind}
+	}
+	return &renamed
+}
+
 // merge combines information from gen and old and returns an updated rule.
 // Both rules must be non-nil and must have the same kind and same name.
-// If nil is returned, the rule should be deleted.
-func mergeRule(gen, old *bf.CallExpr) bf.Expr {
+// If nil is returned, the rule should be deleted. policies determines how
+// individual attributes are merged; see config.AttrPolicy.
+func mergeRule(gen, old *bf.CallExpr, policies map[string]config.AttrPolicy) bf.Expr {
 	genRule := bf.Rule{Call: gen}
 	oldRule := bf.Rule{Call: old}
 	merged := *old
@@ -122,6 +366,44 @@ func mergeRule(gen, old *bf.CallExpr) bf.Expr {
 	// Assume generated attributes have no comments.
 	for _, k := range oldRule.AttrKeys() {
 		oldAttr := oldRule.AttrDefn(k)
+		if preservedFields[k] {
+			merged.List = append(merged.List, oldAttr)
+			continue
+		}
+		if k == "tags" && !shouldKeep(oldAttr) {
+			// Tags set by the user are never removed, but default tags from
+			// "# gazelle:default_tags" are added to them.
+			mergedAttr := *oldAttr
+			if mergedExpr := mergeAttrWithPolicy(genRule.Attr(k), oldAttr.Y, config.MergeAttr); mergedExpr != nil {
+				mergedAttr.Y = mergedExpr
+			}
+			merged.List = append(merged.List, &mergedAttr)
+			continue
+		}
+		if policy, ok := policies[k]; ok && k != "name" && !shouldKeep(oldAttr) {
+			if mergedExpr := mergeAttrWithPolicy(genRule.Attr(k), oldAttr.Y, policy); mergedExpr != nil {
+				mergedAttr := *oldAttr
+				mergedAttr.Y = mergedExpr
+				merged.List = append(merged.List, &mergedAttr)
+			}
+			continue
+		}
+		if k == "data" && oldRule.Kind() == "go_test" && !shouldKeep(oldAttr) {
+			if mergedExpr := mergeTestdata(genRule.Attr(k), oldAttr.Y); mergedExpr != nil {
+				mergedAttr := *oldAttr
+				mergedAttr.Y = mergedExpr
+				merged.List = append(merged.List, &mergedAttr)
+			}
+			continue
+		}
+		if (k == "gc_goopts" || k == "gc_linkopts") && !shouldKeep(oldAttr) {
+			if mergedExpr := mergeGcOpts(genRule.Attr(k), oldAttr.Y); mergedExpr != nil {
+				mergedAttr := *oldAttr
+				mergedAttr.Y = mergedExpr
+				merged.List = append(merged.List, &mergedAttr)
+			}
+			continue
+		}
 		if !mergeableFields[k] || shouldKeep(oldAttr) {
 			merged.List = append(merged.List, oldAttr)
 			continue
@@ -129,9 +411,9 @@ func mergeRule(gen, old *bf.CallExpr) bf.Expr {
 
 		oldExpr := oldAttr.Y
 		genExpr := genRule.Attr(k)
-		mergedExpr, err := mergeExpr(genExpr, oldExpr)
+		mergedExpr, err := mergeExpr(genExpr, oldExpr, false)
 		if err != nil {
-			// TODO: add a verbose mode and log errors like this.
+			logging.Infof("%s %q: replacing attribute %q with generated value: %v", oldRule.Kind(), oldRule.Name(), k, err)
 			mergedExpr = genExpr
 		}
 		if mergedExpr != nil {
@@ -142,7 +424,11 @@ func mergeRule(gen, old *bf.CallExpr) bf.Expr {
 	}
 
 	// Merge attributes from genRule that we haven't processed already.
+	// Attributes owned by the user are not added.
 	for _, k := range genRule.AttrKeys() {
+		if policy, ok := policies[k]; ok && policy == config.KeepAttr && k != "name" {
+			continue
+		}
 		if mergedRule.Attr(k) == nil {
 			mergedRule.SetAttr(k, genRule.Attr(k))
 		}
@@ -154,6 +440,127 @@ func mergeRule(gen, old *bf.CallExpr) bf.Expr {
 	return &merged
 }
 
+// mergeAttrWithPolicy merges the values of an attribute from a generated
+// rule and an existing rule according to policy. Either value may be nil.
+// nil is returned if the attribute should be removed.
+func mergeAttrWithPolicy(gen, old bf.Expr, policy config.AttrPolicy) bf.Expr {
+	switch policy {
+	case config.OverwriteAttr:
+		return gen
+	case config.MergeAttr:
+		merged, err := mergeExpr(gen, old, true)
+		if err != nil {
+			return old
+		}
+		return merged
+	default:
+		return old
+	}
+}
+
+// mergeTestdata merges the data attribute of a go_test rule. Gazelle only
+// generates a glob of the package's testdata directory, so globs of testdata
+// directories in old are replaced with gen or removed if gen is nil. Other
+// terms in old (lists of labels, other globs) are preserved, since they were
+// written by hand. A testdata glob with extra arguments, like exclude, was
+// edited by hand and is kept as long as gen is not nil.
+func mergeTestdata(gen, old bf.Expr) bf.Expr {
+	var terms []bf.Expr
+	replaced := false
+	for _, t := range splitSum(old) {
+		call, ok := t.(*bf.CallExpr)
+		if !ok || !isTestdataGlob(call) {
+			terms = append(terms, t)
+			continue
+		}
+		if gen == nil || replaced {
+			continue
+		}
+		if len(call.List) > 1 {
+			terms = append(terms, t)
+		} else {
+			terms = append(terms, gen)
+		}
+		replaced = true
+	}
+	if gen != nil && !replaced {
+		terms = append([]bf.Expr{gen}, terms...)
+	}
+
+	if len(terms) == 0 {
+		return nil
+	}
+	merged := terms[0]
+	for _, t := range terms[1:] {
+		merged = &bf.BinaryExpr{X: merged, Op: "+", Y: t}
+	}
+	return merged
+}
+
+// mergeGcOpts merges the gc_goopts or gc_linkopts attribute of a rule.
+// Gazelle generates these as plain lists from "# gazelle:gc_goopts" and
+// "# gazelle:gc_linkopts" directives. The list in old is replaced with gen,
+// except for flags marked with "# keep". A select in old was written by hand,
+// since Gazelle never generates one, so it's preserved. If old can't be
+// parsed, it's returned unchanged. nil is returned if the attribute should
+// be removed.
+func mergeGcOpts(gen, old bf.Expr) bf.Expr {
+	oldList, oldDict, err := exprListAndDict(old)
+	if err != nil {
+		return old
+	}
+	genList, _, err := exprListAndDict(gen)
+	if err != nil {
+		return old
+	}
+	mergedList := mergeList(genList, oldList, false)
+	if oldDict == nil {
+		if mergedList == nil {
+			return nil
+		}
+		return mergedList
+	}
+	sel := &bf.CallExpr{
+		X:    &bf.LiteralExpr{Token: "select"},
+		List: []bf.Expr{oldDict},
+	}
+	if mergedList == nil {
+		return sel
+	}
+	mergedList.ForceMultiLine = true
+	return &bf.BinaryExpr{X: mergedList, Op: "+", Y: sel}
+}
+
+// splitSum returns the operands of an expression like a + b + c. If e is not
+// a sum, a slice containing only e is returned.
+func splitSum(e bf.Expr) []bf.Expr {
+	if b, ok := e.(*bf.BinaryExpr); ok && b.Op == "+" {
+		return append(splitSum(b.X), splitSum(b.Y)...)
+	}
+	return []bf.Expr{e}
+}
+
+// isTestdataGlob returns whether call is a call to glob whose patterns all
+// match files in testdata directories, like the glob Gazelle generates for
+// the data attribute of go_test rules.
+func isTestdataGlob(call *bf.CallExpr) bool {
+	x, ok := call.X.(*bf.LiteralExpr)
+	if !ok || x.Token != "glob" || len(call.List) == 0 {
+		return false
+	}
+	patterns, ok := call.List[0].(*bf.ListExpr)
+	if !ok || len(patterns.List) == 0 {
+		return false
+	}
+	for _, p := range patterns.List {
+		s := stringValue(p)
+		if s != "testdata/**" && !strings.HasSuffix(s, "/testdata/**") {
+			return false
+		}
+	}
+	return true
+}
+
 // mergeExpr combines information from gen and old and returns an updated
 // expression. The following kinds of expressions are recognized:
 //
@@ -164,19 +571,32 @@ func mergeRule(gen, old *bf.CallExpr) bf.Expr {
 //     and the values must be lists of strings.
 //   * a list of strings combined with a select call using +. The list must
 //     be the left operand.
+//   * a dict with string keys, like x_defs. These are merged key by key with
+//     mergeKeyValueDict.
+//
+// If union is true, strings in old lists are preserved even if they
+// are not in gen and are not marked with "# keep".
 //
 // An error is returned if the expressions can't be merged, for example
 // because they are not in one of the above formats.
-func mergeExpr(gen, old bf.Expr) (bf.Expr, error) {
+func mergeExpr(gen, old bf.Expr, union bool) (bf.Expr, error) {
 	if shouldKeep(old) {
 		return old, nil
 	}
 	if gen == nil && (old == nil || isScalar(old)) {
+		if union {
+			return old, nil
+		}
 		return nil, nil
 	}
 	if isScalar(gen) {
 		return gen, nil
 	}
+	if genDict, oldDict, ok, err := keyValueDicts(gen, old); err != nil {
+		return nil, err
+	} else if ok {
+		return mergeKeyValueDict(genDict, oldDict)
+	}
 
 	genList, genDict, err := exprListAndDict(gen)
 	if err != nil {
@@ -187,8 +607,8 @@ func mergeExpr(gen, old bf.Expr) (bf.Expr, error) {
 		return nil, err
 	}
 
-	mergedList := mergeList(genList, oldList)
-	mergedDict, err := mergeDict(genDict, oldDict)
+	mergedList := mergeList(genList, oldList, union)
+	mergedDict, err := mergeDict(genDict, oldDict, union)
 	if err != nil {
 		return nil, err
 	}
@@ -256,21 +676,26 @@ func exprListAndDict(expr bf.Expr) (*bf.ListExpr, *bf.DictExpr, error) {
 	return nil, nil, fmt.Errorf("expression could not be matched")
 }
 
-func mergeList(gen, old *bf.ListExpr) *bf.ListExpr {
+func mergeList(gen, old *bf.ListExpr, union bool) *bf.ListExpr {
 	if old == nil {
 		return gen
 	}
 	if gen == nil {
 		gen = &bf.ListExpr{List: []bf.Expr{}}
 	}
+	if doNotSort(old) {
+		return mergeOrderedList(gen, old, union)
+	}
 
 	// Build a list of strings from the gen list and keep matching strings
 	// in the old list. This preserves comments. Also keep anything with
 	// a "# keep" comment, whether or not it's in the gen list.
 	genSet := make(map[string]bool)
+	genStrings := make(map[string]*bf.StringExpr)
 	for _, v := range gen.List {
 		if s := stringValue(v); s != "" {
 			genSet[s] = true
+			genStrings[s], _ = v.(*bf.StringExpr)
 		}
 	}
 
@@ -279,8 +704,11 @@ func mergeList(gen, old *bf.ListExpr) *bf.ListExpr {
 	keepComment := false
 	for _, v := range old.List {
 		s := stringValue(v)
-		if keep := shouldKeep(v); keep || genSet[s] {
+		if keep := shouldKeep(v); keep || union || genSet[s] {
 			keepComment = keepComment || keep
+			if !keep {
+				v = updateAnnotation(v, genStrings[s])
+			}
 			merged = append(merged, v)
 			if s != "" {
 				kept[s] = true
@@ -305,7 +733,105 @@ func mergeList(gen, old *bf.ListExpr) *bf.ListExpr {
 	}
 }
 
-func mergeDict(gen, old *bf.DictExpr) (*bf.DictExpr, error) {
+// updateAnnotation returns old with the trailing comment of gen, if gen has
+// one. Generated strings only have trailing comments when deps are
+// annotated with "# gazelle:annotate_deps on", and these replace stale
+// annotations on matching old strings. old is returned unchanged otherwise.
+func updateAnnotation(old bf.Expr, gen *bf.StringExpr) bf.Expr {
+	s, ok := old.(*bf.StringExpr)
+	if !ok || gen == nil || len(gen.Suffix) == 0 || sameComments(s.Suffix, gen.Suffix) {
+		return old
+	}
+	updated := *s
+	updated.Suffix = append([]bf.Comment(nil), gen.Suffix...)
+	return &updated
+}
+
+func sameComments(a, b []bf.Comment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Token != b[i].Token {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeOrderedList is like mergeList, but it's used for lists marked with a
+// "# do not sort" comment, like copts or clinkopts where the order of flags
+// matters. Strings are matched by count instead of by value, so repeated
+// flags like "-Wl,--start-group" are neither dropped nor added twice. Kept
+// elements stay in their original order, and the comment is moved to the
+// new first element if the old one was removed, so buildifier leaves the
+// merged list alone, too.
+func mergeOrderedList(gen, old *bf.ListExpr, union bool) *bf.ListExpr {
+	genCount := make(map[string]int)
+	for _, v := range gen.List {
+		if s := stringValue(v); s != "" {
+			genCount[s]++
+		}
+	}
+
+	var merged []bf.Expr
+	keptCount := make(map[string]int)
+	keepComment := false
+	for _, v := range old.List {
+		s := stringValue(v)
+		if keep := shouldKeep(v); keep || union || keptCount[s] < genCount[s] {
+			keepComment = keepComment || keep
+			merged = append(merged, v)
+			if s != "" {
+				keptCount[s]++
+			}
+		}
+	}
+
+	// Add occurrences in the gen list beyond those that were kept.
+	addedCount := make(map[string]int)
+	for _, v := range gen.List {
+		s := stringValue(v)
+		if s != "" && addedCount[s] < keptCount[s] {
+			addedCount[s]++
+			continue
+		}
+		merged = append(merged, v)
+	}
+
+	if len(merged) == 0 {
+		return nil
+	}
+	if first := old.List[0]; merged[0] != first {
+		// The first element carrying the comment was removed.
+		if s, ok := merged[0].(*bf.StringExpr); ok {
+			moved := *s
+			moved.Before = append(append([]bf.Comment(nil), first.Comment().Before...), s.Before...)
+			merged[0] = &moved
+		}
+	}
+	return &bf.ListExpr{
+		List:           merged,
+		ForceMultiLine: gen.ForceMultiLine || old.ForceMultiLine || keepComment,
+	}
+}
+
+// doNotSort returns whether list is marked with a "# do not sort" comment
+// before its first element. Buildifier doesn't sort lists marked this way,
+// and Gazelle doesn't reorder them either.
+func doNotSort(list *bf.ListExpr) bool {
+	if len(list.List) == 0 {
+		return false
+	}
+	for _, c := range list.List[0].Comment().Before {
+		if strings.Contains(strings.ToLower(c.Token), "do not sort") {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeDict(gen, old *bf.DictExpr, union bool) (*bf.DictExpr, error) {
 	if old == nil {
 		return gen, nil
 	}
@@ -346,7 +872,7 @@ func mergeDict(gen, old *bf.DictExpr) (*bf.DictExpr, error) {
 	keys := make([]string, 0, len(entries))
 	haveDefault := false
 	for _, e := range entries {
-		e.mergedValue = mergeList(e.genValue, e.oldValue)
+		e.mergedValue = mergeList(e.genValue, e.oldValue, union)
 		if e.key == "//conditions:default" {
 			// Keep the default case, even if it's empty.
 			haveDefault = true
@@ -378,6 +904,93 @@ func mergeDict(gen, old *bf.DictExpr) (*bf.DictExpr, error) {
 	return &bf.DictExpr{List: mergedEntries, ForceMultiLine: true}, nil
 }
 
+// keyValueDicts returns gen and old as dicts if either is a dict that is not
+// the argument of a select call. ok is false if neither is a dict. An error
+// is returned if one is a dict and the other is neither a dict nor nil.
+func keyValueDicts(gen, old bf.Expr) (genDict, oldDict *bf.DictExpr, ok bool, err error) {
+	genDict, genOk := gen.(*bf.DictExpr)
+	oldDict, oldOk := old.(*bf.DictExpr)
+	if !genOk && !oldOk {
+		return nil, nil, false, nil
+	}
+	if !genOk && gen != nil || !oldOk && old != nil {
+		return nil, nil, false, fmt.Errorf("can't merge dict with non-dict expression")
+	}
+	return genDict, oldDict, true, nil
+}
+
+// mergeKeyValueDict merges dicts with string keys, like x_defs, key by key.
+// Entries in old whose keys are not in gen are preserved, since they were
+// probably written by hand. Entries in gen replace entries in old with the
+// same key, unless the old entry is marked with a "# keep" comment. A warning
+// is logged when an existing value is replaced with a different one.
+func mergeKeyValueDict(gen, old *bf.DictExpr) (bf.Expr, error) {
+	if old == nil {
+		return gen, nil
+	}
+
+	genValues := make(map[string]bf.Expr)
+	var genKeys []string
+	if gen != nil {
+		for _, e := range gen.List {
+			kv, key, err := keyValueEntry(e)
+			if err != nil {
+				return nil, err
+			}
+			genValues[key] = kv.Value
+			genKeys = append(genKeys, key)
+		}
+	}
+
+	merged := *old
+	merged.List = make([]bf.Expr, 0, len(old.List)+len(genKeys))
+	seen := make(map[string]bool)
+	for _, e := range old.List {
+		kv, key, err := keyValueEntry(e)
+		if err != nil {
+			return nil, err
+		}
+		seen[key] = true
+		genValue, ok := genValues[key]
+		if !ok || shouldKeep(kv) || shouldKeep(kv.Value) {
+			merged.List = append(merged.List, kv)
+			continue
+		}
+		if oldStr, genStr := bf.FormatString(kv.Value), bf.FormatString(genValue); oldStr != genStr {
+			logging.Warningf("dict key %q: replacing value %s with generated value %s", key, oldStr, genStr)
+		}
+		mergedKV := *kv
+		mergedKV.Value = genValue
+		merged.List = append(merged.List, &mergedKV)
+	}
+	if gen != nil {
+		for _, e := range gen.List {
+			if kv, key, _ := keyValueEntry(e); !seen[key] {
+				merged.List = append(merged.List, kv)
+			}
+		}
+	}
+
+	if len(merged.List) == 0 {
+		return nil, nil
+	}
+	return &merged, nil
+}
+
+// keyValueEntry returns an entry in a dict and its key. An error is returned
+// if the entry is not a key-value pair with a string key.
+func keyValueEntry(e bf.Expr) (*bf.KeyValueExpr, string, error) {
+	kv, ok := e.(*bf.KeyValueExpr)
+	if !ok {
+		return nil, "", fmt.Errorf("dict entry was not a key-value pair: %#v", e)
+	}
+	k, ok := kv.Key.(*bf.StringExpr)
+	if !ok {
+		return nil, "", fmt.Errorf("dict key was not string: %#v", kv.Key)
+	}
+	return kv, k.Value, nil
+}
+
 type dictEntry struct {
 	key                             string
 	oldValue, genValue, mergedValue *bf.ListExpr
@@ -493,6 +1106,13 @@ func (m *loadMatcher) match(c *bf.CallExpr) bool {
 	return kind(c) == "load" && len(c.List) > 0 && m.load == stringValue(c.List[0])
 }
 
+// startLine returns the line where e starts in its file, or 0 if it's
+// unknown, as for expressions Gazelle generated.
+func startLine(e bf.Expr) int {
+	start, _ := e.Span()
+	return start.Line
+}
+
 func kind(c *bf.CallExpr) string {
 	return (&bf.Rule{c}).Kind()
 }
@@ -513,6 +1133,12 @@ func isEmpty(c *bf.CallExpr) bool {
 	return ok && x.Token == "name"
 }
 
+// hasSrcs returns whether e is a rule with a srcs attribute.
+func hasSrcs(e bf.Expr) bool {
+	c, ok := e.(*bf.CallExpr)
+	return ok && (&bf.Rule{c}).Attr("srcs") != nil
+}
+
 func isScalar(e bf.Expr) bool {
 	switch e.(type) {
 	case *bf.StringExpr, *bf.LiteralExpr:
@@ -1,9 +1,12 @@
 package merger
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 
 	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
 )
 
 // should fix
@@ -14,6 +17,7 @@ import (
 type testCase struct {
 	desc, previous, current, empty, expected string
 	ignore                                   bool
+	policies                                 map[string]config.AttrPolicy
 }
 
 var testCases = []testCase{
@@ -115,6 +119,9 @@ load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
 load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
 # gazelle:ignore`,
 		ignore: false,
+		expected: `
+# gazelle:ignore
+`,
 	}, {
 		desc: "merge dicts",
 		previous: `
@@ -384,6 +391,33 @@ go_library(
 		expected: `
 load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+	}, {
+		desc: "delete stale embedsrcs",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    embedsrcs = ["static/index.html"],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
 go_library(
     name = "go_default_library",
     srcs = ["foo.go"],
@@ -621,6 +655,563 @@ go_library(
         ],
     }),
 )
+`,
+	}, {
+		desc: "merge x_defs dict",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+go_binary(
+    name = "cmd",
+    x_defs = {
+        "main.Version": "1.0",
+        "main.Commit": "abc123",
+        "main.Owner": "me",  # keep
+    },
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+go_binary(
+    name = "cmd",
+    x_defs = {
+        "main.Version": "2.0",
+        "main.Owner": "gazelle",
+        "main.Date": "today",
+    },
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+go_binary(
+    name = "cmd",
+    x_defs = {
+        "main.Version": "2.0",
+        "main.Commit": "abc123",
+        "main.Owner": "me",  # keep
+        "main.Date": "today",
+    },
+)
+`,
+	}, {
+		desc: "preserve x_defs without generated value",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+    x_defs = {"main.Version": "1.0"},
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+    x_defs = {"main.Version": "1.0"},
+)
+`,
+	}, {
+		desc: "merge testdata glob",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+    data = [":extra"] + glob(["old/testdata/**"]),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+    data = glob(["testdata/**"]),
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+    data = [":extra"] + glob(["testdata/**"]),
+)
+`,
+	}, {
+		desc: "remove testdata glob",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+    data = glob(["testdata/**"]) + [":extra"],
+)
+
+go_test(
+    name = "other_test",
+    srcs = ["other_test.go"],
+    data = glob(["testdata/**"]),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+)
+
+go_test(
+    name = "other_test",
+    srcs = ["other_test.go"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+    data = [":extra"],
+)
+
+go_test(
+    name = "other_test",
+    srcs = ["other_test.go"],
+)
+`,
+	}, {
+		desc: "keep edited testdata glob",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+    data = glob(
+        ["testdata/**"],
+        exclude = ["testdata/big"],
+    ),
+)
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+    data = glob(["testdata/**"]),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+    data = glob(["testdata/**"]),
+)
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+    data = glob(
+        ["testdata/**"],
+        exclude = ["testdata/big"],
+    ),
+)
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+    data = glob(["testdata/**"]),
+)
+`,
+	}, {
+		desc: "attr policies",
+		policies: map[string]config.AttrPolicy{
+			"deps":       config.MergeAttr,
+			"srcs":       config.OverwriteAttr,
+			"visibility": config.KeepAttr,
+			"importpath": config.KeepAttr,
+		},
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "old.go",  # keep
+        "lib.go",
+    ],
+    deps = [
+        "//manual:go_default_library",
+        "//old:go_default_library",
+    ],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["new.go"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+    deps = ["//new:go_default_library"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["new.go"],
+    deps = [
+        "//manual:go_default_library",
+        "//old:go_default_library",
+        "//new:go_default_library",
+    ],
+)
+`,
+	}, {
+		desc: "overwrite removes attr",
+		policies: map[string]config.AttrPolicy{
+			"copts": config.OverwriteAttr,
+		},
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    copts = ["-Dfoo"],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+`,
+	}, {
+		desc: "preserve test attrs",
+		policies: map[string]config.AttrPolicy{
+			"size": config.OverwriteAttr,
+			"tags": config.OverwriteAttr,
+		},
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    size = "large",
+    timeout = "long",
+    srcs = ["foo_test.go"],
+    flaky = True,
+    shard_count = 4,
+    tags = ["manual"],
+)
+
+go_test(
+    name = "go_default_xtest",
+    srcs = ["bar_test.go"],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    size = "small",
+    timeout = "short",
+    srcs = ["foo_test.go"],
+    tags = ["no-remote"],
+)
+
+go_test(
+    name = "go_default_xtest",
+    size = "small",
+    srcs = ["bar_test.go"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    size = "large",
+    timeout = "long",
+    srcs = ["foo_test.go"],
+    flaky = True,
+    shard_count = 4,
+    tags = [
+        "manual",
+        "no-remote",
+    ],
+)
+
+go_test(
+    name = "go_default_xtest",
+    srcs = ["bar_test.go"],
+    size = "small",
+)
+`,
+	}, {
+		desc: "preserve rundir",
+		policies: map[string]config.AttrPolicy{
+			"rundir": config.OverwriteAttr,
+		},
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+    rundir = "testdata",
+)
+
+go_test(
+    name = "go_default_xtest",
+    srcs = ["bar_test.go"],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+    rundir = ".",
+)
+
+go_test(
+    name = "go_default_xtest",
+    srcs = ["bar_test.go"],
+    rundir = ".",
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+    rundir = "testdata",
+)
+
+go_test(
+    name = "go_default_xtest",
+    srcs = ["bar_test.go"],
+    rundir = ".",
+)
+`,
+	}, {
+		desc: "preserve mode attrs",
+		policies: map[string]config.AttrPolicy{
+			"race": config.OverwriteAttr,
+		},
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_test")
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+    pure = "on",
+    race = select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": "on",
+        "//conditions:default": "off",
+    }),
+    static = "on",
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["main_test.go"],
+    msan = "on",
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_test")
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+    race = "off",
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["main_test.go"],
+    pure = "on",
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_test")
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+    pure = "on",
+    race = select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": "on",
+        "//conditions:default": "off",
+    }),
+    static = "on",
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["main_test.go"],
+    msan = "on",
+    pure = "on",
+)
+`,
+	}, {
+		desc: "do not sort",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    cgo = True,
+    clinkopts = [
+        # do not sort
+        "-lstale",
+        "-Wl,--whole-archive",
+        "-lfoo",
+        "-Wl,--no-whole-archive",
+        "-Wl,--whole-archive",
+        "-lbar",
+        "-Wl,--no-whole-archive",
+    ],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    cgo = True,
+    clinkopts = [
+        "-Wl,--whole-archive",
+        "-lbar",
+        "-Wl,--no-whole-archive",
+        "-Wl,--whole-archive",
+        "-lfoo",
+        "-Wl,--no-whole-archive",
+        "-lm",
+    ],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    cgo = True,
+    clinkopts = [
+        # do not sort
+        "-Wl,--whole-archive",
+        "-lfoo",
+        "-Wl,--no-whole-archive",
+        "-Wl,--whole-archive",
+        "-lbar",
+        "-Wl,--no-whole-archive",
+        "-lm",
+    ],
+)
+`,
+	}, {
+		desc: "merge gc opts",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    gc_goopts = [
+        "-trimpath",
+        "-N",  # keep
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": ["-race"],
+        "//conditions:default": [],
+    }),
+)
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+    gc_linkopts = ["-s"],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    gc_goopts = ["-dwarf=false"],
+)
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    gc_goopts = [
+        "-N",  # keep
+        "-dwarf=false",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": ["-race"],
+        "//conditions:default": [],
+    }),
+)
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+)
 `,
 	}, {
 		desc: "delete empty rule",
@@ -657,6 +1248,69 @@ go_library(
     srcs = ["lib.go"],
 )
 `,
+	}, {
+		desc: "delete empty rule keeps comments",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+
+# TODO: move the binary to cmd/old.
+go_binary(
+    name = "old",
+    srcs = ["bin.go"],
+    library = ":go_default_library",
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+`,
+		empty: `
+go_binary(name = "old")
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+
+# TODO: move the binary to cmd/old.
+`,
+	}, {
+		desc: "delete empty rule with other attrs",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo/lib",
+    visibility = ["//visibility:public"],
+)
+
+go_test(
+    name = "go_default_test",
+    size = "small",
+    srcs = ["lib_test.go"],
+    library = ":go_default_library",
+)
+`,
+		empty: `
+go_library(name = "go_default_library")
+
+go_test(name = "go_default_test")
+`,
+		expected: "",
 	}, {
 		desc: "don't delete kept rule",
 		previous: `
@@ -698,7 +1352,7 @@ func TestMergeWithExisting(t *testing.T) {
 			if err != nil {
 				t.Fatalf("%s: %v", tc.desc, err)
 			}
-			mergedFile := MergeWithExisting(genFile, oldFile, emptyFile.Stmt)
+			mergedFile := MergeWithExisting(genFile, oldFile, emptyFile.Stmt, tc.policies)
 			if mergedFile == nil {
 				if !tc.ignore {
 					t.Errorf("%s: got nil; want file", tc.desc)
@@ -708,7 +1362,7 @@ func TestMergeWithExisting(t *testing.T) {
 			if mergedFile != nil && tc.ignore {
 				t.Fatalf("%s: got file; want nil", tc.desc)
 			}
-			mergedFile = FixLoads(mergedFile)
+			mergedFile = FixLoads(mergedFile, nil)
 
 			want := tc.expected
 			if len(want) > 0 && want[0] == '\n' {
@@ -725,8 +1379,215 @@ func TestMergeWithExisting(t *testing.T) {
 func TestMergeWithExistingDifferentName(t *testing.T) {
 	oldFile := &bf.File{Path: "BUILD"}
 	genFile := &bf.File{Path: "BUILD.bazel"}
-	mergedFile := MergeWithExisting(genFile, oldFile, nil)
+	mergedFile := MergeWithExisting(genFile, oldFile, nil, nil)
 	if got, want := mergedFile.Path, oldFile.Path; got != want {
 		t.Errorf("got %q; want %q", got, want)
 	}
 }
+
+func TestMergeWithKindAliases(t *testing.T) {
+	newRule := func(kind, name string, srcs ...string) *bf.CallExpr {
+		attr := func(key string, value bf.Expr) bf.Expr {
+			return &bf.BinaryExpr{X: &bf.LiteralExpr{Token: key}, Op: "=", Y: value}
+		}
+		c := &bf.CallExpr{
+			X:    &bf.LiteralExpr{Token: kind},
+			List: []bf.Expr{attr("name", &bf.StringExpr{Value: name})},
+		}
+		if len(srcs) > 0 {
+			list := &bf.ListExpr{}
+			for _, s := range srcs {
+				list.List = append(list.List, &bf.StringExpr{Value: s})
+			}
+			c.List = append(c.List, attr("srcs", list))
+		}
+		return c
+	}
+	oldFile := &bf.File{Path: "BUILD.bazel", Stmt: []bf.Expr{
+		newRule("team_go_library", "go_default_library", "a.go"),
+		newRule("team_go_test", "go_default_test", "a_test.go"),
+		newRule("go_binary", "cmd", "main.go"),
+	}}
+	genFile := &bf.File{Stmt: []bf.Expr{
+		newRule("go_library", "go_default_library", "a.go", "b.go"),
+		newRule("go_binary", "cmd", "main.go"),
+	}}
+	empty := []bf.Expr{newRule("go_test", "go_default_test")}
+	aliases := map[string]string{
+		"team_go_library": "go_library",
+		"team_go_test":    "go_test",
+	}
+
+	mergedFile := MergeWithKindAliases(genFile, oldFile, empty, nil, aliases)
+	var got []string
+	for _, r := range mergedFile.Rules("") {
+		srcs, _ := ListStrings(r.Attr("srcs"))
+		got = append(got, fmt.Sprintf("%s %s %v", r.Kind(), r.Name(), srcs))
+	}
+	want := []string{
+		"team_go_library go_default_library [a.go b.go]",
+		"go_binary cmd [main.go]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if k := oldFile.Rules("")[0].Kind(); k != "team_go_library" {
+		t.Errorf("old file was modified: got kind %q", k)
+	}
+}
+
+func TestRemoveRules(t *testing.T) {
+	newRule := func(kind, name string) *bf.CallExpr {
+		return &bf.CallExpr{
+			X: &bf.LiteralExpr{Token: kind},
+			List: []bf.Expr{&bf.BinaryExpr{
+				X:  &bf.LiteralExpr{Token: "name"},
+				Op: "=",
+				Y:  &bf.StringExpr{Value: name},
+			}},
+		}
+	}
+	kept := newRule("go_test", "go_default_test")
+	kept.Comments.Suffix = []bf.Comment{{Token: "# keep"}}
+	oldFile := &bf.File{Path: "BUILD.bazel", Stmt: []bf.Expr{
+		newRule("team_go_library", "go_default_library"),
+		kept,
+		newRule("go_binary", "cmd"),
+		newRule("sh_test", "go_default_xtest"),
+		newRule("go_library", "hand_written"),
+	}}
+	genRules := []bf.Expr{
+		newRule("go_library", "go_default_library"),
+		newRule("go_test", "go_default_test"),
+		newRule("go_test", "go_default_xtest"),
+		newRule("go_binary", "cmd"),
+	}
+	aliases := map[string]string{"team_go_library": "go_library"}
+
+	cleanedFile := RemoveRules(oldFile, genRules, aliases)
+	var got []string
+	for _, r := range cleanedFile.Rules("") {
+		got = append(got, r.Kind()+" "+r.Name())
+	}
+	want := []string{
+		"go_test go_default_test",
+		"sh_test go_default_xtest",
+		"go_library hand_written",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if len(oldFile.Stmt) != 5 {
+		t.Errorf("old file was modified: got %d statements", len(oldFile.Stmt))
+	}
+	if f := RemoveRules(cleanedFile, genRules, aliases); f != cleanedFile {
+		t.Errorf("got a new file when nothing was removed")
+	}
+}
+
+func TestUpdateDeps(t *testing.T) {
+	newRule := func(kind, name string, attrs map[string][]string) *bf.CallExpr {
+		c := &bf.CallExpr{X: &bf.LiteralExpr{Token: kind}}
+		c.List = append(c.List, &bf.BinaryExpr{X: &bf.LiteralExpr{Token: "name"}, Op: "=", Y: &bf.StringExpr{Value: name}})
+		for _, key := range []string{"srcs", "deps"} {
+			values, ok := attrs[key]
+			if !ok {
+				continue
+			}
+			list := &bf.ListExpr{}
+			for _, v := range values {
+				list.List = append(list.List, &bf.StringExpr{Value: v})
+			}
+			c.List = append(c.List, &bf.BinaryExpr{X: &bf.LiteralExpr{Token: key}, Op: "=", Y: list})
+		}
+		return c
+	}
+	kept := newRule("go_test", "go_default_test", map[string][]string{"deps": {"//old:go_default_library"}})
+	kept.Comments.Suffix = []bf.Comment{{Token: "# keep"}}
+	oldFile := &bf.File{Path: "BUILD.bazel", Stmt: []bf.Expr{
+		newRule("team_go_library", "go_default_library", map[string][]string{
+			"srcs": {"a.go", "hand_picked.go"},
+			"deps": {"//old:go_default_library"},
+		}),
+		kept,
+		newRule("go_binary", "cmd", map[string][]string{"srcs": {"main.go"}}),
+		newRule("go_library", "hand_written", map[string][]string{"deps": {"//old:go_default_library"}}),
+	}}
+	genFile := &bf.File{Stmt: []bf.Expr{
+		newRule("go_library", "go_default_library", map[string][]string{
+			"srcs": {"a.go", "b.go"},
+			"deps": {"//new:go_default_library"},
+		}),
+		newRule("go_test", "go_default_test", map[string][]string{"deps": {"//new:go_default_library"}}),
+		newRule("go_binary", "cmd", map[string][]string{"deps": {":go_default_library"}}),
+		newRule("go_library", "added", map[string][]string{"srcs": {"added.go"}}),
+	}}
+	aliases := map[string]string{"team_go_library": "go_library"}
+
+	updatedFile := UpdateDeps(genFile, oldFile, nil, aliases)
+	var got []string
+	for _, r := range updatedFile.Rules("") {
+		srcs, _ := ListStrings(r.Attr("srcs"))
+		deps, _ := ListStrings(r.Attr("deps"))
+		got = append(got, fmt.Sprintf("%s %s srcs=%v deps=%v", r.Kind(), r.Name(), srcs, deps))
+	}
+	want := []string{
+		"team_go_library go_default_library srcs=[a.go hand_picked.go] deps=[//new:go_default_library]",
+		"go_test go_default_test srcs=[] deps=[//old:go_default_library]",
+		"go_binary cmd srcs=[main.go] deps=[:go_default_library]",
+		"go_library hand_written srcs=[] deps=[//old:go_default_library]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if deps, _ := ListStrings(oldFile.Rules("")[0].Attr("deps")); !reflect.DeepEqual(deps, []string{"//old:go_default_library"}) {
+		t.Errorf("old file was modified: got deps %q", deps)
+	}
+}
+
+func TestMergeListAnnotations(t *testing.T) {
+	str := func(value, comment string) *bf.StringExpr {
+		s := &bf.StringExpr{Value: value}
+		if comment != "" {
+			s.Suffix = []bf.Comment{{Token: comment}}
+		}
+		return s
+	}
+	old := &bf.ListExpr{List: []bf.Expr{
+		str("//a:go_default_library", "# example.com/old/a"),
+		str("//b:go_default_library", "# keep"),
+		str("//c:go_default_library", "# hand-written"),
+		str("//d:go_default_library", ""),
+	}}
+	gen := &bf.ListExpr{List: []bf.Expr{
+		str("//a:go_default_library", "# example.com/a"),
+		str("//b:go_default_library", "# example.com/b"),
+		str("//c:go_default_library", ""),
+		str("//d:go_default_library", "# example.com/d"),
+		str("//e:go_default_library", "# example.com/e"),
+	}}
+
+	merged := mergeList(gen, old, false)
+	var got []string
+	for _, e := range merged.List {
+		s := e.(*bf.StringExpr)
+		var comment string
+		if len(s.Suffix) > 0 {
+			comment = s.Suffix[0].Token
+		}
+		got = append(got, s.Value+" "+comment)
+	}
+	want := []string{
+		"//a:go_default_library # example.com/a",
+		"//b:go_default_library # keep",
+		"//c:go_default_library # hand-written",
+		"//d:go_default_library # example.com/d",
+		"//e:go_default_library # example.com/e",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if c := old.List[0].(*bf.StringExpr).Suffix[0].Token; c != "# example.com/old/a" {
+		t.Errorf("old list was modified: got comment %q", c)
+	}
+}
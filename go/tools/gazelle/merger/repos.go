@@ -0,0 +1,368 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+// repoSourceAttrs are the attributes of go_repository that determine where
+// a repository is fetched from and at which revision. go_repository only
+// accepts one way of fetching a repository, so when a generated rule is
+// merged into an existing rule, these attributes are taken from the
+// generated rule, and any the generated rule doesn't set are removed.
+var repoSourceAttrs = map[string]bool{
+	"branch":       true,
+	"commit":       true,
+	"importpath":   true,
+	"sha256":       true,
+	"strip_prefix": true,
+	"tag":          true,
+	"type":         true,
+	"urls":         true,
+	"version":      true,
+}
+
+// MergeRepos merges the go_repository rules in genRules into oldFile and
+// returns the merged file. oldFile may be a WORKSPACE file or a .bzl file.
+//
+// If macroName is empty, repository rules are top-level statements in
+// oldFile. Otherwise, oldFile is a .bzl file, and repository rules are
+// statements in the body of the function macroName, which is added to the
+// end of the file if it isn't defined already. This lets large sets of
+// dependencies be kept out of WORKSPACE, which only needs to load and call
+// the macro.
+//
+// Generated rules are matched with existing rules by kind and name.
+// Unmatched rules are added after the existing statements. Rules and
+// attributes marked with "# keep" are not changed. Other attributes the
+// user added to an existing rule, like build_tags, are preserved.
+// oldFile is not modified. An error is returned if the body of the macro
+// can't be parsed.
+func MergeRepos(genRules []*bf.CallExpr, oldFile *bf.File, macroName string) (*bf.File, error) {
+	if len(genRules) == 0 {
+		return oldFile, nil
+	}
+
+	mergedFile := *oldFile
+	mergedFile.Stmt = append([]bf.Expr(nil), oldFile.Stmt...)
+	if macroName == "" {
+		mergeRepoStmts(genRules, &mergedFile.Stmt)
+		return &mergedFile, nil
+	}
+
+	i, block := findMacro(mergedFile.Stmt, macroName)
+	var m *macro
+	if block == nil {
+		m = newMacro(macroName)
+	} else {
+		var err error
+		if m, err = parseMacro(block); err != nil {
+			return nil, fmt.Errorf("%s: %v", oldFile.Path, err)
+		}
+	}
+	mergeRepoStmts(genRules, &m.stmts)
+	if block == nil {
+		mergedFile.Stmt = append(mergedFile.Stmt, m.block(nil))
+	} else {
+		mergedFile.Stmt[i] = m.block(block)
+	}
+	return &mergedFile, nil
+}
+
+// mergeRepoStmts merges genRules into the statements in *stmts, which are
+// modified in place. See MergeRepos.
+func mergeRepoStmts(genRules []*bf.CallExpr, stmts *[]bf.Expr) {
+	oldStmtCount := len(*stmts)
+	for _, genRule := range genRules {
+		i, oldRule := match((*stmts)[:oldStmtCount], genRule)
+		if oldRule == nil {
+			*stmts = append(*stmts, genRule)
+			continue
+		}
+		if shouldKeep(oldRule) {
+			continue
+		}
+		(*stmts)[i] = mergeRepoRule(genRule, oldRule)
+	}
+}
+
+// mergeRepoRule merges a generated repository rule into an existing rule
+// with the same kind and name and returns the merged rule. See MergeRepos.
+func mergeRepoRule(gen, old *bf.CallExpr) *bf.CallExpr {
+	genRule := bf.Rule{Call: gen}
+	merged := *old
+	merged.List = nil
+	mergedRule := bf.Rule{Call: &merged}
+
+	for _, a := range old.List {
+		b, ok := a.(*bf.BinaryExpr)
+		if !ok || b.Op != "=" {
+			merged.List = append(merged.List, a)
+			continue
+		}
+		x, ok := b.X.(*bf.LiteralExpr)
+		if !ok || !repoSourceAttrs[x.Token] || shouldKeep(b) {
+			merged.List = append(merged.List, a)
+			continue
+		}
+		if genExpr := genRule.Attr(x.Token); genExpr != nil {
+			mergedAttr := *b
+			mergedAttr.Y = genExpr
+			merged.List = append(merged.List, &mergedAttr)
+		}
+	}
+	for _, k := range genRule.AttrKeys() {
+		if mergedRule.Attr(k) == nil && !hasKeptAttr(old, k) {
+			mergedRule.SetAttr(k, genRule.Attr(k))
+		}
+	}
+	return &merged
+}
+
+// PruneRepos deletes go_repository rules from f for which used returns
+// false and returns the pruned file and the names of the deleted rules.
+// As in MergeRepos, rules are top-level statements unless macroName is set,
+// in which case they are statements in the body of that function. Rules
+// marked with "# keep" are not deleted, and comments around deleted rules
+// are preserved. f is not modified. An error is returned if the body of the
+// macro can't be parsed.
+func PruneRepos(f *bf.File, macroName string, used func(r *bf.Rule) bool) (*bf.File, []string, error) {
+	var deleted []string
+	prune := func(stmts []bf.Expr) ([]bf.Expr, bool) {
+		pruned := make([]bf.Expr, 0, len(stmts))
+		changed := false
+		for _, stmt := range stmts {
+			if call, ok := stmt.(*bf.CallExpr); ok && kind(call) == "go_repository" && !shouldKeep(call) {
+				if r := (&bf.Rule{Call: call}); !used(r) {
+					pruned = append(pruned, deletedStmtComments(call)...)
+					deleted = append(deleted, r.Name())
+					changed = true
+					continue
+				}
+			}
+			pruned = append(pruned, stmt)
+		}
+		return pruned, changed
+	}
+
+	prunedFile := *f
+	if macroName == "" {
+		stmts, changed := prune(f.Stmt)
+		if !changed {
+			return f, nil, nil
+		}
+		prunedFile.Stmt = stmts
+		return &prunedFile, deleted, nil
+	}
+
+	i, block := findMacro(f.Stmt, macroName)
+	if block == nil {
+		return f, nil, nil
+	}
+	m, err := parseMacro(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", f.Path, err)
+	}
+	stmts, changed := prune(m.stmts)
+	if !changed {
+		return f, nil, nil
+	}
+	m.stmts = stmts
+	prunedFile.Stmt = append([]bf.Expr(nil), f.Stmt...)
+	prunedFile.Stmt[i] = m.block(block)
+	return &prunedFile, deleted, nil
+}
+
+// hasKeptAttr returns whether the rule call has an attribute named key
+// marked with "# keep".
+func hasKeptAttr(call *bf.CallExpr, key string) bool {
+	attr := (&bf.Rule{Call: call}).AttrDefn(key)
+	return attr != nil && shouldKeep(attr)
+}
+
+// macro is a function in a .bzl file whose body holds repository rules.
+// The build file parser doesn't parse function definitions; it keeps them
+// as uninterpreted Python blocks. The statements in the body are parsed
+// separately, so the rules in them can be merged like top-level rules, and
+// printed back into the block.
+type macro struct {
+	// header is the first line of the definition, like
+	// "def go_dependencies():\n".
+	header string
+
+	// indent is the indentation of the statements in the body.
+	indent string
+
+	// stmts are the parsed statements in the body, without "pass".
+	stmts []bf.Expr
+}
+
+// newMacro returns an empty macro named name without parameters.
+func newMacro(name string) *macro {
+	return &macro{header: fmt.Sprintf("def %s():\n", name), indent: "    "}
+}
+
+// parseMacro parses the body of the function definition in block. The
+// first line of the definition must include the whole signature.
+func parseMacro(block *bf.PythonBlock) (*macro, error) {
+	lines := strings.SplitAfter(block.Token, "\n")
+	m := &macro{header: lines[0]}
+	if !strings.HasSuffix(strings.TrimSpace(m.header), ":") {
+		return nil, fmt.Errorf("can't parse the signature of %q; it must be on one line", strings.TrimSpace(m.header))
+	}
+	var body []string
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			body = append(body, "\n")
+			continue
+		}
+		if m.indent == "" {
+			m.indent = line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		}
+		if m.indent == "" || !strings.HasPrefix(line, m.indent) {
+			return nil, fmt.Errorf("unexpected indentation in the body of %q", strings.TrimSpace(m.header))
+		}
+		body = append(body, line[len(m.indent):])
+	}
+	if m.indent == "" {
+		m.indent = "    "
+	}
+	f, err := bf.Parse(strings.TrimSpace(m.header), []byte(strings.Join(body, "")))
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range f.Stmt {
+		if x, ok := stmt.(*bf.LiteralExpr); ok && x.Token == "pass" && len(x.Comment().Before) == 0 && len(x.Comment().Suffix) == 0 {
+			continue
+		}
+		m.stmts = append(m.stmts, stmt)
+	}
+	return m, nil
+}
+
+// block returns a Python block with the definition of m. If old is not nil,
+// the returned block has its comments. old is not modified.
+func (m *macro) block(old *bf.PythonBlock) *bf.PythonBlock {
+	var body string
+	if len(m.stmts) == 0 {
+		body = "pass\n"
+	} else {
+		body = string(bf.Format(&bf.File{Stmt: m.stmts}))
+	}
+	var buf bytes.Buffer
+	buf.WriteString(m.header)
+	for _, line := range strings.SplitAfter(body, "\n") {
+		if strings.TrimSpace(line) != "" {
+			buf.WriteString(m.indent)
+		}
+		buf.WriteString(line)
+	}
+	b := &bf.PythonBlock{Token: buf.String()}
+	if old != nil {
+		b.Comments = old.Comments
+		b.Start = old.Start
+	}
+	return b
+}
+
+// findMacro returns the index and block of the definition of the function
+// named name among the top-level statements in stmts. -1 and nil are
+// returned if there is no such function.
+func findMacro(stmts []bf.Expr, name string) (int, *bf.PythonBlock) {
+	for i, stmt := range stmts {
+		b, ok := stmt.(*bf.PythonBlock)
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(b.Token, "def "+name+"(") || strings.HasPrefix(b.Token, "def "+name+" (") {
+			return i, b
+		}
+	}
+	return -1, nil
+}
+
+// HasMacroCall returns whether name is called by a top-level statement in f.
+func HasMacroCall(f *bf.File, name string) bool {
+	for _, stmt := range f.Stmt {
+		if call, ok := stmt.(*bf.CallExpr); ok {
+			if x, ok := call.X.(*bf.LiteralExpr); ok && x.Token == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EnsureLoad returns a copy of f in which symbol is loaded from file. If f
+// already loads symbol from file, f is returned. If f loads other symbols
+// from file, symbol is added to the first of those load statements.
+// Otherwise, a new load statement is added after the last load statement in
+// f, or at the top of the file, after any comment blocks, if there are none.
+// New loads follow existing loads because a WORKSPACE file may only load
+// from a repository after the repository is declared.
+func EnsureLoad(f *bf.File, file, symbol string) *bf.File {
+	loadIndex, lastLoad := -1, -1
+	for i, stmt := range f.Stmt {
+		call, loadedFile, ok := loadFile(stmt)
+		if !ok {
+			continue
+		}
+		lastLoad = i
+		if loadedFile != file {
+			continue
+		}
+		for _, arg := range call.List[1:] {
+			if local, _, ok := loadBinding(arg); ok && local == symbol {
+				return f
+			}
+		}
+		if loadIndex < 0 {
+			loadIndex = i
+		}
+	}
+
+	fixedFile := *f
+	if loadIndex >= 0 {
+		load := *f.Stmt[loadIndex].(*bf.CallExpr)
+		load.List = append(append([]bf.Expr(nil), load.List...), &bf.StringExpr{Value: symbol})
+		fixedFile.Stmt = append([]bf.Expr(nil), f.Stmt...)
+		fixedFile.Stmt[loadIndex] = &load
+		return &fixedFile
+	}
+
+	load := &bf.CallExpr{
+		X: &bf.LiteralExpr{Token: "load"},
+		List: []bf.Expr{
+			&bf.StringExpr{Value: file},
+			&bf.StringExpr{Value: symbol},
+		},
+		ForceCompact: true,
+	}
+	if lastLoad < 0 {
+		fixedFile.Stmt = insertLeadingStmts(f.Stmt, []bf.Expr{load})
+		return &fixedFile
+	}
+	fixedFile.Stmt = make([]bf.Expr, 0, len(f.Stmt)+1)
+	fixedFile.Stmt = append(fixedFile.Stmt, f.Stmt[:lastLoad+1]...)
+	fixedFile.Stmt = append(fixedFile.Stmt, load)
+	fixedFile.Stmt = append(fixedFile.Stmt, f.Stmt[lastLoad+1:]...)
+	return &fixedFile
+}
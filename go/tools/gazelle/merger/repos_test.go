@@ -0,0 +1,383 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+func TestMergeRepos(t *testing.T) {
+	for _, tc := range []struct {
+		desc, macro, old, gen, want string
+	}{
+		{
+			desc: "add to workspace",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies")
+
+go_rules_dependencies()
+`,
+			gen: `go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies")
+
+go_rules_dependencies()
+
+go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+`,
+		}, {
+			desc: "update existing",
+			old: `go_repository(
+    name = "org_golang_x_tools",
+    build_tags = ["foo"],
+    importpath = "golang.org/x/tools",
+    tag = "v1",
+)
+`,
+			gen: `go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+`,
+			want: `go_repository(
+    name = "org_golang_x_tools",
+    build_tags = ["foo"],
+    importpath = "golang.org/x/tools",
+    commit = "abc",
+)
+`,
+		}, {
+			desc: "keep rule",
+			old: `go_repository(
+    name = "org_golang_x_tools",
+    importpath = "golang.org/x/tools",
+    tag = "v1",
+)  # keep
+`,
+			gen: `go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+`,
+			want: `go_repository(
+    name = "org_golang_x_tools",
+    importpath = "golang.org/x/tools",
+    tag = "v1",
+)  # keep
+`,
+		}, {
+			desc: "keep attr",
+			old: `go_repository(
+    name = "org_golang_x_tools",
+    commit = "old",  # keep
+    importpath = "golang.org/x/tools",
+)
+`,
+			gen: `go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+`,
+			want: `go_repository(
+    name = "org_golang_x_tools",
+    commit = "old",  # keep
+    importpath = "golang.org/x/tools",
+)
+`,
+		}, {
+			desc:  "new macro",
+			macro: "go_dependencies",
+			old:   "",
+			gen: `go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+`,
+			want: `def go_dependencies():
+    go_repository(
+        name = "org_golang_x_tools",
+        commit = "abc",
+        importpath = "golang.org/x/tools",
+    )
+`,
+		}, {
+			desc:  "existing macro",
+			macro: "go_dependencies",
+			old: `def go_dependencies():
+    go_repository(
+        name = "com_github_pkg_errors",
+        commit = "old",
+        importpath = "github.com/pkg/errors",
+    )
+`,
+			gen: `go_repository(
+    name = "com_github_pkg_errors",
+    commit = "new",
+    importpath = "github.com/pkg/errors",
+)
+
+go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+`,
+			want: `def go_dependencies():
+    go_repository(
+        name = "com_github_pkg_errors",
+        commit = "new",
+        importpath = "github.com/pkg/errors",
+    )
+
+    go_repository(
+        name = "org_golang_x_tools",
+        commit = "abc",
+        importpath = "golang.org/x/tools",
+    )
+`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			oldFile, err := bf.Parse("old", []byte(tc.old))
+			if err != nil {
+				t.Fatal(err)
+			}
+			genFile, err := bf.Parse("gen", []byte(tc.gen))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var genRules []*bf.CallExpr
+			for _, stmt := range genFile.Stmt {
+				genRules = append(genRules, stmt.(*bf.CallExpr))
+			}
+			mergedFile, err := MergeRepos(genRules, oldFile, tc.macro)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(bf.Format(mergedFile)); got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+			if got := string(bf.Format(oldFile)); got != tc.old {
+				t.Errorf("old file was modified:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestEnsureLoad(t *testing.T) {
+	for _, tc := range []fixTestCase{
+		{
+			desc: "already loaded",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_repository")
+
+go_repository(name = "foo")
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_repository")
+
+go_repository(name = "foo")
+`,
+		}, {
+			desc: "added to existing load",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies")
+
+go_rules_dependencies()
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies", "go_repository")
+
+go_rules_dependencies()
+`,
+		}, {
+			desc: "new load after last load",
+			old: `git_repository(name = "io_bazel_rules_go")
+
+load("@other//:def.bzl", "other")
+
+other()
+`,
+			want: `git_repository(name = "io_bazel_rules_go")
+
+load("@other//:def.bzl", "other")
+load("@io_bazel_rules_go//go:def.bzl", "go_repository")
+
+other()
+`,
+		}, {
+			desc: "new load at top",
+			old: `# Copyright
+
+def go_dependencies():
+    pass
+`,
+			want: `# Copyright
+
+load("@io_bazel_rules_go//go:def.bzl", "go_repository")
+
+def go_dependencies():
+    pass
+`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			f, err := bf.Parse("old", []byte(tc.old))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fixed := EnsureLoad(f, "@io_bazel_rules_go//go:def.bzl", "go_repository")
+			if got := string(bf.Format(fixed)); got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPruneRepos(t *testing.T) {
+	for _, tc := range []struct {
+		desc, macro, old, want string
+		wantDeleted            []string
+	}{
+		{
+			desc: "workspace",
+			old: `go_repository(
+    name = "com_github_pkg_errors",
+    commit = "abc",
+    importpath = "github.com/pkg/errors",
+)
+
+# Unused.
+go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+
+go_repository(
+    name = "org_golang_x_net",
+    commit = "abc",
+    importpath = "golang.org/x/net",
+)  # keep
+`,
+			want: `go_repository(
+    name = "com_github_pkg_errors",
+    commit = "abc",
+    importpath = "github.com/pkg/errors",
+)
+
+# Unused.
+
+go_repository(
+    name = "org_golang_x_net",
+    commit = "abc",
+    importpath = "golang.org/x/net",
+)  # keep
+`,
+			wantDeleted: []string{"org_golang_x_tools"},
+		}, {
+			desc: "first statement",
+			old: `go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+
+go_repository(
+    name = "com_github_pkg_errors",
+    commit = "abc",
+    importpath = "github.com/pkg/errors",
+)
+`,
+			want: `go_repository(
+    name = "com_github_pkg_errors",
+    commit = "abc",
+    importpath = "github.com/pkg/errors",
+)
+`,
+			wantDeleted: []string{"org_golang_x_tools"},
+		}, {
+			desc:  "macro",
+			macro: "go_dependencies",
+			old: `go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+
+def go_dependencies():
+    go_repository(
+        name = "com_github_pkg_errors",
+        commit = "abc",
+        importpath = "github.com/pkg/errors",
+    )
+
+    go_repository(
+        name = "org_golang_x_tools",
+        commit = "abc",
+        importpath = "golang.org/x/tools",
+    )
+`,
+			want: `go_repository(
+    name = "org_golang_x_tools",
+    commit = "abc",
+    importpath = "golang.org/x/tools",
+)
+
+def go_dependencies():
+    go_repository(
+        name = "com_github_pkg_errors",
+        commit = "abc",
+        importpath = "github.com/pkg/errors",
+    )
+`,
+			wantDeleted: []string{"org_golang_x_tools"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			f, err := bf.Parse("old", []byte(tc.old))
+			if err != nil {
+				t.Fatal(err)
+			}
+			used := func(r *bf.Rule) bool {
+				return r.AttrString("importpath") == "github.com/pkg/errors"
+			}
+			pruned, deleted, err := PruneRepos(f, tc.macro, used)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(bf.Format(pruned)); got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+			if !reflect.DeepEqual(deleted, tc.wantDeleted) {
+				t.Errorf("deleted: got %q; want %q", deleted, tc.wantDeleted)
+			}
+			if got := string(bf.Format(f)); got != tc.old {
+				t.Errorf("old file was modified:\n%s", got)
+			}
+		})
+	}
+}
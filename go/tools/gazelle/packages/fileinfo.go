@@ -22,17 +22,21 @@ import (
 	"fmt"
 	"go/ast"
 	"go/parser"
+	"go/scanner"
 	"go/token"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/trace"
 )
 
 // fileInfo holds information used to decide how to build a file. This
@@ -57,7 +61,8 @@ type fileInfo struct {
 	isXTest bool
 
 	// imports is a list of packages imported by a file. It does not include
-	// "C" or anything from the standard library.
+	// "C" or anything from the standard library. For .proto files, it's the
+	// sorted list of imported .proto files.
 	imports []string
 
 	// isCgo is true for .go files that import "C".
@@ -74,6 +79,23 @@ type fileInfo struct {
 	// copts and clinkopts contain flags that are part of CFLAGS, CPPFLAGS,
 	// CXXFLAGS, and LDFLAGS directives in cgo comments.
 	copts, clinkopts []taggedOpts
+
+	// embeds is a list of files embedded with //go:embed directives, relative
+	// to the package directory and sorted. Directories matched by patterns
+	// are expanded to the files they contain.
+	embeds []string
+
+	// protoPackage is the package declared in a .proto file. It is empty for
+	// other files and for .proto files without a package statement.
+	protoPackage string
+
+	// goImportPath is the Go import path named by the go_package option in a
+	// .proto file. It is empty if the option isn't set or only names a Go
+	// package.
+	goImportPath string
+
+	// hasServices indicates whether a .proto file defines any services.
+	hasServices bool
 }
 
 // taggedOpts a list of compile or link options which should only be applied
@@ -118,6 +140,10 @@ const (
 
 	// protoExt is applied to .proto files.
 	protoExt
+
+	// sysoExt is applied to .syso object files. These are added to the
+	// package archive whether or not cgo is used.
+	sysoExt
 )
 
 // fileNameInfo returns information that can be inferred from the name of
@@ -140,19 +166,26 @@ func fileNameInfo(dir, rel, name string) fileInfo {
 		category = csExt
 	case ".proto":
 		category = protoExt
-	case ".m", ".f", ".F", ".for", ".f90", ".swig", ".swigcxx", ".syso":
+	case ".syso":
+		category = sysoExt
+	case ".m", ".f", ".F", ".for", ".f90", ".swig", ".swigcxx":
 		category = unsupportedExt
 	default:
 		category = ignoredExt
 	}
 
 	// Determine test, goos, and goarch. This is intended to match the logic
-	// in goodOSArchFile in go/build.
-	var isTest bool
+	// in goodOSArchFile in go/build. As in go/build, everything after the
+	// first dot is ignored when looking for suffixes, so foo_linux.pb.go is
+	// only built on linux.
+	isTest := category == goExt && strings.HasSuffix(name, "_test.go")
 	var goos, goarch string
-	l := strings.Split(name[:len(name)-len(ext)], "_")
+	base := name
+	if i := strings.Index(base, "."); i >= 0 {
+		base = base[:i]
+	}
+	l := strings.Split(base, "_")
 	if len(l) >= 2 && l[len(l)-1] == "test" {
-		isTest = category == goExt
 		l = l[:len(l)-1]
 	}
 	switch {
@@ -182,12 +215,23 @@ func fileNameInfo(dir, rel, name string) fileInfo {
 // If the file can't be read, an error will be logged, and partial information
 // will be returned.
 // This function is intended to match go/build.Context.Import.
+// errorLine returns the line of the first error in err, if err is a list of
+// errors from the Go parser. Otherwise, it returns 0.
+func errorLine(err error) int {
+	if errs, ok := err.(scanner.ErrorList); ok && len(errs) > 0 {
+		return errs[0].Pos.Line
+	}
+	return 0
+}
+
 func goFileInfo(c *config.Config, dir, rel, name string) fileInfo {
 	info := fileNameInfo(dir, rel, name)
 	fset := token.NewFileSet()
+	endParse := trace.Start(trace.Parse, info.path)
 	pf, err := parser.ParseFile(fset, info.path, nil, parser.ImportsOnly|parser.ParseComments)
+	endParse()
 	if err != nil {
-		log.Printf("%s: error reading go file: %v", info.path, err)
+		logging.ErrorfAt(info.path, errorLine(err), "error reading go file: %v", err)
 		return info
 	}
 
@@ -197,6 +241,7 @@ func goFileInfo(c *config.Config, dir, rel, name string) fileInfo {
 		info.packageName = info.packageName[:len(info.packageName)-len("_test")]
 	}
 
+	importsEmbed := false
 	for _, decl := range pf.Decls {
 		d, ok := decl.(*ast.GenDecl)
 		if !ok {
@@ -208,15 +253,16 @@ func goFileInfo(c *config.Config, dir, rel, name string) fileInfo {
 				continue
 			}
 			quoted := spec.Path.Value
+			line := fset.Position(spec.Pos()).Line
 			path, err := strconv.Unquote(quoted)
 			if err != nil {
-				log.Printf("%s: error reading go file: %v", info.path, err)
+				logging.ErrorfAt(info.path, line, "error reading go file: %v", err)
 				continue
 			}
 
 			if path == "C" {
 				if info.isTest {
-					log.Printf("%s: warning: use of cgo in test not supported", info.path)
+					logging.WarningfAt(info.path, line, "use of cgo in test not supported")
 				}
 				info.isCgo = true
 				cg := spec.Doc
@@ -225,18 +271,31 @@ func goFileInfo(c *config.Config, dir, rel, name string) fileInfo {
 				}
 				if cg != nil {
 					if err := saveCgo(&info, cg); err != nil {
-						log.Printf("%s: error reading go file: %v", info.path, err)
+						logging.ErrorfAt(info.path, fset.Position(cg.Pos()).Line, "error reading go file: %v", err)
 					}
 				}
+			} else if path == "embed" {
+				importsEmbed = true
 			} else if !isStandard(c.GoPrefix, path) {
 				info.imports = append(info.imports, path)
 			}
 		}
 	}
 
+	if importsEmbed {
+		// //go:embed directives are on declarations after the imports, so
+		// the whole file needs to be parsed. This is only done for the few
+		// files that use embed.
+		embeds, err := readEmbeds(dir, info.path)
+		if err != nil {
+			logging.ErrorfAt(info.path, 0, "%v", err)
+		}
+		info.embeds = embeds
+	}
+
 	tags, err := readTags(info.path)
 	if err != nil {
-		log.Printf("%s: error reading go file: %v", info.path, err)
+		logging.ErrorfAt(info.path, 0, "error reading go file: %v", err)
 		return info
 	}
 	info.tags = tags
@@ -244,6 +303,158 @@ func goFileInfo(c *config.Config, dir, rel, name string) fileInfo {
 	return info
 }
 
+// readEmbeds reads the //go:embed directives in the .go file at path and
+// returns the files they match in dir, relative to dir and sorted. Like the
+// go command, it reports an error for patterns that match nothing, since
+// the package won't compile; files matched by other patterns are still
+// returned.
+func readEmbeds(dir, path string) ([]string, error) {
+	fset := token.NewFileSet()
+	pf, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	for _, cg := range pf.Comments {
+		for _, c := range cg.List {
+			if !strings.HasPrefix(c.Text, "//go:embed") {
+				continue
+			}
+			args := strings.TrimPrefix(c.Text, "//go:embed")
+			if args != "" && args[0] != ' ' && args[0] != '\t' {
+				continue
+			}
+			ps, err := parseEmbedPatterns(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid //go:embed directive: %v", fset.Position(c.Pos()), err)
+			}
+			patterns = append(patterns, ps...)
+		}
+	}
+
+	var embeds []string
+	var errs []string
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		files, err := matchEmbedPattern(dir, pattern)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, f := range files {
+			if !seen[f] {
+				seen[f] = true
+				embeds = append(embeds, f)
+			}
+		}
+	}
+	sort.Strings(embeds)
+	if len(errs) > 0 {
+		return embeds, errors.New(strings.Join(errs, "; "))
+	}
+	return embeds, nil
+}
+
+// parseEmbedPatterns splits the arguments of a //go:embed directive into
+// patterns. Patterns are separated by spaces and may be quoted with double
+// quotes or back quotes.
+func parseEmbedPatterns(args string) ([]string, error) {
+	var patterns []string
+	for {
+		args = strings.TrimLeft(args, " \t")
+		if args == "" {
+			break
+		}
+		var pattern string
+		switch args[0] {
+		case '"', '`':
+			quote := args[0]
+			i := 1
+			for i < len(args) && args[i] != quote {
+				if quote == '"' && args[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(args) {
+				return nil, fmt.Errorf("unterminated string: %s", args)
+			}
+			var err error
+			pattern, err = strconv.Unquote(args[:i+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted string: %s", args[:i+1])
+			}
+			args = args[i+1:]
+		default:
+			i := strings.IndexAny(args, " \t")
+			if i < 0 {
+				i = len(args)
+			}
+			pattern, args = args[:i], args[i:]
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 {
+		return nil, errors.New("no patterns")
+	}
+	return patterns, nil
+}
+
+// matchEmbedPattern returns the files in dir matched by a //go:embed
+// pattern, relative to dir. Matched directories are expanded to the files
+// they contain, skipping files whose names start with "." or "_" unless the
+// pattern starts with "all:". This is intended to match
+// cmd/go/internal/load.resolveEmbed.
+func matchEmbedPattern(dir, pattern string) ([]string, error) {
+	all := strings.HasPrefix(pattern, "all:")
+	glob := strings.TrimPrefix(pattern, "all:")
+	if glob == "" || path.IsAbs(glob) || path.Clean(glob) != glob || glob == ".." || strings.HasPrefix(glob, "../") {
+		return nil, fmt.Errorf("pattern %q in //go:embed directive is invalid", pattern)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(glob)))
+	if err != nil {
+		return nil, fmt.Errorf("pattern %q in //go:embed directive is invalid: %v", pattern, err)
+	}
+
+	var files []string
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			rel, _ := filepath.Rel(dir, m)
+			files = append(files, filepath.ToSlash(rel))
+			continue
+		}
+		err = filepath.Walk(m, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if p != m && !all && (strings.HasPrefix(fi.Name(), ".") || strings.HasPrefix(fi.Name(), "_")) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			rel, _ := filepath.Rel(dir, p)
+			files = append(files, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("pattern %q in //go:embed directive matches no files", pattern)
+	}
+	return files, nil
+}
+
 // saveCgo extracts CFLAGS, CPPFLAGS, CXXFLAGS, and LDFLAGS directives
 // from a comment above a "C" import. This is intended to match logic in
 // go/build.Context.saveCgo.
@@ -455,10 +666,22 @@ func escapeOption(opt string) string {
 	).Replace(opt)
 }
 
-// isStandard determines if importpath points a Go standard package.
+// isStandard determines if importpath points a Go standard package. Packages
+// under goPrefix are never considered standard, even if their paths collide
+// with standard packages. Otherwise, import paths whose first element has no
+// dot are standard.
+//
+// This deliberately differs from resolve.IsStandard, which only accepts
+// packages in its table. Imports rejected here are never resolved, and a
+// path without a dot can't be fetched with "go get", so it can't be provided
+// by a go_repository either. Treating all of them as standard keeps packages
+// added in Go releases newer than the table out of deps.
 func isStandard(goPrefix, importpath string) bool {
+	if importpath == goPrefix || strings.HasPrefix(importpath, goPrefix+"/") {
+		return false
+	}
 	seg := strings.SplitN(importpath, "/", 2)[0]
-	return !strings.Contains(seg, ".") && !strings.HasPrefix(importpath, goPrefix+"/")
+	return !strings.Contains(seg, ".")
 }
 
 // otherFileInfo returns information about a non-.go file. It will parse
@@ -470,22 +693,41 @@ func otherFileInfo(dir, rel, name string) fileInfo {
 		return info
 	}
 	if info.category == unsupportedExt {
-		log.Printf("%s: warning: file extension not yet supported", info.path)
+		logging.WarningfAt(info.path, 0, "file extension not yet supported")
 		return info
 	}
+	if info.category == sysoExt {
+		// Binary file; only the name is used to determine constraints.
+		return info
+	}
+	if info.category == protoExt {
+		// Build constraints don't apply to .proto files.
+		return protoFileInfo(info)
+	}
 
 	tags, err := readTags(info.path)
 	if err != nil {
-		log.Printf("%s: error reading file: %v", info.path, err)
+		logging.ErrorfAt(info.path, 0, "error reading file: %v", err)
 		return info
 	}
 	info.tags = tags
 	return info
 }
 
-// Copied from go/build. Keep in sync as new platforms are added.
-const goosList = "android darwin dragonfly freebsd linux nacl netbsd openbsd plan9 solaris windows zos "
-const goarchList = "386 amd64 amd64p32 arm armbe arm64 arm64be ppc64 ppc64le mips mipsle mips64 mips64le mips64p32 mips64p32le ppc s390 s390x sparc sparc64 "
+// Copied from go/build. Keep in sync as new platforms are added. These
+// include platforms that are reserved but not yet supported by Go, so that
+// files with those suffixes are excluded rather than built everywhere.
+const goosList = "aix android darwin dragonfly freebsd hurd illumos ios js linux nacl netbsd openbsd plan9 solaris wasip1 windows zos "
+const goarchList = "386 amd64 amd64p32 arm armbe arm64 arm64be loong64 mips mipsle mips64 mips64le mips64p32 mips64p32le ppc ppc64 ppc64le riscv riscv64 s390 s390x sparc sparc64 wasm "
+
+// impliedOS maps operating systems to more specific operating systems that
+// also satisfy their constraints. For example, a file with the suffix
+// _linux.go is built on android.
+var impliedOS = map[string]string{
+	"darwin":  "ios",
+	"linux":   "android",
+	"solaris": "illumos",
+}
 
 var knownOS = make(map[string]bool)
 var knownArch = make(map[string]bool)
@@ -553,16 +795,11 @@ func (fi *fileInfo) hasConstraints() bool {
 // checkConstraints determines whether a file should be built on a platform
 // with the given tags. It returns true for files without constraints.
 func (fi *fileInfo) checkConstraints(tags map[string]bool) bool {
-	// TODO: linux should match on android.
-	if fi.goos != "" {
-		if _, ok := tags[fi.goos]; !ok {
-			return false
-		}
+	if fi.goos != "" && !matchTag(fi.goos, tags) {
+		return false
 	}
-	if fi.goarch != "" {
-		if _, ok := tags[fi.goarch]; !ok {
-			return false
-		}
+	if fi.goarch != "" && !matchTag(fi.goarch, tags) {
+		return false
 	}
 
 	for _, line := range fi.tags {
@@ -578,8 +815,8 @@ func (fi *fileInfo) checkConstraints(tags map[string]bool) bool {
 // tags. The constraints are satisfied for the line if any of the groups are
 // satisfied. A group is satisfied if all of the tags in it are true. A tag can
 // be negated with a "!" prefix, but double negatation ("!!") is not allowed.
+// Empty tags (for example, from a trailing comma) are never satisfied.
 func checkTags(line string, tags map[string]bool) bool {
-	// TODO: linux should match on android.
 	lineOk := false
 	for _, group := range strings.Fields(line) {
 		groupOk := true
@@ -591,19 +828,43 @@ func checkTags(line string, tags map[string]bool) bool {
 			if not {
 				tag = tag[1:]
 			}
+			if tag == "" {
+				groupOk = false
+				continue
+			}
 			if isReleaseTag(tag) {
 				// Release tags are treated as "unknown" and are considered true,
 				// whether or not they are negated.
 				continue
 			}
-			_, ok := tags[tag]
-			groupOk = groupOk && (not != ok)
+			groupOk = groupOk && (not != matchTag(tag, tags))
 		}
 		lineOk = lineOk || groupOk
 	}
 	return lineOk
 }
 
+// matchTag returns whether a single, non-negated tag is true for the given
+// set of tags. As in go/build, "linux" is also true when "android" is set,
+// "solaris" is true when "illumos" is set, and "darwin" is true when "ios" is
+// set. Tags containing characters other than letters, digits, '_', and '.'
+// are never true.
+func matchTag(tag string, tags map[string]bool) bool {
+	for _, c := range tag {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && c != '.' {
+			return false
+		}
+	}
+	if _, ok := tags[tag]; ok {
+		return true
+	}
+	if implied, ok := impliedOS[tag]; ok {
+		_, ok := tags[implied]
+		return ok
+	}
+	return false
+}
+
 // isReleaseTag returns whether the tag matches the pattern "go[0-9]\.[0-9]+".
 func isReleaseTag(tag string) bool {
 	if len(tag) < 5 || !strings.HasPrefix(tag, "go") {
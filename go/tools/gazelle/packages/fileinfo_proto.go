@@ -0,0 +1,122 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+)
+
+// protoFileInfo extracts metadata from the .proto file described by info.
+// The file isn't fully parsed; statements are matched with a regular
+// expression that skips comments. If the file can't be read, an error is
+// logged, and info is returned unchanged.
+func protoFileInfo(info fileInfo) fileInfo {
+	content, err := ioutil.ReadFile(info.path)
+	if err != nil {
+		logging.ErrorfAt(info.path, 0, "error reading proto file: %v", err)
+		return info
+	}
+
+	for _, match := range protoRe.FindAllSubmatch(content, -1) {
+		switch {
+		case match[protoImportSubexp] != nil:
+			info.imports = append(info.imports, unquoteProtoString(match[protoImportSubexp]))
+
+		case match[protoPackageSubexp] != nil:
+			info.protoPackage = string(match[protoPackageSubexp])
+
+		case match[protoOptKeySubexp] != nil:
+			if string(match[protoOptKeySubexp]) == "go_package" {
+				info.goImportPath = goPackageImportPath(unquoteProtoString(match[protoOptValSubexp]))
+			}
+
+		case match[protoServiceSubexp] != nil:
+			info.hasServices = true
+		}
+	}
+	sort.Strings(info.imports)
+	return info
+}
+
+var (
+	protoRe                                                                                         = buildProtoRegexp()
+	protoImportSubexp, protoPackageSubexp, protoOptKeySubexp, protoOptValSubexp, protoServiceSubexp int
+)
+
+func init() {
+	for i, name := range protoRe.SubexpNames() {
+		switch name {
+		case "import":
+			protoImportSubexp = i
+		case "package":
+			protoPackageSubexp = i
+		case "optkey":
+			protoOptKeySubexp = i
+		case "optval":
+			protoOptValSubexp = i
+		case "service":
+			protoServiceSubexp = i
+		}
+	}
+}
+
+// buildProtoRegexp returns a regular expression that matches the statements
+// Gazelle is interested in, following the grammar at
+// https://developers.google.com/protocol-buffers/docs/reference/proto3-spec.
+// Comments are matched too, so statements inside them are skipped.
+func buildProtoRegexp() *regexp.Regexp {
+	strLit := `'(?:[^'\\\n]|\\.)*'|"(?:[^"\\\n]|\\.)*"`
+	ident := `[A-Za-z][A-Za-z0-9_]*`
+	fullIdent := ident + `(?:\.` + ident + `)*`
+	importStmt := `\bimport\s+(?:public\s+|weak\s+)?(?P<import>` + strLit + `)\s*;`
+	packageStmt := `\bpackage\s+(?P<package>` + fullIdent + `)\s*;`
+	optionStmt := `\boption\s+(?P<optkey>` + fullIdent + `)\s*=\s*(?P<optval>` + strLit + `)\s*;`
+	serviceStmt := `\bservice\s+(?P<service>` + ident + `)\s*\{`
+	comment := `//[^\n]*|/\*(?s:.*?)\*/`
+	return regexp.MustCompile(strings.Join([]string{importStmt, packageStmt, optionStmt, serviceStmt, comment}, "|"))
+}
+
+// unquoteProtoString returns the value of a string literal in a .proto file.
+// Proto string literals may be quoted with single or double quotes.
+func unquoteProtoString(lit []byte) string {
+	s := string(lit)
+	if strings.HasPrefix(s, "'") {
+		s = `"` + strings.Replace(s[1:len(s)-1], `"`, `\"`, -1) + `"`
+	}
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+	return s[1 : len(s)-1]
+}
+
+// goPackageImportPath returns the Go import path named by the value of a
+// go_package option, like "example.com/foo" or "example.com/foo;foo".
+// "" is returned if the option only names a Go package, like "foo".
+func goPackageImportPath(opt string) string {
+	if i := strings.Index(opt, ";"); i >= 0 {
+		opt = opt[:i]
+	}
+	if !strings.Contains(opt, "/") {
+		return ""
+	}
+	return opt
+}
@@ -0,0 +1,86 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProtoFileInfo(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "TestProtoFileInfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		desc, source                  string
+		wantPackage, wantGoImportPath string
+		wantServices                  bool
+	}{
+		{
+			desc: "empty file",
+		}, {
+			desc:        "package",
+			source:      "syntax = \"proto3\";\n\npackage foo.bar;\n",
+			wantPackage: "foo.bar",
+		}, {
+			desc:        "commented package",
+			source:      "// package foo;\n/* package bar;\n */\npackage baz;\n",
+			wantPackage: "baz",
+		}, {
+			desc:             "go_package import path",
+			source:           "package foo;\noption go_package = \"example.com/foo;foopb\";\n",
+			wantPackage:      "foo",
+			wantGoImportPath: "example.com/foo",
+		}, {
+			desc:             "go_package single quotes",
+			source:           "option go_package='example.com/foo';\n",
+			wantGoImportPath: "example.com/foo",
+		}, {
+			desc:        "go_package name only",
+			source:      "package foo;\noption go_package = \"foopb\";\noption java_package = \"com.example.foo\";\n",
+			wantPackage: "foo",
+		}, {
+			desc:         "service",
+			source:       "package foo;\nservice Foo {\n  rpc Bar(Req) returns (Resp);\n}\n",
+			wantPackage:  "foo",
+			wantServices: true,
+		}, {
+			desc:   "commented service",
+			source: "// service Foo {}\nmessage Service {}\n",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if err := ioutil.WriteFile(filepath.Join(dir, "foo.proto"), []byte(tc.source), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got := otherFileInfo(dir, "", "foo.proto")
+			if got.protoPackage != tc.wantPackage {
+				t.Errorf("got package %q; want %q", got.protoPackage, tc.wantPackage)
+			}
+			if got.goImportPath != tc.wantGoImportPath {
+				t.Errorf("got go_package import path %q; want %q", got.goImportPath, tc.wantGoImportPath)
+			}
+			if got.hasServices != tc.wantServices {
+				t.Errorf("got hasServices %v; want %v", got.hasServices, tc.wantServices)
+			}
+		})
+	}
+}
@@ -324,6 +324,52 @@ func TestFileNameInfo(t *testing.T) {
 				goos:     "linux",
 			},
 		},
+		{
+			"goos before extra extension",
+			"foo_linux.pb.go",
+			fileInfo{
+				ext:      ".go",
+				category: goExt,
+				goos:     "linux",
+			},
+		},
+		{
+			"test with extra extension",
+			"foo.bar_test.go",
+			fileInfo{
+				ext:      ".go",
+				category: goExt,
+				isTest:   true,
+			},
+		},
+		{
+			"goos after dot",
+			"foo.bar_linux.go",
+			fileInfo{
+				ext:      ".go",
+				category: goExt,
+			},
+		},
+		{
+			"reserved goos and goarch",
+			"foo_js_wasm.go",
+			fileInfo{
+				ext:      ".go",
+				category: goExt,
+				goos:     "js",
+				goarch:   "wasm",
+			},
+		},
+		{
+			"reserved goos test",
+			"foo_zos_test.go",
+			fileInfo{
+				ext:      ".go",
+				category: goExt,
+				goos:     "zos",
+				isTest:   true,
+			},
+		},
 		{
 			"goos source",
 			"linux.go",
@@ -389,6 +435,16 @@ func TestFileNameInfo(t *testing.T) {
 				goarch:   "amd64",
 			},
 		},
+		{
+			"go asm file with goos and goarch",
+			"foo_linux_arm.s",
+			fileInfo{
+				ext:      ".s",
+				category: sExt,
+				goos:     "linux",
+				goarch:   "arm",
+			},
+		},
 		{
 			"c asm file",
 			"foo.S",
@@ -397,6 +453,33 @@ func TestFileNameInfo(t *testing.T) {
 				category: csExt,
 			},
 		},
+		{
+			"c asm file with goos",
+			"foo_darwin.S",
+			fileInfo{
+				ext:      ".S",
+				category: csExt,
+				goos:     "darwin",
+			},
+		},
+		{
+			"syso file",
+			"rsrc.syso",
+			fileInfo{
+				ext:      ".syso",
+				category: sysoExt,
+			},
+		},
+		{
+			"syso file with goos and goarch",
+			"rsrc_windows_amd64.syso",
+			fileInfo{
+				ext:      ".syso",
+				category: sysoExt,
+				goos:     "windows",
+				goarch:   "amd64",
+			},
+		},
 		{
 			"unsupported file",
 			"foo.m",
@@ -442,6 +525,45 @@ func TestFileNameInfo(t *testing.T) {
 	}
 }
 
+// TestFileNameInfoMatrix checks that every combination of known GOOS and
+// GOARCH suffixes is recognized, with and without a _test suffix, for each
+// kind of file that may have them.
+func TestFileNameInfoMatrix(t *testing.T) {
+	var oss, archs []string
+	for os := range knownOS {
+		oss = append(oss, os)
+	}
+	for arch := range knownArch {
+		archs = append(archs, arch)
+	}
+	oss = append(oss, "")
+	archs = append(archs, "")
+
+	for _, ext := range []string{".go", ".s", ".c", ".syso"} {
+		for _, test := range []string{"", "_test"} {
+			for _, os := range oss {
+				for _, arch := range archs {
+					name := "foo"
+					if os != "" {
+						name += "_" + os
+					}
+					if arch != "" {
+						name += "_" + arch
+					}
+					name += test + ext
+					info := fileNameInfo("dir", "dir", name)
+					if info.goos != os || info.goarch != arch {
+						t.Errorf("%s: got goos %q, goarch %q; want %q, %q", name, info.goos, info.goarch, os, arch)
+					}
+					if wantTest := ext == ".go" && test != ""; info.isTest != wantTest {
+						t.Errorf("%s: got isTest %v; want %v", name, info.isTest, wantTest)
+					}
+				}
+			}
+		}
+	}
+}
+
 func TestCgo(t *testing.T) {
 	c := &config.Config{}
 	dir := "."
@@ -575,6 +697,111 @@ var expandSrcDirTests = []struct {
 }
 
 // Copied from go/build build_test.go
+func TestGoEmbed(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "embed_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.txt", "b.txt", "static/index.html", "static/.hidden", "static/_draft/x.html", "c d.txt"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &config.Config{}
+	for _, tc := range []struct {
+		desc, source string
+		want         []string
+	}{
+		{
+			"no embed import",
+			`package foo
+
+//go:embed a.txt
+var s string
+`,
+			nil,
+		},
+		{
+			"globs and dirs",
+			`package foo
+
+import _ "embed"
+
+//go:embed *.txt static
+var s string
+
+//go:embed a.txt "c d.txt"
+var t string
+`,
+			[]string{"a.txt", "b.txt", "c d.txt", "static/index.html"},
+		},
+		{
+			"all prefix",
+			`package foo
+
+import "embed"
+
+//go:embed all:static
+var fs embed.FS
+`,
+			[]string{"static/.hidden", "static/_draft/x.html", "static/index.html"},
+		},
+		{
+			"no match",
+			`package foo
+
+import _ "embed"
+
+//go:embed missing.txt a.txt
+var s string
+`,
+			[]string{"a.txt"},
+		},
+	} {
+		name := "TestGoEmbed.go"
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(tc.source), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got := goFileInfo(c, dir, "", name)
+		if !reflect.DeepEqual(got.embeds, tc.want) {
+			t.Errorf("case %q: got %q; want %q", tc.desc, got.embeds, tc.want)
+		}
+	}
+}
+
+func TestParseEmbedPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		args    string
+		want    []string
+		wantErr bool
+	}{
+		{args: " a.txt  b/*.html", want: []string{"a.txt", "b/*.html"}},
+		{args: ` "a b.txt" ` + "`c d`", want: []string{"a b.txt", "c d"}},
+		{args: ` "a\"b"`, want: []string{`a"b`}},
+		{args: ` "unterminated`, wantErr: true},
+		{args: "", wantErr: true},
+	} {
+		got, err := parseEmbedPatterns(tc.args)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: got success; want error", tc.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: got error %v; want success", tc.args, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %q; want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
 func TestExpandSrcDir(t *testing.T) {
 	for _, test := range expandSrcDirTests {
 		output, _ := expandSrcDir(test.input, expandSrcDirPath)
@@ -682,17 +909,20 @@ func TestIsStandard(t *testing.T) {
 	}{
 		{"", "fmt", true},
 		{"", "encoding/json", true},
+		{"", "context", true},
+		{"", "log/slog", true},
 		{"", "foo/bar", true},
 		{"", "foo.com/bar", false},
 		{"foo", "fmt", true},
 		{"foo", "encoding/json", true},
-		{"foo", "foo", true},
+		{"foo", "foo", false},
 		{"foo", "foo/bar", false},
 		{"foo", "foo.com/bar", false},
 		{"foo.com/bar", "fmt", true},
 		{"foo.com/bar", "encoding/json", true},
 		{"foo.com/bar", "foo/bar", true},
 		{"foo.com/bar", "foo.com/bar", false},
+		{"net", "net/http", false},
 	} {
 		if got := isStandard(tc.goPrefix, tc.importpath); got != tc.want {
 			t.Errorf("for prefix %q, importpath %q: got %#v; want %#v", tc.goPrefix, tc.importpath, got, tc.want)
@@ -846,6 +1076,42 @@ func TestCheckConstraints(t *testing.T) {
 			"darwin,foo",
 			false,
 		},
+		{
+			"linux goos satisfied on android",
+			fileInfo{goos: "linux"},
+			"android,arm",
+			true,
+		},
+		{
+			"solaris goos satisfied on illumos",
+			fileInfo{goos: "solaris"},
+			"illumos,amd64",
+			true,
+		},
+		{
+			"darwin goos satisfied on ios",
+			fileInfo{goos: "darwin"},
+			"ios,arm64",
+			true,
+		},
+		{
+			"android goos unsatisfied on linux",
+			fileInfo{goos: "android"},
+			"linux,amd64",
+			false,
+		},
+		{
+			"tags OR NOT satisfied",
+			fileInfo{tags: []string{"linux,!arm darwin"}},
+			"linux,amd64",
+			true,
+		},
+		{
+			"tags OR NOT unsatisfied",
+			fileInfo{tags: []string{"linux,!arm darwin"}},
+			"linux,arm",
+			false,
+		},
 	} {
 		if got := tc.fi.checkConstraints(parseTags(tc.tags)); got != tc.want {
 			t.Errorf("case %q: got %#v; want %#v", tc.desc, got, tc.want)
@@ -960,6 +1226,36 @@ func TestCheckTags(t *testing.T) {
 			"",
 			true,
 		},
+		{
+			"linux satisfied by android",
+			"linux",
+			"android",
+			true,
+		},
+		{
+			"NOT linux unsatisfied by android",
+			"!linux",
+			"android",
+			false,
+		},
+		{
+			"empty tag in group",
+			"foo,",
+			"foo",
+			false,
+		},
+		{
+			"bare negation",
+			"!",
+			"",
+			false,
+		},
+		{
+			"invalid characters",
+			"foo-bar",
+			"foo-bar",
+			false,
+		},
 	} {
 		if got := checkTags(tc.line, parseTags(tc.tags)); got != tc.want {
 			t.Errorf("case %q: got %#v; want %#v", tc.desc, got, tc.want)
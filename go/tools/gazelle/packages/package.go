@@ -45,6 +45,36 @@ type Package struct {
 	Protos      []string
 	HasPbGo     bool
 	HasTestdata bool
+
+	// ProtoFiles contains metadata about each file in Protos, in the
+	// same order.
+	ProtoFiles []ProtoFile
+
+	// Secondary is a list of other packages in the same directory, sorted by
+	// name. Gazelle generates rules for these with names and import paths
+	// derived from their package names. Secondary packages never have
+	// secondary packages of their own.
+	Secondary []*Package
+
+	// SourceGroups holds library sources split out of Library by
+	// "# gazelle:go_source" directives, in the order the groups were
+	// declared. Groups with no files are included, so rules left over from
+	// them can be deleted.
+	SourceGroups []SourceGroup
+
+	// BrokenBuildFile is the path to an existing build file in Dir that
+	// couldn't be parsed. It's only set when c.NewOnParseError is set; the
+	// directory is skipped otherwise.
+	BrokenBuildFile string
+}
+
+// SourceGroup is a set of library sources in a package that are built by a
+// go_source rule embedded in the package's library.
+type SourceGroup struct {
+	// Name is the name of the group from config.SourceGroup.
+	Name string
+
+	Target Target
 }
 
 // Target contains metadata about a buildable Go target in a package.
@@ -52,6 +82,37 @@ type Target struct {
 	Sources, Imports PlatformStrings
 	COpts, CLinkOpts PlatformStrings
 	Cgo              bool
+
+	// EmbedSrcs lists files embedded with //go:embed directives in the
+	// target's sources, relative to the package directory. The Go rules
+	// can't build them yet, so they're only used to warn about them.
+	EmbedSrcs PlatformStrings
+
+	// ImportedBy maps each import path in Imports to the names of the files
+	// that import it, in the order the files were added. It's used to explain
+	// why dependencies are added to generated rules.
+	ImportedBy map[string][]string
+}
+
+// ProtoFile contains metadata about a .proto file in a package.
+type ProtoFile struct {
+	// Name is the name of the file, relative to the package directory.
+	Name string
+
+	// PackageName is the proto package declared in the file. It is empty if
+	// the file has no package statement.
+	PackageName string
+
+	// GoImportPath is the Go import path named by the file's go_package
+	// option. It is empty if the option isn't set or only names a Go package.
+	GoImportPath string
+
+	// Imports is the sorted list of .proto files imported by the file, as
+	// written in import statements.
+	Imports []string
+
+	// HasServices indicates whether the file defines any gRPC services.
+	HasServices bool
 }
 
 // PlatformStrings contains a set of strings associated with a buildable
@@ -75,7 +136,22 @@ func (p *Package) IsCommand() bool {
 // .go source file. If a package does not contain Go code, Gazelle will
 // not generate rules for it.
 func (p *Package) HasGo() bool {
-	return p.Library.HasGo() || p.Binary.HasGo() || p.Test.HasGo() || p.XTest.HasGo()
+	for _, t := range p.Targets() {
+		if t.HasGo() {
+			return true
+		}
+	}
+	return false
+}
+
+// Targets returns pointers to the targets in the package: the library,
+// binary, and tests, followed by the targets of its source groups.
+func (p *Package) Targets() []*Target {
+	ts := []*Target{&p.Library, &p.Binary, &p.Test, &p.XTest}
+	for i := range p.SourceGroups {
+		ts = append(ts, &p.SourceGroups[i].Target)
+	}
+	return ts
 }
 
 // ImportPath returns the inferred Go import path for this package. This
@@ -83,11 +159,14 @@ func (p *Package) HasGo() bool {
 //
 // * If "vendor" is a component in p.Rel, everything after the last "vendor"
 //   component is returned.
-// * Otherwise, prefix joined with Rel is returned.
+// * Otherwise, prefix joined with the path from prefixRel to p.Rel is
+//   returned. prefixRel is the directory that corresponds to prefix, relative
+//   to the repository root; it is empty unless a "# gazelle:prefix"
+//   directive appears in a subdirectory.
 //
 // TODO(jayconrod): extract canonical import paths from comments on
 // package statements.
-func (p *Package) ImportPath(prefix string) string {
+func (p *Package) ImportPath(prefix, prefixRel string) string {
 	components := strings.Split(p.Rel, "/")
 	for i := len(components) - 1; i >= 0; i-- {
 		if components[i] == "vendor" {
@@ -95,22 +174,24 @@ func (p *Package) ImportPath(prefix string) string {
 		}
 	}
 
-	return path.Join(prefix, p.Rel)
+	rel := p.Rel
+	if rel == prefixRel {
+		rel = ""
+	} else if prefixRel != "" && strings.HasPrefix(rel, prefixRel+"/") {
+		rel = rel[len(prefixRel)+1:]
+	}
+	return path.Join(prefix, rel)
 }
 
 // firstGoFile returns the name of a .go file if the package contains at least
 // one .go file, or "" otherwise. Used by HasGo and for error reporting.
 func (p *Package) firstGoFile() string {
-	if f := p.Library.firstGoFile(); f != "" {
-		return f
-	}
-	if f := p.Binary.firstGoFile(); f != "" {
-		return f
-	}
-	if f := p.Test.firstGoFile(); f != "" {
-		return f
+	for _, t := range p.Targets() {
+		if f := t.firstGoFile(); f != "" {
+			return f
+		}
 	}
-	return p.XTest.firstGoFile()
+	return ""
 }
 
 func (t *Target) HasGo() bool {
@@ -179,8 +260,15 @@ func (p *Package) addFile(c *config.Config, info fileInfo, cgo bool) error {
 		p.Test.addFile(c, info)
 	case info.category == protoExt:
 		p.Protos = append(p.Protos, info.name)
+		p.ProtoFiles = append(p.ProtoFiles, ProtoFile{
+			Name:         info.name,
+			PackageName:  info.protoPackage,
+			GoImportPath: info.goImportPath,
+			Imports:      info.imports,
+			HasServices:  info.hasServices,
+		})
 	default:
-		p.Library.addFile(c, info)
+		p.libraryTarget(c, info).addFile(c, info)
 	}
 	if strings.HasSuffix(info.name, ".pb.go") {
 		p.HasPbGo = true
@@ -189,13 +277,37 @@ func (p *Package) addFile(c *config.Config, info fileInfo, cgo bool) error {
 	return nil
 }
 
+// libraryTarget returns the target a library file is added to: the target
+// of the first source group with a pattern matching the file, or Library.
+// Cgo files and files other than .go files always go in Library, since
+// go_source can't build them.
+func (p *Package) libraryTarget(c *config.Config, info fileInfo) *Target {
+	if len(c.SourceGroups) == 0 || info.category != goExt || info.isCgo {
+		return &p.Library
+	}
+	if p.SourceGroups == nil {
+		p.SourceGroups = make([]SourceGroup, len(c.SourceGroups))
+		for i, g := range c.SourceGroups {
+			p.SourceGroups[i].Name = g.Name
+		}
+	}
+	for i, g := range c.SourceGroups {
+		if g.Match(info.name) {
+			return &p.SourceGroups[i].Target
+		}
+	}
+	return &p.Library
+}
+
 func (t *Target) addFile(c *config.Config, info fileInfo) {
 	if info.isCgo {
 		t.Cgo = true
 	}
+	t.addImportedBy(info)
 	if !info.hasConstraints() || info.checkConstraints(c.GenericTags) {
 		t.Sources.addGenericStrings(info.name)
 		t.Imports.addGenericStrings(info.imports...)
+		t.EmbedSrcs.addGenericStrings(info.embeds...)
 		t.COpts.addGenericOpts(c.Platforms, info.copts)
 		t.CLinkOpts.addGenericOpts(c.Platforms, info.clinkopts)
 		return
@@ -205,12 +317,27 @@ func (t *Target) addFile(c *config.Config, info fileInfo) {
 		if info.checkConstraints(tags) {
 			t.Sources.addPlatformStrings(name, info.name)
 			t.Imports.addPlatformStrings(name, info.imports...)
+			t.EmbedSrcs.addPlatformStrings(name, info.embeds...)
 			t.COpts.addTaggedOpts(name, info.copts, tags)
 			t.CLinkOpts.addTaggedOpts(name, info.clinkopts, tags)
 		}
 	}
 }
 
+func (t *Target) addImportedBy(info fileInfo) {
+	for _, imp := range info.imports {
+		if t.ImportedBy == nil {
+			t.ImportedBy = make(map[string][]string)
+		}
+		files := t.ImportedBy[imp]
+		if len(files) > 0 && files[len(files)-1] == info.name {
+			// The same path may be imported more than once with different names.
+			continue
+		}
+		t.ImportedBy[imp] = append(files, info.name)
+	}
+}
+
 func (ps *PlatformStrings) addGenericStrings(ss ...string) {
 	ps.Generic = append(ps.Generic, ss...)
 }
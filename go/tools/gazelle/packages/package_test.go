@@ -20,12 +20,14 @@ import (
 	"path"
 	"reflect"
 	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
 )
 
 func TestImportPath(t *testing.T) {
 	prefix := "example.com/repo"
 	for _, tc := range []struct {
-		name, rel, prefix, want string
+		name, rel, prefixRel, want string
 	}{
 		{
 			name: "simple_vendor",
@@ -43,6 +45,21 @@ func TestImportPath(t *testing.T) {
 			name: "prefix",
 			rel:  "foo/bar",
 			want: "example.com/repo/foo/bar",
+		}, {
+			name:      "prefix_rel",
+			rel:       "foo/bar",
+			prefixRel: "foo",
+			want:      "example.com/repo/bar",
+		}, {
+			name:      "prefix_rel_root",
+			rel:       "foo",
+			prefixRel: "foo",
+			want:      "example.com/repo",
+		}, {
+			name:      "prefix_rel_vendor",
+			rel:       "foo/vendor/bar",
+			prefixRel: "foo",
+			want:      "bar",
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
@@ -55,7 +72,7 @@ func TestImportPath(t *testing.T) {
 					},
 				},
 			}
-			if got := pkg.ImportPath(prefix); got != tc.want {
+			if got := pkg.ImportPath(prefix, tc.prefixRel); got != tc.want {
 				t.Errorf("%s: got %q ; want %q", tc.name, got, tc.want)
 			}
 		})
@@ -67,7 +84,7 @@ func TestImportPathNoLib(t *testing.T) {
 		Name: "bar",
 		Rel:  "foo/bar",
 	}
-	if got, want := pkg.ImportPath("example.com/repo"), "example.com/repo/foo/bar"; got != want {
+	if got, want := pkg.ImportPath("example.com/repo", ""), "example.com/repo/foo/bar"; got != want {
 		t.Errorf(`got %q; want %q`, got, want)
 	}
 }
@@ -82,11 +99,62 @@ func TestImportPathCmd(t *testing.T) {
 			},
 		},
 	}
-	if got, want := pkg.ImportPath("example.com/repo"), "example.com/repo/foo/bar"; got != want {
+	if got, want := pkg.ImportPath("example.com/repo", ""), "example.com/repo/foo/bar"; got != want {
 		t.Errorf(`got %q; want %q`, got, want)
 	}
 }
 
+func TestTargetImportedBy(t *testing.T) {
+	c := &config.Config{Platforms: config.DefaultPlatformTags}
+	var target Target
+	for _, info := range []fileInfo{
+		{name: "a.go", category: goExt, imports: []string{"example.com/x", "example.com/y"}},
+		{name: "b_linux.go", category: goExt, goos: "linux", imports: []string{"example.com/x"}},
+		{name: "c.go", category: goExt, imports: []string{"example.com/x", "example.com/x"}},
+	} {
+		target.addFile(c, info)
+	}
+	want := map[string][]string{
+		"example.com/x": {"a.go", "b_linux.go", "c.go"},
+		"example.com/y": {"a.go"},
+	}
+	if !reflect.DeepEqual(target.ImportedBy, want) {
+		t.Errorf("got %#v; want %#v", target.ImportedBy, want)
+	}
+}
+
+func TestPackageSourceGroups(t *testing.T) {
+	c := &config.Config{
+		Platforms: config.DefaultPlatformTags,
+		SourceGroups: []config.SourceGroup{
+			{Name: "tables", Patterns: []string{"tables*.go"}},
+			{Name: "gen", Patterns: []string{"gen_*.go"}},
+		},
+	}
+	pkg := &Package{Name: "foo"}
+	for _, info := range []fileInfo{
+		{name: "foo.go", category: goExt},
+		{name: "tables.go", category: goExt},
+		{name: "tables_cgo.go", category: goExt, isCgo: true},
+		{name: "tables_test.go", category: goExt, isTest: true},
+		{name: "tables.s", category: sExt},
+	} {
+		if err := pkg.addFile(c, info, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []SourceGroup{
+		{Name: "tables", Target: Target{Sources: PlatformStrings{Generic: []string{"tables.go"}}}},
+		{Name: "gen"},
+	}
+	if !reflect.DeepEqual(pkg.SourceGroups, want) {
+		t.Errorf("got source groups %#v; want %#v", pkg.SourceGroups, want)
+	}
+	if got, want := pkg.Library.Sources.Generic, []string{"foo.go", "tables_cgo.go", "tables.s"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got library sources %q; want %q", got, want)
+	}
+}
+
 func TestCleanPlatformStrings(t *testing.T) {
 	for _, tc := range []struct {
 		desc     string
@@ -0,0 +1,65 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/walk"
+)
+
+// IndexProtos returns an index of the .proto files in the repository, used
+// to resolve imports in .proto files to rules in other directories. The
+// repository is scanned the first time the index is used. Directories that
+// walk.Walk would skip because of their names or .bazelignore are skipped,
+// but directives in build files aren't read, so import paths are based on
+// the prefix in c.
+func IndexProtos(c *config.Config) *resolve.ProtoIndex {
+	return resolve.NewProtoIndex(func(x *resolve.ProtoIndex) {
+		bazelIgnored := walk.ReadBazelIgnore(c.RepoRoot)
+		filepath.Walk(c.RepoRoot, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			rel, _ := c.RelPath(p)
+			base := fi.Name()
+			if fi.IsDir() {
+				if rel != "" && (base[0] == '.' || base[0] == '_' || walk.IsBazelIgnored(bazelIgnored, rel)) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasSuffix(base, ".proto") {
+				return nil
+			}
+
+			dir := filepath.Dir(p)
+			dirRel, _ := c.RelPath(dir)
+			info := protoFileInfo(fileNameInfo(dir, dirRel, base))
+			x.Add(rel, resolve.ProtoIndexEntry{
+				Rel:           dirRel,
+				PackageName:   info.protoPackage,
+				GoImportPath:  info.goImportPath,
+				DirImportPath: (&Package{Rel: dirRel}).ImportPath(c.GoPrefix, c.GoPrefixRel),
+			})
+			return nil
+		})
+	})
+}
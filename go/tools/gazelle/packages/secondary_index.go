@@ -0,0 +1,104 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/walk"
+)
+
+// IndexSecondaryPackages returns an index of the secondary packages in the
+// repository, used to resolve imports of them. Like IndexProtos, the
+// repository is scanned the first time the index is used, and directives in
+// build files aren't read. Only the package clauses of .go files are parsed.
+func IndexSecondaryPackages(c *config.Config) *resolve.SecondaryIndex {
+	return resolve.NewSecondaryIndex(func(x *resolve.SecondaryIndex) {
+		bazelIgnored := walk.ReadBazelIgnore(c.RepoRoot)
+		filepath.Walk(c.RepoRoot, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() {
+				return nil
+			}
+			rel, _ := c.RelPath(p)
+			base := fi.Name()
+			if rel != "" && (base[0] == '.' || base[0] == '_' || walk.IsBazelIgnored(bazelIgnored, rel)) {
+				return filepath.SkipDir
+			}
+			for _, name := range secondaryPackageNames(c, p) {
+				x.Add(rel, name)
+			}
+			return nil
+		})
+	})
+}
+
+// secondaryPackageNames returns the names of the secondary packages in dir,
+// chosen the way selectPackage chooses them. Packages with the same name as
+// a subdirectory are left out, since imports of their import path are
+// resolved to the subdirectory.
+func secondaryPackageNames(c *config.Config, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	fset := token.NewFileSet()
+	subdirs := make(map[string]bool)
+	seen := make(map[string]bool)
+	var names []string
+	for _, fi := range files {
+		base := fi.Name()
+		switch {
+		case base[0] == '.' || base[0] == '_':
+			continue
+		case fi.IsDir():
+			subdirs[base] = true
+			continue
+		case !strings.HasSuffix(base, ".go") || strings.HasSuffix(base, "_test.go"):
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, base), nil, parser.PackageClauseOnly)
+		if err != nil {
+			continue
+		}
+		name := f.Name.Name
+		if name == "documentation" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) < 2 {
+		return nil
+	}
+	sort.Strings(names)
+
+	primaryName := primaryPackageName(c, dir, names)
+	var secondary []string
+	for _, name := range names {
+		if name != primaryName && name != "main" && !subdirs[name] {
+			secondary = append(secondary, name)
+		}
+	}
+	return secondary
+}
@@ -16,16 +16,20 @@ limitations under the License.
 package packages
 
 import (
+	"fmt"
 	"go/build"
-	"io/ioutil"
-	"log"
-	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/trace"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/walk"
 )
 
 // A WalkFunc is a callback called by Walk for each package.
@@ -39,132 +43,135 @@ type WalkFunc func(c *config.Config, pkg *Package, oldFile *bf.File)
 // it does not assume the standard Go tree because Bazel rules_go uses
 // go_prefix instead of the standard tree.
 //
-// If a directory contains no buildable Go code, "f" is not called. If a
+// If a directory contains no buildable Go code, "f" is not called, unless
+// the directory has no .go files at all and its build file has Go rules or
+// a "# gazelle:go_path" directive. In that case, "f" is called with a
+// package with no sources, so that rules whose sources were deleted can be
+// deleted, too, and go_path rules can be generated. If c.EmptyBuildFiles is
+// set, "f" is also called with a package with no sources for directories
+// without build files or Go packages that have packages in subdirectories,
+// so build files can be created for them. If a
 // directory contains one package with any name, "f" will be called with that
-// package. If a directory contains multiple packages and one of the package
-// names matches the directory name, "f" will be called on that package and the
-// other packages will be silently ignored. If none of the package names match
-// the directory name, or if some other error occurs, an error will be logged,
-// and "f" will not be called.
+// package. If a directory contains multiple packages, "f" will be called once
+// with the primary package (see selectPackage), and the other packages will
+// be listed in its Secondary field. If an error occurs, an error will be
+// logged, and "f" will not be called.
+//
+// An existing build file that can't be parsed is reported with the location
+// of the syntax error, and its directory is skipped, but Walk continues with
+// other directories. If c.NewOnParseError is set, "f" is called for the
+// directory anyway with a nil build file and the path of the broken file in
+// the package's BrokenBuildFile field, so rules can be written elsewhere.
+//
+// Directories are traversed with walk.Walk, which skips directories listed
+// in .bazelignore or c.ExcludedDirs, files and directories matched by
+// "# gazelle:exclude" directives or, when c.UseGitignore is set, by
+// .gitignore files, and symbolic links that shouldn't be followed.
+//
+// If c.ChangedDirs is set, "f" is only called for directories in that set
+// and directories with rules that depend on rules in them. Source files in
+// other directories aren't read.
+//
+// Directories are visited one at a time, and nothing is kept after "f"
+// returns, so Walk only holds the build files and file lists of the
+// directories between dir and the one being visited.
 func Walk(c *config.Config, dir string, f WalkFunc) {
-	// visit walks the directory tree in post-order. It returns whether the
-	// the directory it was called on or any subdirectory contains a Bazel
-	// package. This affects whether "testdata" directories are considered
-	// data dependencies.
-	var visit func(string) bool
-	visit = func(path string) bool {
-		// Look for an existing BUILD file.
-		var oldFile *bf.File
-		haveError := false
-		for _, base := range c.ValidBuildFileNames {
-			oldPath := filepath.Join(path, base)
-			st, err := os.Stat(oldPath)
-			if os.IsNotExist(err) || err == nil && st.IsDir() {
-				continue
-			}
-			oldData, err := ioutil.ReadFile(oldPath)
-			if err != nil {
-				log.Print(err)
-				haveError = true
-				continue
-			}
-			if oldFile != nil {
-				log.Printf("in directory %s, multiple Bazel files are present: %s, %s",
-					path, filepath.Base(oldFile.Path), base)
-				haveError = true
-				continue
-			}
-			oldFile, err = bf.Parse(oldPath, oldData)
-			if err != nil {
-				log.Print(err)
-				haveError = true
-				continue
-			}
-		}
-
-		// Process directives in the build file.
-		excluded := make(map[string]bool)
-		if oldFile != nil {
-			directives := config.ParseDirectives(oldFile)
-			c = config.ApplyDirectives(c, directives)
-			for _, d := range directives {
-				if d.Key == "exclude" {
-					excluded[d.Value] = true
-				}
-			}
-		}
+	walk.Walk(c, dir, walk.Funcs{
+		OnDirDone: func(d *walk.Dir, subdirHasPackage map[string]bool) bool {
+			return visitDir(d, subdirHasPackage, f)
+		},
+	})
+}
 
-		// List files and subdirectories.
-		files, err := ioutil.ReadDir(path)
-		if err != nil {
-			log.Print(err)
-			return false
+// visitDir builds a package from the files in the directory d and calls f
+// with it, if there is one. subdirHasPackage records whether each
+// subdirectory contains a Bazel package. visitDir returns whether d or any
+// subdirectory contains one. This affects whether "testdata" directories are
+// considered data dependencies.
+func visitDir(d *walk.Dir, subdirHasPackage map[string]bool, f WalkFunc) bool {
+	c := d.Config
+	hasTestdata := false
+	anySubdirHasPackage := false
+	for _, sub := range d.Subdirs {
+		if sub == "testdata" && !subdirHasPackage[sub] {
+			hasTestdata = true
 		}
+		anySubdirHasPackage = anySubdirHasPackage || subdirHasPackage[sub]
+	}
 
-		var goFiles, otherFiles, subdirs []string
-		for _, f := range files {
-			base := f.Name()
-			switch {
-			case base == "" || base[0] == '.' || base[0] == '_' ||
-				excluded != nil && excluded[base] ||
-				base == "vendor" && f.IsDir() && c.DepMode != config.VendorMode:
-				continue
-
-			case f.IsDir():
-				subdirs = append(subdirs, base)
-
-			case strings.HasSuffix(base, ".go"):
-				goFiles = append(goFiles, base)
-
-			default:
-				otherFiles = append(otherFiles, base)
-			}
-		}
+	hasPackage := anySubdirHasPackage || d.File != nil || d.BrokenFile != ""
+	if d.HasError {
+		return hasPackage
+	}
 
-		// Recurse into subdirectories.
-		hasTestdata := false
-		subdirHasPackage := false
-		for _, sub := range subdirs {
-			hasPackage := visit(filepath.Join(path, sub))
-			if sub == "testdata" && !hasPackage {
-				hasTestdata = true
-			}
-			subdirHasPackage = subdirHasPackage || hasPackage
+	var goFiles, otherFiles []string
+	for _, base := range d.Files {
+		if strings.HasSuffix(base, ".go") {
+			goFiles = append(goFiles, base)
+		} else {
+			otherFiles = append(otherFiles, base)
 		}
+	}
+	if c.ChangedDirs != nil && !c.ChangedDirs[d.Rel] && !dependsOnDirs(d.File, c.ChangedDirs) {
+		// Rules aren't generated here. Guess whether there would be a
+		// package without reading any files.
+		return hasPackage || len(goFiles) > 0
+	}
 
-		hasPackage := subdirHasPackage || oldFile != nil
-		if haveError {
-			return hasPackage
-		}
+	// Build a package from files in this directory.
+	var genFiles []string
+	if d.File != nil {
+		genFiles = findGenFiles(d.File, d.Excluded)
+	}
+	pkg := buildPackage(c, d.Path, goFiles, otherFiles, genFiles, hasTestdata)
+	declaresGoPath := c.GoPathName != "" && c.GoPathRel == d.Rel
+	if pkg == nil && len(goFiles) == 0 && len(genFiles) == 0 && d.File != nil && (hasGoRules(c, d.File) || declaresGoPath) {
+		pkg = &Package{Dir: d.Path, Rel: d.Rel, HasTestdata: hasTestdata}
+	}
+	if pkg == nil && d.File == nil && d.BrokenFile == "" && anySubdirHasPackage && c.EmptyBuildFiles != "" {
+		pkg = &Package{Dir: d.Path, Rel: d.Rel, HasTestdata: hasTestdata}
+	}
+	if pkg != nil {
+		pkg.BrokenBuildFile = d.BrokenFile
+		trace.Count(trace.Packages, 1)
+		f(c, pkg, d.File)
+		hasPackage = true
+	}
+	return hasPackage
+}
 
-		// Build a package from files in this directory.
-		var genFiles []string
-		if oldFile != nil {
-			genFiles = findGenFiles(oldFile, excluded)
+// hasGoRules returns whether f contains rules of the kinds Gazelle
+// generates for Go packages, including calls to macros that are aliases
+// for those kinds.
+func hasGoRules(c *config.Config, f *bf.File) bool {
+	for _, r := range f.Rules("") {
+		kind := r.Kind()
+		if wrapped, ok := c.KindAliases[kind]; ok {
+			kind = wrapped
 		}
-		pkg := buildPackage(c, path, goFiles, otherFiles, genFiles, hasTestdata)
-		if pkg != nil {
-			f(c, pkg, oldFile)
-			hasPackage = true
+		switch kind {
+		case "go_library", "go_binary", "go_test", "go_source", "cgo_library", "go_proto_library":
+			return true
+		case "filegroup":
+			if r.Name() == config.DefaultProtosName {
+				return true
+			}
 		}
-		return hasPackage
 	}
-
-	visit(dir)
+	return false
 }
 
 // buildPackage reads source files in a given directory and returns a Package
 // containing information about those files and how to build them.
 //
 // If no buildable .go files are found in the directory, nil will be returned.
-// If the directory contains multiple buildable packages, the package whose
-// name matches the directory base name will be returned. If there is no such
-// package or if an error occurs, an error will be logged, and nil will be
-// returned.
+// If the directory contains multiple buildable packages, the primary package
+// will be returned with the others in its Secondary field. If an error
+// occurs, an error will be logged, and nil will be returned.
 func buildPackage(c *config.Config, dir string, goFiles, otherFiles, genFiles []string, hasTestdata bool) *Package {
 	rel, err := filepath.Rel(c.RepoRoot, dir)
 	if err != nil {
-		log.Print(err)
+		logging.Error(err)
 		return nil
 	}
 	rel = filepath.ToSlash(rel)
@@ -172,6 +179,13 @@ func buildPackage(c *config.Config, dir string, goFiles, otherFiles, genFiles []
 		rel = ""
 	}
 
+	// When proto rules are generated, .pb.go files generated from .proto files
+	// in this directory are replaced by a go_proto_library. Compiling both
+	// would define the same symbols twice.
+	if !c.ProtoMode.ShouldIncludePregeneratedFiles() {
+		goFiles = excludeGeneratedProtoFiles(goFiles, otherFiles)
+	}
+
 	// Process the .go files first.
 	packageMap := make(map[string]*Package)
 	cgo := false
@@ -199,18 +213,32 @@ func buildPackage(c *config.Config, dir string, goFiles, otherFiles, genFiles []
 		}
 		err = packageMap[info.packageName].addFile(c, info, false)
 		if err != nil {
-			log.Print(err)
+			logging.Error(err)
 		}
 	}
 
 	// Select a package to generate rules for.
 	pkg, err := selectPackage(c, dir, packageMap)
+	if _, ok := err.(*build.NoGoError); ok && c.ProtoMode.ShouldGenerateRules() && hasProtoFiles(otherFiles) {
+		// A directory with only .proto files still gets a go_library that
+		// embeds the go_proto_library.
+		pkg = &Package{
+			Name:        defaultPackageName(c, dir),
+			Dir:         dir,
+			Rel:         rel,
+			HasTestdata: hasTestdata,
+		}
+		err = nil
+	}
 	if err != nil {
 		if _, ok := err.(*build.NoGoError); !ok {
-			log.Print(err)
+			logging.Error(err)
 		}
 		return nil
 	}
+	if !checkRelativeImports(c, pkg) {
+		return nil
+	}
 
 	// Add .go files with unknown packages. This happens when there are parse
 	// or I/O errors. We should keep the file in the srcs list and let the
@@ -224,7 +252,7 @@ func buildPackage(c *config.Config, dir string, goFiles, otherFiles, genFiles []
 		info := otherFileInfo(dir, rel, file)
 		err = pkg.addFile(c, info, cgo)
 		if err != nil {
-			log.Print(err)
+			logging.Error(err)
 		}
 	}
 
@@ -245,45 +273,146 @@ func buildPackage(c *config.Config, dir string, goFiles, otherFiles, genFiles []
 		info := fileNameInfo(dir, rel, f)
 		err := pkg.addFile(c, info, cgo)
 		if err != nil {
-			log.Print(err)
+			logging.Error(err)
 		}
 	}
 
 	return pkg
 }
 
+// excludeGeneratedProtoFiles returns goFiles without .pb.go files generated
+// by protoc from .proto files in otherFiles. foo.pb.go and foo_grpc.pb.go
+// are generated from foo.proto.
+func excludeGeneratedProtoFiles(goFiles, otherFiles []string) []string {
+	protos := make(map[string]bool)
+	for _, f := range otherFiles {
+		if strings.HasSuffix(f, ".proto") {
+			protos[strings.TrimSuffix(f, ".proto")] = true
+		}
+	}
+	if len(protos) == 0 {
+		return goFiles
+	}
+
+	var kept []string
+	for _, f := range goFiles {
+		if strings.HasSuffix(f, ".pb.go") {
+			stem := strings.TrimSuffix(f, ".pb.go")
+			if protos[stem] || protos[strings.TrimSuffix(stem, "_grpc")] {
+				continue
+			}
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+// hasProtoFiles returns whether any of files is a .proto file.
+func hasProtoFiles(files []string) bool {
+	for _, f := range files {
+		if strings.HasSuffix(f, ".proto") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRelativeImports reports each relative import (like "./foo") in the
+// .go files of pkg and its secondary packages, together with the full import
+// path that should be used instead. Relative imports are reported as
+// warnings if c.AllowRelativeImports is set and as errors otherwise.
+// false is returned if rules should not be generated for pkg.
+func checkRelativeImports(c *config.Config, pkg *Package) bool {
+	dirImportPath := pkg.ImportPath(c.GoPrefix, c.GoPrefixRel)
+	found := false
+	for _, p := range append([]*Package{pkg}, pkg.Secondary...) {
+		for _, t := range p.Targets() {
+			var imps []string
+			for imp := range t.ImportedBy {
+				if isRelativeImport(imp) {
+					imps = append(imps, imp)
+				}
+			}
+			sort.Strings(imps)
+			for _, imp := range imps {
+				found = true
+				msg := fmt.Sprintf("relative import %q is not supported", imp)
+				if full := path.Join(dirImportPath, imp); full == c.GoPrefix || strings.HasPrefix(full, c.GoPrefix+"/") {
+					msg += fmt.Sprintf("; use %q instead", full)
+				}
+				for _, file := range t.ImportedBy[imp] {
+					if c.AllowRelativeImports {
+						logging.WarningfAt(filepath.Join(pkg.Dir, file), 0, "%s", msg)
+					} else {
+						logging.ErrorfAt(filepath.Join(pkg.Dir, file), 0, "%s", msg)
+					}
+				}
+			}
+		}
+	}
+	return !found || c.AllowRelativeImports
+}
+
+// isRelativeImport returns whether imp is a relative import path, which
+// starts with "./" or "../" or is "." or "..".
+func isRelativeImport(imp string) bool {
+	return imp == "." || imp == ".." ||
+		strings.HasPrefix(imp, "./") || strings.HasPrefix(imp, "../")
+}
+
+// selectPackage chooses the primary package among the packages found in a
+// directory. The primary package is the only package, the package whose name
+// matches the directory, or the only package other than "main". If none of
+// these apply, the primary package is the first package by name, other than
+// "main". Other packages, except "main", are returned as secondary packages.
+// Secondary "main" packages are ignored with a warning, since the main files
+// are most likely scripts missing a "+build ignore" tag.
 func selectPackage(c *config.Config, dir string, packageMap map[string]*Package) (*Package, error) {
-	packagesWithGo := make(map[string]*Package)
+	var names []string
 	for name, pkg := range packageMap {
 		if pkg.HasGo() {
-			packagesWithGo[name] = pkg
+			names = append(names, name)
 		}
 	}
+	sort.Strings(names)
 
-	if len(packagesWithGo) == 0 {
+	if len(names) == 0 {
 		return nil, &build.NoGoError{Dir: dir}
 	}
-
-	if len(packagesWithGo) == 1 {
-		for _, pkg := range packagesWithGo {
-			return pkg, nil
+	primaryName := primaryPackageName(c, dir, names)
+	pkg := packageMap[primaryName]
+	for _, name := range names {
+		switch name {
+		case primaryName:
+			continue
+		case "main":
+			logging.WarningfAt(dir, 0, "found packages %s and main; ignoring files in package main (%s)", primaryName, packageMap[name].firstGoFile())
+		default:
+			pkg.Secondary = append(pkg.Secondary, packageMap[name])
 		}
 	}
+	return pkg, nil
+}
 
-	if pkg, ok := packagesWithGo[defaultPackageName(c, dir)]; ok {
-		return pkg, nil
+// primaryPackageName returns the name of the primary package among names,
+// the sorted, non-empty list of names of the packages in dir. See
+// selectPackage.
+func primaryPackageName(c *config.Config, dir string, names []string) string {
+	if len(names) == 1 {
+		return names[0]
 	}
-
-	err := &build.MultiplePackageError{Dir: dir}
-	for name, pkg := range packagesWithGo {
-		// Add the first file for each package for the error message.
-		// Error() method expects these lists to be the same length. File
-		// lists must be non-empty. These lists are only created by
-		// buildPackage for packages with .go files present.
-		err.Packages = append(err.Packages, name)
-		err.Files = append(err.Files, pkg.firstGoFile())
+	defaultName := defaultPackageName(c, dir)
+	for _, name := range names {
+		if name == defaultName {
+			return name
+		}
 	}
-	return nil, err
+	for _, name := range names {
+		if name != "main" {
+			return name
+		}
+	}
+	return names[0]
 }
 
 func defaultPackageName(c *config.Config, dir string) string {
@@ -323,3 +452,30 @@ func findGenFiles(f *bf.File, excluded map[string]bool) []string {
 	}
 	return genFiles
 }
+
+// dependsOnDirs returns whether any rule in f has deps, embed, or library
+// attributes with labels of rules in the directories in dirs, which are
+// slash-separated paths relative to the repository root. f may be nil.
+func dependsOnDirs(f *bf.File, dirs map[string]bool) bool {
+	if f == nil {
+		return false
+	}
+	for _, r := range f.Rules("") {
+		var labels []string
+		for _, key := range []string{"deps", "embed"} {
+			if strs, ok := merger.ListStrings(r.Attr(key)); ok {
+				labels = append(labels, strs...)
+			}
+		}
+		if lib := r.AttrString("library"); lib != "" {
+			labels = append(labels, lib)
+		}
+		for _, s := range labels {
+			l, err := resolve.ParseLabel(s)
+			if err == nil && !l.Relative && l.Repo == "" && dirs[l.Pkg] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -16,16 +16,19 @@ limitations under the License.
 package packages_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
 )
 
 func tempDir() (string, error) {
@@ -45,6 +48,9 @@ func checkFiles(t *testing.T, files []fileSpec, goPrefix string, want []*package
 
 	for _, p := range want {
 		p.Dir = filepath.Join(dir, filepath.FromSlash(p.Rel))
+		for _, sec := range p.Secondary {
+			sec.Dir = p.Dir
+		}
 	}
 
 	got := walkPackages(dir, goPrefix, dir)
@@ -128,6 +134,77 @@ func TestWalkSimple(t *testing.T) {
 	checkFiles(t, files, "", want)
 }
 
+func TestWalkAsmAndSyso(t *testing.T) {
+	files := []fileSpec{
+		{path: "lib.go", content: "package lib"},
+		{path: "asm.s"},
+		{path: "asm.h"},
+		{path: "cgo.S"},
+		{path: "rsrc.syso", content: "// +build ignore\n\n"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go", "asm.h", "asm.s", "rsrc.syso"},
+				},
+			},
+		},
+	}
+	checkFiles(t, files, "", want)
+}
+
+func TestWalkOSArchSuffixes(t *testing.T) {
+	files := []fileSpec{
+		{path: "a.go", content: "package a"},
+		{path: "a_js_wasm.go", content: "package a"},
+		{path: "a_linux.go", content: "package a"},
+		{path: "a_linux.pb.go", content: "package a"},
+		{path: "a_linux_amd64.go", content: "package a"},
+		{path: "a_linux_arm64.go", content: "package a"},
+		{path: "a_windows_test.go", content: "package a"},
+		{path: "a_zos.go", content: "package a"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+		Platforms:           config.DefaultPlatformTags,
+	}
+	var got []*packages.Package
+	packages.Walk(c, dir, func(_ *config.Config, pkg *packages.Package, _ *bf.File) {
+		got = append(got, pkg)
+	})
+	if len(got) != 1 {
+		t.Fatalf("got %d packages; want 1", len(got))
+	}
+	linux := "@io_bazel_rules_go//go/platform:linux_amd64"
+	windows := "@io_bazel_rules_go//go/platform:windows_amd64"
+	wantLib := packages.PlatformStrings{
+		Generic: []string{"a.go"},
+		Platform: map[string][]string{
+			linux: {"a_linux.go", "a_linux.pb.go", "a_linux_amd64.go"},
+		},
+	}
+	if !reflect.DeepEqual(got[0].Library.Sources, wantLib) {
+		t.Errorf("got library sources %#v; want %#v", got[0].Library.Sources, wantLib)
+	}
+	wantTest := packages.PlatformStrings{
+		Platform: map[string][]string{
+			windows: {"a_windows_test.go"},
+		},
+	}
+	if !reflect.DeepEqual(got[0].Test.Sources, wantTest) {
+		t.Errorf("got test sources %#v; want %#v", got[0].Test.Sources, wantTest)
+	}
+}
+
 func TestWalkNested(t *testing.T) {
 	files := []fileSpec{
 		{path: "a/foo.go", content: "package a"},
@@ -180,6 +257,17 @@ func TestMultiplePackagesWithDefault(t *testing.T) {
 					Generic: []string{"a.go"},
 				},
 			},
+			Secondary: []*packages.Package{
+				{
+					Name: "b",
+					Rel:  "a",
+					Library: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"b.go"},
+						},
+					},
+				},
+			},
 		},
 	}
 	checkFiles(t, files, "", want)
@@ -190,16 +278,110 @@ func TestMultiplePackagesWithoutDefault(t *testing.T) {
 		{path: "a/b.go", content: "package b"},
 		{path: "a/c.go", content: "package c"},
 	}
-	dir, err := createFiles(files)
-	if err != nil {
-		t.Fatalf("createFiles() failed with %v; want success", err)
+	want := []*packages.Package{
+		{
+			Name: "b",
+			Rel:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"b.go"},
+				},
+			},
+			Secondary: []*packages.Package{
+				{
+					Name: "c",
+					Rel:  "a",
+					Library: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"c.go"},
+						},
+					},
+				},
+			},
+		},
 	}
-	defer os.RemoveAll(dir)
+	checkFiles(t, files, "", want)
+}
+
+func TestMultiplePackagesWithMain(t *testing.T) {
+	files := []fileSpec{
+		{path: "a/b.go", content: "package b"},
+		{path: "a/gen.go", content: "package main"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "b",
+			Rel:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"b.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, files, "", want)
+}
+
+func TestMultiplePackagesWithMainAndDefault(t *testing.T) {
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/b.go", content: "package b"},
+		{path: "a/gen.go", content: "package main"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Rel:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
+			Secondary: []*packages.Package{
+				{
+					Name: "b",
+					Rel:  "a",
+					Library: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"b.go"},
+						},
+					},
+				},
+			},
+		},
+	}
+	checkFiles(t, files, "", want)
+}
 
-	got := walkPackages(dir, "", dir)
-	if len(got) > 0 {
-		t.Errorf("got %v; want empty slice", got)
+func TestMultiplePackagesWithMainWithoutDefault(t *testing.T) {
+	files := []fileSpec{
+		{path: "a/b.go", content: "package b"},
+		{path: "a/c.go", content: "package c"},
+		{path: "a/gen.go", content: "package main"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "b",
+			Rel:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"b.go"},
+				},
+			},
+			Secondary: []*packages.Package{
+				{
+					Name: "c",
+					Rel:  "a",
+					Library: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"c.go"},
+						},
+					},
+				},
+			},
+		},
 	}
+	checkFiles(t, files, "", want)
 }
 
 func TestRootWithPrefix(t *testing.T) {
@@ -215,6 +397,16 @@ func TestRootWithPrefix(t *testing.T) {
 					Generic: []string{"a.go"},
 				},
 			},
+			Secondary: []*packages.Package{
+				{
+					Name: "b",
+					Library: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"b.go"},
+						},
+					},
+				},
+			},
 		},
 	}
 	checkFiles(t, files, "github.com/a", want)
@@ -225,16 +417,27 @@ func TestRootWithoutPrefix(t *testing.T) {
 		{path: "a.go", content: "package a"},
 		{path: "b.go", content: "package b"},
 	}
-	dir, err := createFiles(files)
-	if err != nil {
-		t.Fatalf("createFiles() failed with %v; want success", err)
-	}
-	defer os.RemoveAll(dir)
-
-	got := walkPackages(dir, "", dir)
-	if len(got) > 0 {
-		t.Errorf("got %v; want empty slice", got)
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
+			Secondary: []*packages.Package{
+				{
+					Name: "b",
+					Library: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"b.go"},
+						},
+					},
+				},
+			},
+		},
 	}
+	checkFiles(t, files, "", want)
 }
 
 func TestTestdata(t *testing.T) {
@@ -349,6 +552,9 @@ import "github.com/jr_hacker/stuff"
 				Imports: packages.PlatformStrings{
 					Generic: []string{"github.com/jr_hacker/stuff"},
 				},
+				ImportedBy: map[string][]string{
+					"github.com/jr_hacker/stuff": {"foo.go"},
+				},
 			},
 		},
 	}
@@ -392,6 +598,9 @@ import "github.com/jr_hacker/stuff"
 				Imports: packages.PlatformStrings{
 					Generic: []string{"github.com/jr_hacker/stuff"},
 				},
+				ImportedBy: map[string][]string{
+					"github.com/jr_hacker/stuff": {"foo.go"},
+				},
 				Cgo: true,
 			},
 		},
@@ -399,6 +608,97 @@ import "github.com/jr_hacker/stuff"
 	checkFiles(t, files, "", want)
 }
 
+func TestGeneratedProtoFiles(t *testing.T) {
+	files := []fileSpec{
+		{path: "a/a.proto"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/a.pb.go", content: "package a"},
+		{path: "a/a_grpc.pb.go", content: "package a"},
+		{path: "a/other.pb.go", content: "package a"},
+		{path: "b/b.proto"},
+		{path: "b/b.pb.go", content: "package b"},
+	}
+	for _, tc := range []struct {
+		desc string
+		mode config.ProtoMode
+		want []*packages.Package
+	}{
+		{
+			desc: "default",
+			mode: config.DefaultProtoMode,
+			want: []*packages.Package{
+				{
+					Name: "a",
+					Rel:  "a",
+					Library: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"a.go", "other.pb.go"},
+						},
+					},
+					Protos:     []string{"a.proto"},
+					ProtoFiles: []packages.ProtoFile{{Name: "a.proto"}},
+					HasPbGo:    true,
+				}, {
+					Name:       "b",
+					Rel:        "b",
+					Protos:     []string{"b.proto"},
+					ProtoFiles: []packages.ProtoFile{{Name: "b.proto"}},
+				},
+			},
+		}, {
+			desc: "disable_global",
+			mode: config.DisableGlobalProtoMode,
+			want: []*packages.Package{
+				{
+					Name: "a",
+					Rel:  "a",
+					Library: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"a.go", "a.pb.go", "a_grpc.pb.go", "other.pb.go"},
+						},
+					},
+					Protos:     []string{"a.proto"},
+					ProtoFiles: []packages.ProtoFile{{Name: "a.proto"}},
+					HasPbGo:    true,
+				}, {
+					Name: "b",
+					Rel:  "b",
+					Library: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"b.pb.go"},
+						},
+					},
+					Protos:     []string{"b.proto"},
+					ProtoFiles: []packages.ProtoFile{{Name: "b.proto"}},
+					HasPbGo:    true,
+				},
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, err := createFiles(files)
+			if err != nil {
+				t.Fatalf("createFiles() failed with %v; want success", err)
+			}
+			defer os.RemoveAll(dir)
+
+			for _, p := range tc.want {
+				p.Dir = filepath.Join(dir, filepath.FromSlash(p.Rel))
+			}
+			c := &config.Config{
+				RepoRoot:            dir,
+				ValidBuildFileNames: config.DefaultValidBuildFileNames,
+				ProtoMode:           tc.mode,
+			}
+			var got []*packages.Package
+			packages.Walk(c, dir, func(_ *config.Config, pkg *packages.Package, _ *bf.File) {
+				got = append(got, pkg)
+			})
+			checkPackages(t, got, tc.want)
+		})
+	}
+}
+
 func TestExcluded(t *testing.T) {
 	files := []fileSpec{
 		{
@@ -486,6 +786,30 @@ func TestVendor(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "hybrid mode",
+			mode: config.HybridMode,
+			want: []*packages.Package{
+				{
+					Name: "foo",
+					Rel:  "vendor/foo",
+					Library: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"foo.go"},
+						},
+					},
+				},
+				{
+					Name: "bar",
+					Rel:  "x/vendor/bar",
+					Library: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"bar.go"},
+						},
+					},
+				},
+			},
+		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
 			dir, err := createFiles(files)
@@ -513,6 +837,284 @@ func TestVendor(t *testing.T) {
 	}
 }
 
+func TestBazelIgnore(t *testing.T) {
+	files := []fileSpec{
+		{path: ".bazelignore", content: "# output\nbazel-out\n\na/gen/\n"},
+		{path: "bazel-out/x/x.go", content: "package x"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/gen/gen.go", content: "package gen"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Rel:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, files, "", want)
+}
+
+func TestGitignore(t *testing.T) {
+	files := []fileSpec{
+		{path: ".gitignore", content: "*.gen.go\n/out/\n"},
+		{path: "a/.gitignore", content: "tmp\n!keep.gen.go\n"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/a.gen.go", content: "package a"},
+		{path: "a/keep.gen.go", content: "package a"},
+		{path: "a/tmp/tmp.go", content: "package tmp"},
+		{path: "a/out/out.go", content: "package out"},
+		{path: "out/out.go", content: "package out"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		desc         string
+		useGitignore bool
+		walkDir      string
+		want         map[string][]string
+	}{
+		{
+			desc: "disabled",
+			want: map[string][]string{
+				"a":     {"a.gen.go", "a.go", "keep.gen.go"},
+				"a/out": {"out.go"},
+				"a/tmp": {"tmp.go"},
+				"out":   {"out.go"},
+			},
+		}, {
+			desc:         "enabled",
+			useGitignore: true,
+			want: map[string][]string{
+				"a":     {"a.go", "keep.gen.go"},
+				"a/out": {"out.go"},
+			},
+		}, {
+			desc:         "subdirectory",
+			useGitignore: true,
+			walkDir:      "a",
+			want: map[string][]string{
+				"a":     {"a.go", "keep.gen.go"},
+				"a/out": {"out.go"},
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := &config.Config{
+				RepoRoot:            dir,
+				ValidBuildFileNames: config.DefaultValidBuildFileNames,
+				UseGitignore:        tc.useGitignore,
+			}
+			got := make(map[string][]string)
+			packages.Walk(c, filepath.Join(dir, tc.walkDir), func(_ *config.Config, pkg *packages.Package, _ *bf.File) {
+				got[pkg.Rel] = pkg.Library.Sources.Generic
+			})
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEmptyBuildFiles(t *testing.T) {
+	files := []fileSpec{
+		{path: "cmd/foo/foo.go", content: "package main"},
+		{path: "cmd/bar/bar.go", content: "package main"},
+		{path: "docs/index.md"},
+		{path: "has_build/BUILD"},
+		{path: "has_build/sub/sub.go", content: "package sub"},
+		{path: "lib/lib.go", content: "package lib"},
+		{path: "lib/testdata/data.txt"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		desc, emptyBuildFiles string
+		want                  []string
+	}{
+		{
+			desc: "disabled",
+			want: []string{"cmd/bar", "cmd/foo", "has_build/sub", "lib"},
+		}, {
+			desc:            "enabled",
+			emptyBuildFiles: config.EmptyBuildFilesEmpty,
+			want:            []string{"", "cmd", "cmd/bar", "cmd/foo", "has_build/sub", "lib"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := &config.Config{
+				RepoRoot:            dir,
+				ValidBuildFileNames: config.DefaultValidBuildFileNames,
+				EmptyBuildFiles:     tc.emptyBuildFiles,
+			}
+			var got []string
+			packages.Walk(c, dir, func(_ *config.Config, pkg *packages.Package, _ *bf.File) {
+				got = append(got, pkg.Rel)
+			})
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got packages in %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "a/a.go", content: "package a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	extDir, err := createFiles([]fileSpec{
+		{path: "ext.go", content: "package ext"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(extDir)
+	for _, link := range []struct{ old, new string }{
+		{filepath.Join(dir, "a"), filepath.Join(dir, "inside")},
+		{extDir, filepath.Join(dir, "ext")},
+		{extDir, filepath.Join(extDir, "loop")},
+	} {
+		if err := os.Symlink(link.old, link.new); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		desc           string
+		followSymlinks bool
+		want           []string
+	}{
+		{
+			desc: "disabled",
+			want: []string{"a"},
+		}, {
+			desc:           "enabled",
+			followSymlinks: true,
+			want:           []string{"a", "ext"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := &config.Config{
+				RepoRoot:            dir,
+				ValidBuildFileNames: config.DefaultValidBuildFileNames,
+				FollowSymlinks:      tc.followSymlinks,
+			}
+			var got []string
+			packages.Walk(c, dir, func(_ *config.Config, pkg *packages.Package, _ *bf.File) {
+				got = append(got, pkg.Rel)
+			})
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRelativeImports(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "b/b.go", content: `package b
+
+import _ "../a"
+`},
+		{path: "c/c_test.go", content: `package c
+
+import _ "./sub"
+`},
+		{path: "c/sub/sub.go", content: "package sub"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		desc  string
+		allow bool
+		want  []string
+	}{
+		{
+			desc: "rejected",
+			want: []string{"a", "c/sub"},
+		}, {
+			desc:  "allowed",
+			allow: true,
+			want:  []string{"a", "b", "c/sub", "c"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := &config.Config{
+				RepoRoot:             dir,
+				GoPrefix:             "example.com/repo",
+				ValidBuildFileNames:  config.DefaultValidBuildFileNames,
+				AllowRelativeImports: tc.allow,
+			}
+			var got []string
+			packages.Walk(c, dir, func(_ *config.Config, pkg *packages.Package, _ *bf.File) {
+				got = append(got, pkg.Rel)
+			})
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeletedSources(t *testing.T) {
+	files := []fileSpec{
+		{
+			path: "gone/BUILD",
+			content: `
+go_library(
+    name = "go_default_library",
+    srcs = ["gone.go"],
+)
+`,
+		}, {
+			path: "data/BUILD",
+			content: `
+filegroup(
+    name = "data",
+    srcs = glob(["*.txt"]),
+)
+`,
+		}, {
+			path: "gen/BUILD",
+			content: `
+genrule(
+    name = "gen",
+    outs = ["gen.go"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["gen.go"],
+)
+`,
+		},
+	}
+	want := []*packages.Package{
+		{Rel: "gone"},
+	}
+	checkFiles(t, files, "", want)
+}
+
 func TestMalformedBuildFile(t *testing.T) {
 	files := []fileSpec{
 		{path: "BUILD", content: "????"},
@@ -522,6 +1124,37 @@ func TestMalformedBuildFile(t *testing.T) {
 	checkFiles(t, files, "", want)
 }
 
+func TestMalformedBuildFileNewOnParseError(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "BUILD", content: "????"},
+		{path: "foo.go", content: "package foo"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		GoPrefix:            "example.com/repo",
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+		NewOnParseError:     true,
+	}
+	var pkgs []*packages.Package
+	packages.Walk(c, dir, func(_ *config.Config, pkg *packages.Package, oldFile *bf.File) {
+		if oldFile != nil {
+			t.Errorf("got build file %s; want nil", oldFile.Path)
+		}
+		pkgs = append(pkgs, pkg)
+	})
+	if len(pkgs) != 1 {
+		t.Fatalf("got %d packages; want 1", len(pkgs))
+	}
+	if got, want := pkgs[0].BrokenBuildFile, filepath.Join(dir, "BUILD"); got != want {
+		t.Errorf("got broken build file %q; want %q", got, want)
+	}
+}
+
 func TestMultipleBuildFiles(t *testing.T) {
 	files := []fileSpec{
 		{path: "BUILD"},
@@ -549,3 +1182,138 @@ func TestMalformedGoFile(t *testing.T) {
 	}
 	checkFiles(t, files, "", want)
 }
+
+func TestIndexProtos(t *testing.T) {
+	files := []fileSpec{
+		{path: "a/a.proto", content: "package example.a;\n"},
+		{path: "b/c/c.proto", content: "package example.c;\noption go_package = \"example.com/other/c\";\n"},
+		{path: "_hidden/h.proto"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:  dir,
+		GoPrefix:  "example.com/repo",
+		ProtoMode: config.PackageProtoMode,
+	}
+	r := resolve.NewResolver(c, resolve.NewLabeler(c))
+	r.SetProtoIndex(packages.IndexProtos(c))
+	for _, tc := range []struct {
+		imp, wantProto, wantGo string
+	}{
+		{"a/a.proto", "//a:example_a_proto", "//a:go_default_library"},
+		{"b/c/c.proto", "//b/c:example_c_proto", "//b/c:example_c_go_proto"},
+		{"_hidden/h.proto", "", ""},
+	} {
+		proto, err := r.ResolveProto(tc.imp)
+		if tc.wantProto == "" {
+			if err == nil {
+				t.Errorf("ResolveProto(%q) = %s; want error", tc.imp, proto)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ResolveProto(%q): %v", tc.imp, err)
+			continue
+		}
+		if got := proto.String(); got != tc.wantProto {
+			t.Errorf("ResolveProto(%q) = %q; want %q", tc.imp, got, tc.wantProto)
+		}
+		goLabel, err := r.ResolveGoProto(tc.imp, "")
+		if err != nil {
+			t.Errorf("ResolveGoProto(%q): %v", tc.imp, err)
+			continue
+		}
+		if got := goLabel.String(); got != tc.wantGo {
+			t.Errorf("ResolveGoProto(%q) = %q; want %q", tc.imp, got, tc.wantGo)
+		}
+	}
+}
+
+func TestIndexSecondaryPackages(t *testing.T) {
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/b.go", content: "package b"},
+		{path: "a/c.go", content: "package c"},
+		{path: "a/c/c.go", content: "package c"},
+		{path: "a/main.go", content: "package main"},
+		{path: "a/x_test.go", content: "package x_test"},
+		{path: "d/d.go", content: "package d"},
+		{path: "_hidden/h.go", content: "package h"},
+		{path: "_hidden/i.go", content: "package i"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot: dir,
+		GoPrefix: "example.com/repo",
+	}
+	r := resolve.NewResolver(c, resolve.NewLabeler(c))
+	r.SetSecondaryIndex(packages.IndexSecondaryPackages(c))
+	for _, tc := range []struct {
+		imp, want string
+	}{
+		{"example.com/repo/a", "//a:go_default_library"},
+		{"example.com/repo/a/b", "//a:go_b_library"},
+		{"example.com/repo/a/c", "//a/c:go_default_library"},
+		{"example.com/repo/a/main", "//a/main:go_default_library"},
+		{"example.com/repo/a/x", "//a/x:go_default_library"},
+		{"example.com/repo/d/e", "//d/e:go_default_library"},
+		{"example.com/repo/_hidden/i", "//_hidden/i:go_default_library"},
+	} {
+		l, err := r.ResolveGo(tc.imp, "")
+		if err != nil {
+			t.Errorf("ResolveGo(%q): %v", tc.imp, err)
+			continue
+		}
+		if got := l.String(); got != tc.want {
+			t.Errorf("ResolveGo(%q) = %q; want %q", tc.imp, got, tc.want)
+		}
+	}
+}
+
+// BenchmarkWalk measures the time and allocations needed to walk a tree of
+// packages, each importing the package before it.
+func BenchmarkWalk(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("%d packages", n), func(b *testing.B) {
+			var files []fileSpec
+			for i := 0; i < n; i++ {
+				dir := fmt.Sprintf("d%d/p%d", i/10, i)
+				files = append(files,
+					fileSpec{path: dir + "/lib.go", content: fmt.Sprintf("package p%d\n\nimport _ \"example.com/bench/d%d/p%d\"\n", i, (i+n-1)%n/10, (i+n-1)%n)},
+					fileSpec{path: dir + "/lib_test.go", content: fmt.Sprintf("package p%d\n\nimport \"testing\"\n\nfunc TestX(t *testing.T) {}\n", i)})
+			}
+			dir, err := createFiles(files)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c := &config.Config{
+					RepoRoot:            dir,
+					GoPrefix:            "example.com/bench",
+					ValidBuildFileNames: config.DefaultValidBuildFileNames,
+				}
+				count := 0
+				packages.Walk(c, dir, func(_ *config.Config, _ *packages.Package, _ *bf.File) {
+					count++
+				})
+				if count != n {
+					b.Fatalf("got %d packages; want %d", count, n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostLimiter spaces out requests to each host, so looking up many import
+// paths on a vanity domain doesn't send the host a burst of requests. It's
+// safe for concurrent use. Requests to different hosts aren't limited.
+type hostLimiter struct {
+	// interval is the minimum time between the starts of requests to the
+	// same host. If it's zero or negative, requests aren't limited.
+	interval time.Duration
+
+	// now and sleep are time.Now and time.Sleep by default. They may be
+	// overridden by tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+func newHostLimiter(interval time.Duration) *hostLimiter {
+	return &hostLimiter{
+		interval: interval,
+		now:      time.Now,
+		sleep:    time.Sleep,
+		next:     make(map[string]time.Time),
+	}
+}
+
+// wait blocks until a request for importpath may be sent to its host.
+// Callers that wait on the same host are given consecutive turns in the
+// order they called wait.
+func (l *hostLimiter) wait(importpath string) {
+	if l.interval <= 0 {
+		return
+	}
+	host := importpath
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+
+	l.mu.Lock()
+	now := l.now()
+	turn := l.next[host]
+	if turn.Before(now) {
+		turn = now
+	}
+	l.next[host] = turn.Add(l.interval)
+	l.mu.Unlock()
+
+	if d := turn.Sub(now); d > 0 {
+		l.sleep(d)
+	}
+}
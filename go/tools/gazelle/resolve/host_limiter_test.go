@@ -0,0 +1,48 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHostLimiter(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	var slept []time.Duration
+	l := newHostLimiter(time.Second)
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	// The first request to each host goes right away. Later requests to the
+	// same host wait for their turns.
+	for _, imp := range []string{"example.com/a", "example.com/b", "example.org/a", "example.com/c"} {
+		l.wait(imp)
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second}; !reflect.DeepEqual(slept, want) {
+		t.Errorf("got sleeps %v; want %v", slept, want)
+	}
+
+	// Once the host's turns have passed, requests go right away again.
+	slept = nil
+	now = start.Add(time.Minute)
+	l.wait("example.com/d")
+	if len(slept) != 0 {
+		t.Errorf("after turns passed, got sleeps %v; want none", slept)
+	}
+}
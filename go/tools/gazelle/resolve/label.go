@@ -18,6 +18,7 @@ package resolve
 import (
 	"fmt"
 	"path"
+	"strings"
 )
 
 // A Label represents a label of a build target in Bazel.
@@ -26,6 +27,50 @@ type Label struct {
 	Relative        bool
 }
 
+// ParseLabel parses a label string like "@repo//pkg:name", "//pkg:name",
+// "//pkg", or ":name". If the name is omitted, it is the last component of
+// the package path.
+func ParseLabel(s string) (Label, error) {
+	var l Label
+	rest := s
+	if strings.HasPrefix(rest, "@") {
+		i := strings.Index(rest, "//")
+		if i < 0 {
+			return Label{}, fmt.Errorf("label %q: repository name must be followed by //", s)
+		}
+		l.Repo, rest = rest[1:i], rest[i:]
+		if l.Repo == "" {
+			return Label{}, fmt.Errorf("label %q: empty repository name", s)
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(rest, "//"):
+		rest = rest[2:]
+		if i := strings.IndexByte(rest, ':'); i >= 0 {
+			l.Pkg, l.Name = rest[:i], rest[i+1:]
+		} else {
+			l.Pkg, l.Name = rest, path.Base(rest)
+		}
+	case l.Repo == "" && strings.HasPrefix(rest, ":"):
+		l.Relative = true
+		l.Name = rest[1:]
+	default:
+		return Label{}, fmt.Errorf("label %q: must start with //, @, or :", s)
+	}
+
+	if l.Name == "" || l.Name == "." || strings.ContainsAny(l.Name, ":") {
+		return Label{}, fmt.Errorf("label %q: invalid target name", s)
+	}
+	if strings.HasPrefix(l.Pkg, "/") || strings.HasSuffix(l.Pkg, "/") {
+		return Label{}, fmt.Errorf("label %q: invalid package name", s)
+	}
+	return l, nil
+}
+
+// String returns the label in the short form buildifier prefers. The target
+// name is omitted if it matches the last component of the package path, and
+// only the target name is included if the label is relative.
 func (l Label) String() string {
 	if l.Relative {
 		return fmt.Sprintf(":%s", l.Name)
@@ -41,3 +86,14 @@ func (l Label) String() string {
 	}
 	return fmt.Sprintf("%s//%s:%s", repo, l.Pkg, l.Name)
 }
+
+// FullString returns the label in its long form, which always includes the
+// package path and target name. Relative labels are written as if they were
+// in Pkg.
+func (l Label) FullString() string {
+	var repo string
+	if l.Repo != "" {
+		repo = fmt.Sprintf("@%s", l.Repo)
+	}
+	return fmt.Sprintf("%s//%s:%s", repo, l.Pkg, l.Name)
+}
@@ -28,6 +28,22 @@ type Labeler interface {
 	LibraryLabel(rel string) Label
 	TestLabel(rel string, isXTest bool) Label
 	BinaryLabel(rel string) Label
+
+	// SecondaryLibraryLabel and SecondaryTestLabel return labels for targets
+	// built from a secondary package named "name" in the directory "rel",
+	// that is, a package other than the one named after the directory.
+	SecondaryLibraryLabel(rel, name string) Label
+	SecondaryTestLabel(rel, name string, isXTest bool) Label
+
+	// ProtoLabel and GoProtoLabel return labels for the proto_library and
+	// go_proto_library built from .proto files in the directory "rel".
+	// "name" is the name the rules are based on; see ProtoName.
+	ProtoLabel(rel, name string) Label
+	GoProtoLabel(rel, name string) Label
+
+	// SourceLabel returns the label for the go_source rule built from
+	// the group of library sources named "name" in the directory "rel".
+	SourceLabel(rel, name string) Label
 }
 
 func NewLabeler(c *config.Config) Labeler {
@@ -42,6 +58,9 @@ type hierarchicalLabeler struct {
 }
 
 func (l *hierarchicalLabeler) LibraryLabel(rel string) Label {
+	if l.c.LibraryNaming == config.DirNameLibraryNaming {
+		return Label{Pkg: rel, Name: relBaseName(l.c, rel)}
+	}
 	return Label{Pkg: rel, Name: config.DefaultLibName}
 }
 
@@ -60,6 +79,30 @@ func (l *hierarchicalLabeler) BinaryLabel(rel string) Label {
 	return Label{Pkg: rel, Name: name}
 }
 
+func (l *hierarchicalLabeler) SecondaryLibraryLabel(rel, name string) Label {
+	return Label{Pkg: rel, Name: "go_" + name + "_library"}
+}
+
+func (l *hierarchicalLabeler) SecondaryTestLabel(rel, name string, isXTest bool) Label {
+	suffix := "_test"
+	if isXTest {
+		suffix = "_xtest"
+	}
+	return Label{Pkg: rel, Name: "go_" + name + suffix}
+}
+
+func (l *hierarchicalLabeler) ProtoLabel(rel, name string) Label {
+	return Label{Pkg: rel, Name: name + "_proto"}
+}
+
+func (l *hierarchicalLabeler) GoProtoLabel(rel, name string) Label {
+	return Label{Pkg: rel, Name: name + "_go_proto"}
+}
+
+func (l *hierarchicalLabeler) SourceLabel(rel, name string) Label {
+	return Label{Pkg: rel, Name: name}
+}
+
 type flatLabeler struct {
 	c *config.Config
 }
@@ -92,6 +135,37 @@ func (l *flatLabeler) BinaryLabel(rel string) Label {
 	return Label{Name: rel + suffix}
 }
 
+func (l *flatLabeler) SecondaryLibraryLabel(rel, name string) Label {
+	return Label{Name: l.LibraryLabel(rel).Name + "_" + name}
+}
+
+func (l *flatLabeler) SecondaryTestLabel(rel, name string, isXTest bool) Label {
+	suffix := "_test"
+	if isXTest {
+		suffix = "_xtest"
+	}
+	return Label{Name: l.LibraryLabel(rel).Name + "_" + name + suffix}
+}
+
+func (l *flatLabeler) ProtoLabel(rel, name string) Label {
+	return Label{Name: path.Join(path.Dir(rel), name) + "_proto"}
+}
+
+func (l *flatLabeler) GoProtoLabel(rel, name string) Label {
+	return Label{Name: path.Join(path.Dir(rel), name) + "_go_proto"}
+}
+
+func (l *flatLabeler) SourceLabel(rel, name string) Label {
+	return Label{Name: l.LibraryLabel(rel).Name + "_" + name}
+}
+
+// ProtoName returns the name proto rules for the directory "rel" are based
+// on: the name of the directory, or the last component of the prefix for
+// the repository root. See also ProtoRuleName.
+func ProtoName(c *config.Config, rel string) string {
+	return relBaseName(c, rel)
+}
+
 func relBaseName(c *config.Config, rel string) string {
 	base := path.Base(rel)
 	if base == "." || base == "/" {
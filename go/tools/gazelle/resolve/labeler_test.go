@@ -25,6 +25,7 @@ func TestLabeler(t *testing.T) {
 	for _, tc := range []struct {
 		name, rel                             string
 		mode                                  config.StructureMode
+		libraryNaming                         string
 		wantLib, wantBin, wantTest, wantXTest string
 	}{
 		{
@@ -43,6 +44,15 @@ func TestLabeler(t *testing.T) {
 			wantBin:   "//sub",
 			wantTest:  "//sub:go_default_test",
 			wantXTest: "//sub:go_default_xtest",
+		}, {
+			name:          "sub_hierarchical_dirname",
+			rel:           "sub",
+			mode:          config.HierarchicalMode,
+			libraryNaming: config.DirNameLibraryNaming,
+			wantLib:       "//sub",
+			wantBin:       "//sub",
+			wantTest:      "//sub:go_default_test",
+			wantXTest:     "//sub:go_default_xtest",
 		}, {
 			name:      "root_flat",
 			rel:       "",
@@ -70,7 +80,7 @@ func TestLabeler(t *testing.T) {
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			c := &config.Config{StructureMode: tc.mode}
+			c := &config.Config{StructureMode: tc.mode, LibraryNaming: tc.libraryNaming}
 			l := NewLabeler(c)
 
 			if got := l.LibraryLabel(tc.rel).String(); got != tc.wantLib {
@@ -88,3 +98,143 @@ func TestLabeler(t *testing.T) {
 		})
 	}
 }
+
+func TestSecondaryLabeler(t *testing.T) {
+	for _, tc := range []struct {
+		name, rel                    string
+		mode                         config.StructureMode
+		wantLib, wantTest, wantXTest string
+	}{
+		{
+			name:      "root_hierarchical",
+			rel:       "",
+			mode:      config.HierarchicalMode,
+			wantLib:   "//:go_b_library",
+			wantTest:  "//:go_b_test",
+			wantXTest: "//:go_b_xtest",
+		}, {
+			name:      "sub_hierarchical",
+			rel:       "sub",
+			mode:      config.HierarchicalMode,
+			wantLib:   "//sub:go_b_library",
+			wantTest:  "//sub:go_b_test",
+			wantXTest: "//sub:go_b_xtest",
+		}, {
+			name:      "root_flat",
+			rel:       "",
+			mode:      config.FlatMode,
+			wantLib:   "//:root_b",
+			wantTest:  "//:root_b_test",
+			wantXTest: "//:root_b_xtest",
+		}, {
+			name:      "sub_flat",
+			rel:       "sub",
+			mode:      config.FlatMode,
+			wantLib:   "//:sub_b",
+			wantTest:  "//:sub_b_test",
+			wantXTest: "//:sub_b_xtest",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &config.Config{StructureMode: tc.mode}
+			l := NewLabeler(c)
+
+			if got := l.SecondaryLibraryLabel(tc.rel, "b").String(); got != tc.wantLib {
+				t.Errorf("for library in %s: got %q ; want %q", tc.rel, got, tc.wantLib)
+			}
+			if got := l.SecondaryTestLabel(tc.rel, "b", false).String(); got != tc.wantTest {
+				t.Errorf("for test in %s: got %q ; want %q", tc.rel, got, tc.wantTest)
+			}
+			if got := l.SecondaryTestLabel(tc.rel, "b", true).String(); got != tc.wantXTest {
+				t.Errorf("for test in %s: got %q ; want %q", tc.rel, got, tc.wantXTest)
+			}
+		})
+	}
+}
+
+func TestProtoLabeler(t *testing.T) {
+	for _, tc := range []struct {
+		name, rel, protoName   string
+		mode                   config.StructureMode
+		wantProto, wantGoProto string
+	}{
+		{
+			name:        "root_hierarchical",
+			rel:         "",
+			protoName:   "root",
+			mode:        config.HierarchicalMode,
+			wantProto:   "//:root_proto",
+			wantGoProto: "//:root_go_proto",
+		}, {
+			name:        "sub_hierarchical",
+			rel:         "sub",
+			protoName:   "sub",
+			mode:        config.HierarchicalMode,
+			wantProto:   "//sub:sub_proto",
+			wantGoProto: "//sub:sub_go_proto",
+		}, {
+			name:        "root_flat",
+			rel:         "",
+			protoName:   "root",
+			mode:        config.FlatMode,
+			wantProto:   "//:root_proto",
+			wantGoProto: "//:root_go_proto",
+		}, {
+			name:        "deep_flat",
+			rel:         "sub/deep",
+			protoName:   "deep",
+			mode:        config.FlatMode,
+			wantProto:   "//:sub/deep_proto",
+			wantGoProto: "//:sub/deep_go_proto",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &config.Config{StructureMode: tc.mode}
+			l := NewLabeler(c)
+
+			if got := ProtoName(c, tc.rel); got != tc.protoName {
+				t.Errorf("for proto name in %s: got %q ; want %q", tc.rel, got, tc.protoName)
+			}
+			if got := l.ProtoLabel(tc.rel, tc.protoName).String(); got != tc.wantProto {
+				t.Errorf("for proto in %s: got %q ; want %q", tc.rel, got, tc.wantProto)
+			}
+			if got := l.GoProtoLabel(tc.rel, tc.protoName).String(); got != tc.wantGoProto {
+				t.Errorf("for go proto in %s: got %q ; want %q", tc.rel, got, tc.wantGoProto)
+			}
+		})
+	}
+}
+
+func TestSourceLabeler(t *testing.T) {
+	for _, tc := range []struct {
+		name, rel string
+		mode      config.StructureMode
+		want      string
+	}{
+		{
+			name: "sub_hierarchical",
+			rel:  "sub",
+			mode: config.HierarchicalMode,
+			want: "//sub:tables",
+		}, {
+			name: "root_flat",
+			rel:  "",
+			mode: config.FlatMode,
+			want: "//:root_tables",
+		}, {
+			name: "deep_flat",
+			rel:  "sub/deep",
+			mode: config.FlatMode,
+			want: "//:sub/deep_tables",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &config.Config{StructureMode: tc.mode}
+			l := NewLabeler(c)
+
+			if got := l.SourceLabel(tc.rel, "tables").String(); got != tc.want {
+				t.Errorf("for source group in %s: got %q ; want %q", tc.rel, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"sync"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+)
+
+// Prefetcher looks up the repositories that provide external import paths
+// in the background, so rules can be generated for other packages while
+// lookups are in flight. Results are stored in the cache of the Resolver
+// the Prefetcher was created from; ResolveGo uses them or waits for lookups
+// that are still in flight.
+//
+// Import paths are grouped by the repository root guessed from their first
+// components. Only one lookup per group is in flight at a time, since the
+// result of the first usually answers the rest without another lookup.
+//
+// AddGo and Close must be called from one goroutine; lookups run on others.
+type Prefetcher struct {
+	r  *Resolver
+	wg sync.WaitGroup
+
+	// mu guards the fields below. cond is signaled when a group becomes
+	// ready or the Prefetcher is closed.
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// seen contains every import path added, so each is only queued once.
+	seen map[string]bool
+
+	// groups contains groups with queued or in-flight lookups, indexed by
+	// guessed repository root. ready contains the groups that are waiting
+	// for a worker, in the order they were created.
+	groups map[string]*prefetchGroup
+	ready  []*prefetchGroup
+
+	closed bool
+}
+
+// prefetchGroup is a list of import paths that probably belong to the
+// same repository. They're looked up one at a time by the same worker.
+type prefetchGroup struct {
+	root string
+	imps []string
+}
+
+// NewPrefetcher starts jobs goroutines that look up import paths added to
+// the returned Prefetcher. It returns nil if jobs is less than one or if r
+// never looks import paths up over the network. A nil Prefetcher may be
+// used; it ignores everything added to it.
+func (r *Resolver) NewPrefetcher(jobs int) *Prefetcher {
+	if jobs < 1 || r.externalRepos == nil || r.externalRepos.offline {
+		return nil
+	}
+	p := &Prefetcher{
+		r:      r,
+		seen:   make(map[string]bool),
+		groups: make(map[string]*prefetchGroup),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.wg.Add(jobs)
+	for i := 0; i < jobs; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// AddGo queues a lookup for an import path from a Go source file in the
+// package pkgRel, configured by c. Import paths that ResolveGo would
+// resolve without looking in external repositories are ignored.
+func (p *Prefetcher) AddGo(c *config.Config, imp, pkgRel string) {
+	if p == nil {
+		return
+	}
+	if _, ok, _ := p.r.ForConfig(c).resolveGoInRepo(imp, pkgRel); ok {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.seen[imp] {
+		return
+	}
+	p.seen[imp] = true
+	root := guessRepoRoot(imp)
+	if g, ok := p.groups[root]; ok {
+		g.imps = append(g.imps, imp)
+		return
+	}
+	g := &prefetchGroup{root: root, imps: []string{imp}}
+	p.groups[root] = g
+	p.ready = append(p.ready, g)
+	p.cond.Signal()
+}
+
+// Close stops the Prefetcher. Lookups that haven't started are dropped,
+// and Close waits for lookups in flight to finish.
+func (p *Prefetcher) Close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.closed = true
+	p.ready = nil
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// work looks up import paths in ready groups until p is closed.
+func (p *Prefetcher) work() {
+	defer p.wg.Done()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		for len(p.ready) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			return
+		}
+		g := p.ready[0]
+		p.ready = p.ready[1:]
+		for len(g.imps) > 0 && !p.closed {
+			imp := g.imps[0]
+			g.imps = g.imps[1:]
+			p.mu.Unlock()
+			// Errors are cached and reported when the import path is
+			// resolved for a rule.
+			p.r.external.resolve(imp)
+			p.mu.Lock()
+		}
+		delete(p.groups, g.root)
+	}
+}
@@ -0,0 +1,117 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"golang.org/x/tools/go/vcs"
+)
+
+func TestPrefetcher(t *testing.T) {
+	c := &config.Config{
+		GoPrefix: "example.com/local",
+		DepMode:  config.ExternalMode,
+	}
+	r := NewResolver(c, NewLabeler(c))
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	r.externalRepos.repoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+		mu.Lock()
+		calls[importpath]++
+		mu.Unlock()
+		started <- importpath
+		<-release
+		return &vcs.RepoRoot{Root: guessRepoRoot(importpath)}, nil
+	}
+
+	p := r.NewPrefetcher(2)
+	defer p.Close()
+	for _, imp := range []string{
+		"fmt",
+		"example.com/local/lib",
+		"example.com/user/repo/a",
+		"example.com/user/repo/b",
+		"example.org/other/x",
+		"example.com/user/repo/a",
+	} {
+		p.AddGo(c, imp, "")
+	}
+
+	// Both repositories should be looked up at the same time, but only one
+	// import path from each.
+	var got []string
+	for len(got) < 2 {
+		select {
+		case imp := <-started:
+			got = append(got, imp)
+		case <-time.After(10 * time.Second):
+			close(release)
+			t.Fatalf("timed out waiting for lookups; started %q", got)
+		}
+	}
+	sort.Strings(got)
+	if want := []string{"example.com/user/repo/a", "example.org/other/x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got lookups %q; want %q", got, want)
+	}
+	close(release)
+
+	for _, tc := range []struct {
+		imp  string
+		want Label
+	}{
+		{"example.com/user/repo/a", Label{Repo: "com_example_user_repo", Pkg: "a", Name: config.DefaultLibName}},
+		{"example.com/user/repo/b", Label{Repo: "com_example_user_repo", Pkg: "b", Name: config.DefaultLibName}},
+		{"example.org/other/x", Label{Repo: "org_example_other_x", Name: config.DefaultLibName}},
+	} {
+		if l, err := r.ResolveGo(tc.imp, ""); err != nil || l != tc.want {
+			t.Errorf("%s: got %v, %v; want %v", tc.imp, l, err, tc.want)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := map[string]int{"example.com/user/repo/a": 1, "example.org/other/x": 1}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got lookups %v; want %v", calls, want)
+	}
+}
+
+func TestPrefetcherDisabled(t *testing.T) {
+	for _, c := range []*config.Config{
+		{DepMode: config.VendorMode},
+		{DepMode: config.ExternalMode, Offline: true},
+	} {
+		r := NewResolver(c, NewLabeler(c))
+		if p := r.NewPrefetcher(8); p != nil {
+			t.Errorf("%v: got prefetcher; want nil", c.DepMode)
+		}
+	}
+	c := &config.Config{DepMode: config.ExternalMode}
+	if p := NewResolver(c, NewLabeler(c)).NewPrefetcher(0); p != nil {
+		t.Error("with no jobs, got prefetcher; want nil")
+	}
+
+	// A nil Prefetcher ignores everything.
+	var p *Prefetcher
+	p.AddGo(c, "example.com/repo", "")
+	p.Close()
+}
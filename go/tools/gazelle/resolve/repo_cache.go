@@ -0,0 +1,136 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// repoRootDiskCache stores repository roots found by looking up import
+// paths over the network in a JSON file, so they don't need to be looked
+// up again in later runs. Entries expire after a TTL, since a vanity
+// import path may be moved to a different repository.
+//
+// Only successful lookups are cached. Failures may be caused by network
+// problems, and they're cached in memory by externalResolver anyway.
+type repoRootDiskCache struct {
+	path string
+	ttl  time.Duration
+
+	// now returns the current time. It may be overridden by tests.
+	now func() time.Time
+
+	entries map[string]repoRootDiskCacheEntry
+}
+
+type repoRootDiskCacheEntry struct {
+	// Root is the import path of the repository root.
+	Root string `json:"root"`
+
+	// Time is when the import path was looked up.
+	Time time.Time `json:"time"`
+}
+
+// loadRepoRootDiskCache reads the cache file at file. If the file doesn't
+// exist or can't be read, the cache starts out empty; it's only an
+// optimization, so this isn't an error.
+func loadRepoRootDiskCache(file string, ttl time.Duration) *repoRootDiskCache {
+	d := &repoRootDiskCache{path: file, ttl: ttl, now: time.Now}
+	d.entries = d.read()
+	return d
+}
+
+// read returns the entries in the cache file, or an empty map if it can't
+// be read.
+func (d *repoRootDiskCache) read() map[string]repoRootDiskCacheEntry {
+	entries := make(map[string]repoRootDiskCacheEntry)
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return entries
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return make(map[string]repoRootDiskCacheEntry)
+	}
+	return entries
+}
+
+// get returns the root of the repository that provides importpath if it
+// was looked up within the TTL. Entries for any prefix of importpath are
+// used, so one lookup covers every package in a repository.
+func (d *repoRootDiskCache) get(importpath string) (string, bool) {
+	now := d.now()
+	for prefix := importpath; prefix != "." && prefix != "/"; prefix = path.Dir(prefix) {
+		e, ok := d.entries[prefix]
+		if !ok || now.Sub(e.Time) > d.ttl {
+			continue
+		}
+		if importpath == e.Root || strings.HasPrefix(importpath, e.Root+"/") {
+			return e.Root, true
+		}
+	}
+	return "", false
+}
+
+// put records that importpath is provided by the repository at root and
+// writes the cache file. Entries written by other runs since the file was
+// loaded are kept, and expired entries are dropped.
+func (d *repoRootDiskCache) put(importpath, root string) error {
+	now := d.now()
+	e := repoRootDiskCacheEntry{Root: root, Time: now}
+	d.entries[importpath] = e
+	d.entries[root] = e
+
+	for k, other := range d.read() {
+		if cur, ok := d.entries[k]; !ok || other.Time.After(cur.Time) {
+			d.entries[k] = other
+		}
+	}
+	for k, e := range d.entries {
+		if now.Sub(e.Time) > d.ttl {
+			delete(d.entries, k)
+		}
+	}
+
+	data, err := json.MarshalIndent(d.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it, so concurrent runs never see
+	// a partially written cache.
+	if err := os.MkdirAll(filepath.Dir(d.path), 0777); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(d.path), filepath.Base(d.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path)
+}
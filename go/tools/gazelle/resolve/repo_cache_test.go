@@ -0,0 +1,90 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+func TestRepoRootDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "repo_cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "cache", "repos.json")
+
+	lookups := 0
+	newResolver := func() *externalResolver {
+		r := newStubExternalResolver(nil)
+		r.repoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+			lookups++
+			if importpath == "example.com/repo/a" || importpath == "example.com/repo/b" {
+				return &vcs.RepoRoot{Root: "example.com/repo"}, nil
+			}
+			return nil, fmt.Errorf("not found: %s", importpath)
+		}
+		r.diskCache = loadRepoRootDiskCache(cacheFile, time.Hour)
+		return r
+	}
+
+	// The first run looks up the import path over the network.
+	if got, err := newResolver().lookupPrefix("example.com/repo/a"); err != nil || got != "example.com/repo" {
+		t.Fatalf("first run: got %q, %v; want %q", got, err, "example.com/repo")
+	}
+	if lookups != 1 {
+		t.Errorf("first run: got %d lookups; want 1", lookups)
+	}
+
+	// Later runs use the cache file, for other packages in the same
+	// repository too.
+	r := newResolver()
+	for _, imp := range []string{"example.com/repo/a", "example.com/repo/b/c", "example.com/repo"} {
+		if got, err := r.lookupPrefix(imp); err != nil || got != "example.com/repo" {
+			t.Errorf("%s: got %q, %v; want %q", imp, got, err, "example.com/repo")
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("second run: got %d lookups; want 1", lookups)
+	}
+
+	// Failures aren't cached.
+	for i := 0; i < 2; i++ {
+		if _, err := newResolver().lookupPrefix("example.com/missing"); err == nil {
+			t.Errorf("missing: got success; want error")
+		}
+	}
+	if lookups != 3 {
+		t.Errorf("missing: got %d lookups; want 3", lookups)
+	}
+
+	// Expired entries are looked up again.
+	r = newResolver()
+	r.diskCache.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := r.lookupPrefix("example.com/repo/b"); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 4 {
+		t.Errorf("expired: got %d lookups; want 4", lookups)
+	}
+}
@@ -0,0 +1,103 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// repoRootsFile records the repository roots of import paths that were
+// looked up over the network in a JSON file checked into the repository,
+// like gazelle-repos.json. Everyone working in the repository resolves these
+// import paths the same way, and offline runs can resolve them too.
+//
+// Unlike repoRootDiskCache, entries never expire, and they're consulted
+// before the disk cache and the network, since the file is meant to pin
+// results. The file is only written if it already exists, so it's never
+// created unexpectedly.
+type repoRootsFile struct {
+	path string
+
+	// exists is whether the file was present when it was loaded. New roots
+	// are only written if it was.
+	exists bool
+
+	// roots maps import paths that were looked up, and the roots they were
+	// found in, to the roots.
+	roots map[string]string
+}
+
+// loadRepoRootsFile reads the file at file. If it doesn't exist, the file is
+// empty and will not be written. Unlike the disk cache, a file that exists
+// but can't be read or parsed is an error, since it's checked in.
+func loadRepoRootsFile(file string) (*repoRootsFile, error) {
+	f := &repoRootsFile{path: file, roots: make(map[string]string)}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	f.exists = true
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return f, nil
+	}
+	if err := json.Unmarshal(data, &f.roots); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for imp, root := range f.roots {
+		if imp != root && !strings.HasPrefix(imp, root+"/") {
+			return nil, fmt.Errorf("%s: root %q of %q is not a prefix of the import path", file, root, imp)
+		}
+	}
+	return f, nil
+}
+
+// get returns the root of the repository that provides importpath, if it's
+// recorded for importpath or any prefix of it.
+func (f *repoRootsFile) get(importpath string) (string, bool) {
+	for prefix := importpath; prefix != "." && prefix != "/"; prefix = path.Dir(prefix) {
+		root, ok := f.roots[prefix]
+		if !ok {
+			continue
+		}
+		if importpath == root || strings.HasPrefix(importpath, root+"/") {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+// put records that importpath is provided by the repository at root and
+// writes the file, if it existed when it was loaded. Keys are sorted, so the
+// file only changes when roots are added.
+func (f *repoRootsFile) put(importpath, root string) error {
+	if !f.exists {
+		return nil
+	}
+	f.roots[importpath] = root
+	f.roots[root] = root
+	data, err := json.MarshalIndent(f.roots, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.path, append(data, '\n'), 0666)
+}
@@ -0,0 +1,105 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+func TestRepoRootsFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "repo_roots_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootsFile := filepath.Join(dir, "gazelle-repos.json")
+
+	lookups := 0
+	newResolver := func(offline bool) *externalResolver {
+		r := newStubExternalResolver(nil)
+		r.repoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+			lookups++
+			if importpath == "example.com/repo/a" {
+				return &vcs.RepoRoot{Root: "example.com/repo"}, nil
+			}
+			return nil, fmt.Errorf("not found: %s", importpath)
+		}
+		r.offline = offline
+		f, err := loadRepoRootsFile(rootsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.rootsFile = f
+		return r
+	}
+
+	// Without the file, roots are looked up but not recorded.
+	if _, err := newResolver(false).lookupPrefix("example.com/repo/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(rootsFile); !os.IsNotExist(err) {
+		t.Errorf("file was created: %v", err)
+	}
+
+	// Once the file exists, new roots are recorded.
+	if err := ioutil.WriteFile(rootsFile, []byte("{}\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newResolver(false).lookupPrefix("example.com/repo/a"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(rootsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "example.com/repo": "example.com/repo",
+  "example.com/repo/a": "example.com/repo"
+}
+`
+	if got := string(data); got != want {
+		t.Errorf("got file:\n%s\nwant:\n%s", got, want)
+	}
+	if lookups != 2 {
+		t.Errorf("got %d lookups; want 2", lookups)
+	}
+
+	// Recorded roots are used offline, for other packages in the same
+	// repository too.
+	r := newResolver(true)
+	for _, imp := range []string{"example.com/repo/a", "example.com/repo/b/c"} {
+		if got, err := r.lookupPrefix(imp); err != nil || got != "example.com/repo" {
+			t.Errorf("%s: got %q, %v; want %q", imp, got, err, "example.com/repo")
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("offline: got %d lookups; want 2", lookups)
+	}
+
+	// Roots that aren't prefixes of their import paths are errors.
+	if err := ioutil.WriteFile(rootsFile, []byte(`{"example.com/a": "example.com/b"}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRepoRootsFile(rootsFile); err == nil {
+		t.Error("got success loading a bad root; want error")
+	}
+}
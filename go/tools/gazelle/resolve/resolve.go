@@ -18,9 +18,11 @@ package resolve
 import (
 	"fmt"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 )
 
 // Resolver resolves import strings in source files (import paths in Go,
@@ -32,6 +34,26 @@ type Resolver struct {
 	c        *config.Config
 	l        Labeler
 	external nonlocalResolver
+
+	// externalRepos is the resolver for imports in external repositories if
+	// c.DepMode is external or hybrid. It's nil otherwise.
+	externalRepos *externalResolver
+
+	// rootPrefix is the Go prefix for the repository root. Imports under this
+	// prefix are resolved locally even if c has a different prefix set by a
+	// "# gazelle:prefix" directive.
+	rootPrefix string
+
+	// protos is used to resolve imports in .proto files. It may be nil.
+	protos *ProtoIndex
+
+	// goIndex maps Go import paths to labels of existing rules found with
+	// bazel query. It may be nil.
+	goIndex *GoIndex
+
+	// secondary is used to resolve imports of secondary packages. It may
+	// be nil.
+	secondary *SecondaryIndex
 }
 
 // nonlocalResolver resolves import paths outside of the current repository's
@@ -42,40 +64,217 @@ type nonlocalResolver interface {
 }
 
 func NewResolver(c *config.Config, l Labeler) *Resolver {
+	repoName := RepoNamerForConfig(c)
+	var externalRepos *externalResolver
+	if c.DepMode == config.ExternalMode || c.DepMode == config.HybridMode {
+		// go_repository generates build files with libraries named
+		// DefaultLibName, whatever naming this repository uses.
+		externalLabeler := l
+		if c.LibraryNaming == config.DirNameLibraryNaming {
+			ec := *c
+			ec.LibraryNaming = config.DefaultLibraryNaming
+			externalLabeler = NewLabeler(&ec)
+		}
+		externalRepos = newExternalResolver(externalLabeler, c.KnownImports, c.KnownHosts, repoName)
+		if c.RepoCacheFile != "" {
+			externalRepos.diskCache = loadRepoRootDiskCache(c.RepoCacheFile, c.RepoCacheTTL)
+		}
+		if c.RepoRootsFile != "" {
+			if f, err := loadRepoRootsFile(c.RepoRootsFile); err != nil {
+				logging.Error(err)
+			} else {
+				externalRepos.rootsFile = f
+			}
+		}
+		externalRepos.limiter.interval = c.RepoLookupInterval
+		externalRepos.retries = c.RepoLookupRetries
+		externalRepos.offline = c.Offline
+		externalRepos.offlineHeuristic = c.OfflineHeuristic
+	}
 	var e nonlocalResolver
 	switch c.DepMode {
 	case config.ExternalMode:
-		e = newExternalResolver(l, c.KnownImports)
+		e = externalRepos
 	case config.VendorMode:
 		e = newVendoredResolver(l)
+	case config.HybridMode:
+		e = newHybridResolver(c.RepoRoot, newVendoredResolver(l), externalRepos)
 	}
 
 	return &Resolver{
-		c:        c,
-		l:        l,
-		external: e,
+		c:             c,
+		l:             l,
+		external:      e,
+		externalRepos: externalRepos,
+		rootPrefix:    c.GoPrefix,
+	}
+}
+
+// ForConfig returns a Resolver for packages in a directory configured by c.
+// Imports under c.GoPrefix are resolved to packages under c.GoPrefixRel.
+// The returned Resolver shares its labeler and external resolver (and its
+// cache) with r.
+func (r *Resolver) ForConfig(c *config.Config) *Resolver {
+	if c == r.c {
+		return r
+	}
+	forConfig := *r
+	forConfig.c = c
+	return &forConfig
+}
+
+// OfflineUnresolved returns the sorted import paths that couldn't be
+// resolved because the repositories providing them are unknown, and
+// c.Offline prevented looking them up.
+func (r *Resolver) OfflineUnresolved() []string {
+	if r.externalRepos == nil {
+		return nil
 	}
+	var imps []string
+	r.externalRepos.mu.Lock()
+	for imp := range r.externalRepos.unresolved {
+		imps = append(imps, imp)
+	}
+	r.externalRepos.mu.Unlock()
+	sort.Strings(imps)
+	return imps
 }
 
 // ResolveGo resolves an import path from a Go source file to a label.
 // pkgRel is the path to the Go package relative to the repository root; it
-// is used to resolve relative imports.
+// is used to resolve relative imports. Import paths named in
+// "# gazelle:resolve" directives are resolved to the labels given there.
+// Import paths under prefixes named in "# gazelle:repo_override" directives
+// are resolved in the repositories or packages given there.
+// Import paths in the index set with SetGoIndex are resolved to the labels
+// of the rules that provide them. When proto rules are generated, import
+// paths named by go_package options of .proto files in the repository are
+// resolved to the rules generated for those files.
+// Packages in the Go standard library don't have labels; an error is
+// returned for them.
 func (r *Resolver) ResolveGo(imp, pkgRel string) (Label, error) {
+	if l, ok, err := r.resolveGoInRepo(imp, pkgRel); ok {
+		return l, err
+	}
+	return r.external.resolve(imp)
+}
+
+// resolveGoInRepo resolves an import path like ResolveGo, but without
+// resolving it in vendor/ or an external repository. ok is false if
+// r.external must resolve it. Nothing is looked up over the network.
+func (r *Resolver) resolveGoInRepo(imp, pkgRel string) (l Label, ok bool, err error) {
 	if imp == "." || imp == ".." ||
 		strings.HasPrefix(imp, "./") || strings.HasPrefix(imp, "../") {
 		cleanRel := path.Clean(path.Join(pkgRel, imp))
 		if strings.HasPrefix(cleanRel, "..") {
-			return Label{}, fmt.Errorf("relative import path %q from %q points outside of repository", imp, pkgRel)
+			return Label{}, true, fmt.Errorf("relative import path %q from %q points outside of repository", imp, pkgRel)
+		}
+		if cleanRel == "." {
+			cleanRel = ""
 		}
-		imp = path.Join(r.c.GoPrefix, cleanRel)
+		return r.localLabel(cleanRel), true, nil
 	}
 
-	if imp != r.c.GoPrefix && !strings.HasPrefix(imp, r.c.GoPrefix+"/") {
-		return r.external.resolve(imp)
+	if s, ok := r.c.GoResolveOverrides[imp]; ok {
+		l, err := ParseLabel(s)
+		if err != nil {
+			return Label{}, true, fmt.Errorf("in gazelle:resolve directive for %q: %v", imp, err)
+		}
+		if l.Relative {
+			return Label{}, true, fmt.Errorf("in gazelle:resolve directive for %q: label %q must not be relative", imp, s)
+		}
+		return l, true, nil
+	}
+
+	if l, ok := r.resolveRepoOverride(imp); ok {
+		return l, true, nil
 	}
 
-	if imp == r.c.GoPrefix {
-		return r.l.LibraryLabel(""), nil
+	if r.goIndex != nil {
+		if l, ok := r.goIndex.lookup(imp, r.c.PreferredLabels); ok {
+			return l, true, nil
+		}
+	}
+
+	if r.protos != nil && r.c.ProtoMode.ShouldGenerateRules() {
+		if e, ok := r.protos.lookupGo(imp); ok {
+			return r.goProtoLabel(e), true, nil
+		}
+	}
+
+	if rel, ok := localRel(imp, r.c.GoPrefix, r.c.GoPrefixRel); ok {
+		return r.localLabel(rel), true, nil
+	}
+	if rel, ok := localRel(imp, r.rootPrefix, ""); ok {
+		return r.localLabel(rel), true, nil
+	}
+	if IsStandard(imp) {
+		return Label{}, true, fmt.Errorf("import path %q is in the standard library", imp)
+	}
+	if r.c.ResolveWellKnownTypes {
+		if name, ok := wktGoPackages[imp]; ok {
+			return Label{Repo: config.RulesGoRepoName, Pkg: wktPkg, Name: name}, true, nil
+		}
+	}
+	return Label{}, false, nil
+}
+
+// IsStandard returns whether imp is the import path of a package in the Go
+// standard library. Standard packages are compiled into the Go toolchain,
+// so rules never need dependencies on them.
+func IsStandard(imp string) bool {
+	return stdPackages[imp]
+}
+
+// localLabel returns the label of the library in the directory rel, or of
+// the secondary package rel names, if the index set with SetSecondaryIndex
+// has one.
+func (r *Resolver) localLabel(rel string) Label {
+	if r.secondary != nil {
+		if dirRel, name, ok := r.secondary.lookup(rel); ok {
+			return r.l.SecondaryLibraryLabel(dirRel, name)
+		}
+	}
+	return r.l.LibraryLabel(rel)
+}
+
+// resolveRepoOverride resolves imp if it's under a prefix named in a
+// "# gazelle:repo_override" directive. The longest matching prefix is used.
+// Imports overridden with a repository are resolved to libraries in it,
+// named the way go_repository names them. Imports overridden with a package
+// in this repository are resolved like local imports.
+func (r *Resolver) resolveRepoOverride(imp string) (Label, bool) {
+	var prefix string
+	for p := range r.c.RepoOverrides {
+		if len(p) > len(prefix) && (imp == p || strings.HasPrefix(imp, p+"/")) {
+			prefix = p
+		}
+	}
+	if prefix == "" {
+		return Label{}, false
+	}
+	target := r.c.RepoOverrides[prefix]
+	if strings.HasPrefix(target, "//") {
+		rel, _ := localRel(imp, prefix, strings.Trim(target, "/"))
+		return r.localLabel(rel), true
+	}
+	var pkg string
+	if imp != prefix {
+		pkg = imp[len(prefix)+1:]
+	}
+	repo := strings.TrimSuffix(strings.TrimPrefix(target, "@"), "//")
+	return Label{Repo: repo, Pkg: pkg, Name: config.DefaultLibName}, true
+}
+
+// localRel returns the slash-separated path, relative to the repository
+// root, of the directory for imp if imp is prefix or starts with prefix.
+// prefixRel is the directory corresponding to prefix.
+func localRel(imp, prefix, prefixRel string) (string, bool) {
+	if imp == prefix {
+		return prefixRel, true
+	}
+	if strings.HasPrefix(imp, prefix+"/") {
+		return path.Join(prefixRel, imp[len(prefix)+1:]), true
 	}
-	return r.l.LibraryLabel(strings.TrimPrefix(imp, r.c.GoPrefix+"/")), nil
+	return "", false
 }
@@ -19,7 +19,11 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 	"golang.org/x/tools/go/vcs"
 )
 
@@ -29,29 +33,95 @@ import (
 // The prefix is converted to a Bazel external name repo according to the
 // guidelines in http://bazel.io/docs/be/functions.html#workspace. The remaining
 // portion of the import path is treated as the package name.
+//
+// An externalResolver is safe for concurrent use. Concurrent lookups of the
+// same import path share one network fetch.
 type externalResolver struct {
 	l Labeler
 
+	// repoName converts the import path of a repository root to the name
+	// of the external repository.
+	repoName RepoNamer
+
 	// repoRootForImportPath is vcs.RepoRootForImportPath by default. It may
 	// be overridden by tests.
 	repoRootForImportPath func(string, bool) (*vcs.RepoRoot, error)
 
+	// limiter spaces out network fetches to each host.
+	limiter *hostLimiter
+
+	// retries is the number of times a failed network fetch is retried.
+	// The first retry waits for retryBackoff, and each later retry waits
+	// twice as long as the one before.
+	retries      int
+	retryBackoff time.Duration
+
+	// sleep is time.Sleep by default. It may be overridden by tests.
+	sleep func(time.Duration)
+
+	// mu guards cache, diskCache, rootsFile, unresolved, and pending.
+	mu sync.Mutex
+
 	// cache stores lookup results, both positive and negative to reduce
 	// network fetches when there are multiple imports on the same external repo.
 	cache map[string]repoRootCacheEntry
+
+	// pending holds network fetches in progress, indexed by import path.
+	pending map[string]*repoRootFetch
+
+	// diskCache stores the results of network lookups across runs. It's
+	// nil if results are only cached in memory.
+	diskCache *repoRootDiskCache
+
+	// rootsFile records the roots of import paths looked up over the network
+	// in a file checked into the repository. It's nil if there's no such
+	// file.
+	rootsFile *repoRootsFile
+
+	// offline is set if import paths may not be looked up over the network.
+	// The roots of import paths that aren't known already are guessed with
+	// guessRepoRoot if offlineHeuristic is set. Otherwise, the import paths
+	// are recorded in unresolved, and errors are returned for them.
+	offline, offlineHeuristic bool
+	unresolved                map[string]bool
 }
 
 var _ nonlocalResolver = (*externalResolver)(nil)
 
-func newExternalResolver(l Labeler, extraKnownImports []string) *externalResolver {
+// repoRootFetch is a network fetch of the repository root of an import path.
+// done is closed when prefix and err are set.
+type repoRootFetch struct {
+	done   chan struct{}
+	prefix string
+	err    error
+}
+
+// defaultRetryBackoff is how long the first retry of a failed network fetch
+// waits.
+const defaultRetryBackoff = time.Second
+
+// knownHosts are hosting sites and vanity domains where repository roots
+// can be found without looking them up over the network. gopkg.in is
+// handled separately by gopkgInRoot, since its roots don't have a fixed
+// number of components.
+var knownHosts = []config.KnownHost{
+	{Prefix: "bitbucket.org", Components: 2},
+	{Prefix: "cloud.google.com", Components: 1},
+	{Prefix: "github.com", Components: 2},
+	{Prefix: "go.uber.org", Components: 1},
+	{Prefix: "golang.org/x", Components: 1},
+	{Prefix: "google.golang.org", Components: 1},
+	{Prefix: "honnef.co/go", Components: 1},
+	{Prefix: "k8s.io", Components: 1},
+	{Prefix: "sigs.k8s.io", Components: 1},
+}
+
+func newExternalResolver(l Labeler, extraKnownImports []string, extraKnownHosts []config.KnownHost, repoName RepoNamer) *externalResolver {
 	cache := make(map[string]repoRootCacheEntry)
-	for _, e := range []repoRootCacheEntry{
-		{prefix: "golang.org/x", missing: 1},
-		{prefix: "google.golang.org", missing: 1},
-		{prefix: "cloud.google.com", missing: 1},
-		{prefix: "github.com", missing: 2},
-	} {
-		cache[e.prefix] = e
+	for _, hosts := range [][]config.KnownHost{knownHosts, extraKnownHosts} {
+		for _, h := range hosts {
+			cache[h.Prefix] = repoRootCacheEntry{prefix: h.Prefix, missing: h.Components}
+		}
 	}
 
 	for _, e := range extraKnownImports {
@@ -59,8 +129,13 @@ func newExternalResolver(l Labeler, extraKnownImports []string) *externalResolve
 	}
 
 	return &externalResolver{
-		l:     l,
-		cache: cache,
+		l:                     l,
+		repoName:              repoName,
+		cache:                 cache,
+		pending:               make(map[string]*repoRootFetch),
+		limiter:               newHostLimiter(0),
+		retryBackoff:          defaultRetryBackoff,
+		sleep:                 time.Sleep,
 		repoRootForImportPath: vcs.RepoRootForImportPath,
 	}
 }
@@ -81,13 +156,55 @@ func (r *externalResolver) resolve(importpath string) (Label, error) {
 	}
 
 	label := r.l.LibraryLabel(pkg)
-	label.Repo = ImportPathToBazelRepoName(prefix)
+	label.Repo = r.repoName(prefix)
 	return label, nil
 }
 
 // lookupPrefix determines the prefix of "importpath" that corresponds to
 // the root of the repository. Results are cached.
 func (r *externalResolver) lookupPrefix(importpath string) (string, error) {
+	r.mu.Lock()
+	if prefix, ok, err := r.knownPrefix(importpath); ok {
+		r.mu.Unlock()
+		return prefix, err
+	}
+	if f, ok := r.pending[importpath]; ok {
+		r.mu.Unlock()
+		<-f.done
+		return f.prefix, f.err
+	}
+	f := &repoRootFetch{done: make(chan struct{})}
+	r.pending[importpath] = f
+	r.mu.Unlock()
+
+	f.prefix, f.err = r.fetchPrefix(importpath)
+
+	r.mu.Lock()
+	delete(r.pending, importpath)
+	if f.err != nil {
+		r.cache[importpath] = repoRootCacheEntry{prefix: importpath, err: f.err}
+	} else {
+		r.cache[f.prefix] = repoRootCacheEntry{prefix: f.prefix}
+		if r.rootsFile != nil {
+			if err := r.rootsFile.put(importpath, f.prefix); err != nil {
+				logging.Warningf("could not write repository roots file: %v", err)
+			}
+		}
+		if r.diskCache != nil {
+			if err := r.diskCache.put(importpath, f.prefix); err != nil {
+				logging.Warningf("could not write repository cache: %v", err)
+			}
+		}
+	}
+	r.mu.Unlock()
+	close(f.done)
+	return f.prefix, f.err
+}
+
+// knownPrefix determines the prefix of importpath that corresponds to the
+// root of the repository without looking it up over the network. ok is
+// false if importpath must be looked up. r.mu must be held.
+func (r *externalResolver) knownPrefix(importpath string) (prefix string, ok bool, err error) {
 	// subpaths contains slices of importpath with components removed. For
 	// example:
 	//   golang.org/x/tools/go/vcs
@@ -96,15 +213,15 @@ func (r *externalResolver) lookupPrefix(importpath string) (string, error) {
 	subpaths := []string{importpath}
 
 	// Check the cache for prefixes of the import path.
-	prefix := importpath
+	prefix = importpath
 	for {
 		if e, ok := r.cache[prefix]; ok {
 			if e.missing >= len(subpaths) {
-				return "", fmt.Errorf("import path %q is shorter than the known prefix %q", prefix, e.prefix)
+				return "", true, fmt.Errorf("import path %q is shorter than the known prefix %q", prefix, e.prefix)
 			}
 			// Cache hit. Restore n components of the import path to get the
 			// repository root.
-			return subpaths[len(subpaths)-e.missing-1], e.err
+			return subpaths[len(subpaths)-e.missing-1], true, e.err
 		}
 
 		// Prefix not found. Remove the last component and try again.
@@ -116,15 +233,156 @@ func (r *externalResolver) lookupPrefix(importpath string) (string, error) {
 		subpaths = append(subpaths, prefix)
 	}
 
-	// Look up the import path using vcs.
-	root, err := r.repoRootForImportPath(importpath, false)
-	if err != nil {
-		r.cache[importpath] = repoRootCacheEntry{prefix: importpath, err: err}
-		return "", err
+	if root, ok := gopkgInRoot(importpath); ok {
+		r.cache[root] = repoRootCacheEntry{prefix: root}
+		return root, true, nil
+	}
+
+	if r.rootsFile != nil {
+		if root, ok := r.rootsFile.get(importpath); ok {
+			r.cache[root] = repoRootCacheEntry{prefix: root}
+			return root, true, nil
+		}
+	}
+
+	if r.diskCache != nil {
+		if root, ok := r.diskCache.get(importpath); ok {
+			r.cache[root] = repoRootCacheEntry{prefix: root}
+			return root, true, nil
+		}
+	}
+
+	if r.offline {
+		if r.offlineHeuristic {
+			prefix = guessRepoRoot(importpath)
+			r.cache[prefix] = repoRootCacheEntry{prefix: prefix}
+			return prefix, true, nil
+		}
+		if r.unresolved == nil {
+			r.unresolved = make(map[string]bool)
+		}
+		r.unresolved[importpath] = true
+		return "", true, fmt.Errorf("the repository that provides %q is unknown, and -offline prevents looking it up", importpath)
+	}
+
+	return "", false, nil
+}
+
+// fetchPrefix looks up the root of the repository that provides importpath
+// over the network, waiting for its host's turn first. Failed fetches are
+// retried with exponential backoff, since large first runs may look up many
+// import paths, and hosts may fail some requests.
+func (r *externalResolver) fetchPrefix(importpath string) (string, error) {
+	backoff := r.retryBackoff
+	for attempt := 0; ; attempt++ {
+		r.limiter.wait(importpath)
+		root, err := r.repoRootForImportPath(importpath, false)
+		if err == nil {
+			return root.Root, nil
+		}
+		if attempt >= r.retries {
+			return "", err
+		}
+		logging.Infof("looking up %s failed; retrying in %v: %v", importpath, backoff, err)
+		r.sleep(backoff)
+		backoff *= 2
 	}
-	prefix = root.Root
-	r.cache[prefix] = repoRootCacheEntry{prefix: prefix}
-	return prefix, nil
+}
+
+// gopkgInRoot returns the repository root of an import path on gopkg.in.
+// gopkg.in has two forms of roots: gopkg.in/pkg.v1, for packages on GitHub
+// at github.com/go-pkg/pkg, and gopkg.in/user/pkg.v1, for packages at
+// github.com/user/pkg. The version suffix tells them apart.
+func gopkgInRoot(importpath string) (string, bool) {
+	parts := strings.Split(importpath, "/")
+	if parts[0] != "gopkg.in" || len(parts) < 2 {
+		return "", false
+	}
+	for n := 2; n <= 3 && n <= len(parts); n++ {
+		if isGopkgInVersion(parts[n-1]) {
+			return strings.Join(parts[:n], "/"), true
+		}
+	}
+	return "", false
+}
+
+// isGopkgInVersion returns whether elem is a gopkg.in package name with a
+// version suffix, like "yaml.v2".
+func isGopkgInVersion(elem string) bool {
+	i := strings.LastIndex(elem, ".v")
+	if i <= 0 || i+2 == len(elem) {
+		return false
+	}
+	for _, r := range elem[i+2:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// guessRepoRoot returns the root of the repository that probably provides
+// importpath without looking it up. Like most hosting sites, the root is
+// assumed to be the first three components of the import path, for
+// example, example.com/user/repo.
+func guessRepoRoot(importpath string) string {
+	parts := strings.SplitN(importpath, "/", 4)
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+	return strings.Join(parts, "/")
+}
+
+// RepoNamer converts the import path of the root of a repository to the
+// name of the external repository that provides it.
+type RepoNamer func(importpath string) string
+
+const (
+	// GoDefaultNaming names repositories after the reverse-DNS form of their
+	// import paths, so golang.org/x/tools is @org_golang_x_tools. This is the
+	// default, and it's the naming convention go_repository rules written by
+	// hand usually follow.
+	GoDefaultNaming = "go_default"
+
+	// ImportAliasNaming names repositories after their import paths with
+	// separators replaced by underscores, so golang.org/x/tools is
+	// @golang_org_x_tools.
+	ImportAliasNaming = "import_alias"
+)
+
+// NamingConvention returns the function that names external repositories
+// according to the convention called name. ok is false if there is no such
+// convention.
+func NamingConvention(name string) (namer RepoNamer, ok bool) {
+	switch name {
+	case GoDefaultNaming:
+		return ImportPathToBazelRepoName, true
+	case ImportAliasNaming:
+		return ImportPathToAliasRepoName, true
+	default:
+		return nil, false
+	}
+}
+
+// RepoNamerForConfig returns the function that names external repositories
+// for c: c.RepoNamer if it's set, or the convention named by
+// c.ExternalNaming. If neither is set, or the convention is unknown,
+// ImportPathToBazelRepoName is returned.
+func RepoNamerForConfig(c *config.Config) RepoNamer {
+	if c.RepoNamer != nil {
+		return c.RepoNamer
+	}
+	if namer, ok := NamingConvention(c.ExternalNaming); ok {
+		return namer
+	}
+	return ImportPathToBazelRepoName
+}
+
+// ImportPathToAliasRepoName converts a Go import path into a bazel repo name
+// by replacing characters that can't appear in repository names with
+// underscores, without reordering the components of the domain name.
+func ImportPathToAliasRepoName(importpath string) string {
+	return strings.NewReplacer("/", "_", "-", "_", ".", "_").Replace(importpath)
 }
 
 // ImportPathToBazelRepoName converts a Go import path into a bazel repo name
@@ -16,10 +16,13 @@ limitations under the License.
 package resolve
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
 	"golang.org/x/tools/go/vcs"
@@ -39,6 +42,13 @@ func TestSpecialCases(t *testing.T) {
 		{in: "github.com/foo/bar", want: "github.com/foo/bar"},
 		{in: "github.com/foo/bar/baz", want: "github.com/foo/bar"},
 		{in: "unsupported.org/x/net/context", wantError: true},
+		{in: "k8s.io/apimachinery/pkg/util", want: "k8s.io/apimachinery"},
+		{in: "go.uber.org/zap/zapcore", want: "go.uber.org/zap"},
+		{in: "bitbucket.org/foo/bar/baz", want: "bitbucket.org/foo/bar"},
+		{in: "gopkg.in/yaml.v2", want: "gopkg.in/yaml.v2"},
+		{in: "gopkg.in/check.v1/sub", want: "gopkg.in/check.v1"},
+		{in: "gopkg.in/src-d/go-git.v4/plumbing", want: "gopkg.in/src-d/go-git.v4"},
+		{in: "gopkg.in/foo", wantError: true},
 		{
 			in:         "private.com/my/repo/package/path",
 			extraKnown: []string{"other-host.com/repo", "private.com/my/repo"},
@@ -112,9 +122,47 @@ func TestExternalResolver(t *testing.T) {
 	}
 }
 
+func TestExternalNaming(t *testing.T) {
+	for _, tc := range []struct {
+		naming, importpath, want string
+	}{
+		{"", "golang.org/x/tools", "org_golang_x_tools"},
+		{GoDefaultNaming, "golang.org/x/tools", "org_golang_x_tools"},
+		{GoDefaultNaming, "github.com/foo-bar/baz", "com_github_foo_bar_baz"},
+		{ImportAliasNaming, "golang.org/x/tools", "golang_org_x_tools"},
+		{ImportAliasNaming, "github.com/foo-bar/baz", "github_com_foo_bar_baz"},
+	} {
+		c := &config.Config{ExternalNaming: tc.naming, KnownImports: []string{tc.importpath}}
+		r := NewResolver(c, NewLabeler(c))
+		l, err := r.ResolveGo(tc.importpath+"/pkg", "")
+		if err != nil {
+			t.Errorf("with naming %q, r.ResolveGo(%q) failed with %v; want success", tc.naming, tc.importpath, err)
+			continue
+		}
+		if l.Repo != tc.want {
+			t.Errorf("with naming %q, r.ResolveGo(%q) has repo %q; want %q", tc.naming, tc.importpath, l.Repo, tc.want)
+		}
+	}
+
+	// A custom RepoNamer overrides ExternalNaming.
+	c := &config.Config{
+		ExternalNaming: ImportAliasNaming,
+		RepoNamer: func(importpath string) string {
+			return "custom_" + ImportPathToAliasRepoName(importpath)
+		},
+		KnownImports: []string{"golang.org/x/tools"},
+	}
+	r := NewResolver(c, NewLabeler(c))
+	if l, err := r.ResolveGo("golang.org/x/tools/pkg", ""); err != nil {
+		t.Errorf("with RepoNamer, r.ResolveGo failed with %v; want success", err)
+	} else if want := "custom_golang_org_x_tools"; l.Repo != want {
+		t.Errorf("with RepoNamer, r.ResolveGo has repo %q; want %q", l.Repo, want)
+	}
+}
+
 func newStubExternalResolver(extraKnown []string) *externalResolver {
 	l := NewLabeler(&config.Config{})
-	r := newExternalResolver(l, extraKnown)
+	r := newExternalResolver(l, extraKnown, nil, ImportPathToBazelRepoName)
 	r.repoRootForImportPath = stubRepoRootForImportPath
 	return r
 }
@@ -147,3 +195,158 @@ func stubRepoRootForImportPath(importpath string, verbose bool) (*vcs.RepoRoot,
 
 	return nil, fmt.Errorf("could not resolve import path: %q", importpath)
 }
+
+func TestExternalResolverOffline(t *testing.T) {
+	c := &config.Config{
+		DepMode:      config.ExternalMode,
+		KnownImports: []string{"example.com/known"},
+		Offline:      true,
+	}
+	r := NewResolver(c, NewLabeler(c))
+	r.externalRepos.repoRootForImportPath = func(string, bool) (*vcs.RepoRoot, error) {
+		t.Fatal("unexpected network lookup")
+		return nil, nil
+	}
+	for _, imp := range []string{"github.com/foo/bar/baz", "example.com/known/pkg"} {
+		if _, err := r.ResolveGo(imp, ""); err != nil {
+			t.Errorf("%s: %v", imp, err)
+		}
+	}
+	for _, imp := range []string{"example.com/unknown/b", "example.com/unknown/a", "example.com/unknown/a"} {
+		if _, err := r.ResolveGo(imp, ""); err == nil {
+			t.Errorf("%s: got success; want error", imp)
+		}
+	}
+	if got, want := r.OfflineUnresolved(), []string{"example.com/unknown/a", "example.com/unknown/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unresolved: got %q; want %q", got, want)
+	}
+
+	c.OfflineHeuristic = true
+	r = NewResolver(c, NewLabeler(c))
+	want := Label{Repo: "com_example_unknown_repo", Pkg: "a/b", Name: config.DefaultLibName}
+	if got, err := r.ResolveGo("example.com/unknown/repo/a/b", ""); err != nil || got != want {
+		t.Errorf("heuristic: got %v, %v; want %v", got, err, want)
+	}
+	if got := r.OfflineUnresolved(); len(got) != 0 {
+		t.Errorf("heuristic: got unresolved %q; want none", got)
+	}
+}
+
+func TestExternalResolverLibraryNaming(t *testing.T) {
+	c := &config.Config{
+		GoPrefix:         "example.com/repo",
+		DepMode:          config.ExternalMode,
+		LibraryNaming:    config.DirNameLibraryNaming,
+		Offline:          true,
+		OfflineHeuristic: true,
+	}
+	r := NewResolver(c, NewLabeler(c))
+	for _, tc := range []struct {
+		imp  string
+		want Label
+	}{
+		{
+			imp:  "example.com/repo/a/b",
+			want: Label{Pkg: "a/b", Name: "b"},
+		}, {
+			imp:  "example.com/other/repo/a/b",
+			want: Label{Repo: "com_example_other_repo", Pkg: "a/b", Name: config.DefaultLibName},
+		},
+	} {
+		if got, err := r.ResolveGo(tc.imp, ""); err != nil || got != tc.want {
+			t.Errorf("%s: got %v, %v; want %v", tc.imp, got, err, tc.want)
+		}
+	}
+}
+
+func TestExtraKnownHosts(t *testing.T) {
+	hosts := []config.KnownHost{
+		{Prefix: "example.com/go", Components: 1},
+		{Prefix: "go.example.org", Components: 0},
+	}
+	r := newExternalResolver(NewLabeler(&config.Config{}), nil, hosts, ImportPathToBazelRepoName)
+	r.repoRootForImportPath = func(string, bool) (*vcs.RepoRoot, error) {
+		t.Fatal("unexpected network lookup")
+		return nil, nil
+	}
+	for _, tc := range []struct{ in, want string }{
+		{"example.com/go/foo/bar", "example.com/go/foo"},
+		{"go.example.org/baz", "go.example.org"},
+	} {
+		if got, err := r.lookupPrefix(tc.in); err != nil || got != tc.want {
+			t.Errorf("%s: got %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestExternalResolverRetries(t *testing.T) {
+	r := newStubExternalResolver(nil)
+	r.retries = 2
+	var slept []time.Duration
+	r.sleep = func(d time.Duration) { slept = append(slept, d) }
+	calls := 0
+	r.repoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+		calls++
+		if calls < 3 {
+			return nil, errors.New("connection reset")
+		}
+		return stubRepoRootForImportPath(importpath, verbose)
+	}
+	if got, err := r.lookupPrefix("example.com/repo/pkg"); err != nil || got != "example.com/repo" {
+		t.Errorf("got %q, %v; want %q", got, err, "example.com/repo")
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second}; !reflect.DeepEqual(slept, want) {
+		t.Errorf("got backoffs %v; want %v", slept, want)
+	}
+
+	calls = 0
+	slept = nil
+	r.retries = 0
+	if _, err := r.lookupPrefix("example.org/flaky"); err == nil {
+		t.Error("with no retries, got success; want error")
+	}
+	if calls != 1 || len(slept) != 0 {
+		t.Errorf("with no retries, got %d calls and backoffs %v; want 1 call and none", calls, slept)
+	}
+}
+
+func TestExternalResolverConcurrent(t *testing.T) {
+	r := newStubExternalResolver(nil)
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	release := make(chan struct{})
+	r.repoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+		mu.Lock()
+		calls[importpath]++
+		mu.Unlock()
+		<-release
+		return stubRepoRootForImportPath(importpath, verbose)
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	results := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l, err := r.resolve("example.com/repo/pkg")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = l.Repo
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+
+	for _, repo := range results {
+		if repo != "com_example_repo" {
+			t.Errorf("got repo %q; want %q", repo, "com_example_repo")
+		}
+	}
+	if calls["example.com/repo/pkg"] > 1 {
+		t.Errorf("import path was looked up %d times; want once", calls["example.com/repo/pkg"])
+	}
+}
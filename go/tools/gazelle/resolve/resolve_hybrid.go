@@ -0,0 +1,46 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// hybridResolver resolves external packages as packages in vendor/ if they
+// are present there. Other packages are resolved to external repositories.
+type hybridResolver struct {
+	vendorDir string
+	vendored  nonlocalResolver
+	external  nonlocalResolver
+}
+
+var _ nonlocalResolver = (*hybridResolver)(nil)
+
+func newHybridResolver(repoRoot string, vendored, external nonlocalResolver) *hybridResolver {
+	return &hybridResolver{
+		vendorDir: filepath.Join(repoRoot, "vendor"),
+		vendored:  vendored,
+		external:  external,
+	}
+}
+
+func (h *hybridResolver) resolve(importpath string) (Label, error) {
+	if fi, err := os.Stat(filepath.Join(h.vendorDir, filepath.FromSlash(importpath))); err == nil && fi.IsDir() {
+		return h.vendored.resolve(importpath)
+	}
+	return h.external.resolve(importpath)
+}
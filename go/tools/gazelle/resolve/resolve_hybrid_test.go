@@ -0,0 +1,71 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+)
+
+func TestHybridResolver(t *testing.T) {
+	repoRoot, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "hybrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoRoot)
+	vendored := filepath.Join(repoRoot, "vendor", "example.com", "repo", "vendored")
+	if err := os.MkdirAll(vendored, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repoRoot, "vendor", "example.com", "repo", "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewLabeler(&config.Config{})
+	r := newHybridResolver(repoRoot, newVendoredResolver(l), newStubExternalResolver(nil))
+	for _, spec := range []struct {
+		importpath string
+		want       Label
+	}{
+		{
+			importpath: "example.com/repo/vendored",
+			want:       Label{Pkg: "vendor/example.com/repo/vendored", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/repo",
+			want:       Label{Pkg: "vendor/example.com/repo", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/repo/lib",
+			want:       Label{Repo: "com_example_repo", Pkg: "lib", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/repo/file",
+			want:       Label{Repo: "com_example_repo", Pkg: "file", Name: config.DefaultLibName},
+		},
+	} {
+		l, err := r.resolve(spec.importpath)
+		if err != nil {
+			t.Errorf("r.resolve(%q) failed with %v; want success", spec.importpath, err)
+			continue
+		}
+		if got, want := l, spec.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("r.resolve(%q) = %s; want %s", spec.importpath, got, want)
+		}
+	}
+}
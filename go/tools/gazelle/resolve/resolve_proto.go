@@ -0,0 +1,191 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+)
+
+// protobufRepoName is the name of the repository that provides
+// proto_library rules for well-known types.
+const protobufRepoName = "com_google_protobuf"
+
+// wktProtos maps import paths of .proto files for well-known types to the
+// names of proto_library rules in @com_google_protobuf and the import paths
+// of the Go packages generated from them.
+var wktProtos = map[string]struct{ name, goImportPath string }{
+	"google/protobuf/any.proto":             {"any_proto", "github.com/golang/protobuf/ptypes/any"},
+	"google/protobuf/api.proto":             {"api_proto", "google.golang.org/genproto/protobuf/api"},
+	"google/protobuf/compiler/plugin.proto": {"compiler_plugin_proto", "github.com/golang/protobuf/protoc-gen-go/plugin"},
+	"google/protobuf/descriptor.proto":      {"descriptor_proto", "github.com/golang/protobuf/protoc-gen-go/descriptor"},
+	"google/protobuf/duration.proto":        {"duration_proto", "github.com/golang/protobuf/ptypes/duration"},
+	"google/protobuf/empty.proto":           {"empty_proto", "github.com/golang/protobuf/ptypes/empty"},
+	"google/protobuf/field_mask.proto":      {"field_mask_proto", "google.golang.org/genproto/protobuf/field_mask"},
+	"google/protobuf/source_context.proto":  {"source_context_proto", "google.golang.org/genproto/protobuf/source_context"},
+	"google/protobuf/struct.proto":          {"struct_proto", "github.com/golang/protobuf/ptypes/struct"},
+	"google/protobuf/timestamp.proto":       {"timestamp_proto", "github.com/golang/protobuf/ptypes/timestamp"},
+	"google/protobuf/type.proto":            {"type_proto", "google.golang.org/genproto/protobuf/ptype"},
+	"google/protobuf/wrappers.proto":        {"wrappers_proto", "github.com/golang/protobuf/ptypes/wrappers"},
+}
+
+// ProtoIndex maps .proto files in the repository to information needed to
+// find the rules that build them. Keys are paths relative to the repository
+// root, which is how .proto files are imported. Files are also indexed by
+// the Go import paths named in their go_package options, so imports of
+// generated Go packages can be resolved.
+//
+// The index is built the first time an import is looked up, so runs that
+// don't resolve any imports don't pay for it.
+type ProtoIndex struct {
+	build      func(x *ProtoIndex)
+	files      map[string]ProtoIndexEntry
+	goPackages map[string]ProtoIndexEntry
+}
+
+// ProtoIndexEntry describes a .proto file in a ProtoIndex.
+type ProtoIndexEntry struct {
+	// Rel is the slash-separated path to the directory containing the file,
+	// relative to the repository root.
+	Rel string
+
+	// PackageName is the proto package declared in the file, or "".
+	PackageName string
+
+	// GoImportPath is the Go import path named by the go_package option, or "".
+	GoImportPath string
+
+	// DirImportPath is the Go import path of the directory containing the file.
+	DirImportPath string
+}
+
+// NewProtoIndex returns an empty index. build is called to add files to the
+// index before the first lookup. It may be nil.
+func NewProtoIndex(build func(x *ProtoIndex)) *ProtoIndex {
+	return &ProtoIndex{
+		build:      build,
+		files:      make(map[string]ProtoIndexEntry),
+		goPackages: make(map[string]ProtoIndexEntry),
+	}
+}
+
+// Add records the .proto file at the slash-separated path imp, relative to
+// the repository root. If the file has a go_package option, it's also
+// recorded under that import path, unless another file was recorded there
+// first.
+func (x *ProtoIndex) Add(imp string, e ProtoIndexEntry) {
+	x.files[imp] = e
+	if e.GoImportPath != "" {
+		if _, ok := x.goPackages[e.GoImportPath]; !ok {
+			x.goPackages[e.GoImportPath] = e
+		}
+	}
+}
+
+func (x *ProtoIndex) lookup(imp string) (ProtoIndexEntry, bool) {
+	x.ensureBuilt()
+	e, ok := x.files[imp]
+	return e, ok
+}
+
+// lookupGo returns a .proto file whose go_package option is the Go import
+// path imp.
+func (x *ProtoIndex) lookupGo(imp string) (ProtoIndexEntry, bool) {
+	x.ensureBuilt()
+	e, ok := x.goPackages[imp]
+	return e, ok
+}
+
+func (x *ProtoIndex) ensureBuilt() {
+	if x.build != nil {
+		build := x.build
+		x.build = nil
+		build(x)
+	}
+}
+
+// SetProtoIndex sets the index used to resolve imports in .proto files.
+// Resolvers returned by ForConfig share the index.
+func (r *Resolver) SetProtoIndex(x *ProtoIndex) {
+	r.protos = x
+}
+
+// ProtoRuleName returns the name that proto rules for .proto files in the
+// directory rel, declaring the proto package packageName, are based on. In
+// PackageProtoMode, this is the package name with dots replaced by
+// underscores. Otherwise, it's ProtoName(c, rel).
+func ProtoRuleName(c *config.Config, rel, packageName string) string {
+	if c.ProtoMode == config.PackageProtoMode && packageName != "" {
+		return strings.Replace(packageName, ".", "_", -1)
+	}
+	return ProtoName(c, rel)
+}
+
+// ResolveProto resolves an import statement in a .proto file to the label
+// of the proto_library that provides the imported file. Well-known types are
+// provided by @com_google_protobuf. Other files must be in the repository.
+func (r *Resolver) ResolveProto(imp string) (Label, error) {
+	if wkt, ok := wktProtos[imp]; ok {
+		return Label{Repo: protobufRepoName, Name: wkt.name}, nil
+	}
+	e, err := r.lookupProto(imp)
+	if err != nil {
+		return Label{}, err
+	}
+	return r.l.ProtoLabel(e.Rel, ProtoRuleName(r.c, e.Rel, e.PackageName)), nil
+}
+
+// ResolveGoProto resolves an import statement in a .proto file to the label
+// of the Go library generated from the imported file, for the deps of a
+// go_proto_library. pkgRel is the directory containing the importing file.
+//
+// For a file in the repository, this is the go_library in its directory,
+// which embeds the go_proto_library, unless the go_package option gives the
+// file a different import path. Well-known types are resolved like imports
+// of their Go packages.
+func (r *Resolver) ResolveGoProto(imp, pkgRel string) (Label, error) {
+	if wkt, ok := wktProtos[imp]; ok {
+		return r.ResolveGo(wkt.goImportPath, pkgRel)
+	}
+	e, err := r.lookupProto(imp)
+	if err != nil {
+		return Label{}, err
+	}
+	return r.goProtoLabel(e), nil
+}
+
+// goProtoLabel returns the label of the Go library generated from the
+// .proto file described by e. This is the go_library in the file's
+// directory, which embeds the go_proto_library, unless the go_package
+// option gives the file a different import path. In that case, it's the
+// go_proto_library itself.
+func (r *Resolver) goProtoLabel(e ProtoIndexEntry) Label {
+	if e.GoImportPath == "" || e.GoImportPath == e.DirImportPath {
+		return r.l.LibraryLabel(e.Rel)
+	}
+	return r.l.GoProtoLabel(e.Rel, ProtoRuleName(r.c, e.Rel, e.PackageName))
+}
+
+func (r *Resolver) lookupProto(imp string) (ProtoIndexEntry, error) {
+	if r.protos != nil {
+		if e, ok := r.protos.lookup(imp); ok {
+			return e, nil
+		}
+	}
+	return ProtoIndexEntry{}, fmt.Errorf("proto import %q was not found in the repository", imp)
+}
@@ -0,0 +1,160 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+)
+
+func TestResolveProto(t *testing.T) {
+	built := 0
+	x := NewProtoIndex(func(x *ProtoIndex) {
+		built++
+		x.Add("foo/foo.proto", ProtoIndexEntry{
+			Rel:           "foo",
+			PackageName:   "example.foo",
+			DirImportPath: "example.com/repo/foo",
+		})
+		x.Add("bar/bar.proto", ProtoIndexEntry{
+			Rel:           "bar",
+			PackageName:   "example.bar",
+			GoImportPath:  "example.com/repo/barpb",
+			DirImportPath: "example.com/repo/bar",
+		})
+	})
+
+	for _, tc := range []struct {
+		desc, imp         string
+		mode              config.ProtoMode
+		wantProto, wantGo string
+		wantErr           bool
+	}{
+		{
+			desc:      "local",
+			imp:       "foo/foo.proto",
+			wantProto: "//foo:foo_proto",
+			wantGo:    "//foo:go_default_library",
+		}, {
+			desc:      "local package mode",
+			imp:       "foo/foo.proto",
+			mode:      config.PackageProtoMode,
+			wantProto: "//foo:example_foo_proto",
+			wantGo:    "//foo:go_default_library",
+		}, {
+			desc:      "go_package elsewhere",
+			imp:       "bar/bar.proto",
+			wantProto: "//bar:bar_proto",
+			wantGo:    "//bar:bar_go_proto",
+		}, {
+			desc:      "well known",
+			imp:       "google/protobuf/any.proto",
+			wantProto: "@com_google_protobuf//:any_proto",
+			wantGo:    "@io_bazel_rules_go//proto/wkt:any_go_proto",
+		}, {
+			desc:    "missing",
+			imp:     "baz/baz.proto",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := &config.Config{
+				GoPrefix:              "example.com/repo",
+				ProtoMode:             tc.mode,
+				ResolveWellKnownTypes: true,
+			}
+			l := NewLabeler(c)
+			r := NewResolver(c, l)
+			r.SetProtoIndex(x)
+
+			proto, err := r.ResolveProto(tc.imp)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("ResolveProto(%q) succeeded; want error", tc.imp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := proto.String(); got != tc.wantProto {
+				t.Errorf("ResolveProto(%q) = %q; want %q", tc.imp, got, tc.wantProto)
+			}
+			goLabel, err := r.ResolveGoProto(tc.imp, "baz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := goLabel.String(); got != tc.wantGo {
+				t.Errorf("ResolveGoProto(%q) = %q; want %q", tc.imp, got, tc.wantGo)
+			}
+		})
+	}
+	if built != 1 {
+		t.Errorf("index was built %d times; want 1", built)
+	}
+}
+
+func TestResolveGoPackageOption(t *testing.T) {
+	x := NewProtoIndex(func(x *ProtoIndex) {
+		x.Add("bar/bar.proto", ProtoIndexEntry{
+			Rel:           "bar",
+			PackageName:   "example.bar",
+			GoImportPath:  "example.com/repo/barpb",
+			DirImportPath: "example.com/repo/bar",
+		})
+		x.Add("gen/baz.proto", ProtoIndexEntry{
+			Rel:           "gen",
+			PackageName:   "example.baz",
+			GoImportPath:  "example.org/baz",
+			DirImportPath: "example.com/repo/gen",
+		})
+	})
+
+	for _, tc := range []struct {
+		desc, imp string
+		mode      config.ProtoMode
+		want      string
+	}{
+		{
+			desc: "go_package in repo",
+			imp:  "example.com/repo/barpb",
+			want: "//bar:bar_go_proto",
+		}, {
+			desc: "go_package outside prefix",
+			imp:  "example.org/baz",
+			want: "//gen:gen_go_proto",
+		}, {
+			desc: "proto rules disabled",
+			imp:  "example.com/repo/barpb",
+			mode: config.DisableProtoMode,
+			want: "//barpb:go_default_library",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := &config.Config{GoPrefix: "example.com/repo", ProtoMode: tc.mode}
+			r := NewResolver(c, NewLabeler(c))
+			r.SetProtoIndex(x)
+			l, err := r.ResolveGo(tc.imp, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l.String(); got != tc.want {
+				t.Errorf("ResolveGo(%q) = %q; want %q", tc.imp, got, tc.want)
+			}
+		})
+	}
+}
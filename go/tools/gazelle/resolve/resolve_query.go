@@ -0,0 +1,246 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+)
+
+// goLibraryQuery is the query run by QueryGoIndex. It matches go_library
+// and go_proto_library rules, including rules declared by macros.
+const goLibraryQuery = `kind("go_(proto_)?library", //...)`
+
+// GoIndex maps Go import paths to the labels of the rules that provide
+// them, as reported by "bazel query". Unlike labels guessed from import
+// paths, these include rules declared by macros and rules whose import
+// paths don't match their directories.
+//
+// When a library embeds another rule with the same import path, like a
+// go_library embedding a go_proto_library, the import path is resolved to
+// the embedding library, since depending on both would link the package
+// twice. When other rules have the same import path, the one named in a
+// "# gazelle:prefer" directive is chosen. Without one, the least label is
+// chosen, and a warning listing the candidates is logged.
+//
+// Like ProtoIndex, the index is built the first time an import is looked
+// up, so Bazel is only run if it's needed.
+type GoIndex struct {
+	build  func(x *GoIndex)
+	labels map[string][]Label
+
+	// reported records ambiguous import paths that have been warned about,
+	// so each is only reported once.
+	reported map[string]bool
+}
+
+// NewGoIndex returns an empty index. build is called to add rules to the
+// index before the first lookup. It may be nil.
+func NewGoIndex(build func(x *GoIndex)) *GoIndex {
+	return &GoIndex{
+		build:    build,
+		labels:   make(map[string][]Label),
+		reported: make(map[string]bool),
+	}
+}
+
+// Add records that the rule with label l provides the import path imp.
+// Several rules may provide the same import path.
+func (x *GoIndex) Add(imp string, l Label) {
+	for _, other := range x.labels[imp] {
+		if other == l {
+			return
+		}
+	}
+	x.labels[imp] = append(x.labels[imp], l)
+}
+
+// lookup returns the label of the rule providing imp. If several rules
+// provide it, and exactly one of them is in preferred, that one is
+// returned. Otherwise, the least label of the candidates is returned, so the
+// choice doesn't depend on the order rules were added.
+func (x *GoIndex) lookup(imp string, preferred []string) (Label, bool) {
+	if x.build != nil {
+		build := x.build
+		x.build = nil
+		build(x)
+	}
+	candidates := x.labels[imp]
+	switch len(candidates) {
+	case 0:
+		return Label{}, false
+	case 1:
+		return candidates[0], true
+	}
+
+	var chosen []Label
+	for _, l := range candidates {
+		if isPreferred(l, preferred) {
+			chosen = append(chosen, l)
+		}
+	}
+	if len(chosen) == 1 {
+		return chosen[0], true
+	}
+	if len(chosen) == 0 {
+		chosen = candidates
+	}
+	best := chosen[0]
+	for _, l := range chosen[1:] {
+		if l.FullString() < best.FullString() {
+			best = l
+		}
+	}
+	if !x.reported[imp] {
+		x.reported[imp] = true
+		strs := make([]string, len(candidates))
+		for i, l := range candidates {
+			strs[i] = l.FullString()
+		}
+		sort.Strings(strs)
+		logging.Warningf("import path %q is provided by more than one rule: %s; using %s. Add a \"# gazelle:prefer label\" directive to choose one.", imp, strings.Join(strs, ", "), best.FullString())
+	}
+	return best, true
+}
+
+// isPreferred returns whether l is one of the labels in preferred, which
+// were set with "# gazelle:prefer" directives. Labels that can't be parsed
+// never match.
+func isPreferred(l Label, preferred []string) bool {
+	for _, s := range preferred {
+		if p, err := ParseLabel(s); err == nil && p == l {
+			return true
+		}
+	}
+	return false
+}
+
+// SetGoIndex sets the index consulted to resolve Go imports before labels
+// are guessed from import paths. Resolvers returned by ForConfig share the
+// index.
+func (r *Resolver) SetGoIndex(x *GoIndex) {
+	r.goIndex = x
+}
+
+// QueryGoIndex returns an index of the go_library and go_proto_library
+// rules in the repository. If c.BazelQueryFile is set, the index is read
+// from that file, which should contain the output of
+// "bazel query --output=xml" for a query like goLibraryQuery. Otherwise,
+// bazel is run in c.RepoRoot. If the query fails, a warning is logged, and
+// the index is empty, so imports are resolved as if there were no index.
+func QueryGoIndex(c *config.Config) *GoIndex {
+	return NewGoIndex(func(x *GoIndex) {
+		var data []byte
+		var err error
+		if c.BazelQueryFile != "" {
+			data, err = ioutil.ReadFile(c.BazelQueryFile)
+		} else {
+			cmd := exec.Command("bazel", "query", "--output=xml", goLibraryQuery)
+			cmd.Dir = c.RepoRoot
+			data, err = cmd.Output()
+			if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+				logging.Warningf("bazel query: %s", bytes.TrimSpace(ee.Stderr))
+			}
+		}
+		if err == nil {
+			err = x.AddQueryXML(data)
+		}
+		if err != nil {
+			logging.Warningf("could not index Go rules with bazel query; import paths will be resolved without it: %v", err)
+		}
+	})
+}
+
+// queryXML is the part of the output of "bazel query --output=xml" that
+// GoIndex needs.
+type queryXML struct {
+	Rules []struct {
+		Name    string `xml:"name,attr"`
+		Strings []struct {
+			Name  string `xml:"name,attr"`
+			Value string `xml:"value,attr"`
+		} `xml:"string"`
+		Lists []struct {
+			Name   string `xml:"name,attr"`
+			Labels []struct {
+				Value string `xml:"value,attr"`
+			} `xml:"label"`
+		} `xml:"list"`
+	} `xml:"rule"`
+}
+
+// AddQueryXML adds the rules with an importpath attribute in data, the
+// output of "bazel query --output=xml", to the index. Rules embedded by
+// another rule with the same import path are left out, so the import path
+// resolves to the embedding rule.
+func (x *GoIndex) AddQueryXML(data []byte) error {
+	// Bazel declares XML 1.1, which encoding/xml rejects. The output doesn't
+	// use anything from 1.1.
+	data = bytes.Replace(data, []byte(`<?xml version="1.1"`), []byte(`<?xml version="1.0"`), 1)
+	var q queryXML
+	if err := xml.Unmarshal(data, &q); err != nil {
+		return err
+	}
+
+	type ruleInfo struct {
+		label      Label
+		importpath string
+	}
+	var rules []ruleInfo
+	embeddedBy := make(map[Label]string)
+	for _, r := range q.Rules {
+		var imp string
+		for _, s := range r.Strings {
+			if s.Name == "importpath" {
+				imp = s.Value
+			}
+		}
+		if imp == "" {
+			continue
+		}
+		l, err := ParseLabel(r.Name)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, ruleInfo{l, imp})
+		for _, list := range r.Lists {
+			if list.Name != "embed" {
+				continue
+			}
+			for _, e := range list.Labels {
+				el, err := ParseLabel(e.Value)
+				if err != nil {
+					return err
+				}
+				embeddedBy[el] = imp
+			}
+		}
+	}
+	for _, r := range rules {
+		if embeddedBy[r.label] == r.importpath {
+			continue
+		}
+		x.Add(r.importpath, r.label)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+)
+
+const queryOutput = `<?xml version="1.1" encoding="UTF-8" standalone="no"?>
+<query version="2">
+    <rule class="go_library" location="/repo/gen/BUILD.bazel:3:1" name="//gen:client">
+        <string name="name" value="client"/>
+        <string name="importpath" value="example.com/repo/api/client"/>
+        <list name="srcs">
+            <label value="//gen:client.go"/>
+        </list>
+    </rule>
+    <rule class="go_proto_library" location="/repo/api/BUILD.bazel:10:1" name="//api:api_go_proto">
+        <string name="name" value="api_go_proto"/>
+        <string name="importpath" value="example.com/repo/api"/>
+    </rule>
+    <rule class="go_library" location="/repo/api/BUILD.bazel:20:1" name="//api:go_default_library">
+        <string name="name" value="go_default_library"/>
+        <string name="importpath" value="example.com/repo/api"/>
+    </rule>
+    <rule class="go_proto_library" location="/repo/svc/BUILD.bazel:10:1" name="//svc:svc_go_proto">
+        <string name="name" value="svc_go_proto"/>
+        <string name="importpath" value="example.com/repo/svc"/>
+    </rule>
+    <rule class="go_library" location="/repo/svc/BUILD.bazel:20:1" name="//svc:go_default_library">
+        <string name="name" value="go_default_library"/>
+        <string name="importpath" value="example.com/repo/svc"/>
+        <list name="embed">
+            <label value="//svc:svc_go_proto"/>
+        </list>
+    </rule>
+    <rule class="go_library" location="/repo/old/BUILD.bazel:1:1" name="//old:go_default_library">
+        <string name="name" value="go_default_library"/>
+    </rule>
+</query>
+`
+
+func TestResolveGoIndex(t *testing.T) {
+	built := 0
+	x := NewGoIndex(func(x *GoIndex) {
+		built++
+		if err := x.AddQueryXML([]byte(queryOutput)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	c := &config.Config{GoPrefix: "example.com/repo"}
+	r := NewResolver(c, NewLabeler(c))
+	r.SetGoIndex(x)
+
+	for _, tc := range []struct {
+		desc, imp string
+		want      string
+	}{
+		{
+			desc: "macro",
+			imp:  "example.com/repo/api/client",
+			want: "//gen:client",
+		}, {
+			desc: "least label wins",
+			imp:  "example.com/repo/api",
+			want: "//api:api_go_proto",
+		}, {
+			desc: "embedding rule wins",
+			imp:  "example.com/repo/svc",
+			want: "//svc:go_default_library",
+		}, {
+			desc: "not in index",
+			imp:  "example.com/repo/old",
+			want: "//old:go_default_library",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			l, err := r.ResolveGo(tc.imp, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l.FullString(); got != tc.want {
+				t.Errorf("got %s; want %s", got, tc.want)
+			}
+		})
+	}
+	if built != 1 {
+		t.Errorf("index was built %d times; want 1", built)
+	}
+}
+
+func TestResolveGoIndexAmbiguous(t *testing.T) {
+	x := NewGoIndex(nil)
+	for _, l := range []Label{
+		{Pkg: "third_party/b", Name: "go_default_library"},
+		{Pkg: "third_party/a", Name: "go_default_library"},
+		{Pkg: "vendor/c", Name: "go_default_library"},
+	} {
+		x.Add("example.com/lib", l)
+	}
+	c := &config.Config{GoPrefix: "example.com/repo"}
+	r := NewResolver(c, NewLabeler(c))
+	r.SetGoIndex(x)
+
+	logging.Collect()
+	for i := 0; i < 2; i++ {
+		l, err := r.ResolveGo("example.com/lib", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := l.FullString(), "//third_party/a:go_default_library"; got != want {
+			t.Errorf("got %s; want %s", got, want)
+		}
+	}
+	ds := logging.Diagnostics()
+	if len(ds) != 1 {
+		t.Fatalf("got %d diagnostics; want 1: %v", len(ds), ds)
+	}
+	wantMsg := "//third_party/a:go_default_library, //third_party/b:go_default_library, //vendor/c:go_default_library; using //third_party/a:go_default_library"
+	if !strings.Contains(ds[0].Message, wantMsg) {
+		t.Errorf("got message %q; want it to contain %q", ds[0].Message, wantMsg)
+	}
+
+	pc := *c
+	pc.PreferredLabels = []string{"//vendor/c:go_default_library", "//unrelated:go_default_library"}
+	pr := r.ForConfig(&pc)
+	l, err := pr.ResolveGo("example.com/lib", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := l.FullString(), "//vendor/c:go_default_library"; got != want {
+		t.Errorf("with preferred label: got %s; want %s", got, want)
+	}
+}
+
+func TestQueryGoIndexFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "query.xml")
+	if err := ioutil.WriteFile(path, []byte(queryOutput), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &config.Config{GoPrefix: "example.com/repo", BazelQuery: true, BazelQueryFile: path}
+	x := QueryGoIndex(c)
+	if l, ok := x.lookup("example.com/repo/api/client", nil); !ok || l.FullString() != "//gen:client" {
+		t.Errorf("got %s, %v; want //gen:client", l, ok)
+	}
+}
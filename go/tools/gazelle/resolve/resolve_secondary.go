@@ -0,0 +1,70 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import "path"
+
+// SecondaryIndex records the secondary Go packages in the repository, that
+// is, packages in a directory other than the one named after it. Gazelle
+// gives a secondary package the import path of its directory with the
+// package name appended, so imports of it look like imports of a
+// subdirectory that doesn't exist.
+//
+// Like ProtoIndex, the index is built the first time an import is looked
+// up, so runs that don't resolve any imports don't pay for it.
+type SecondaryIndex struct {
+	build func(x *SecondaryIndex)
+
+	// packages maps the slash-separated path of each secondary package,
+	// relative to the repository root and ending with the package name, to
+	// the directory containing it.
+	packages map[string]string
+}
+
+// NewSecondaryIndex returns an empty index. build is called to add
+// packages to the index before the first lookup. It may be nil.
+func NewSecondaryIndex(build func(x *SecondaryIndex)) *SecondaryIndex {
+	return &SecondaryIndex{
+		build:    build,
+		packages: make(map[string]string),
+	}
+}
+
+// Add records a secondary package named name in the directory rel.
+func (x *SecondaryIndex) Add(rel, name string) {
+	x.packages[path.Join(rel, name)] = rel
+}
+
+// lookup returns the directory and name of the secondary package whose
+// import path corresponds to rel.
+func (x *SecondaryIndex) lookup(rel string) (dirRel, name string, ok bool) {
+	if x.build != nil {
+		build := x.build
+		x.build = nil
+		build(x)
+	}
+	dirRel, ok = x.packages[rel]
+	if !ok {
+		return "", "", false
+	}
+	return dirRel, path.Base(rel), true
+}
+
+// SetSecondaryIndex sets the index used to resolve imports of secondary
+// packages. Resolvers returned by ForConfig share the index.
+func (r *Resolver) SetSecondaryIndex(x *SecondaryIndex) {
+	r.secondary = x
+}
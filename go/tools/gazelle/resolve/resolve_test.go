@@ -58,6 +58,35 @@ func TestLabelString(t *testing.T) {
 	}
 }
 
+func TestParseLabel(t *testing.T) {
+	for _, spec := range []struct {
+		s    string
+		want Label
+	}{
+		{s: "//:foo", want: Label{Name: "foo"}},
+		{s: "//foo/bar:baz", want: Label{Pkg: "foo/bar", Name: "baz"}},
+		{s: "//foo/bar", want: Label{Pkg: "foo/bar", Name: "bar"}},
+		{s: "@com_example_repo//foo/bar:baz", want: Label{Repo: "com_example_repo", Pkg: "foo/bar", Name: "baz"}},
+		{s: "@com_example_repo//:baz", want: Label{Repo: "com_example_repo", Name: "baz"}},
+		{s: ":foo", want: Label{Relative: true, Name: "foo"}},
+	} {
+		got, err := ParseLabel(spec.s)
+		if err != nil {
+			t.Errorf("ParseLabel(%q) failed with %v; want success", spec.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, spec.want) {
+			t.Errorf("ParseLabel(%q) = %#v; want %#v", spec.s, got, spec.want)
+		}
+	}
+
+	for _, s := range []string{"", "foo", "//", "//foo:", "@//foo", "@repo", "@repo:foo", "//foo:a:b", "///foo"} {
+		if l, err := ParseLabel(s); err == nil {
+			t.Errorf("ParseLabel(%q) = %#v; want error", s, l)
+		}
+	}
+}
+
 func TestResolveGoLocal(t *testing.T) {
 	for _, spec := range []struct {
 		mode       config.StructureMode
@@ -103,6 +132,54 @@ func TestResolveGoLocal(t *testing.T) {
 	}
 }
 
+func TestResolveGoSecondary(t *testing.T) {
+	c := &config.Config{GoPrefix: "example.com/repo"}
+	l := NewLabeler(c)
+	r := NewResolver(c, l)
+	r.SetSecondaryIndex(NewSecondaryIndex(func(x *SecondaryIndex) {
+		x.Add("a", "b")
+		x.Add("", "b")
+	}))
+	for _, spec := range []struct {
+		importpath, pkgRel string
+		want               Label
+	}{
+		{
+			importpath: "example.com/repo/a",
+			want:       Label{Pkg: "a", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/repo/a/sub",
+			want:       Label{Pkg: "a/sub", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/repo/a/b",
+			want:       Label{Pkg: "a", Name: "go_b_library"},
+		}, {
+			importpath: "example.com/repo/b",
+			want:       Label{Name: "go_b_library"},
+		}, {
+			importpath: "./b",
+			pkgRel:     "a",
+			want:       Label{Pkg: "a", Name: "go_b_library"},
+		}, {
+			importpath: "example.com/repo/x/y",
+			want:       Label{Pkg: "x/y", Name: config.DefaultLibName},
+		}, {
+			// Packages that weren't indexed, like typos, aren't secondary.
+			importpath: "example.com/repo/a/c",
+			want:       Label{Pkg: "a/c", Name: config.DefaultLibName},
+		},
+	} {
+		label, err := r.ResolveGo(spec.importpath, spec.pkgRel)
+		if err != nil {
+			t.Errorf("r.ResolveGo(%q) failed with %v; want success", spec.importpath, err)
+			continue
+		}
+		if got, want := label, spec.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("r.ResolveGo(%q) = %s; want %s", spec.importpath, got, want)
+		}
+	}
+}
+
 func TestResolveGoLocalError(t *testing.T) {
 	c := &config.Config{GoPrefix: "example.com/repo"}
 	l := NewLabeler(c)
@@ -122,3 +199,222 @@ func TestResolveGoLocalError(t *testing.T) {
 		t.Errorf("r.ResolveGo(%q) = %s; want error", "..", l)
 	}
 }
+
+func TestResolveGoPrefixDirective(t *testing.T) {
+	root := &config.Config{GoPrefix: "example.com/repo"}
+	l := NewLabeler(root)
+	r := NewResolver(root, l)
+	sub := *root
+	sub.GoPrefix = "example.com/team-a"
+	sub.GoPrefixRel = "a"
+	subR := r.ForConfig(&sub)
+
+	for _, spec := range []struct {
+		importpath, pkgRel string
+		want               Label
+	}{
+		{
+			importpath: "example.com/team-a",
+			want:       Label{Pkg: "a", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/team-a/lib",
+			want:       Label{Pkg: "a/lib", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/repo/b",
+			want:       Label{Pkg: "b", Name: config.DefaultLibName},
+		}, {
+			importpath: "./lib",
+			pkgRel:     "a",
+			want:       Label{Pkg: "a/lib", Name: config.DefaultLibName},
+		},
+	} {
+		label, err := subR.ResolveGo(spec.importpath, spec.pkgRel)
+		if err != nil {
+			t.Errorf("r.ResolveGo(%q) failed with %v; want success", spec.importpath, err)
+			continue
+		}
+		if got, want := label, spec.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("r.ResolveGo(%q) = %s; want %s", spec.importpath, got, want)
+		}
+	}
+
+	if l, err := r.ResolveGo("example.com/team-a/lib", ""); err == nil {
+		t.Errorf("r.ResolveGo(%q) = %s; want error", "example.com/team-a/lib", l)
+	}
+}
+
+func TestResolveGoOverride(t *testing.T) {
+	c := &config.Config{
+		GoPrefix: "example.com/repo",
+		DepMode:  config.VendorMode,
+		GoResolveOverrides: map[string]string{
+			"github.com/foo/bar":    "//third_party/bar:go_default_library",
+			"example.com/repo/lib":  "@com_example_lib//:go_default_library",
+			"example.com/relative":  ":foo",
+			"example.com/malformed": "foo",
+		},
+	}
+	l := NewLabeler(c)
+	r := NewResolver(c, l)
+
+	for _, spec := range []struct {
+		importpath string
+		want       Label
+	}{
+		{
+			importpath: "github.com/foo/bar",
+			want:       Label{Pkg: "third_party/bar", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/repo/lib",
+			want:       Label{Repo: "com_example_lib", Name: config.DefaultLibName},
+		}, {
+			importpath: "github.com/foo/bar/baz",
+			want:       Label{Pkg: "vendor/github.com/foo/bar/baz", Name: config.DefaultLibName},
+		},
+	} {
+		label, err := r.ResolveGo(spec.importpath, "")
+		if err != nil {
+			t.Errorf("r.ResolveGo(%q) failed with %v; want success", spec.importpath, err)
+			continue
+		}
+		if got, want := label, spec.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("r.ResolveGo(%q) = %s; want %s", spec.importpath, got, want)
+		}
+	}
+
+	for _, imp := range []string{"example.com/relative", "example.com/malformed"} {
+		if l, err := r.ResolveGo(imp, ""); err == nil {
+			t.Errorf("r.ResolveGo(%q) = %s; want error", imp, l)
+		}
+	}
+}
+
+func TestResolveGoRepoOverride(t *testing.T) {
+	c := &config.Config{
+		GoPrefix: "example.com/repo",
+		DepMode:  config.ExternalMode,
+		Offline:  true,
+		RepoOverrides: map[string]string{
+			"example.com/dep":        "@dep",
+			"example.com/dep/nested": "//third_party/nested",
+			"example.com/other":      "@other//",
+		},
+		GoResolveOverrides: map[string]string{
+			"example.com/dep/pinned": "//pinned:go_default_library",
+		},
+	}
+	l := NewLabeler(c)
+	r := NewResolver(c, l)
+
+	for _, spec := range []struct {
+		importpath string
+		want       Label
+	}{
+		{
+			importpath: "example.com/dep",
+			want:       Label{Repo: "dep", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/dep/a/b",
+			want:       Label{Repo: "dep", Pkg: "a/b", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/dep/nested/c",
+			want:       Label{Pkg: "third_party/nested/c", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/other/d",
+			want:       Label{Repo: "other", Pkg: "d", Name: config.DefaultLibName},
+		}, {
+			importpath: "example.com/dep/pinned",
+			want:       Label{Pkg: "pinned", Name: config.DefaultLibName},
+		},
+	} {
+		label, err := r.ResolveGo(spec.importpath, "")
+		if err != nil {
+			t.Errorf("r.ResolveGo(%q) failed with %v; want success", spec.importpath, err)
+			continue
+		}
+		if got, want := label, spec.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("r.ResolveGo(%q) = %s; want %s", spec.importpath, got, want)
+		}
+	}
+
+	if l, err := r.ResolveGo("example.com/depot", ""); err == nil {
+		t.Errorf("r.ResolveGo(%q) = %s; want error, since the prefix doesn't match", "example.com/depot", l)
+	}
+}
+
+func TestResolveGoStandard(t *testing.T) {
+	for _, mode := range []config.DependencyMode{config.ExternalMode, config.VendorMode} {
+		c := &config.Config{GoPrefix: "example.com/repo", DepMode: mode}
+		l := NewLabeler(c)
+		r := NewResolver(c, l)
+		for _, imp := range []string{"fmt", "net/http", "context", "log/slog"} {
+			if l, err := r.ResolveGo(imp, ""); err == nil {
+				t.Errorf("in mode %v, r.ResolveGo(%q) = %s; want error", mode, imp, l)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		imp  string
+		want bool
+	}{
+		{"fmt", true},
+		{"encoding/json", true},
+		{"embed", true},
+		{"syscall/js", true},
+		{"internal/syscall/windows", true},
+		{"foo/bar", false},
+		{"github.com/foo/bar", false},
+		{"vendor/golang.org/x/net/http2/hpack", false},
+	} {
+		if got := IsStandard(tc.imp); got != tc.want {
+			t.Errorf("IsStandard(%q) = %v; want %v", tc.imp, got, tc.want)
+		}
+	}
+}
+
+func TestResolveGoWellKnownTypes(t *testing.T) {
+	for _, spec := range []struct {
+		desc, importpath string
+		wkt              bool
+		want             Label
+	}{
+		{
+			desc:       "wkt",
+			importpath: "github.com/golang/protobuf/ptypes/any",
+			wkt:        true,
+			want:       Label{Repo: config.RulesGoRepoName, Pkg: "proto/wkt", Name: "any_go_proto"},
+		}, {
+			desc:       "descriptor",
+			importpath: "github.com/golang/protobuf/protoc-gen-go/descriptor",
+			wkt:        true,
+			want:       Label{Repo: config.RulesGoRepoName, Pkg: "proto/wkt", Name: "descriptor_go_proto"},
+		}, {
+			desc:       "ptypes not wkt",
+			importpath: "github.com/golang/protobuf/ptypes",
+			wkt:        true,
+			want:       Label{Pkg: "vendor/github.com/golang/protobuf/ptypes", Name: config.DefaultLibName},
+		}, {
+			desc:       "disabled",
+			importpath: "github.com/golang/protobuf/ptypes/any",
+			want:       Label{Pkg: "vendor/github.com/golang/protobuf/ptypes/any", Name: config.DefaultLibName},
+		},
+	} {
+		t.Run(spec.desc, func(t *testing.T) {
+			c := &config.Config{
+				GoPrefix:              "example.com/repo",
+				DepMode:               config.VendorMode,
+				ResolveWellKnownTypes: spec.wkt,
+			}
+			l := NewLabeler(c)
+			r := NewResolver(c, l)
+			label, err := r.ResolveGo(spec.importpath, "")
+			if err != nil {
+				t.Fatalf("r.ResolveGo(%q) failed with %v; want success", spec.importpath, err)
+			}
+			if got, want := label, spec.want; !reflect.DeepEqual(got, want) {
+				t.Errorf("r.ResolveGo(%q) = %s; want %s", spec.importpath, got, want)
+			}
+		})
+	}
+}
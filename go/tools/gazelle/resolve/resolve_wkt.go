@@ -0,0 +1,34 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+// wktPkg is the package in the rules_go repository that contains targets for
+// well-known protobuf types.
+const wktPkg = "proto/wkt"
+
+// wktGoPackages maps import paths of Go packages for well-known protobuf
+// types to the names of targets in wktPkg. This must be kept in sync with
+// //proto/wkt:BUILD.bazel.
+var wktGoPackages = map[string]string{
+	"github.com/golang/protobuf/protoc-gen-go/descriptor": "descriptor_go_proto",
+	"github.com/golang/protobuf/protoc-gen-go/plugin":     "compiler_plugin_go_proto",
+	"github.com/golang/protobuf/ptypes/any":               "any_go_proto",
+	"github.com/golang/protobuf/ptypes/duration":          "duration_go_proto",
+	"github.com/golang/protobuf/ptypes/empty":             "empty_go_proto",
+	"github.com/golang/protobuf/ptypes/struct":            "struct_go_proto",
+	"github.com/golang/protobuf/ptypes/timestamp":         "timestamp_go_proto",
+	"github.com/golang/protobuf/ptypes/wrappers":          "wrappers_go_proto",
+}
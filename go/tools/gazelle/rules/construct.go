@@ -36,6 +36,20 @@ type globvalue struct {
 	excludes []string
 }
 
+// dictvalue is a dict with string keys and values, like x_defs. Entries
+// are written sorted by key.
+type dictvalue struct {
+	entries map[string]string
+}
+
+// annotatedvalue is a value whose strings get trailing comments, like deps
+// annotated with the import paths they were resolved from. Strings without
+// an entry in comments are written as usual.
+type annotatedvalue struct {
+	value    interface{}
+	comments map[string]string
+}
+
 func emptyRule(kind, name string) *bf.CallExpr {
 	return newRule(kind, []keyvalue{{"name", name}})
 }
@@ -127,6 +141,26 @@ func newValue(val interface{}) bf.Expr {
 				List: globArgs,
 			}
 
+		case dictvalue:
+			keys := make([]string, 0, len(val.entries))
+			for k := range val.entries {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			args := make([]bf.Expr, len(keys))
+			for i, k := range keys {
+				args[i] = &bf.KeyValueExpr{
+					Key:   &bf.StringExpr{Value: k},
+					Value: &bf.StringExpr{Value: val.entries[k]},
+				}
+			}
+			return &bf.DictExpr{List: args, ForceMultiLine: true}
+
+		case annotatedvalue:
+			expr := newValue(val.value)
+			annotate(expr, val.comments)
+			return expr
+
 		case packages.PlatformStrings:
 			gen := newValue(val.Generic)
 			if len(val.Platform) == 0 {
@@ -149,6 +183,38 @@ func newValue(val interface{}) bf.Expr {
 	return nil
 }
 
+// annotate adds a suffix comment to each string in lists in expr that has
+// an entry in comments. Annotated lists are written on multiple lines so
+// each comment stays next to its string.
+func annotate(expr bf.Expr, comments map[string]string) {
+	switch expr := expr.(type) {
+	case *bf.ListExpr:
+		for _, e := range expr.List {
+			s, ok := e.(*bf.StringExpr)
+			if !ok {
+				continue
+			}
+			if c, ok := comments[s.Value]; ok {
+				s.Suffix = []bf.Comment{{Token: "# " + c}}
+				expr.ForceMultiLine = true
+			}
+		}
+	case *bf.BinaryExpr:
+		annotate(expr.X, comments)
+		annotate(expr.Y, comments)
+	case *bf.CallExpr:
+		for _, arg := range expr.List {
+			annotate(arg, comments)
+		}
+	case *bf.DictExpr:
+		for _, kv := range expr.List {
+			if kv, ok := kv.(*bf.KeyValueExpr); ok {
+				annotate(kv.Value, comments)
+			}
+		}
+	}
+}
+
 type byAttrName []keyvalue
 
 var _ sort.Interface = byAttrName{}
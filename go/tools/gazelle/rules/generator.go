@@ -23,17 +23,28 @@ import (
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/resolve"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/trace"
 )
 
 // NewGenerator returns a new instance of Generator.
 // "buildRel" is a slash-separated path to the directory containing the
 // build file being generated, relative to the repository root.
-// "oldFile" is the existing build file. May be nil.
+// "oldFile" is the existing build file. May be nil. If it has a package rule
+// with default_visibility, or if c.DefaultVisibility is set, generated rules
+// don't get visibility attributes.
 func NewGenerator(c *config.Config, r *resolve.Resolver, l resolve.Labeler, buildRel string, oldFile *bf.File) *Generator {
-	shouldSetVisibility := oldFile == nil || !hasDefaultVisibility(oldFile)
-	return &Generator{c: c, r: r, l: l, buildRel: buildRel, shouldSetVisibility: shouldSetVisibility}
+	shouldSetVisibility := len(c.DefaultVisibility) == 0 && (oldFile == nil || !hasDefaultVisibility(oldFile))
+	return &Generator{
+		c:                   c,
+		r:                   r.ForConfig(c),
+		l:                   l,
+		buildRel:            buildRel,
+		shouldSetVisibility: shouldSetVisibility,
+		depSources:          make(DepSources),
+	}
 }
 
 // Generator generates Bazel build rules for Go build targets.
@@ -43,22 +54,47 @@ type Generator struct {
 	l                   resolve.Labeler
 	buildRel            string
 	shouldSetVisibility bool
+	depSources          DepSources
+}
+
+// DepSources maps names of generated rules to labels in their deps to the
+// names of the source files that import the corresponding packages. It's
+// used to explain why dependencies were added.
+type DepSources map[string]map[string][]string
+
+// DepSources returns the source files responsible for each dependency of
+// the rules generated so far.
+func (g *Generator) DepSources() DepSources {
+	return g.depSources
 }
 
 // GenerateRules generates a list of rules for targets in "pkg". It also returns
-// a list of empty rules that may be deleted from an existing file.
+// a list of empty rules that may be deleted from an existing file. Rules of
+// kinds disabled in the configuration are left out of both lists.
 func (g *Generator) GenerateRules(pkg *packages.Package) (rules []bf.Expr, empty []bf.Expr) {
 	var rs []bf.Expr
 
-	library, r := g.generateLib(pkg)
+	embeds, protoRules := g.generateProto(pkg)
+	rs = append(rs, protoRules...)
+	sourceEmbeds, sourceRules := g.generateSources(pkg, "")
+	embeds = append(embeds, sourceEmbeds...)
+	rs = append(rs, sourceRules...)
+	library, r := g.generateLib(pkg, embeds)
+	rs = append(rs, r, g.generateBin(pkg, library))
+	if fg := g.filegroup(pkg); fg != nil {
+		rs = append(rs, fg)
+	}
 	rs = append(rs,
-		r,
-		g.generateBin(pkg, library),
-		g.filegroup(pkg),
 		g.generateTest(pkg, library, false),
 		g.generateTest(pkg, "", true))
+	for _, sec := range pkg.Secondary {
+		rs = append(rs, g.generateSecondary(sec)...)
+	}
 
 	for _, r := range rs {
+		if rule := (bf.Rule{Call: r.(*bf.CallExpr)}); !g.c.ShouldGenerate(rule.Kind()) {
+			continue
+		}
 		if isEmpty(r) {
 			empty = append(empty, r)
 		} else {
@@ -68,25 +104,292 @@ func (g *Generator) GenerateRules(pkg *packages.Package) (rules []bf.Expr, empty
 	return rules, empty
 }
 
+// GeneratePath returns a go_path rule called name that depends on libs,
+// the libraries in the directory of the build file being generated and its
+// subdirectories. It's generated for "# gazelle:go_path" directives.
+func (g *Generator) GeneratePath(name string, libs []resolve.Label) bf.Expr {
+	deps := make([]string, 0, len(libs))
+	for _, l := range libs {
+		deps = append(deps, g.labelString(l))
+	}
+	return newRule("go_path", []keyvalue{
+		{"name", name},
+		{"deps", deps},
+	})
+}
+
 func (g *Generator) generateBin(pkg *packages.Package, library string) bf.Expr {
-	name := g.l.BinaryLabel(pkg.Rel).Name
+	name := g.binaryName(pkg)
 	if !pkg.IsCommand() || pkg.Binary.Sources.IsEmpty() && library == "" {
 		return emptyRule("go_binary", name)
 	}
-	visibility := checkInternalVisibility(pkg.Rel, "//visibility:public")
+	visibility := g.checkInternalVisibility(pkg.Rel, "//visibility:public")
 	attrs := g.commonAttrs(pkg.Rel, name, visibility, pkg.Binary)
 	// TODO(jayconrod): don't add importpath if it can be inherited from library.
 	// This is blocked by bazelbuild/bazel#3575.
-	attrs = append(attrs, keyvalue{"importpath", pkg.ImportPath(g.c.GoPrefix)})
+	attrs = append(attrs, keyvalue{"importpath", pkg.ImportPath(g.c.GoPrefix, g.c.GoPrefixRel)})
 	if library != "" {
 		attrs = append(attrs, keyvalue{"library", ":" + library})
 	}
+	if len(g.c.XDefs) > 0 {
+		attrs = append(attrs, keyvalue{"x_defs", dictvalue{g.c.XDefs}})
+	}
+	attrs = g.gcOpts(attrs, library != "", true)
+	attrs = g.testOnly(attrs)
 	return newRule("go_binary", attrs)
 }
 
-func (g *Generator) generateLib(pkg *packages.Package) (string, *bf.CallExpr) {
+// binaryName returns the name of the go_binary rule for pkg, according to
+// the -binary_naming strategy. In flat mode, binaries are always named by
+// the labeler, since names must be unique within the repository.
+func (g *Generator) binaryName(pkg *packages.Package) string {
+	dirName := g.l.BinaryLabel(pkg.Rel).Name
+	if g.c.StructureMode == config.FlatMode {
+		return dirName
+	}
+	switch g.c.BinaryNaming {
+	case "", config.DirNameBinaryNaming:
+		return dirName
+	case config.ImportPathBinaryNaming:
+		return importPathBinaryName(pkg.ImportPath(g.c.GoPrefix, g.c.GoPrefixRel), dirName)
+	default:
+		r := strings.NewReplacer(
+			"{dirname}", dirName,
+			"{importpath}", importPathBinaryName(pkg.ImportPath(g.c.GoPrefix, g.c.GoPrefixRel), dirName))
+		return r.Replace(g.c.BinaryNaming)
+	}
+}
+
+// importPathBinaryName returns the name "go build" would give a binary built
+// from the package with the given import path: the last element of the path,
+// or the element before it if the last is a major version suffix like "v2".
+// fallback is returned if the import path is empty.
+func importPathBinaryName(importPath, fallback string) string {
+	base := path.Base(importPath)
+	if isMajorVersion(base) {
+		if dir := path.Dir(importPath); dir != "." {
+			base = path.Base(dir)
+		}
+	}
+	if base == "." || base == "/" || base == "" {
+		return fallback
+	}
+	return base
+}
+
+// isMajorVersion returns whether s is a major version suffix like "v2".
+// "v0" and "v1" are not considered major version suffixes.
+func isMajorVersion(s string) bool {
+	if len(s) < 2 || s[0] != 'v' || s[1] == '0' || s == "v1" {
+		return false
+	}
+	for _, r := range s[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *Generator) generateLib(pkg *packages.Package, embeds []string) (string, *bf.CallExpr) {
 	name := g.l.LibraryLabel(pkg.Rel).Name
-	if !pkg.Library.HasGo() {
+	if g.c.LibraryNaming == config.DirNameLibraryNaming && g.c.StructureMode == config.HierarchicalMode && pkg.IsCommand() {
+		// The go_binary is named after the directory, too.
+		name += "_lib"
+	}
+	return g.libraryRule(pkg, name, pkg.ImportPath(g.c.GoPrefix, g.c.GoPrefixRel), embeds)
+}
+
+// protoGroup is a set of .proto files in a package that are built by the
+// same proto_library and go_proto_library, or go_grpc_library if any of the
+// files define services. The import path is taken from the
+// first go_package option that names one, or from the package.
+type protoGroup struct {
+	name, importpath string
+	files, imports   []string
+	hasServices      bool
+}
+
+// generateProto generates a proto_library and a go_proto_library for each
+// group of .proto files in pkg. In DefaultProtoMode, all files are in one
+// group. In PackageProtoMode, files are grouped by proto package.
+//
+// It returns the names of the go_proto_library rules that the go_library
+// for pkg should embed: those with the same import path as the package. In
+// modes where proto rules aren't generated, no rules are returned, not even
+// empty ones, so existing proto rules are left alone.
+func (g *Generator) generateProto(pkg *packages.Package) ([]string, []bf.Expr) {
+	if !g.c.ProtoMode.ShouldGenerateRules() {
+		return nil, nil
+	}
+
+	importpath := pkg.ImportPath(g.c.GoPrefix, g.c.GoPrefixRel)
+	defaultName := resolve.ProtoName(g.c, pkg.Rel)
+	var groups []*protoGroup
+	groupByName := make(map[string]*protoGroup)
+	for _, f := range pkg.ProtoFiles {
+		name := resolve.ProtoRuleName(g.c, pkg.Rel, f.PackageName)
+		group, ok := groupByName[name]
+		if !ok {
+			group = &protoGroup{name: name}
+			groupByName[name] = group
+			groups = append(groups, group)
+		}
+		group.files = append(group.files, f.Name)
+		group.imports = append(group.imports, f.Imports...)
+		if group.importpath == "" {
+			group.importpath = f.GoImportPath
+		}
+		group.hasServices = group.hasServices || f.HasServices
+	}
+	for _, group := range groups {
+		if group.importpath == "" {
+			group.importpath = importpath
+		}
+	}
+
+	var embeds []string
+	var rs []bf.Expr
+	visibility := g.checkInternalVisibility(pkg.Rel, "//visibility:public")
+	for _, group := range groups {
+		protoName := g.l.ProtoLabel(pkg.Rel, group.name).Name
+		goProtoName := g.l.GoProtoLabel(pkg.Rel, group.name).Name
+		protoAttrs := []keyvalue{
+			{"name", protoName},
+			{"srcs", g.sources(packages.PlatformStrings{Generic: group.files}, pkg.Rel)},
+		}
+		goProtoAttrs := []keyvalue{
+			{"name", goProtoName},
+			{"proto", ":" + protoName},
+			{"importpath", group.importpath},
+		}
+		if g.shouldSetVisibility {
+			protoAttrs = append(protoAttrs, keyvalue{"visibility", []string{visibility}})
+			goProtoAttrs = append(goProtoAttrs, keyvalue{"visibility", []string{visibility}})
+		}
+		protoAttrs = g.defaultTags(protoAttrs)
+		goProtoAttrs = g.defaultTags(goProtoAttrs)
+		deps, goDeps := g.protoDependencies(pkg, group)
+		if len(deps) > 0 {
+			protoAttrs = append(protoAttrs, keyvalue{"deps", deps})
+		}
+		if len(goDeps) > 0 {
+			goProtoAttrs = append(goProtoAttrs, keyvalue{"deps", goDeps})
+		}
+		// Services are only generated by go_grpc_library. The rule of the
+		// other kind is emitted empty, so it's deleted if the group gained or
+		// lost services since the last run.
+		goProtoKind, otherKind := "go_proto_library", "go_grpc_library"
+		if group.hasServices {
+			goProtoKind, otherKind = otherKind, goProtoKind
+		}
+		rs = append(rs,
+			newRule("proto_library", protoAttrs),
+			newRule(goProtoKind, goProtoAttrs),
+			emptyRule(otherKind, goProtoName))
+		if group.importpath == importpath {
+			embeds = append(embeds, goProtoName)
+		}
+	}
+
+	// Rules named after the directory may be left over from another mode or
+	// from .proto files that were deleted.
+	if _, ok := groupByName[defaultName]; !ok {
+		rs = append(rs,
+			emptyRule("proto_library", g.l.ProtoLabel(pkg.Rel, defaultName).Name),
+			emptyRule("go_proto_library", g.l.GoProtoLabel(pkg.Rel, defaultName).Name),
+			emptyRule("go_grpc_library", g.l.GoProtoLabel(pkg.Rel, defaultName).Name))
+	}
+	return embeds, rs
+}
+
+// protoDependencies resolves the imports of the .proto files in group to
+// labels for the deps of its proto_library and go_proto_library. Imports of
+// files in the same group are skipped, as are imports that can't be
+// resolved, which are reported as errors.
+func (g *Generator) protoDependencies(pkg *packages.Package, group *protoGroup) (deps, goDeps []string) {
+	self := map[string]bool{
+		g.labelString(g.l.ProtoLabel(pkg.Rel, group.name)):   true,
+		g.labelString(g.l.GoProtoLabel(pkg.Rel, group.name)): true,
+		g.labelString(g.l.LibraryLabel(pkg.Rel)):             group.importpath == pkg.ImportPath(g.c.GoPrefix, g.c.GoPrefixRel),
+	}
+	seen := make(map[string]bool)
+	for _, imp := range group.imports {
+		label, err := g.r.ResolveProto(imp)
+		if err != nil {
+			logging.Errorf("in dir %q, could not resolve proto import %q: %v", pkg.Rel, imp, err)
+			trace.Count(trace.UnresolvedImports, 1)
+			continue
+		}
+		s := g.labelString(label)
+		if self[s] || seen[s] {
+			continue
+		}
+		seen[s] = true
+		deps = append(deps, s)
+
+		goLabel, err := g.r.ResolveGoProto(imp, pkg.Rel)
+		if err != nil {
+			logging.Errorf("in dir %q, could not resolve Go library for proto import %q: %v", pkg.Rel, imp, err)
+			trace.Count(trace.UnresolvedImports, 1)
+			continue
+		}
+		if s := g.labelString(goLabel); !self[s] && !seen[s] {
+			seen[s] = true
+			goDeps = append(goDeps, s)
+		}
+	}
+	return deps, goDeps
+}
+
+// generateSecondary generates a go_library and tests for sec, a secondary
+// package in the directory being processed. Its targets are named after the
+// package, and its import path is the directory's import path with the
+// package name appended. The resolver follows the same convention.
+func (g *Generator) generateSecondary(sec *packages.Package) []bf.Expr {
+	importpath := path.Join(sec.ImportPath(g.c.GoPrefix, g.c.GoPrefixRel), sec.Name)
+	embeds, rs := g.generateSources(sec, sec.Name+"_")
+	library, r := g.libraryRule(sec, g.l.SecondaryLibraryLabel(sec.Rel, sec.Name).Name, importpath, embeds)
+	return append(rs,
+		r,
+		g.testRule(sec, g.l.SecondaryTestLabel(sec.Rel, sec.Name, false).Name, importpath, library, false),
+		g.testRule(sec, g.l.SecondaryTestLabel(sec.Rel, sec.Name, true).Name, importpath+"_test", "", true))
+}
+
+// generateSources generates a go_source rule for each group of library
+// sources in pkg declared with "# gazelle:go_source". Rule names are the
+// group names with "prefix" prepended, adjusted by the labeler. Groups with
+// no files get empty rules, so rules left over from them are deleted.
+//
+// It returns the names of the non-empty rules, which the go_library for pkg
+// embeds, so binaries and tests built with the library get the sources, too.
+func (g *Generator) generateSources(pkg *packages.Package, prefix string) ([]string, []bf.Expr) {
+	var embeds []string
+	var rs []bf.Expr
+	for _, sg := range g.c.SourceGroups {
+		name := g.l.SourceLabel(pkg.Rel, prefix+sg.Name).Name
+		var target *packages.Target
+		for i := range pkg.SourceGroups {
+			if pkg.SourceGroups[i].Name == sg.Name {
+				target = &pkg.SourceGroups[i].Target
+				break
+			}
+		}
+		if target == nil || !target.HasGo() {
+			rs = append(rs, emptyRule("go_source", name))
+			continue
+		}
+		rs = append(rs, newRule("go_source", g.sourceAttrs(pkg.Rel, name, *target)))
+		embeds = append(embeds, name)
+	}
+	return embeds, rs
+}
+
+// libraryRule generates a go_library named "name" for the library sources
+// in pkg. "embeds" are the names of go_proto_library and go_source rules the
+// library embeds. It returns the name of the rule, or "" if the rule is empty.
+func (g *Generator) libraryRule(pkg *packages.Package, name, importpath string, embeds []string) (string, *bf.CallExpr) {
+	if !pkg.Library.HasGo() && len(embeds) == 0 {
 		return "", emptyRule("go_library", name)
 	}
 	var visibility string
@@ -94,11 +397,23 @@ func (g *Generator) generateLib(pkg *packages.Package) (string, *bf.CallExpr) {
 		// Libraries made for a go_binary should not be exposed to the public.
 		visibility = "//visibility:private"
 	} else {
-		visibility = checkInternalVisibility(pkg.Rel, "//visibility:public")
+		visibility = g.checkInternalVisibility(pkg.Rel, "//visibility:public")
 	}
 
 	attrs := g.commonAttrs(pkg.Rel, name, visibility, pkg.Library)
-	attrs = append(attrs, keyvalue{"importpath", pkg.ImportPath(g.c.GoPrefix)})
+	attrs = append(attrs, keyvalue{"importpath", importpath})
+	if len(embeds) > 0 {
+		embedLabels := make([]string, len(embeds))
+		for i, e := range embeds {
+			embedLabels[i] = ":" + e
+		}
+		attrs = append(attrs, keyvalue{"embed", embedLabels})
+	}
+	attrs = g.gcOpts(attrs, false, false)
+	attrs = g.testOnly(attrs)
+	if g.c.NoCoverage {
+		attrs = addTag(attrs, config.NoCoverageTag)
+	}
 
 	rule := newRule("go_library", attrs)
 	return name, rule
@@ -122,12 +437,29 @@ func hasDefaultVisibility(oldFile *bf.File) bool {
 }
 
 // checkInternalVisibility overrides the given visibility if the package is
-// internal.
-func checkInternalVisibility(rel, visibility string) string {
-	if i := strings.LastIndex(rel, "/internal/"); i >= 0 {
-		visibility = fmt.Sprintf("//%s:__subpackages__", rel[:i])
-	} else if strings.HasPrefix(rel, "internal/") {
-		visibility = "//:__subpackages__"
+// internal. As in Go, a package in or below a directory named "internal" is
+// only visible to packages in the tree rooted at that directory's parent.
+// This can be disabled with -internal_visibility=false.
+func (g *Generator) checkInternalVisibility(rel, visibility string) string {
+	if !g.c.InternalVisibility {
+		return visibility
+	}
+	components := strings.Split(rel, "/")
+	if g.c.StructureMode == config.FlatMode {
+		// All rules are in the root package, so the tree rooted at the
+		// parent of an internal directory can't be named. Rules in the same
+		// package are the closest match.
+		for _, c := range components {
+			if c == "internal" {
+				return "//visibility:private"
+			}
+		}
+		return visibility
+	}
+	for i := len(components) - 1; i >= 0; i-- {
+		if components[i] == "internal" {
+			return fmt.Sprintf("//%s:__subpackages__", path.Join(components[:i]...))
+		}
 	}
 	return visibility
 }
@@ -135,25 +467,48 @@ func checkInternalVisibility(rel, visibility string) string {
 // filegroup is a small hack for directories with pre-generated .pb.go files
 // and also source .proto files.  This creates a filegroup for the .proto in
 // addition to the usual go_library for the .pb.go files.
+//
+// The filegroup is generated in LegacyProtoMode, and in
+// LegacyFilegroupProtoMode, where it includes every .proto file alongside
+// the proto rules. When proto rules are generated in other modes, it's
+// always empty, so an old filegroup is deleted. In the disable modes, nil is
+// returned, and an existing filegroup is left alone.
 func (g *Generator) filegroup(pkg *packages.Package) bf.Expr {
 	name := config.DefaultProtosName
-	if !pkg.HasPbGo || len(pkg.Protos) == 0 {
-		return emptyRule("filegroup", name)
+	switch g.c.ProtoMode {
+	case config.DisableProtoMode, config.DisableGlobalProtoMode:
+		return nil
+	case config.LegacyProtoMode, config.LegacyFilegroupProtoMode:
+		if len(pkg.Protos) > 0 && (pkg.HasPbGo || g.c.ProtoMode == config.LegacyFilegroupProtoMode) {
+			attrs := []keyvalue{
+				{key: "name", value: name},
+				{key: "srcs", value: pkg.Protos},
+			}
+			if g.shouldSetVisibility {
+				attrs = append(attrs, keyvalue{key: "visibility", value: []string{"//visibility:public"}})
+			}
+			return newRule("filegroup", g.defaultTags(attrs))
+		}
 	}
-	return newRule("filegroup", []keyvalue{
-		{key: "name", value: config.DefaultProtosName},
-		{key: "srcs", value: pkg.Protos},
-		{key: "visibility", value: []string{"//visibility:public"}},
-	})
+	return emptyRule("filegroup", name)
 }
 
 func (g *Generator) generateTest(pkg *packages.Package, library string, isXTest bool) bf.Expr {
 	name := g.l.TestLabel(pkg.Rel, isXTest).Name
+	importpath := pkg.ImportPath(g.c.GoPrefix, g.c.GoPrefixRel)
+	if isXTest {
+		importpath += "_test"
+	}
+	return g.testRule(pkg, name, importpath, library, isXTest)
+}
+
+// testRule generates a go_test named "name" for the internal or external
+// test sources in pkg. "library" is the name of the library the internal
+// test is built with; it may be "".
+func (g *Generator) testRule(pkg *packages.Package, name, importpath, library string, isXTest bool) bf.Expr {
 	target := pkg.Test
-	importpath := pkg.ImportPath(g.c.GoPrefix)
 	if isXTest {
 		target = pkg.XTest
-		importpath += "_test"
 	}
 	if !target.HasGo() {
 		return emptyRule("go_test", name)
@@ -165,13 +520,24 @@ func (g *Generator) generateTest(pkg *packages.Package, library string, isXTest
 	if library != "" {
 		attrs = append(attrs, keyvalue{"library", ":" + library})
 	}
-	if pkg.HasTestdata {
+	if pkg.HasTestdata && g.c.GenerateTestdata {
 		glob := globvalue{patterns: []string{path.Join(g.buildPkgRel(pkg.Rel), "testdata/**")}}
 		attrs = append(attrs, keyvalue{"data", glob})
 	}
-	if g.c.StructureMode == config.FlatMode {
+	if g.c.TestRundir == config.TestRundirWorkspace {
+		attrs = append(attrs, keyvalue{"rundir", "."})
+	} else if g.c.StructureMode == config.FlatMode {
+		// go_test runs in the directory of the build file by default, which
+		// is the repository root in flat mode.
 		attrs = append(attrs, keyvalue{"rundir", pkg.Rel})
 	}
+	if g.c.TestSize != "" {
+		attrs = append(attrs, keyvalue{"size", g.c.TestSize})
+	}
+	if g.c.TestTimeout != "" {
+		attrs = append(attrs, keyvalue{"timeout", g.c.TestTimeout})
+	}
+	attrs = g.gcOpts(attrs, library != "", true)
 	return newRule("go_test", attrs)
 }
 
@@ -180,6 +546,7 @@ func (g *Generator) commonAttrs(pkgRel, name, visibility string, target packages
 	if !target.Sources.IsEmpty() {
 		attrs = append(attrs, keyvalue{"srcs", g.sources(target.Sources, pkgRel)})
 	}
+	g.checkEmbedSrcs(pkgRel, name, target)
 	if target.Cgo {
 		attrs = append(attrs, keyvalue{"cgo", true})
 	}
@@ -192,13 +559,94 @@ func (g *Generator) commonAttrs(pkgRel, name, visibility string, target packages
 	if g.shouldSetVisibility && visibility != "" {
 		attrs = append(attrs, keyvalue{"visibility", []string{visibility}})
 	}
-	if !target.Imports.IsEmpty() {
-		deps := g.dependencies(target.Imports, pkgRel)
-		attrs = append(attrs, keyvalue{"deps", deps})
+	attrs = g.depsAttr(attrs, pkgRel, name, target)
+	return g.defaultTags(attrs)
+}
+
+// sourceAttrs returns the attributes of a go_source rule for target. Only
+// attributes go_source declares are set, so unlike commonAttrs, there are no
+// cgo options; packages keeps cgo files out of source groups. Flags from
+// "# gazelle:gc_goopts" are set on the library that embeds the rule.
+func (g *Generator) sourceAttrs(pkgRel, name string, target packages.Target) []keyvalue {
+	g.checkEmbedSrcs(pkgRel, name, target)
+	attrs := []keyvalue{
+		{"name", name},
+		{"srcs", g.sources(target.Sources, pkgRel)},
+	}
+	attrs = g.depsAttr(attrs, pkgRel, name, target)
+	return g.defaultTags(attrs)
+}
+
+// checkEmbedSrcs warns if target embeds files with //go:embed. The Go rules
+// don't have an embedsrcs attribute, and the compilers they support don't
+// understand //go:embed, so embedded files can't be listed. Stale embedsrcs
+// attributes are removed when merging.
+func (g *Generator) checkEmbedSrcs(pkgRel, name string, target packages.Target) {
+	if !target.EmbedSrcs.IsEmpty() {
+		logging.Warningf("in dir %q, %s embeds files with //go:embed, which the Go rules don't support; the files aren't added to the rule", pkgRel, name)
+	}
+}
+
+// depsAttr adds a deps attribute for the imports of target to attrs, if it
+// has any.
+func (g *Generator) depsAttr(attrs []keyvalue, pkgRel, name string, target packages.Target) []keyvalue {
+	if target.Imports.IsEmpty() {
+		return attrs
+	}
+	deps, imports := g.dependencies(name, target, pkgRel)
+	if g.c.AnnotateDeps {
+		return append(attrs, keyvalue{"deps", annotatedvalue{deps, imports}})
+	}
+	return append(attrs, keyvalue{"deps", deps})
+}
+
+// gcOpts adds the flags set with "# gazelle:gc_goopts" and
+// "# gazelle:gc_linkopts" directives to attrs. Compiler flags are left out
+// of rules that embed a library, since they're passed along with the
+// library's sources. Linker flags are only added to rules that link.
+func (g *Generator) gcOpts(attrs []keyvalue, hasLibrary, link bool) []keyvalue {
+	if !hasLibrary && len(g.c.GcGoopts) > 0 {
+		attrs = append(attrs, keyvalue{"gc_goopts", g.c.GcGoopts})
+	}
+	if link && len(g.c.GcLinkopts) > 0 {
+		attrs = append(attrs, keyvalue{"gc_linkopts", g.c.GcLinkopts})
 	}
 	return attrs
 }
 
+// testOnly adds testonly = True to attrs if it's set with
+// "# gazelle:testonly on". The merger never changes testonly in existing
+// rules.
+func (g *Generator) testOnly(attrs []keyvalue) []keyvalue {
+	if !g.c.TestOnly {
+		return attrs
+	}
+	return append(attrs, keyvalue{"testonly", true})
+}
+
+// addTag adds tag to the tags attribute in attrs, adding the attribute if
+// it's not there yet.
+func addTag(attrs []keyvalue, tag string) []keyvalue {
+	for i, kv := range attrs {
+		if kv.key == "tags" {
+			tags := append([]string(nil), kv.value.([]string)...)
+			attrs[i].value = append(tags, tag)
+			return attrs
+		}
+	}
+	return append(attrs, keyvalue{"tags", []string{tag}})
+}
+
+// defaultTags adds a tags attribute to attrs if default tags are set with
+// "# gazelle:default_tags". The merger adds these to existing tags rather
+// than replacing them.
+func (g *Generator) defaultTags(attrs []keyvalue) []keyvalue {
+	if len(g.c.DefaultTags) == 0 {
+		return attrs
+	}
+	return append(attrs, keyvalue{"tags", g.c.DefaultTags})
+}
+
 // sources converts paths in "srcs" which are relative to the Go package
 // directory ("pkgRel") into relative paths to the build file
 // being generated ("g.buildRel").
@@ -230,23 +678,48 @@ func (g *Generator) buildPkgRel(pkgRel string) string {
 	return rel
 }
 
-// dependencies converts import paths in "imports" into Bazel labels.
-func (g *Generator) dependencies(imports packages.PlatformStrings, pkgRel string) packages.PlatformStrings {
+// dependencies converts import paths imported by "target" into Bazel labels
+// for the deps of the rule "name". The files importing each label are
+// recorded in g.depSources. The import paths each label was resolved from
+// are also returned, joined with commas, for annotating deps.
+func (g *Generator) dependencies(name string, target packages.Target, pkgRel string) (packages.PlatformStrings, map[string]string) {
+	sources := make(map[string][]string)
+	g.depSources[name] = sources
+	importPaths := make(map[string][]string)
 	resolve := func(imp string) (string, error) {
 		label, err := g.r.ResolveGo(imp, pkgRel)
 		if err != nil {
 			return "", fmt.Errorf("in dir %q, could not resolve import path %q: %v", pkgRel, imp, err)
 		}
-		label.Relative = label.Repo == "" && label.Pkg == g.buildRel
-		return label.String(), nil
+		s := g.labelString(label)
+		// Several import paths may resolve to the same label.
+		files := append(sources[s], target.ImportedBy[imp]...)
+		sources[s] = uniqStable(files, make(map[string]bool))
+		importPaths[s] = uniqStable(append(importPaths[s], imp), make(map[string]bool))
+		return s, nil
 	}
 
-	deps, errors := imports.Map(resolve)
+	deps, errors := target.Imports.Map(resolve)
 	for _, err := range errors {
-		log.Print(err)
+		logging.Error(err)
 	}
+	trace.Count(trace.UnresolvedImports, len(errors))
 	deps.Clean()
-	return deps
+	imports := make(map[string]string)
+	for s, imps := range importPaths {
+		imports[s] = strings.Join(imps, ", ")
+	}
+	return deps, imports
+}
+
+// labelString formats label for an attribute of a rule in the build file
+// being generated. Labels are shortened unless -short_labels=false was given.
+func (g *Generator) labelString(label resolve.Label) string {
+	if !g.c.ShortLabels {
+		return label.FullString()
+	}
+	label.Relative = label.Repo == "" && label.Pkg == g.buildRel
+	return label.String()
 }
 
 var (
@@ -306,9 +779,49 @@ func (g *Generator) options(opts packages.PlatformStrings, pkgRel string) packag
 	if errs != nil {
 		log.Panicf("unexpected error when transforming options with pkg %q: %v", pkgRel, errs)
 	}
+	uniqOptions(&opts)
 	return opts
 }
 
+// uniqOptions removes duplicate option groups from the generic list and from
+// each platform-specific list, keeping the first occurrence. Platform-specific
+// groups that also appear in the generic list are removed, since they would
+// be passed to the compiler twice; platforms left with no options are
+// removed from the select. Unlike PlatformStrings.Clean, this does not sort,
+// since the order of flags may be significant.
+func uniqOptions(opts *packages.PlatformStrings) {
+	genSet := make(map[string]bool)
+	opts.Generic = uniqStable(opts.Generic, genSet)
+	for name, groups := range opts.Platform {
+		seen := make(map[string]bool)
+		for g := range genSet {
+			seen[g] = true
+		}
+		groups = uniqStable(groups, seen)
+		if len(groups) == 0 {
+			delete(opts.Platform, name)
+		} else {
+			opts.Platform[name] = groups
+		}
+	}
+	if len(opts.Platform) == 0 {
+		opts.Platform = nil
+	}
+}
+
+// uniqStable returns the strings in ss that are not in seen, in their
+// original order, without duplicates. Returned strings are added to seen.
+func uniqStable(ss []string, seen map[string]bool) []string {
+	var result []string
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
 func isEmpty(r bf.Expr) bool {
 	c, ok := r.(*bf.CallExpr)
 	return ok && len(c.List) == 1 // name
@@ -19,6 +19,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	bf "github.com/bazelbuild/buildtools/build"
@@ -37,6 +38,12 @@ func testConfig(repoRoot, goPrefix string) *config.Config {
 		GenericTags:         config.BuildTags{},
 		Platforms:           config.DefaultPlatformTags,
 		ValidBuildFileNames: []string{"BUILD.old"},
+		GenerateTestdata:    true,
+		ShortLabels:         true,
+		InternalVisibility:  true,
+		// testdata/repo/lib/relativeimporter has rules for a package with
+		// a relative import.
+		AllowRelativeImports: true,
 	}
 	c.PreprocessTags()
 	return c
@@ -86,7 +93,7 @@ func TestGenerator(t *testing.T) {
 		rs, _ := g.GenerateRules(pkg)
 		f := &bf.File{Stmt: rs}
 		rules.SortLabels(f)
-		f = merger.FixLoads(f)
+		f = merger.FixLoads(f, nil)
 		got := string(bf.Format(f))
 
 		wantPath := filepath.Join(pkg.Dir, "BUILD.want")
@@ -103,6 +110,291 @@ func TestGenerator(t *testing.T) {
 	}
 }
 
+func TestGeneratorTestdataDisabled(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.GenerateTestdata = false
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "", nil)
+	pkg := &packages.Package{
+		Name:        "foo",
+		Rel:         "foo",
+		Test:        packages.Target{Sources: packages.PlatformStrings{Generic: []string{"foo_test.go"}}},
+		HasTestdata: true,
+	}
+
+	rs, _ := g.GenerateRules(pkg)
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		if rule.Kind() == "go_test" && rule.Attr("data") != nil {
+			t.Errorf("got data attribute %s; want none", bf.FormatString(rule.Attr("data")))
+		}
+	}
+}
+
+func TestGeneratorInternalVisibility(t *testing.T) {
+	for _, tc := range []struct {
+		desc, rel, want string
+		disabled, flat  bool
+	}{
+		{desc: "public", rel: "foo", want: "//visibility:public"},
+		{desc: "internal dir", rel: "foo/internal", want: "//foo:__subpackages__"},
+		{desc: "below internal", rel: "foo/internal/bar", want: "//foo:__subpackages__"},
+		{desc: "root internal", rel: "internal", want: "//:__subpackages__"},
+		{desc: "nested internal", rel: "a/internal/b/internal/c", want: "//a/internal/b:__subpackages__"},
+		{desc: "internal prefix", rel: "foo/internalize", want: "//visibility:public"},
+		{desc: "disabled", rel: "foo/internal", want: "//visibility:public", disabled: true},
+		{desc: "flat internal", rel: "foo/internal/bar", want: "//visibility:private", flat: true},
+		{desc: "flat public", rel: "foo", want: "//visibility:public", flat: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := testConfig("", "example.com/repo")
+			c.InternalVisibility = !tc.disabled
+			buildRel := tc.rel
+			if tc.flat {
+				c.StructureMode = config.FlatMode
+				buildRel = ""
+			}
+			l := resolve.NewLabeler(c)
+			r := resolve.NewResolver(c, l)
+			g := rules.NewGenerator(c, r, l, buildRel, nil)
+			pkg := &packages.Package{
+				Name:    "foo",
+				Rel:     tc.rel,
+				Library: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"foo.go"}}},
+			}
+
+			rs, _ := g.GenerateRules(pkg)
+			for _, r := range rs {
+				rule := bf.Rule{Call: r.(*bf.CallExpr)}
+				if rule.Kind() != "go_library" {
+					continue
+				}
+				vis, ok := rule.Attr("visibility").(*bf.ListExpr)
+				if !ok || len(vis.List) != 1 {
+					t.Fatalf("got visibility %s; want [%q]", bf.FormatString(rule.Attr("visibility")), tc.want)
+				}
+				if got := vis.List[0].(*bf.StringExpr).Value; got != tc.want {
+					t.Errorf("got visibility %q; want %q", got, tc.want)
+				}
+				return
+			}
+			t.Errorf("go_library not generated")
+		})
+	}
+}
+
+func TestGeneratorFlatNested(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.StructureMode = config.FlatMode
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "", nil)
+	pkg := &packages.Package{
+		Name: "deep",
+		Rel:  "b/deep",
+		Library: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"deep.go"}},
+			Imports: packages.PlatformStrings{Generic: []string{"example.com/repo/b", "example.com/repo"}},
+		},
+		Test: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"deep_test.go"}},
+		},
+	}
+
+	rs, _ := g.GenerateRules(pkg)
+	got := make(map[string]bf.Rule)
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		if !isEmptyRule(rule) {
+			got[rule.Kind()] = rule
+		}
+	}
+	lib, ok := got["go_library"]
+	if !ok {
+		t.Fatal("go_library not generated")
+	}
+	if name := lib.Name(); name != "b/deep" {
+		t.Errorf("got library name %q; want %q", name, "b/deep")
+	}
+	if srcs, want := listStrings(lib.Attr("srcs")), []string{"b/deep/deep.go"}; !reflect.DeepEqual(srcs, want) {
+		t.Errorf("got srcs %q; want %q", srcs, want)
+	}
+	if deps, want := listStrings(lib.Attr("deps")), []string{":b", ":repo"}; !reflect.DeepEqual(deps, want) {
+		t.Errorf("got deps %q; want %q", deps, want)
+	}
+	test, ok := got["go_test"]
+	if !ok {
+		t.Fatal("go_test not generated")
+	}
+	if name, lib := test.Name(), test.AttrString("library"); name != "b/deep_test" || lib != ":b/deep" {
+		t.Errorf("got test %q with library %q; want %q with library %q", name, lib, "b/deep_test", ":b/deep")
+	}
+}
+
+// listStrings returns the values of the strings in the list x, or nil if x
+// isn't a list.
+func listStrings(x bf.Expr) []string {
+	list, ok := x.(*bf.ListExpr)
+	if !ok {
+		return nil
+	}
+	var strs []string
+	for _, e := range list.List {
+		if s, ok := e.(*bf.StringExpr); ok {
+			strs = append(strs, s.Value)
+		}
+	}
+	return strs
+}
+
+// isEmptyRule returns whether r has no attributes other than name.
+func isEmptyRule(r bf.Rule) bool {
+	keys := r.AttrKeys()
+	return len(keys) == 1 && keys[0] == "name"
+}
+
+func TestGeneratorDefaultVisibility(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.ProtoMode = config.LegacyProtoMode
+	oldFile := &bf.File{Stmt: []bf.Expr{&bf.CallExpr{
+		X: &bf.LiteralExpr{Token: "package"},
+		List: []bf.Expr{&bf.BinaryExpr{
+			X:  &bf.LiteralExpr{Token: "default_visibility"},
+			Op: "=",
+			Y:  &bf.ListExpr{List: []bf.Expr{&bf.StringExpr{Value: "//foo:__subpackages__"}}},
+		}},
+	}}}
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "foo", oldFile)
+	pkg := &packages.Package{
+		Name:    "foo",
+		Rel:     "foo",
+		Library: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"foo.pb.go"}}},
+		Protos:  []string{"foo.proto"},
+		HasPbGo: true,
+	}
+
+	rs, _ := g.GenerateRules(pkg)
+	if len(rs) == 0 {
+		t.Fatal("no rules generated")
+	}
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		if rule.Attr("visibility") != nil {
+			t.Errorf("%s %q has visibility, but the package sets default_visibility", rule.Kind(), rule.Name())
+		}
+	}
+}
+
+func TestGeneratorDefaultVisibilityDirective(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.DefaultVisibility = []string{"//foo:__subpackages__"}
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "foo", nil)
+	pkg := &packages.Package{
+		Name:    "main",
+		Rel:     "foo",
+		Library: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"main.go"}}},
+	}
+
+	rs, _ := g.GenerateRules(pkg)
+	if len(rs) == 0 {
+		t.Fatal("no rules generated")
+	}
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		if rule.Attr("visibility") != nil {
+			t.Errorf("%s %q has visibility, but the default_visibility directive is set", rule.Kind(), rule.Name())
+		}
+	}
+}
+
+func TestGeneratorBinaryNaming(t *testing.T) {
+	for _, tc := range []struct {
+		desc, naming, rel, want string
+		flat                    bool
+	}{
+		{desc: "default", rel: "cmd/foo", want: "foo"},
+		{desc: "dirname", naming: "dirname", rel: "cmd/foo", want: "foo"},
+		{desc: "importpath", naming: "importpath", rel: "cmd/foo", want: "foo"},
+		{desc: "importpath major version", naming: "importpath", rel: "cmd/foo/v2", want: "foo"},
+		{desc: "dirname major version", naming: "dirname", rel: "cmd/foo/v2", want: "v2"},
+		{desc: "importpath vendor", naming: "importpath", rel: "vendor/example.com/bar", want: "bar"},
+		{desc: "importpath root", naming: "importpath", rel: "", want: "repo"},
+		{desc: "template", naming: "{dirname}_bin", rel: "cmd/foo/v2", want: "v2_bin"},
+		{desc: "template importpath", naming: "{importpath}_{dirname}", rel: "cmd/foo/v3", want: "foo_v3"},
+		{desc: "flat ignores naming", naming: "{dirname}_bin", rel: "cmd/foo", want: "cmd/foo_cmd", flat: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := testConfig("", "example.com/repo")
+			c.BinaryNaming = tc.naming
+			if tc.flat {
+				c.StructureMode = config.FlatMode
+			}
+			l := resolve.NewLabeler(c)
+			r := resolve.NewResolver(c, l)
+			g := rules.NewGenerator(c, r, l, tc.rel, nil)
+			pkg := &packages.Package{
+				Name:    "main",
+				Rel:     tc.rel,
+				Library: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"main.go"}}},
+			}
+
+			rs, _ := g.GenerateRules(pkg)
+			for _, r := range rs {
+				rule := bf.Rule{Call: r.(*bf.CallExpr)}
+				if rule.Kind() != "go_binary" {
+					continue
+				}
+				if got := rule.Name(); got != tc.want {
+					t.Errorf("got name %q; want %q", got, tc.want)
+				}
+				return
+			}
+			t.Errorf("go_binary not generated")
+		})
+	}
+}
+
+func TestGeneratorSecondary(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "a", nil)
+	pkg := &packages.Package{
+		Name:    "a",
+		Rel:     "a",
+		Library: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"a.go"}}},
+		Secondary: []*packages.Package{{
+			Name:    "b",
+			Rel:     "a",
+			Library: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"b.go"}}},
+			Test:    packages.Target{Sources: packages.PlatformStrings{Generic: []string{"b_test.go"}}},
+		}},
+	}
+
+	type ruleInfo struct {
+		kind, importpath, library string
+	}
+	want := map[string]ruleInfo{
+		"go_default_library": {"go_library", "example.com/repo/a", ""},
+		"go_b_library":       {"go_library", "example.com/repo/a/b", ""},
+		"go_b_test":          {"go_test", "example.com/repo/a/b", ":go_b_library"},
+	}
+	rs, _ := g.GenerateRules(pkg)
+	got := make(map[string]ruleInfo)
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		got[rule.Name()] = ruleInfo{rule.Kind(), rule.AttrString("importpath"), rule.AttrString("library")}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
 func TestGeneratorEmpty(t *testing.T) {
 	c := testConfig("", "example.com/repo")
 	l := resolve.NewLabeler(c)
@@ -116,7 +408,13 @@ func TestGeneratorEmpty(t *testing.T) {
 	}{
 		{
 			name: "nothing",
-			want: `go_library(name = "go_default_library")
+			want: `proto_library(name = "repo_proto")
+
+go_proto_library(name = "repo_go_proto")
+
+go_grpc_library(name = "repo_go_proto")
+
+go_library(name = "go_default_library")
 
 go_binary(name = "repo")
 
@@ -141,3 +439,607 @@ go_test(name = "go_default_xtest")
 		})
 	}
 }
+
+func TestGeneratorProtoMode(t *testing.T) {
+	pkg := &packages.Package{
+		Name:    "foo",
+		Rel:     "foo",
+		Library: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"foo.go", "foo.pb.go"}}},
+		Protos:  []string{"a.proto", "b.proto", "c.proto"},
+		ProtoFiles: []packages.ProtoFile{
+			{Name: "a.proto", PackageName: "example.foo", GoImportPath: "example.com/repo/foo"},
+			{Name: "b.proto", PackageName: "example.foo"},
+			{Name: "c.proto", PackageName: "example.bar", GoImportPath: "example.com/repo/foo/bar"},
+		},
+		HasPbGo: true,
+	}
+	for _, tc := range []struct {
+		desc  string
+		mode  config.ProtoMode
+		rules []string
+		embed []string
+	}{
+		{
+			desc:  "default",
+			mode:  config.DefaultProtoMode,
+			rules: []string{"proto_library foo_proto", "go_proto_library foo_go_proto", "go_library go_default_library"},
+			embed: []string{":foo_go_proto"},
+		}, {
+			desc: "package",
+			mode: config.PackageProtoMode,
+			rules: []string{
+				"proto_library example_foo_proto",
+				"go_proto_library example_foo_go_proto",
+				"proto_library example_bar_proto",
+				"go_proto_library example_bar_go_proto",
+				"go_library go_default_library",
+			},
+			embed: []string{":example_foo_go_proto"},
+		}, {
+			desc:  "disable_global",
+			mode:  config.DisableGlobalProtoMode,
+			rules: []string{"go_library go_default_library"},
+		}, {
+			desc:  "disable",
+			mode:  config.DisableProtoMode,
+			rules: []string{"go_library go_default_library"},
+		}, {
+			desc:  "legacy",
+			mode:  config.LegacyProtoMode,
+			rules: []string{"go_library go_default_library", "filegroup go_default_library_protos"},
+		}, {
+			desc: "legacy_filegroup",
+			mode: config.LegacyFilegroupProtoMode,
+			rules: []string{
+				"proto_library foo_proto",
+				"go_proto_library foo_go_proto",
+				"go_library go_default_library",
+				"filegroup go_default_library_protos",
+			},
+			embed: []string{":foo_go_proto"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := testConfig("", "example.com/repo")
+			c.ProtoMode = tc.mode
+			l := resolve.NewLabeler(c)
+			r := resolve.NewResolver(c, l)
+			g := rules.NewGenerator(c, r, l, "foo", nil)
+
+			rs, _ := g.GenerateRules(pkg)
+			var got []string
+			for _, r := range rs {
+				rule := bf.Rule{Call: r.(*bf.CallExpr)}
+				got = append(got, rule.Kind()+" "+rule.Name())
+				if rule.Kind() == "go_library" {
+					embed, _ := merger.ListStrings(rule.Attr("embed"))
+					if !reflect.DeepEqual(embed, tc.embed) {
+						t.Errorf("go_library embed: got %q; want %q", embed, tc.embed)
+					}
+				}
+				if rule.Kind() == "go_proto_library" && rule.Name() == "example_bar_go_proto" {
+					if got, want := rule.AttrString("importpath"), "example.com/repo/foo/bar"; got != want {
+						t.Errorf("%s importpath: got %q; want %q", rule.Name(), got, want)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tc.rules) {
+				t.Errorf("got rules %q; want %q", got, tc.rules)
+			}
+		})
+	}
+}
+
+func TestGeneratorProtoDeps(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.ResolveWellKnownTypes = true
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	r.SetProtoIndex(resolve.NewProtoIndex(func(x *resolve.ProtoIndex) {
+		x.Add("foo/a.proto", resolve.ProtoIndexEntry{Rel: "foo", DirImportPath: "example.com/repo/foo"})
+		x.Add("foo/b.proto", resolve.ProtoIndexEntry{Rel: "foo", DirImportPath: "example.com/repo/foo"})
+		x.Add("bar/bar.proto", resolve.ProtoIndexEntry{Rel: "bar", DirImportPath: "example.com/repo/bar"})
+	}))
+	g := rules.NewGenerator(c, r, l, "foo", nil)
+	pkg := &packages.Package{
+		Name:   "foo",
+		Rel:    "foo",
+		Protos: []string{"a.proto", "b.proto"},
+		ProtoFiles: []packages.ProtoFile{
+			{Name: "a.proto", Imports: []string{"bar/bar.proto", "foo/b.proto", "google/protobuf/any.proto"}},
+			{Name: "b.proto", Imports: []string{"bar/bar.proto"}},
+		},
+	}
+
+	rs, _ := g.GenerateRules(pkg)
+	want := map[string][]string{
+		"proto_library":    {"//bar:bar_proto", "@com_google_protobuf//:any_proto"},
+		"go_proto_library": {"//bar:go_default_library", "@io_bazel_rules_go//proto/wkt:any_go_proto"},
+	}
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		wantDeps, ok := want[rule.Kind()]
+		if !ok {
+			continue
+		}
+		delete(want, rule.Kind())
+		deps, _ := merger.ListStrings(rule.Attr("deps"))
+		if !reflect.DeepEqual(deps, wantDeps) {
+			t.Errorf("%s deps: got %q; want %q", rule.Kind(), deps, wantDeps)
+		}
+	}
+	for kind := range want {
+		t.Errorf("%s not generated", kind)
+	}
+}
+
+func TestGeneratorProtoServices(t *testing.T) {
+	for _, tc := range []struct {
+		desc                string
+		hasServices         bool
+		wantKind, wantEmpty string
+	}{
+		{
+			desc:      "messages",
+			wantKind:  "go_proto_library",
+			wantEmpty: "go_grpc_library",
+		}, {
+			desc:        "services",
+			hasServices: true,
+			wantKind:    "go_grpc_library",
+			wantEmpty:   "go_proto_library",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := testConfig("", "example.com/repo")
+			l := resolve.NewLabeler(c)
+			r := resolve.NewResolver(c, l)
+			g := rules.NewGenerator(c, r, l, "foo", nil)
+			pkg := &packages.Package{
+				Name:       "foo",
+				Rel:        "foo",
+				Protos:     []string{"foo.proto"},
+				ProtoFiles: []packages.ProtoFile{{Name: "foo.proto", HasServices: tc.hasServices}},
+			}
+
+			rs, empty := g.GenerateRules(pkg)
+			var gotKind, gotName string
+			for _, r := range rs {
+				rule := bf.Rule{Call: r.(*bf.CallExpr)}
+				if k := rule.Kind(); k == "go_proto_library" || k == "go_grpc_library" {
+					if gotKind != "" {
+						t.Fatalf("got %s and %s; want one", gotKind, k)
+					}
+					gotKind, gotName = k, rule.Name()
+					if rule.Attr("compilers") != nil {
+						t.Errorf("%s has a compilers attribute", k)
+					}
+				}
+			}
+			if gotKind != tc.wantKind {
+				t.Errorf("got kind %q; want %q", gotKind, tc.wantKind)
+			}
+			foundEmpty := false
+			for _, r := range empty {
+				rule := bf.Rule{Call: r.(*bf.CallExpr)}
+				foundEmpty = foundEmpty || rule.Kind() == tc.wantEmpty && rule.Name() == gotName
+			}
+			if !foundEmpty {
+				t.Errorf("empty %s not generated", tc.wantEmpty)
+			}
+		})
+	}
+}
+
+func TestGeneratorDisabledKinds(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.DisabledKinds = map[string]bool{"go_test": true, "go_binary": true}
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "", nil)
+	pkg := &packages.Package{
+		Name: "main",
+		Library: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"main.go"}},
+		},
+		Test: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"main_test.go"}},
+		},
+	}
+
+	rs, empty := g.GenerateRules(pkg)
+	for _, r := range append(rs, empty...) {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		if kind := rule.Kind(); kind == "go_test" || kind == "go_binary" {
+			t.Errorf("%s %q generated, but the kind is disabled", kind, rule.Name())
+		}
+	}
+	var kinds []string
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		kinds = append(kinds, rule.Kind())
+	}
+	if want := []string{"go_library"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got kinds %q; want %q", kinds, want)
+	}
+}
+
+func TestGeneratorTestSizeTimeout(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.TestSize = "small"
+	c.TestTimeout = "short"
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "", nil)
+	pkg := &packages.Package{
+		Name: "foo",
+		Test: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"foo_test.go"}},
+		},
+	}
+
+	rs, _ := g.GenerateRules(pkg)
+	var found bool
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		if rule.Kind() != "go_test" {
+			continue
+		}
+		found = true
+		if got := rule.AttrString("size"); got != "small" {
+			t.Errorf("got size %q; want %q", got, "small")
+		}
+		if got := rule.AttrString("timeout"); got != "short" {
+			t.Errorf("got timeout %q; want %q", got, "short")
+		}
+	}
+	if !found {
+		t.Error("go_test not generated")
+	}
+}
+
+func TestGeneratorTestRundir(t *testing.T) {
+	for _, tc := range []struct {
+		desc, rundir string
+		flat         bool
+		want         string
+	}{
+		{desc: "default"},
+		{desc: "package", rundir: config.TestRundirPackage},
+		{desc: "workspace", rundir: config.TestRundirWorkspace, want: "."},
+		{desc: "flat", flat: true, want: "foo"},
+		{desc: "flat workspace", rundir: config.TestRundirWorkspace, flat: true, want: "."},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := testConfig("", "example.com/repo")
+			c.TestRundir = tc.rundir
+			if tc.flat {
+				c.StructureMode = config.FlatMode
+			}
+			l := resolve.NewLabeler(c)
+			r := resolve.NewResolver(c, l)
+			g := rules.NewGenerator(c, r, l, "", nil)
+			pkg := &packages.Package{
+				Name: "foo",
+				Rel:  "foo",
+				Test: packages.Target{
+					Sources: packages.PlatformStrings{Generic: []string{"foo_test.go"}},
+				},
+			}
+
+			rs, _ := g.GenerateRules(pkg)
+			var found bool
+			for _, r := range rs {
+				rule := bf.Rule{Call: r.(*bf.CallExpr)}
+				if rule.Kind() != "go_test" {
+					continue
+				}
+				found = true
+				if got := rule.AttrString("rundir"); got != tc.want {
+					t.Errorf("got rundir %q; want %q", got, tc.want)
+				}
+			}
+			if !found {
+				t.Error("go_test not generated")
+			}
+		})
+	}
+}
+
+func TestGeneratorTestOnlyNoCoverage(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.TestOnly = true
+	c.NoCoverage = true
+	c.DefaultTags = []string{"manual"}
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "", nil)
+	pkg := &packages.Package{
+		Name: "main",
+		Library: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"main.go"}},
+		},
+		Test: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"main_test.go"}},
+		},
+	}
+
+	rs, _ := g.GenerateRules(pkg)
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		kind := rule.Kind()
+		var testonly string
+		if x, ok := rule.Attr("testonly").(*bf.LiteralExpr); ok {
+			testonly = x.Token
+		}
+		wantTestonly := "True"
+		wantTags := []string{"manual"}
+		switch kind {
+		case "go_library":
+			wantTags = []string{"manual", config.NoCoverageTag}
+		case "go_test":
+			wantTestonly = ""
+		}
+		if testonly != wantTestonly {
+			t.Errorf("%s %q: got testonly %q; want %q", kind, rule.Name(), testonly, wantTestonly)
+		}
+		if got := listStrings(rule.Attr("tags")); !reflect.DeepEqual(got, wantTags) {
+			t.Errorf("%s %q: got tags %q; want %q", kind, rule.Name(), got, wantTags)
+		}
+	}
+}
+
+func TestGeneratorAnnotateDeps(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.AnnotateDeps = true
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "lib", nil)
+	pkg := &packages.Package{
+		Name: "lib",
+		Rel:  "lib",
+		Library: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"lib.go", "lib_linux.go"}},
+			Imports: packages.PlatformStrings{
+				Generic:  []string{"example.com/repo/a", "example.com/repo/lib/b"},
+				Platform: map[string][]string{"@io_bazel_rules_go//go/platform:linux_amd64": {"example.com/repo/a/c"}},
+			},
+		},
+	}
+
+	rs, _ := g.GenerateRules(pkg)
+	var lib bf.Rule
+	for _, r := range rs {
+		if rule := (bf.Rule{Call: r.(*bf.CallExpr)}); rule.Kind() == "go_library" {
+			lib = rule
+		}
+	}
+	if lib.Call == nil {
+		t.Fatal("go_library not generated")
+	}
+	got := make(map[string]string)
+	var collect func(e bf.Expr)
+	collect = func(e bf.Expr) {
+		switch e := e.(type) {
+		case *bf.StringExpr:
+			if len(e.Suffix) > 0 {
+				got[e.Value] = e.Suffix[0].Token
+			}
+		case *bf.ListExpr:
+			for _, x := range e.List {
+				collect(x)
+			}
+		case *bf.BinaryExpr:
+			collect(e.X)
+			collect(e.Y)
+		case *bf.CallExpr:
+			for _, x := range e.List {
+				collect(x)
+			}
+		case *bf.DictExpr:
+			for _, x := range e.List {
+				collect(x.(*bf.KeyValueExpr).Value)
+			}
+		}
+	}
+	collect(lib.Attr("deps"))
+	want := map[string]string{
+		"//a:go_default_library":     "# example.com/repo/a",
+		"//a/c:go_default_library":   "# example.com/repo/a/c",
+		"//lib/b:go_default_library": "# example.com/repo/lib/b",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got annotations %q; want %q", got, want)
+	}
+}
+
+func TestGeneratorXDefs(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.XDefs = map[string]string{
+		"example.com/version.Version": "{STABLE_GIT_TAG}",
+		"main.Commit":                 "{STABLE_GIT_COMMIT}",
+	}
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "", nil)
+	pkg := &packages.Package{
+		Name: "main",
+		Library: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"main.go"}},
+		},
+	}
+
+	rs, _ := g.GenerateRules(pkg)
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		if rule.Kind() != "go_binary" {
+			if rule.Attr("x_defs") != nil {
+				t.Errorf("%s %q has x_defs", rule.Kind(), rule.Name())
+			}
+			continue
+		}
+		dict, ok := rule.Attr("x_defs").(*bf.DictExpr)
+		if !ok {
+			t.Fatalf("got x_defs %#v; want dict", rule.Attr("x_defs"))
+		}
+		got := make(map[string]string)
+		var keys []string
+		for _, e := range dict.List {
+			kv := e.(*bf.KeyValueExpr)
+			key := kv.Key.(*bf.StringExpr).Value
+			keys = append(keys, key)
+			got[key] = kv.Value.(*bf.StringExpr).Value
+		}
+		if !reflect.DeepEqual(got, c.XDefs) {
+			t.Errorf("got x_defs %v; want %v", got, c.XDefs)
+		}
+		if want := []string{"example.com/version.Version", "main.Commit"}; !reflect.DeepEqual(keys, want) {
+			t.Errorf("got keys %q; want %q", keys, want)
+		}
+		return
+	}
+	t.Error("go_binary not generated")
+}
+
+func TestGeneratorGcOpts(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.GcGoopts = []string{"-trimpath", "$(GOPATH)"}
+	c.GcLinkopts = []string{"-s", "-w"}
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "", nil)
+	pkg := &packages.Package{
+		Name: "main",
+		Library: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"main.go"}},
+		},
+		XTest: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"main_test.go"}},
+		},
+	}
+
+	want := map[string][2][]string{
+		"go_library": {c.GcGoopts, nil},
+		"go_binary":  {nil, c.GcLinkopts},
+		"go_test":    {c.GcGoopts, c.GcLinkopts},
+	}
+	rs, _ := g.GenerateRules(pkg)
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		w, ok := want[rule.Kind()]
+		if !ok {
+			continue
+		}
+		delete(want, rule.Kind())
+		goopts, _ := merger.ListStrings(rule.Attr("gc_goopts"))
+		linkopts, _ := merger.ListStrings(rule.Attr("gc_linkopts"))
+		if !reflect.DeepEqual(goopts, w[0]) {
+			t.Errorf("%s %q: got gc_goopts %q; want %q", rule.Kind(), rule.Name(), goopts, w[0])
+		}
+		if !reflect.DeepEqual(linkopts, w[1]) {
+			t.Errorf("%s %q: got gc_linkopts %q; want %q", rule.Kind(), rule.Name(), linkopts, w[1])
+		}
+	}
+	for kind := range want {
+		t.Errorf("%s not generated", kind)
+	}
+}
+
+func TestGeneratorDefaultTags(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.DefaultTags = []string{"manual", "no-remote"}
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "", nil)
+	pkg := &packages.Package{
+		Name: "foo",
+		Library: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"foo.go"}},
+		},
+		Test: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"foo_test.go"}},
+		},
+		Protos:     []string{"foo.proto"},
+		ProtoFiles: []packages.ProtoFile{{Name: "foo.proto"}},
+	}
+
+	rs, empty := g.GenerateRules(pkg)
+	if len(rs) != 4 {
+		t.Errorf("got %d rules; want 4", len(rs))
+	}
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		tags, _ := merger.ListStrings(rule.Attr("tags"))
+		if !reflect.DeepEqual(tags, c.DefaultTags) {
+			t.Errorf("%s %q: got tags %q; want %q", rule.Kind(), rule.Name(), tags, c.DefaultTags)
+		}
+	}
+	for _, r := range empty {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		if rule.Attr("tags") != nil {
+			t.Errorf("empty %s %q has tags", rule.Kind(), rule.Name())
+		}
+	}
+}
+
+func TestGeneratorSourceGroups(t *testing.T) {
+	c := testConfig("", "example.com/repo")
+	c.SourceGroups = []config.SourceGroup{
+		{Name: "tables", Patterns: []string{"tables*.go"}},
+		{Name: "gen", Patterns: []string{"gen_*.go"}},
+	}
+	l := resolve.NewLabeler(c)
+	r := resolve.NewResolver(c, l)
+	g := rules.NewGenerator(c, r, l, "", nil)
+	pkg := &packages.Package{
+		Name: "foo",
+		Library: packages.Target{
+			Sources: packages.PlatformStrings{Generic: []string{"foo.go"}},
+		},
+		SourceGroups: []packages.SourceGroup{{
+			Name: "tables",
+			Target: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"tables.go"}},
+				// go_source has no cgo attributes, so these aren't set.
+				Cgo:   true,
+				COpts: packages.PlatformStrings{Generic: []string{"-DFOO"}},
+			},
+		}},
+	}
+
+	rs, empty := g.GenerateRules(pkg)
+	var sawSource bool
+	for _, r := range rs {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		switch rule.Kind() {
+		case "go_source":
+			sawSource = true
+			if got, want := rule.Name(), "tables"; got != want {
+				t.Errorf("got go_source %q; want %q", got, want)
+			}
+			if got, _ := merger.ListStrings(rule.Attr("srcs")); !reflect.DeepEqual(got, []string{"tables.go"}) {
+				t.Errorf("got go_source srcs %q; want %q", got, []string{"tables.go"})
+			}
+			if got, want := rule.AttrKeys(), []string{"name", "srcs"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got go_source attributes %q; want %q", got, want)
+			}
+		case "go_library":
+			if got, _ := merger.ListStrings(rule.Attr("embed")); !reflect.DeepEqual(got, []string{":tables"}) {
+				t.Errorf("got go_library embed %q; want %q", got, []string{":tables"})
+			}
+		}
+	}
+	if !sawSource {
+		t.Error("go_source not generated")
+	}
+	var sawEmpty bool
+	for _, r := range empty {
+		rule := bf.Rule{Call: r.(*bf.CallExpr)}
+		if rule.Kind() == "go_source" && rule.Name() == "gen" {
+			sawEmpty = true
+		}
+	}
+	if !sawEmpty {
+		t.Error("empty go_source \"gen\" not generated")
+	}
+}
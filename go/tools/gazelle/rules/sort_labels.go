@@ -5,21 +5,30 @@ import (
 	"strings"
 
 	bf "github.com/bazelbuild/buildtools/build"
+	bt "github.com/bazelbuild/buildtools/tables"
 )
 
 var (
 	goRuleKinds = map[string]bool{
-		"cgo_library": true,
-		"go_binary":   true,
-		"go_library":  true,
-		"go_test":     true,
+		"cgo_library":      true,
+		"go_binary":        true,
+		"go_grpc_library":  true,
+		"go_library":       true,
+		"go_path":          true,
+		"go_proto_library": true,
+		"go_source":        true,
+		"go_test":          true,
+		"proto_library":    true,
 	}
 	sortedAttrs = []string{"srcs", "deps"}
 )
 
 // SortLabels sorts lists of strings in "srcs" and "deps" attributes of
-// Go rules using the same order as buildifier. Buildifier also sorts string
-// lists, but not those involved with "select" expressions.
+// Go rules using the same order as buildifier and removes duplicate strings.
+// Like buildifier, it leaves lists alone if their first element has a
+// "# do not sort" comment.
+// Buildifier also sorts string lists, but not those involved with "select"
+// expressions.
 // TODO(jayconrod): remove this when bazelbuild/buildtools#122 is fixed.
 func SortLabels(f *bf.File) {
 	for _, s := range f.Stmt {
@@ -31,7 +40,7 @@ func SortLabels(f *bf.File) {
 		if !goRuleKinds[r.Kind()] {
 			continue
 		}
-		for _, key := range []string{"srcs", "deps"} {
+		for _, key := range sortedAttrs {
 			attr := r.AttrDefn(key)
 			if attr == nil {
 				continue
@@ -43,7 +52,7 @@ func SortLabels(f *bf.File) {
 
 func sortExprLabels(e bf.Expr, _ []bf.Expr) {
 	list, ok := e.(*bf.ListExpr)
-	if !ok || len(list.List) == 0 {
+	if !ok || len(list.List) == 0 || doNotSort(list.List[0]) {
 		return
 	}
 
@@ -60,9 +69,85 @@ func sortExprLabels(e bf.Expr, _ []bf.Expr) {
 	keys[0].x.Comment().Before = nil
 	sort.Sort(byStringExpr(keys))
 	keys[0].x.Comment().Before = append(before, keys[0].x.Comment().Before...)
+
+	// Remove duplicates. Since the sort is stable, the first occurrence is
+	// kept. Suffix comments (like "# keep") on a removed duplicate are moved
+	// to the element that is kept, unless it has its own. A list left with
+	// one element is printed on one line, so it's forced onto several lines
+	// to keep a moved comment next to its element.
+	list.List = list.List[:0]
 	for i, k := range keys {
-		list.List[i] = k.x
+		if i > 0 && k.value == keys[i-1].value {
+			kept := list.List[len(list.List)-1].Comment()
+			if dup := k.x.Comment(); len(kept.Suffix) == 0 && len(dup.Suffix) > 0 {
+				kept.Suffix = dup.Suffix
+				list.ForceMultiLine = true
+			}
+			continue
+		}
+		list.List = append(list.List, k.x)
+	}
+}
+
+// doNotSort returns whether x has a "# do not sort" comment before it.
+func doNotSort(x bf.Expr) bool {
+	for _, c := range x.Comment().Before {
+		if strings.Contains(strings.ToLower(c.Token), "do not sort") {
+			return true
+		}
+	}
+	return false
+}
+
+// SortAttrs sorts the keyword arguments of Go rules in canonical order: by
+// buildifier's priority for each attribute name, then alphabetically.
+// Positional arguments are kept first, in their original order. New
+// attributes added while merging are appended to the end of a rule, so this
+// ensures repeated runs produce the same output.
+func SortAttrs(f *bf.File) {
+	for _, s := range f.Stmt {
+		c, ok := s.(*bf.CallExpr)
+		if !ok {
+			continue
+		}
+		r := bf.Rule{c}
+		if !goRuleKinds[r.Kind()] {
+			continue
+		}
+		sort.Stable(byCallArg(c.List))
+	}
+}
+
+// byCallArg implements sort.Interface for the arguments of a call.
+type byCallArg []bf.Expr
+
+func (x byCallArg) Len() int      { return len(x) }
+func (x byCallArg) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+
+func (x byCallArg) Less(i, j int) bool {
+	ki, iok := callArgName(x[i])
+	kj, jok := callArgName(x[j])
+	if !iok || !jok {
+		return !iok && jok
+	}
+	if cmp := bt.NamePriority[ki] - bt.NamePriority[kj]; cmp != 0 {
+		return cmp < 0
+	}
+	return ki < kj
+}
+
+// callArgName returns the name of a keyword argument. ok is false for
+// positional arguments.
+func callArgName(e bf.Expr) (name string, ok bool) {
+	b, ok := e.(*bf.BinaryExpr)
+	if !ok || b.Op != "=" {
+		return "", false
+	}
+	l, ok := b.X.(*bf.LiteralExpr)
+	if !ok {
+		return "", false
 	}
+	return l.Token, true
 }
 
 // Code below this point is adapted from
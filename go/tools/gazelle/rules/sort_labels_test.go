@@ -0,0 +1,203 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules_test
+
+import (
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
+)
+
+func TestSortLabels(t *testing.T) {
+	for _, tc := range []struct {
+		desc, old, want string
+	}{
+		{
+			desc: "sort and dedup list",
+			old: `go_library(
+    name = "go_default_library",
+    srcs = [
+        "b.go",
+        "a.go",
+        "b.go",
+    ],
+    deps = [
+        "//b:go_default_library",
+        ":a",
+        "//b:go_default_library",
+    ],
+)
+`,
+			want: `go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+    ],
+    deps = [
+        ":a",
+        "//b:go_default_library",
+    ],
+)
+`,
+		}, {
+			desc: "sort and dedup select",
+			old: `go_library(
+    name = "go_default_library",
+    srcs = ["z.go"] + select({
+        "linux_amd64": [
+            "b_linux.go",
+            "a_linux.go",
+            "a_linux.go",
+        ],
+        "//conditions:default": [],
+    }),
+)
+`,
+			want: `go_library(
+    name = "go_default_library",
+    srcs = ["z.go"] + select({
+        "linux_amd64": [
+            "a_linux.go",
+            "b_linux.go",
+        ],
+        "//conditions:default": [],
+    }),
+)
+`,
+		}, {
+			desc: "keep comment on duplicate",
+			old: `go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "a.go",  # keep
+    ],
+)
+`,
+			want: `go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",  # keep
+    ],
+)
+`,
+		}, {
+			desc: "do not sort",
+			old: `go_library(
+    name = "go_default_library",
+    srcs = [
+        # do not sort
+        "b.go",
+        "a.go",
+        "b.go",
+    ],
+)
+`,
+			want: `go_library(
+    name = "go_default_library",
+    srcs = [
+        # do not sort
+        "b.go",
+        "a.go",
+        "b.go",
+    ],
+)
+`,
+		}, {
+			desc: "non-go rule not sorted",
+			old: `filegroup(
+    name = "all",
+    srcs = [
+        "b",
+        "a",
+    ],
+)
+`,
+			want: `filegroup(
+    name = "all",
+    srcs = [
+        "b",
+        "a",
+    ],
+)
+`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			f, err := bf.Parse("old", []byte(tc.old))
+			if err != nil {
+				t.Fatalf("%s: parse error: %v", tc.desc, err)
+			}
+			rules.SortLabels(f)
+			if got := string(bf.Format(f)); got != tc.want {
+				t.Errorf("%s: got %s; want %s", tc.desc, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSortAttrs(t *testing.T) {
+	old := `go_library(
+    deps = [":a"],
+    visibility = ["//visibility:public"],
+    srcs = ["lib.go"],
+    name = "go_default_library",
+)
+
+go_test(
+    library = ":go_default_library",
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+)
+
+filegroup(
+    srcs = ["a"],
+    name = "all",
+)
+`
+	want := `go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    visibility = ["//visibility:public"],
+    deps = [":a"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    library = ":go_default_library",
+)
+
+filegroup(
+    srcs = ["a"],
+    name = "all",
+)
+`
+	f, err := bf.Parse("old", []byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules.SortAttrs(f)
+	if got := string(bf.Format(f)); got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+	rules.SortAttrs(f)
+	if got := string(bf.Format(f)); got != want {
+		t.Errorf("second sort: got %s; want %s", got, want)
+	}
+}
@@ -0,0 +1,5 @@
+#include "native.h"
+
+int add(int a, int b) {
+  return a + b;
+}
@@ -0,0 +1,11 @@
+package native
+
+// #cgo CFLAGS: -DNATIVE=1
+// #cgo linux LDFLAGS: -lm
+// #include "native.h"
+import "C"
+
+// Add adds two numbers in C.
+func Add(a, b int) int {
+	return int(C.add(C.int(a), C.int(b)))
+}
@@ -0,0 +1,9 @@
+package native
+
+import "testing"
+
+func TestAdd(t *testing.T) {
+	if got := Add(1, 2); got != 3 {
+		t.Errorf("got %d; want 3", got)
+	}
+}
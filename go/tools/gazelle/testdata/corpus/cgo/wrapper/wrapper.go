@@ -0,0 +1,12 @@
+package wrapper
+
+import "example.com/cgo/native"
+
+// Sum adds numbers with native code.
+func Sum(xs ...int) int {
+	total := 0
+	for _, x := range xs {
+		total = native.Add(total, x)
+	}
+	return total
+}
@@ -0,0 +1,6 @@
+package api
+
+import "example.com/proto/types"
+
+// DefaultName is used when no name is given.
+var DefaultName = types.Name{Value: "world"}
@@ -0,0 +1,4 @@
+package util
+
+// Hello is how greetings start.
+const Hello = "hello"
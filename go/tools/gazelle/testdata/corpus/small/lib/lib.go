@@ -0,0 +1,8 @@
+package lib
+
+import "example.com/small/lib/internal/util"
+
+// Greeting returns a friendly message.
+func Greeting() string {
+	return util.Hello + ", " + name
+}
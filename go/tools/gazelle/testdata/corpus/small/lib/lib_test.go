@@ -0,0 +1,9 @@
+package lib
+
+import "testing"
+
+func TestGreeting(t *testing.T) {
+	if got, want := Greeting(), "hello, world"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,11 @@
+package app
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Run fails if ctx is done.
+func Run(ctx context.Context) error {
+	return errors.Wrap(ctx.Err(), "run")
+}
@@ -21,6 +21,8 @@ package cgolibwithtags
 #cgo darwin CFLAGS: -DGOOS=darwin
 #cgo windows CFLAGS: -DGOOS=windows
 #cgo LDFLAGS: -lweird
+#cgo linux LDFLAGS: -lweird
+#cgo darwin LDFLAGS: -framework CoreFoundation
 **/
 import "C"
 import "fmt"
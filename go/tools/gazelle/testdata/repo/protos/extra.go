@@ -0,0 +1,6 @@
+package protos
+
+// NewFoo returns a Foo with the given name.
+func NewFoo(name string) *Foo {
+	return &Foo{Name: name}
+}
@@ -0,0 +1,242 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package trace records how much time Gazelle spends in each stage of a run,
+// along with counts of the work it does, like directories visited and rules
+// created. Timing is disabled by default; Start and Count are cheap when
+// it's disabled. Gazelle is single-threaded, so this package is not safe for
+// concurrent use.
+package trace
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// Stage is a phase of Gazelle's work that is timed separately.
+type Stage int
+
+const (
+	// Walk is time spent listing directories and organizing files.
+	Walk Stage = iota
+
+	// Parse is time spent parsing build files and .go files.
+	Parse
+
+	// Resolve is time spent generating rules and resolving imports.
+	Resolve
+
+	// Merge is time spent fixing existing build files and merging generated
+	// rules into them.
+	Merge
+
+	// Write is time spent formatting and emitting build files.
+	Write
+
+	numStages
+)
+
+var stageNames = [numStages]string{"walk", "parse", "resolve", "merge", "write"}
+
+func (s Stage) String() string {
+	return stageNames[s]
+}
+
+type span struct {
+	stage  Stage
+	detail string
+	start  time.Time
+
+	// nested is the time spent in spans started while this span was open.
+	// It is not counted toward this span's stage.
+	nested time.Duration
+}
+
+var (
+	enabled bool
+	events  io.Writer
+	stack   []*span
+	totals  [numStages]time.Duration
+	counts  [numStages]int
+	values  [numCounters]int
+)
+
+// Counter is a quantity that is counted over a run.
+type Counter int
+
+const (
+	// Dirs is the number of directories visited.
+	Dirs Counter = iota
+
+	// Packages is the number of directories with buildable code that rules
+	// were generated for.
+	Packages
+
+	// RulesCreated, RulesUpdated, and RulesDeleted are the numbers of rules
+	// created, updated, and deleted in build files.
+	RulesCreated
+	RulesUpdated
+	RulesDeleted
+
+	// UnresolvedImports is the number of imports that couldn't be resolved
+	// to labels.
+	UnresolvedImports
+
+	numCounters
+)
+
+var counterNames = [numCounters]string{"dirs", "packages", "rules created", "rules updated", "rules deleted", "unresolved imports"}
+
+func (c Counter) String() string {
+	return counterNames[c]
+}
+
+// Enable turns on timing and clears anything recorded earlier. If w is not
+// nil, a line is written to it each time a stage ends, with the name of the
+// stage, the time spent in it, and the detail passed to Start.
+func Enable(w io.Writer) {
+	enabled = true
+	events = w
+	stack = nil
+	totals = [numStages]time.Duration{}
+	counts = [numStages]int{}
+	values = [numCounters]int{}
+}
+
+// Enabled returns whether timing and counting are turned on. This may be
+// used to avoid doing work to compute values passed to Count.
+func Enabled() bool {
+	return enabled
+}
+
+// Disable turns off timing.
+func Disable() {
+	enabled = false
+	events = nil
+	stack = nil
+}
+
+// Start begins timing a stage. detail describes what is being worked on,
+// usually a path. The returned function must be called to end the stage.
+// Stages may be nested; time spent in a nested stage is only counted toward
+// the nested stage.
+func Start(stage Stage, detail string) func() {
+	if !enabled {
+		return func() {}
+	}
+	s := &span{stage: stage, detail: detail, start: time.Now()}
+	stack = append(stack, s)
+	return func() {
+		if !enabled || len(stack) == 0 || stack[len(stack)-1] != s {
+			return
+		}
+		stack = stack[:len(stack)-1]
+		elapsed := time.Since(s.start)
+		if len(stack) > 0 {
+			stack[len(stack)-1].nested += elapsed
+		}
+		own := elapsed - s.nested
+		totals[stage] += own
+		counts[stage]++
+		if events != nil {
+			fmt.Fprintf(events, "%s\t%v\t%s\n", stage, own, s.detail)
+		}
+	}
+}
+
+// Total returns the time spent in a stage and the number of times it was
+// started since timing was enabled.
+func Total(stage Stage) (time.Duration, int) {
+	return totals[stage], counts[stage]
+}
+
+// Count adds n to a counter.
+func Count(c Counter, n int) {
+	if enabled {
+		values[c] += n
+	}
+}
+
+// Counted returns the value of a counter since timing was enabled.
+func Counted(c Counter) int {
+	return values[c]
+}
+
+// WriteSummary writes a table to w with the total time and count for each
+// stage since timing was enabled.
+func WriteSummary(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "stage\tcount\ttime\t")
+	var total time.Duration
+	for s := Stage(0); s < numStages; s++ {
+		fmt.Fprintf(tw, "%s\t%d\t%v\t\n", s, counts[s], totals[s])
+		total += totals[s]
+	}
+	fmt.Fprintf(tw, "total\t\t%v\t\n", total)
+	return tw.Flush()
+}
+
+// WriteCounts writes a table to w with the value of each counter since
+// timing was enabled.
+func WriteCounts(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	for c := Counter(0); c < numCounters; c++ {
+		fmt.Fprintf(tw, "%s\t%d\t\n", c, values[c])
+	}
+	return tw.Flush()
+}
+
+// Stats summarizes a run. It is meant to be encoded as JSON, for example,
+// for dashboards.
+type Stats struct {
+	Dirs, Packages                           int
+	RulesCreated, RulesUpdated, RulesDeleted int
+	UnresolvedImports                        int
+
+	// Stages lists the time spent in each stage, in the order they're
+	// listed by WriteSummary.
+	Stages []StageStats
+}
+
+// StageStats is the time spent in a stage and the number of times it was
+// started.
+type StageStats struct {
+	Stage   string
+	Count   int
+	Seconds float64
+}
+
+// Summary returns the counters and stage times recorded since timing was
+// enabled.
+func Summary() Stats {
+	s := Stats{
+		Dirs:              values[Dirs],
+		Packages:          values[Packages],
+		RulesCreated:      values[RulesCreated],
+		RulesUpdated:      values[RulesUpdated],
+		RulesDeleted:      values[RulesDeleted],
+		UnresolvedImports: values[UnresolvedImports],
+	}
+	for st := Stage(0); st < numStages; st++ {
+		s.Stages = append(s.Stages, StageStats{
+			Stage:   st.String(),
+			Count:   counts[st],
+			Seconds: totals[st].Seconds(),
+		})
+	}
+	return s
+}
@@ -0,0 +1,109 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trace
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDisabled(t *testing.T) {
+	Disable()
+	Start(Walk, "a")()
+	if _, count := Total(Walk); count != 0 {
+		t.Errorf("got count %d while disabled; want 0", count)
+	}
+}
+
+func TestNested(t *testing.T) {
+	var events bytes.Buffer
+	Enable(&events)
+	defer Disable()
+
+	endWalk := Start(Walk, "a")
+	endParse := Start(Parse, "a/BUILD")
+	time.Sleep(10 * time.Millisecond)
+	endParse()
+	endWalk()
+
+	walk, walkCount := Total(Walk)
+	parse, parseCount := Total(Parse)
+	if walkCount != 1 || parseCount != 1 {
+		t.Errorf("got counts walk=%d parse=%d; want 1 each", walkCount, parseCount)
+	}
+	if parse < 10*time.Millisecond {
+		t.Errorf("got parse time %v; want at least 10ms", parse)
+	}
+	if walk >= parse {
+		t.Errorf("got walk time %v including nested parse time %v", walk, parse)
+	}
+
+	lines := strings.Split(strings.TrimSpace(events.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "parse\t") || !strings.HasSuffix(lines[0], "\ta/BUILD") || !strings.HasPrefix(lines[1], "walk\t") {
+		t.Errorf("got events %q; want parse then walk", lines)
+	}
+}
+
+func TestWriteSummary(t *testing.T) {
+	Enable(nil)
+	defer Disable()
+	Start(Resolve, "a")()
+	Start(Resolve, "b")()
+
+	var buf bytes.Buffer
+	if err := WriteSummary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != int(numStages)+2 {
+		t.Fatalf("got %d lines; want %d:\n%s", len(lines), numStages+2, buf.String())
+	}
+	if fields := strings.Fields(lines[1+int(Resolve)]); len(fields) != 3 || fields[0] != "resolve" || fields[1] != "2" {
+		t.Errorf("got resolve line %q; want count 2", lines[1+int(Resolve)])
+	}
+}
+
+func TestCounters(t *testing.T) {
+	Count(Dirs, 1)
+	if got := Counted(Dirs); got != 0 {
+		t.Errorf("got %d dirs while disabled; want 0", got)
+	}
+
+	Enable(nil)
+	defer Disable()
+	Count(Dirs, 2)
+	Count(RulesCreated, 1)
+	Count(RulesCreated, 1)
+	Start(Walk, "a")()
+
+	stats := Summary()
+	if stats.Dirs != 2 || stats.RulesCreated != 2 || stats.RulesDeleted != 0 {
+		t.Errorf("got %+v; want 2 dirs and 2 rules created", stats)
+	}
+	if len(stats.Stages) != int(numStages) || stats.Stages[Walk].Stage != "walk" || stats.Stages[Walk].Count != 1 {
+		t.Errorf("got stages %+v; want walk counted once", stats.Stages)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCounts(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "rules created  2") {
+		t.Errorf("got counts:\n%s\nwant rules created 2", buf.String())
+	}
+}
@@ -0,0 +1,205 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package walk
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+)
+
+const (
+	bazelIgnoreFileName = ".bazelignore"
+	gitignoreFileName   = ".gitignore"
+)
+
+// ReadBazelIgnore returns the set of paths listed in the .bazelignore file
+// at the root of the repository. Paths are slash-separated and relative to
+// the repository root. Bazel does not look for packages in these
+// directories, so Gazelle doesn't either. Blank lines and lines starting
+// with "#" are ignored.
+func ReadBazelIgnore(repoRoot string) map[string]bool {
+	data, err := ioutil.ReadFile(filepath.Join(repoRoot, bazelIgnoreFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Error(err)
+		}
+		return nil
+	}
+
+	ignored := make(map[string]bool)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		rel := path.Clean(filepath.ToSlash(line))
+		if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") || path.IsAbs(rel) {
+			logging.Warningf("%s: ignoring path outside the workspace: %s",
+				filepath.Join(repoRoot, bazelIgnoreFileName), line)
+			continue
+		}
+		ignored[rel] = true
+	}
+	return ignored
+}
+
+// IsBazelIgnored returns whether rel or any of its parent directories is in
+// the ignored set returned by ReadBazelIgnore.
+func IsBazelIgnored(ignored map[string]bool, rel string) bool {
+	if len(ignored) == 0 {
+		return false
+	}
+	for rel != "" && rel != "." {
+		if ignored[rel] {
+			return true
+		}
+		rel = path.Dir(rel)
+	}
+	return false
+}
+
+// gitignorePattern is a pattern read from a .gitignore file.
+type gitignorePattern struct {
+	// rel is the slash-separated path to the directory containing the
+	// .gitignore file, relative to the repository root.
+	rel string
+
+	// glob is the pattern, split into slash-separated components. A "**"
+	// component matches any number of directories.
+	glob []string
+
+	// anchored is true when the pattern contained a slash other than a
+	// trailing slash. Anchored patterns are matched against the path
+	// relative to rel. Other patterns are matched against base names.
+	anchored bool
+
+	// dirOnly is true when the pattern ended with a slash. These patterns
+	// only match directories.
+	dirOnly bool
+
+	// negated is true when the pattern started with "!". A path matched by
+	// a negated pattern is not ignored, even if an earlier pattern matched.
+	negated bool
+}
+
+// readGitignore reads the patterns in the .gitignore file in dir, if there
+// is one. rel is the slash-separated path to dir, relative to the
+// repository root.
+func readGitignore(dir, rel string) []gitignorePattern {
+	data, err := ioutil.ReadFile(filepath.Join(dir, gitignoreFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Error(err)
+		}
+		return nil
+	}
+	return parseGitignore(data, rel)
+}
+
+// parseGitignore parses the patterns in the content of a .gitignore file
+// in the directory rel. Blank lines and comments are skipped. Character
+// classes and wildcards are interpreted by path.Match.
+func parseGitignore(data []byte, rel string) []gitignorePattern {
+	var patterns []gitignorePattern
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p := gitignorePattern{rel: rel}
+		if line[0] == '!' {
+			p.negated = true
+			line = line[1:]
+		} else if line[0] == '\\' {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		p.glob = strings.Split(line, "/")
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// isGitignored returns whether the file or directory at rel is ignored by
+// patterns. rel is slash-separated and relative to the repository root.
+// As in git, the last matching pattern decides.
+func isGitignored(patterns []gitignorePattern, rel string, isDir bool) bool {
+	ignored := false
+	for _, p := range patterns {
+		if p.dirOnly && !isDir || p.negated != ignored {
+			continue
+		}
+		sub := rel
+		if p.rel != "" {
+			if !strings.HasPrefix(rel, p.rel+"/") {
+				continue
+			}
+			sub = rel[len(p.rel)+1:]
+		}
+		var name []string
+		if p.anchored {
+			name = strings.Split(sub, "/")
+		} else {
+			name = []string{path.Base(sub)}
+		}
+		if matchGlob(p.glob, name) {
+			ignored = !p.negated
+		}
+	}
+	return ignored
+}
+
+// matchGlob returns whether the path components in name match the pattern
+// components in glob.
+func matchGlob(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlob(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,86 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package walk
+
+import "testing"
+
+func TestIsBazelIgnored(t *testing.T) {
+	ignored := map[string]bool{"bazel-out": true, "a/gen": true}
+	for _, tc := range []struct {
+		rel  string
+		want bool
+	}{
+		{"", false},
+		{"bazel-out", true},
+		{"bazel-out/x", true},
+		{"a", false},
+		{"a/gen", true},
+		{"a/gen/b", true},
+		{"a/generated", false},
+		{"b/a/gen", false},
+	} {
+		if got := IsBazelIgnored(ignored, tc.rel); got != tc.want {
+			t.Errorf("IsBazelIgnored(%q) = %v; want %v", tc.rel, got, tc.want)
+		}
+	}
+}
+
+func TestIsGitignored(t *testing.T) {
+	patterns := parseGitignore([]byte(`
+# comment
+*.pb.go
+!keep.pb.go
+/out
+build/
+docs/**/*.md
+\#hash
+`), "")
+	patterns = append(patterns, parseGitignore([]byte(`
+gen
+/local.go
+`), "sub")...)
+
+	for _, tc := range []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"a.go", false, false},
+		{"a.pb.go", false, true},
+		{"x/y/a.pb.go", false, true},
+		{"x/keep.pb.go", false, false},
+		{"out", true, true},
+		{"x/out", true, false},
+		{"build", true, true},
+		{"x/build", true, true},
+		{"build", false, false},
+		{"docs/a.md", false, true},
+		{"docs/x/y/a.md", false, true},
+		{"x/docs/a.md", false, false},
+		{"#hash", false, true},
+		{"comment", false, false},
+		{"gen", true, false},
+		{"sub/gen", true, true},
+		{"sub/x/gen", false, true},
+		{"sub/local.go", false, true},
+		{"sub/x/local.go", false, false},
+		{"local.go", false, false},
+	} {
+		if got := isGitignored(patterns, tc.rel, tc.isDir); got != tc.want {
+			t.Errorf("isGitignored(%q, %v) = %v; want %v", tc.rel, tc.isDir, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package walk traverses the directories of a repository the same way
+// Gazelle does, so other tools can visit the directories and files Gazelle
+// would. Directories listed in .bazelignore or excluded with directives or
+// .gitignore files are skipped, symbolic links are followed as configured,
+// and the build file in each directory is read, with its directives applied
+// to the configuration for the directory and its subdirectories. Callers
+// provide callbacks in Funcs.
+package walk
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/trace"
+)
+
+// Dir describes a directory visited by Walk.
+type Dir struct {
+	// Path is the absolute path to the directory.
+	Path string
+
+	// Rel is the slash-separated path to the directory, relative to the
+	// repository root. The root itself is "".
+	Rel string
+
+	// Config is the configuration for the directory, with directives in its
+	// build file applied. It's also the starting configuration for its
+	// subdirectories.
+	Config *config.Config
+
+	// File is the parsed build file in the directory. It's nil if there is
+	// none or it couldn't be read.
+	File *bf.File
+
+	// BrokenFile is the path to the build file in the directory if it
+	// couldn't be parsed. The error has already been reported.
+	BrokenFile string
+
+	// HasError is set if there was an error reading the build file, if there
+	// was more than one, or if it couldn't be parsed and
+	// Config.NewOnParseError isn't set. Errors have already been reported.
+	HasError bool
+
+	// Excluded is the set of file and directory names excluded with
+	// "# gazelle:exclude" directives in the build file.
+	Excluded map[string]bool
+
+	// Files and Subdirs are the names of the files and subdirectories in the
+	// directory that weren't skipped, in sorted order. Files includes the
+	// build file. Symbolic links that are followed are listed as
+	// subdirectories.
+	Files, Subdirs []string
+}
+
+// Funcs holds the callbacks Walk calls as it visits each directory. Any of
+// them may be nil.
+type Funcs struct {
+	// OnBuildFile is called with the build file in a directory after it's
+	// parsed and its directives are applied to d.Config.
+	OnBuildFile func(d *Dir, f *bf.File)
+
+	// OnDir is called once the contents of a directory are known, before
+	// its files and subdirectories are visited. If it returns false, they
+	// are skipped, and OnDirDone isn't called for the directory.
+	OnDir func(d *Dir) bool
+
+	// OnSourceFile is called for each name in d.Files before
+	// subdirectories are visited.
+	OnSourceFile func(d *Dir, base string)
+
+	// OnDirDone is called after the subdirectories of a directory have been
+	// visited, so directories are finished in post-order. results maps the
+	// name of each subdirectory to the value OnDirDone returned for it, like
+	// whether it contains a package; it's false for skipped subdirectories.
+	OnDirDone func(d *Dir, results map[string]bool) bool
+}
+
+// Walk visits the directory dir and its subdirectories, calling the
+// callbacks in funcs. c is the configuration for dir; directives in build
+// files in the parent directories of dir aren't read.
+//
+// Directories listed in .bazelignore at the repository root or in
+// c.ExcludedDirs are skipped, and so are files and directories whose names
+// start with "." or "_", those excluded with "# gazelle:exclude"
+// directives, and the vendor directory in external mode. When
+// c.UseGitignore is set, files and directories matched by .gitignore files
+// are skipped, too.
+//
+// Symbolic links to directories are only followed when c.FollowSymlinks is
+// set. See followSymlink.
+//
+// Errors in build files are reported with the location of the problem.
+// A directory whose build file can't be read or parsed is still visited,
+// with Dir.HasError set, and Walk continues with other directories.
+//
+// Directories are visited one at a time, and nothing is kept after
+// OnDirDone returns, so Walk only holds the build files and file lists of
+// the directories between dir and the one being visited.
+func Walk(c *config.Config, dir string, funcs Funcs) {
+	rel := relPath(c, dir)
+	bazelIgnored := ReadBazelIgnore(c.RepoRoot)
+	if len(c.ExcludedDirs) > 0 {
+		if bazelIgnored == nil {
+			bazelIgnored = make(map[string]bool)
+		}
+		for _, d := range c.ExcludedDirs {
+			bazelIgnored[d] = true
+		}
+	}
+	if IsBazelIgnored(bazelIgnored, rel) {
+		return
+	}
+
+	// Patterns in .gitignore files in parent directories of dir apply, too.
+	var parentIgnores []gitignorePattern
+	if c.UseGitignore && rel != "" {
+		parts := strings.Split(rel, "/")
+		for i := range parts {
+			parentRel := path.Join(parts[:i]...)
+			parentDir := filepath.Join(c.RepoRoot, filepath.FromSlash(parentRel))
+			parentIgnores = append(parentIgnores, readGitignore(parentDir, parentRel)...)
+		}
+	}
+
+	// realRoot and visiting are used to check symbolic links. visiting holds
+	// the real paths of the directories being visited, so we can detect
+	// links to parent directories.
+	var realRoot string
+	visiting := make(map[string]bool)
+	if c.FollowSymlinks {
+		var err error
+		if realRoot, err = filepath.EvalSymlinks(c.RepoRoot); err != nil {
+			logging.Error(err)
+			return
+		}
+	}
+
+	// visit walks the directory tree in post-order. It returns the result of
+	// OnDirDone for the directory, or false if it was skipped. c is the
+	// configuration for the directory; directives in its build file apply to
+	// it and its subdirectories. ignores are the .gitignore patterns from
+	// parent directories.
+	var visit func(*config.Config, string, []gitignorePattern) bool
+	visit = func(c *config.Config, path string, ignores []gitignorePattern) bool {
+		defer trace.Start(trace.Walk, path)()
+		trace.Count(trace.Dirs, 1)
+
+		if c.FollowSymlinks {
+			realPath, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				logging.Error(err)
+				return false
+			}
+			if visiting[realPath] {
+				logging.WarningfAt(path, 0, "not following symbolic link to parent directory %s", realPath)
+				return false
+			}
+			visiting[realPath] = true
+			defer delete(visiting, realPath)
+		}
+
+		// List files and subdirectories.
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			logging.Error(err)
+			return false
+		}
+
+		d := &Dir{Path: path, Rel: relPath(c, path), Config: c}
+		readBuildFile(d, files)
+
+		// Process directives in the build file.
+		d.Excluded = make(map[string]bool)
+		if d.File != nil {
+			directives := config.ParseDirectives(d.File)
+			d.Config = config.ApplyDirectives(d.Config, directives, d.Rel)
+			for _, directive := range directives {
+				if directive.Key == "exclude" {
+					d.Excluded[directive.Value] = true
+				}
+			}
+			if funcs.OnBuildFile != nil {
+				funcs.OnBuildFile(d, d.File)
+			}
+		}
+		c = d.Config
+
+		if c.UseGitignore {
+			ignores = append(ignores[:len(ignores):len(ignores)], readGitignore(path, d.Rel)...)
+		}
+
+		for _, f := range files {
+			base := f.Name()
+			isDir := f.IsDir()
+			if f.Mode()&os.ModeSymlink != 0 {
+				// Broken links and links to files are treated like files.
+				linkPath := filepath.Join(path, base)
+				if st, err := os.Stat(linkPath); err == nil && st.IsDir() {
+					if !followSymlink(c, realRoot, linkPath) {
+						continue
+					}
+					isDir = true
+				}
+			}
+			switch {
+			case base == "" || base[0] == '.' || base[0] == '_' ||
+				d.Excluded[base] ||
+				base == "vendor" && isDir && c.DepMode == config.ExternalMode,
+				bazelIgnored[joinRel(d.Rel, base)],
+				c.UseGitignore && isGitignored(ignores, joinRel(d.Rel, base), isDir):
+				continue
+
+			case isDir:
+				d.Subdirs = append(d.Subdirs, base)
+
+			default:
+				d.Files = append(d.Files, base)
+			}
+		}
+
+		if funcs.OnDir != nil && !funcs.OnDir(d) {
+			return false
+		}
+		if funcs.OnSourceFile != nil {
+			for _, base := range d.Files {
+				funcs.OnSourceFile(d, base)
+			}
+		}
+
+		results := make(map[string]bool)
+		for _, sub := range d.Subdirs {
+			results[sub] = visit(c, filepath.Join(path, sub), ignores)
+		}
+
+		if funcs.OnDirDone == nil {
+			return false
+		}
+		return funcs.OnDirDone(d, results)
+	}
+
+	visit(c, dir, parentIgnores)
+}
+
+// readBuildFile looks for an existing build file among files, the contents
+// of d.Path, and parses it into d.File. Names are compared exactly, so on
+// case-insensitive file systems, a file or directory named "build" isn't
+// mistaken for a BUILD file. Errors are reported, and d.BrokenFile and
+// d.HasError are set as needed.
+func readBuildFile(d *Dir, files []os.FileInfo) {
+	for _, base := range d.Config.ValidBuildFileNames {
+		if !hasBuildFile(d.Path, files, base) {
+			continue
+		}
+		p := filepath.Join(d.Path, base)
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			logging.Error(err)
+			d.HasError = true
+			continue
+		}
+		if d.File != nil || d.BrokenFile != "" {
+			first := d.BrokenFile
+			if d.File != nil {
+				first = d.File.Path
+			}
+			logging.Errorf("in directory %s, multiple Bazel files are present: %s, %s",
+				d.Path, filepath.Base(first), base)
+			d.HasError = true
+			continue
+		}
+		endParse := trace.Start(trace.Parse, p)
+		f, err := bf.Parse(p, data)
+		endParse()
+		if err != nil {
+			LogParseError(p, err)
+			d.BrokenFile = p
+			if !d.Config.NewOnParseError {
+				d.HasError = true
+			}
+			continue
+		}
+		d.File = f
+	}
+}
+
+// LogParseError reports err, an error from parsing the build file at path,
+// along with the line it occurred on, so it's sorted with other diagnostics
+// for the file. Errors from the build file parser start with
+// "path:line:column:".
+func LogParseError(path string, err error) {
+	msg := err.Error()
+	line := 0
+	if rest := strings.TrimPrefix(msg, path+":"); rest != msg {
+		parts := strings.SplitN(rest, ":", 3)
+		if n, convErr := strconv.Atoi(parts[0]); convErr == nil && len(parts) == 3 {
+			line, msg = n, strings.TrimSpace(parts[2])
+		}
+	}
+	logging.ErrorfAt(path, line, "could not parse build file; rules in this directory are not updated: %s", msg)
+}
+
+// relPath returns the slash-separated path to dir, relative to the
+// repository root. The root itself is "".
+func relPath(c *config.Config, dir string) string {
+	rel, _ := c.RelPath(dir)
+	return rel
+}
+
+// joinRel returns the slash-separated path to base within the directory
+// rel, where rel was returned by relPath.
+func joinRel(rel, base string) string {
+	if rel == "" {
+		return base
+	}
+	return rel + "/" + base
+}
+
+// followSymlink returns whether Walk should descend into the directory the
+// symbolic link at linkPath points to. Links are only followed when
+// c.FollowSymlinks is set. Links to directories inside the repository are
+// never followed, since those directories are visited on their own, and
+// rules would be generated for them twice. realRoot is the repository root
+// with symbolic links resolved.
+func followSymlink(c *config.Config, realRoot, linkPath string) bool {
+	if !c.FollowSymlinks {
+		return false
+	}
+	dest, err := filepath.EvalSymlinks(linkPath)
+	if err != nil {
+		logging.Error(err)
+		return false
+	}
+	if rel, err := filepath.Rel(realRoot, dest); err == nil &&
+		rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		logging.Infof("%s: not following symbolic link to %s inside the repository", linkPath, dest)
+		return false
+	}
+	return true
+}
+
+// hasBuildFile returns whether files, the contents of the directory dir,
+// include a regular file (or a link to one) named exactly base.
+func hasBuildFile(dir string, files []os.FileInfo, base string) bool {
+	for _, f := range files {
+		if f.Name() != base {
+			continue
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			st, err := os.Stat(filepath.Join(dir, base))
+			return err == nil && !st.IsDir()
+		}
+		return !f.IsDir()
+	}
+	return false
+}
+
+// FindBuildFile returns the path to the build file in the directory dir: the
+// first regular file named exactly like one of c.ValidBuildFileNames. An
+// error satisfying os.IsNotExist is returned if there is none.
+func FindBuildFile(c *config.Config, dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, base := range c.ValidBuildFileNames {
+		if hasBuildFile(dir, files, base) {
+			return filepath.Join(dir, base), nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// NewBuildFileName returns the name of the build file to create in the
+// directory dir, which has no build file yet. This is the first name in
+// c.ValidBuildFileNames that doesn't match the name of an existing file or
+// directory, ignoring case, so the new file can't collide with a directory
+// named "build" on case-insensitive file systems like those on Windows and
+// macOS. If all names collide, the first name is returned.
+func NewBuildFileName(c *config.Config, dir string) string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return c.DefaultBuildFileName()
+	}
+	for _, base := range c.ValidBuildFileNames {
+		collides := false
+		for _, f := range files {
+			if strings.EqualFold(f.Name(), base) {
+				collides = true
+				break
+			}
+		}
+		if !collides {
+			return base
+		}
+	}
+	return c.DefaultBuildFileName()
+}
@@ -0,0 +1,147 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package walk_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/config"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/walk"
+)
+
+type fileSpec struct {
+	path, content string
+}
+
+func createFiles(files []fileSpec) (string, error) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "walk_test")
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, filepath.FromSlash(f.path))
+		if strings.HasSuffix(f.path, "/") {
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return dir, err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return dir, err
+		}
+		if err := ioutil.WriteFile(path, []byte(f.content), 0600); err != nil {
+			return dir, err
+		}
+	}
+	return dir, nil
+}
+
+func TestWalkFuncs(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: ".bazelignore", content: "ignored\n"},
+		{path: "BUILD.bazel", content: "# gazelle:exclude excluded.go\n# gazelle:exclude skip\n"},
+		{path: "a.go"},
+		{path: "excluded.go"},
+		{path: "_hidden/h.go"},
+		{path: "ignored/i.go"},
+		{path: "skip/s.go"},
+		{path: "sub/b.go"},
+		{path: "sub/deep/c.go"},
+		{path: "vendor/v.go"},
+	})
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+		DepMode:             config.ExternalMode,
+	}
+	var events []string
+	walk.Walk(c, dir, walk.Funcs{
+		OnBuildFile: func(d *walk.Dir, f *bf.File) {
+			events = append(events, fmt.Sprintf("build %q %s", d.Rel, filepath.Base(f.Path)))
+		},
+		OnDir: func(d *walk.Dir) bool {
+			events = append(events, fmt.Sprintf("dir %q %v", d.Rel, d.Subdirs))
+			return d.Rel != "sub/deep"
+		},
+		OnSourceFile: func(d *walk.Dir, base string) {
+			events = append(events, fmt.Sprintf("file %q %s", d.Rel, base))
+		},
+		OnDirDone: func(d *walk.Dir, results map[string]bool) bool {
+			events = append(events, fmt.Sprintf("done %q %v", d.Rel, results))
+			return true
+		},
+	})
+
+	want := []string{
+		`build "" BUILD.bazel`,
+		`dir "" [sub]`,
+		`file "" BUILD.bazel`,
+		`file "" a.go`,
+		`dir "sub" [deep]`,
+		`file "sub" b.go`,
+		`dir "sub/deep" []`,
+		`done "sub" map[deep:false]`,
+		`done "" map[sub:true]`,
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events:\n%s\nwant:\n%s", strings.Join(events, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestBuildFileNameCollision(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "build/"},
+		{path: "lib.go", content: "package lib"},
+		{path: "sub/BUILD", content: "# not a Bazel file"},
+		{path: "sub/BUILD.bazel"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		ValidBuildFileNames: []string{"BUILD", "BUILD.bazel"},
+	}
+	// A directory named "build" would collide with a new BUILD file on a
+	// case-insensitive file system.
+	if got, want := walk.NewBuildFileName(c, dir), "BUILD.bazel"; got != want {
+		t.Errorf("NewBuildFileName(%q) = %q; want %q", dir, got, want)
+	}
+	if _, err := walk.FindBuildFile(c, dir); !os.IsNotExist(err) {
+		t.Errorf("FindBuildFile(%q): got error %v; want not exist", dir, err)
+	}
+
+	sub := filepath.Join(dir, "sub")
+	if got, err := walk.FindBuildFile(c, sub); err != nil {
+		t.Errorf("FindBuildFile(%q) failed with %v; want success", sub, err)
+	} else if want := filepath.Join(sub, "BUILD"); got != want {
+		t.Errorf("FindBuildFile(%q) = %q; want %q", sub, got, want)
+	}
+}
@@ -27,7 +27,7 @@ def _go_proto_library_impl(ctx):
       srcs = go_srcs,
       deps = ctx.attr.deps + go_proto_toolchain.deps,
       embed = ctx.attr.embed,
-      want_coverage = ctx.coverage_instrumented(),
+      want_coverage = ctx.coverage_instrumented() and "no_coverage" not in ctx.attr.tags,
       importpath = importpath,
   )
   return [